@@ -0,0 +1,122 @@
+package sup
+
+import (
+	"fmt"
+	"os/user"
+)
+
+// Authorizer decides whether a run of commands against a network
+// is allowed. It's consulted by Stackup.Run before connecting to any host,
+// so embedders (e.g. a server handling API requests) can plug in their
+// own identity and policy checks.
+type Authorizer interface {
+	Authorize(network *Network, commands []*Command) error
+}
+
+// AccessRule grants users and/or groups the right to run the given
+// commands and targets against the given networks. "*" matches anything.
+type AccessRule struct {
+	Users    []string `yaml:"users"`
+	Groups   []string `yaml:"groups"`
+	Networks []string `yaml:"networks"`
+	Commands []string `yaml:"commands"`
+	Targets  []string `yaml:"targets"`
+}
+
+// ErrForbidden is returned when a user isn't allowed to run a command.
+type ErrForbidden struct {
+	User    string
+	Network string
+	Command string
+}
+
+func (e ErrForbidden) Error() string {
+	return fmt.Sprintf("user %v is not allowed to run %v on network %v", e.User, e.Command, e.Network)
+}
+
+// Authorizer returns an Authorizer enforcing the Supfile's access rules for
+// the given user and groups. If the Supfile has no access rules,
+// everything is allowed.
+func (conf *Supfile) Authorizer(user string, groups []string) Authorizer {
+	return &ruleAuthorizer{conf: conf, user: user, groups: groups}
+}
+
+// LocalGroups returns the names of the groups the current OS user belongs to.
+func LocalGroups() ([]string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, id := range ids {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
+
+type ruleAuthorizer struct {
+	conf   *Supfile
+	user   string
+	groups []string
+}
+
+func (a *ruleAuthorizer) Authorize(network *Network, commands []*Command) error {
+	if len(a.conf.Access) == 0 {
+		return nil
+	}
+
+	for _, cmd := range commands {
+		allowed := false
+		for _, rule := range a.conf.Access {
+			if a.matchRule(rule, network.Name, cmd.Name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrForbidden{User: a.user, Network: network.Name, Command: cmd.Name}
+		}
+	}
+	return nil
+}
+
+func (a *ruleAuthorizer) matchRule(rule AccessRule, network, command string) bool {
+	if !matchAny(rule.Users, a.user) && !matchAny(rule.Groups, a.groups...) {
+		return false
+	}
+	if !matchAny(rule.Networks, network) {
+		return false
+	}
+	if matchAny(rule.Commands, command) {
+		return true
+	}
+	for _, target := range rule.Targets {
+		if target == "*" {
+			return true
+		}
+		if t, _ := a.conf.Targets.Get(target); matchAny(t.Names(), command) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of values is listed in patterns.
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if pattern == "*" || pattern == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package sup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// The sup agent ("sup agent") holds authenticated SSH connections to the
+// hosts, shared by the sup processes run meanwhile, so workflows running
+// sup many times in a row don't connect and authenticate every time.
+//
+// It's an SSH server listening on a unix socket: a sup process connects
+// to it, asks it to connect to a host by an agentConnectRequest, and then
+// opens the sessions on the host as if connected to the host itself, the
+// agent proxying the channels to its connection to the host.
+
+// agentConnectRequest is the type of the global request connecting
+// a connection to the agent to a host.
+const agentConnectRequest = "connect@sup"
+
+// DefaultAgentIdle is how long the agent keeps unused connections.
+const DefaultAgentIdle = 10 * time.Minute
+
+// agentTarget is the payload of agentConnectRequest: the host to connect
+// to, with its identity file or password and its jump hosts, if any.
+type agentTarget struct {
+	Addr            string   `json:"addr"`
+	IdentityFile    string   `json:"identity_file,omitempty"`
+	Password        string   `json:"password,omitempty"`
+	Jumps           []string `json:"jumps,omitempty"`
+	KnownHosts      string   `json:"known_hosts,omitempty"`
+	HostKeyChecking string   `json:"host_key_checking,omitempty"`
+
+	Timeout   time.Duration `json:"timeout,omitempty"`
+	Keepalive time.Duration `json:"keepalive,omitempty"`
+}
+
+// DefaultAgentSocket returns the socket of the sup agent: $SUP_AGENT_SOCK,
+// or agent.sock in the user's cache directory, e.g. ~/.cache/sup/agent.sock.
+func DefaultAgentSocket() string {
+	if socket := os.Getenv("SUP_AGENT_SOCK"); socket != "" {
+		return socket
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sup", "agent.sock")
+}
+
+// agentRunning reports whether a sup agent listens on socket.
+func agentRunning(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// agentDialer returns the dialer connecting to target through the sup
+// agent listening on socket.
+func agentDialer(socket string, target agentTarget) SSHDialFunc {
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, socket, &ssh.ClientConfig{User: "sup"})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		payload, _ := json.Marshal(target)
+		ok, reason, err := c.SendRequest(agentConnectRequest, true, payload)
+		if err == nil && !ok {
+			err = errors.New(string(reason))
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+}
+
+// Agent is the sup agent, see "sup agent".
+type Agent struct {
+	socket string
+	idle   time.Duration
+	log    *debugLog
+
+	mu    sync.Mutex
+	conns map[string]*agentConn // By agentTarget, as JSON.
+}
+
+// agentConn is a connection of the agent to a host.
+type agentConn struct {
+	client   *SSHClient
+	users    int // Connections to the agent using it.
+	lastUsed time.Time
+}
+
+// NewAgent returns the sup agent listening on socket, closing the
+// connections unused for idle.
+func NewAgent(socket string, idle time.Duration) *Agent {
+	return &Agent{socket: socket, idle: idle, conns: map[string]*agentConn{}}
+}
+
+// ListenAndServe listens on the socket of the agent and serves the sup
+// processes connecting to it. The socket is accessible to the user only.
+func (a *Agent) ListenAndServe() error {
+	if a.socket == "" {
+		return errors.New("no socket for the sup agent")
+	}
+	if agentRunning(a.socket) {
+		return fmt.Errorf("a sup agent is already running on %v", a.socket)
+	}
+	if err := os.MkdirAll(filepath.Dir(a.socket), 0700); err != nil {
+		return err
+	}
+	os.Remove(a.socket) // Stale socket of a dead agent.
+	l, err := net.Listen("unix", a.socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(a.socket, 0600); err != nil {
+		return err
+	}
+
+	// The clients connect over a local socket, so the host key of the
+	// agent only makes the SSH handshake possible.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	go a.closeIdle()
+	fmt.Fprintf(os.Stderr, "sup agent listening on %v\n", a.socket)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serve(conn, config)
+	}
+}
+
+// serve serves a connection of a sup process: it connects to the host
+// requested by agentConnectRequest, then proxies the channels to it.
+func (a *Agent) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	var upstream *agentConn
+	for upstream == nil {
+		req, ok := <-reqs
+		if !ok {
+			return
+		}
+		if req.Type != agentConnectRequest {
+			req.Reply(false, nil)
+			continue
+		}
+		var target agentTarget
+		if err := json.Unmarshal(req.Payload, &target); err != nil {
+			req.Reply(false, []byte(err.Error()))
+			continue
+		}
+		if upstream, err = a.connect(string(req.Payload), target); err != nil {
+			req.Reply(false, []byte(err.Error()))
+			continue
+		}
+		req.Reply(true, nil)
+	}
+	defer a.release(upstream)
+
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		go proxyChannel(newChannel, upstream.client.conn)
+	}
+}
+
+// connect returns the connection of the agent to target, connecting to it
+// unless it's connected already and still alive.
+func (a *Agent) connect(key string, target agentTarget) (*agentConn, error) {
+	a.mu.Lock()
+	conn, ok := a.conns[key]
+	if ok {
+		conn.users++
+	}
+	a.mu.Unlock()
+	if ok {
+		if _, _, err := conn.client.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return conn, nil
+		}
+		a.mu.Lock()
+		if a.conns[key] == conn {
+			delete(a.conns, key)
+		}
+		a.mu.Unlock()
+		conn.client.Close()
+	}
+
+	knownHosts, err := loadKnownHosts(target.KnownHosts, target.HostKeyChecking)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading known_hosts failed")
+	}
+	client := &SSHClient{
+		identityFile: target.IdentityFile,
+		password:     target.Password,
+		knownHosts:   knownHosts,
+		timeout:      target.Timeout,
+		keepalive:    target.Keepalive,
+		log:          a.log,
+	}
+	if len(target.Jumps) > 0 {
+		jump, err := connectJumpHosts(target.Jumps, client, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to bastion failed")
+		}
+		client.jump = jump
+		if err := client.ConnectWith(target.Addr, jump.DialThrough); err != nil {
+			jump.Close()
+			return nil, err
+		}
+	} else if err := client.Connect(target.Addr); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "sup agent: connected to %v@%v\n", client.user, client.host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if conn, ok := a.conns[key]; ok {
+		// Connected meanwhile by another sup process.
+		client.Close()
+		conn.users++
+		return conn, nil
+	}
+	conn = &agentConn{client: client, users: 1}
+	a.conns[key] = conn
+	return conn, nil
+}
+
+// release marks a connection to a host unused by a sup process anymore.
+func (a *Agent) release(conn *agentConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	conn.users--
+	conn.lastUsed = time.Now()
+}
+
+// closeIdle closes the connections unused for the agent's idle time.
+func (a *Agent) closeIdle() {
+	for range time.Tick(time.Minute) {
+		a.mu.Lock()
+		for key, conn := range a.conns {
+			if conn.users == 0 && time.Since(conn.lastUsed) > a.idle {
+				fmt.Fprintf(os.Stderr, "sup agent: closing idle connection to %v@%v\n", conn.client.user, conn.client.host)
+				conn.client.Close()
+				delete(a.conns, key)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// proxyChannel opens the same channel as newChannel on upstream, then
+// proxies the data and the requests (exec, signals, exit status etc.)
+// between them until upstream closes it.
+func proxyChannel(newChannel ssh.NewChannel, upstream *ssh.Client) {
+	up, upReqs, err := upstream.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		reason, message := ssh.ConnectionFailed, err.Error()
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			reason, message = openErr.Reason, openErr.Message
+		}
+		newChannel.Reject(reason, message)
+		return
+	}
+	down, downReqs, err := newChannel.Accept()
+	if err != nil {
+		up.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(up, down)
+		up.CloseWrite()
+	}()
+	go func() {
+		forwardRequests(downReqs, up)
+		up.Close() // Closed by the sup process.
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		io.Copy(down, up)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(down.Stderr(), up.Stderr())
+	}()
+	go func() {
+		defer wg.Done()
+		forwardRequests(upReqs, down) // Until upstream closes the channel.
+	}()
+	wg.Wait()
+	down.CloseWrite()
+	down.Close()
+}
+
+// forwardRequests forwards the channel requests to ch, and its replies back.
+func forwardRequests(reqs <-chan *ssh.Request, ch ssh.Channel) {
+	for req := range reqs {
+		ok, err := ch.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GrafanaNotifier marks runs on Grafana dashboards by creating a region
+// annotation when a run starts and closing it when the run finishes.
+type GrafanaNotifier struct {
+	URL          string   `yaml:"url"`     // Grafana base URL, e.g. "https://grafana.example.com".
+	APIKey       string   `yaml:"api_key"` // Service account token or API key.
+	DashboardUID string   `yaml:"dashboard_uid"`
+	Tags         []string `yaml:"tags"`
+
+	mu  sync.Mutex
+	ids map[*RunReport]int64
+}
+
+func (g *GrafanaNotifier) tags(report *RunReport) []string {
+	return append([]string{"sup", "network:" + report.Network, "target:" + report.Target}, g.Tags...)
+}
+
+func (g *GrafanaNotifier) header() http.Header {
+	header := http.Header{}
+	if g.APIKey != "" {
+		header.Set("Authorization", "Bearer "+os.ExpandEnv(g.APIKey))
+	}
+	return header
+}
+
+func (g *GrafanaNotifier) NotifyStart(network *Network, report *RunReport) error {
+	annotation := map[string]interface{}{
+		"time": report.Start.UnixNano() / int64(time.Millisecond),
+		"tags": g.tags(report),
+		"text": fmt.Sprintf("%v started sup %v on %v", report.User, report.Target, report.Network),
+	}
+	if g.DashboardUID != "" {
+		annotation["dashboardUID"] = g.DashboardUID
+	}
+
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	if err := doJSON("POST", g.apiURL(""), g.header(), annotation, &resp); err != nil {
+		return errors.Wrap(err, "grafana")
+	}
+
+	g.mu.Lock()
+	if g.ids == nil {
+		g.ids = map[*RunReport]int64{}
+	}
+	g.ids[report] = resp.ID
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *GrafanaNotifier) Notify(network *Network, report *RunReport) error {
+	g.mu.Lock()
+	id, ok := g.ids[report]
+	delete(g.ids, report)
+	g.mu.Unlock()
+
+	status := "succeeded"
+	if report.Failed() {
+		status = "failed"
+	}
+	annotation := map[string]interface{}{
+		"time":    report.Start.UnixNano() / int64(time.Millisecond),
+		"timeEnd": report.Start.Add(report.Duration).UnixNano() / int64(time.Millisecond),
+		"tags":    append(g.tags(report), "status:"+status),
+		"text":    strings.Replace(report.Summary(), "\n", "<br>", -1),
+	}
+
+	// Close the region opened by NotifyStart, or create a new one
+	// if the start annotation couldn't be created.
+	if ok {
+		return errors.Wrap(doJSON("PATCH", g.apiURL(fmt.Sprint(id)), g.header(), annotation, nil), "grafana")
+	}
+	if g.DashboardUID != "" {
+		annotation["dashboardUID"] = g.DashboardUID
+	}
+	return errors.Wrap(doJSON("POST", g.apiURL(""), g.header(), annotation, nil), "grafana")
+}
+
+func (g *GrafanaNotifier) apiURL(id string) string {
+	u := strings.TrimSuffix(os.ExpandEnv(g.URL), "/") + "/api/annotations"
+	if id != "" {
+		u += "/" + id
+	}
+	return u
+}
+
+// PushgatewayNotifier pushes run metrics to a Prometheus Pushgateway
+// when a run starts and finishes, grouped by network and target.
+type PushgatewayNotifier struct {
+	URL string `yaml:"url"` // Pushgateway base URL, e.g. "http://pushgateway:9091".
+	Job string `yaml:"job"` // Defaults to "sup".
+}
+
+func (p *PushgatewayNotifier) NotifyStart(network *Network, report *RunReport) error {
+	metrics := fmt.Sprintf("# TYPE sup_run_start_timestamp_seconds gauge\nsup_run_start_timestamp_seconds %v\n",
+		report.Start.Unix())
+	return errors.Wrap(p.push(report, metrics), "pushgateway")
+}
+
+func (p *PushgatewayNotifier) Notify(network *Network, report *RunReport) error {
+	success := 1
+	if report.Failed() {
+		success = 0
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE sup_run_start_timestamp_seconds gauge\nsup_run_start_timestamp_seconds %v\n", report.Start.Unix())
+	fmt.Fprintf(&buf, "# TYPE sup_run_end_timestamp_seconds gauge\nsup_run_end_timestamp_seconds %v\n", report.Start.Add(report.Duration).Unix())
+	fmt.Fprintf(&buf, "# TYPE sup_run_duration_seconds gauge\nsup_run_duration_seconds %v\n", report.Duration.Seconds())
+	fmt.Fprintf(&buf, "# TYPE sup_run_success gauge\nsup_run_success %v\n", success)
+	return errors.Wrap(p.push(report, buf.String()), "pushgateway")
+}
+
+func (p *PushgatewayNotifier) push(report *RunReport, metrics string) error {
+	job := p.Job
+	if job == "" {
+		job = "sup"
+	}
+	u := fmt.Sprintf("%v/metrics/job/%v/network/%v/target/%v",
+		strings.TrimSuffix(os.ExpandEnv(p.URL), "/"), url.PathEscape(job), url.PathEscape(report.Network), url.PathEscape(report.Target))
+
+	header := http.Header{"Content-Type": {"text/plain; version=0.0.4"}}
+	return post(u, header, []byte(metrics))
+}
+
+// doJSON sends v encoded as JSON to url and decodes the response into out,
+// unless out is nil.
+func doJSON(method, url string, header http.Header, v, out interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v %v: %v", method, url, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
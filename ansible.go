@@ -0,0 +1,401 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The groups of the Ansible inventory of a Supfile (ansible_inventory) are
+// networks too, so teams migrating from Ansible share a single inventory.
+// Both the INI and the YAML formats are supported, with host ranges, group
+// vars and children. The ansible_host, ansible_user, ansible_port and
+// ansible_ssh_private_key_file vars of the hosts (and their ansible_ssh_*
+// aliases) set their address and credentials; the other scalar vars are
+// their metadata, see Host.Meta. The groups of a host are its roles.
+
+// ansibleInventory is a parsed Ansible inventory.
+type ansibleInventory struct {
+	groups map[string]*ansibleGroup
+	order  []string                     // Names of the groups, as declared.
+	vars   map[string]map[string]string // Vars of the hosts.
+}
+
+type ansibleGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// group returns the group of the given name, adding it if needed.
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	if g, ok := inv.groups[name]; ok {
+		return g
+	}
+	g := &ansibleGroup{vars: map[string]string{}}
+	inv.groups[name] = g
+	inv.order = append(inv.order, name)
+	return g
+}
+
+// addHost adds the host to the group, merging its vars.
+func (inv *ansibleInventory) addHost(group, host string, vars map[string]string) {
+	g := inv.group(group)
+	g.hosts = append(g.hosts, host)
+	if inv.vars[host] == nil {
+		inv.vars[host] = map[string]string{}
+	}
+	for key, value := range vars {
+		inv.vars[host][key] = value
+	}
+}
+
+// readAnsibleInventory reads the Ansible inventory at path, in the YAML
+// format if its extension says so, or else in the INI format.
+func readAnsibleInventory(path string) (*ansibleInventory, error) {
+	data, err := ioutil.ReadFile(expandTilde(path))
+	if err != nil {
+		return nil, err
+	}
+	inv := &ansibleInventory{groups: map[string]*ansibleGroup{}, vars: map[string]map[string]string{}}
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml", ".json":
+		err = inv.parseYAML(data)
+	default:
+		err = inv.parseINI(data)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "ansible inventory %v", path)
+	}
+	return inv, nil
+}
+
+// parseINI parses an inventory in the INI format:
+//
+//	[web]
+//	web[01:03].example.com ansible_user=deploy
+//
+//	[web:vars]
+//	ansible_port=2222
+//
+//	[production:children]
+//	web
+func (inv *ansibleInventory) parseINI(data []byte) error {
+	section, kind := "ungrouped", "hosts"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section, kind = line[1:len(line)-1], "hosts"
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			inv.group(section)
+			continue
+		}
+
+		fields, err := splitQuoted(line)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", n, err)
+		}
+		switch kind {
+		case "hosts":
+			vars := map[string]string{}
+			for _, field := range fields[1:] {
+				i := strings.Index(field, "=")
+				if i <= 0 {
+					return fmt.Errorf("line %v: invalid host var %q", n, field)
+				}
+				vars[field[:i]] = field[i+1:]
+			}
+			hosts, err := expandHostRange(fields[0])
+			if err != nil {
+				return fmt.Errorf("line %v: %v", n, err)
+			}
+			for _, host := range hosts {
+				inv.addHost(section, host, vars)
+			}
+		case "vars":
+			i := strings.Index(line, "=")
+			if i <= 0 {
+				return fmt.Errorf("line %v: invalid group var %q", n, line)
+			}
+			value, err := splitQuoted(line[i+1:])
+			if err != nil {
+				return fmt.Errorf("line %v: %v", n, err)
+			}
+			inv.group(section).vars[strings.TrimSpace(line[:i])] = strings.Join(value, " ")
+		case "children":
+			inv.group(section).children = append(inv.group(section).children, fields[0])
+			inv.group(fields[0])
+		default:
+			return fmt.Errorf("line %v: unsupported section [%v:%v]", n, section, kind)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseYAML parses an inventory in the YAML format:
+//
+//	all:
+//	  children:
+//	    web:
+//	      hosts:
+//	        web1.example.com:
+//	          ansible_user: deploy
+//	      vars:
+//	        ansible_port: 2222
+func (inv *ansibleInventory) parseYAML(data []byte) error {
+	var groups yaml.MapSlice
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+	return inv.addYAMLGroups("", groups)
+}
+
+// addYAMLGroups adds the groups, children of parent if it's not empty.
+func (inv *ansibleInventory) addYAMLGroups(parent string, groups yaml.MapSlice) error {
+	for _, item := range groups {
+		name := fmt.Sprint(item.Key)
+		var group struct {
+			Hosts    yaml.MapSlice          `yaml:"hosts"`
+			Vars     map[string]interface{} `yaml:"vars"`
+			Children yaml.MapSlice          `yaml:"children"`
+		}
+		data, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &group); err != nil {
+			return errors.Wrapf(err, "group %v", name)
+		}
+
+		g := inv.group(name)
+		if parent != "" {
+			inv.group(parent).children = append(inv.group(parent).children, name)
+		}
+		for key, value := range scalarVars(group.Vars) {
+			g.vars[key] = value
+		}
+		for _, host := range group.Hosts {
+			vars, _ := host.Value.(yaml.MapSlice)
+			hostVars := map[string]interface{}{}
+			for _, v := range vars {
+				hostVars[fmt.Sprint(v.Key)] = v.Value
+			}
+			hosts, err := expandHostRange(fmt.Sprint(host.Key))
+			if err != nil {
+				return errors.Wrapf(err, "group %v", name)
+			}
+			for _, h := range hosts {
+				inv.addHost(name, h, scalarVars(hostVars))
+			}
+		}
+		if err := inv.addYAMLGroups(name, group.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scalarVars returns the vars holding strings, numbers or bools.
+func scalarVars(vars map[string]interface{}) map[string]string {
+	scalars := map[string]string{}
+	for key, value := range vars {
+		switch value.(type) {
+		case string, int, int64, uint64, float64, bool:
+			scalars[key] = fmt.Sprint(value)
+		}
+	}
+	return scalars
+}
+
+// hosts returns the hosts of the group and of its children, in order,
+// with the vars of their groups and their own ones.
+func (inv *ansibleInventory) hosts(name string) []Host {
+	var names []string
+	seen := map[string]bool{}
+	inv.walk(name, map[string]bool{}, func(g *ansibleGroup) {
+		for _, host := range g.hosts {
+			if !seen[host] {
+				seen[host] = true
+				names = append(names, host)
+			}
+		}
+	})
+
+	var hosts []Host
+	for _, host := range names {
+		// The vars of the groups closer to the host take precedence, then
+		// the host's own ones.
+		vars := map[string]string{}
+		var roles []string
+		for _, group := range inv.groupsOf(host) {
+			for key, value := range inv.groups[group].vars {
+				vars[key] = value
+			}
+			if group != "all" && group != "ungrouped" {
+				roles = append(roles, group)
+			}
+		}
+		for key, value := range inv.vars[host] {
+			vars[key] = value
+		}
+		hosts = append(hosts, ansibleHost(host, roles, vars))
+	}
+	return hosts
+}
+
+// walk calls fn for the group of the given name and its descendants.
+func (inv *ansibleInventory) walk(name string, visited map[string]bool, fn func(*ansibleGroup)) {
+	g, ok := inv.groups[name]
+	if !ok || visited[name] {
+		return
+	}
+	visited[name] = true
+	fn(g)
+	for _, child := range g.children {
+		inv.walk(child, visited, fn)
+	}
+}
+
+// groupsOf returns the groups the host is in, directly or through their
+// children, from the outermost to the innermost ones.
+func (inv *ansibleInventory) groupsOf(host string) []string {
+	depth := map[string]int{}
+	var visit func(name string, d int)
+	visit = func(name string, d int) {
+		if d > len(inv.groups) {
+			return // Cyclic children.
+		}
+		if current, ok := depth[name]; ok && current >= d {
+			return
+		}
+		depth[name] = d
+		for _, child := range inv.groups[name].children {
+			if _, ok := inv.groups[child]; ok {
+				visit(child, d+1)
+			}
+		}
+	}
+	for _, name := range inv.order {
+		visit(name, 0)
+	}
+
+	var groups []string
+	for _, name := range inv.order {
+		contains := false
+		inv.walk(name, map[string]bool{}, func(g *ansibleGroup) {
+			for _, h := range g.hosts {
+				contains = contains || h == host
+			}
+		})
+		if contains || name == "all" {
+			groups = append(groups, name)
+		}
+	}
+	for i := 1; i < len(groups); i++ {
+		for j := i; j > 0 && depth[groups[j]] < depth[groups[j-1]]; j-- {
+			groups[j], groups[j-1] = groups[j-1], groups[j]
+		}
+	}
+	return groups
+}
+
+// ansibleHost returns the host of the given inventory name, by its vars.
+func ansibleHost(name string, roles []string, vars map[string]string) Host {
+	take := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := vars[key]; ok {
+				delete(vars, key)
+				return value
+			}
+		}
+		return ""
+	}
+	host := Host{Addr: name, Roles: roles}
+	if addr := take("ansible_host", "ansible_ssh_host"); addr != "" {
+		host.Addr = addr
+	}
+	host.User = take("ansible_user", "ansible_ssh_user")
+	host.Port = take("ansible_port", "ansible_ssh_port")
+	host.IdentityFile = take("ansible_ssh_private_key_file", "ansible_private_key_file")
+	host.Password = take("ansible_password", "ansible_ssh_pass")
+	if take("ansible_connection") == "local" {
+		host.Addr = "localhost"
+	}
+	host.Meta = map[string]string{"Name": name}
+	for key, value := range vars {
+		host.Meta[key] = value
+	}
+	return host
+}
+
+// importAnsibleInventory adds the groups of the Ansible inventory of conf,
+// if any, as networks. The networks defined by the Supfile itself take
+// precedence, but get the hosts of their group if they have none.
+func (conf *Supfile) importAnsibleInventory() error {
+	if conf.AnsibleInventory == "" {
+		return nil
+	}
+	inv, err := readAnsibleInventory(conf.AnsibleInventory)
+	if err != nil {
+		return err
+	}
+	for _, name := range inv.order {
+		if name == "all" || name == "ungrouped" {
+			continue
+		}
+		network, ok := conf.Networks.Get(name)
+		if ok && (len(network.Hosts) > 0 || network.dynamic()) {
+			continue
+		}
+		network.Hosts = inv.hosts(name)
+		conf.Networks.Set(name, network)
+	}
+	return nil
+}
+
+// splitQuoted splits s into fields separated by spaces, except in quotes.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var field []byte
+	var quote byte
+	inField := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			field = append(field, c)
+		case c == '"' || c == '\'':
+			quote, inField = c, true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = field[:0], false
+			}
+		case c == '#' && !inField:
+			i = len(s) // Comment.
+		default:
+			field, inField = append(field, c), true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
@@ -0,0 +1,136 @@
+package sup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Values of the buttons of Slack approval requests.
+const (
+	slackApprove = "approve"
+	slackReject  = "reject"
+)
+
+// RequestApproval posts a message asking to approve the pending run,
+// with buttons to approve or reject it. The clicks are sent by Slack
+// to the Request URL of the interactivity settings of the Slack app,
+// which is expected to be handled by ParseAction.
+func (s *SlackNotifier) RequestApproval(run QueuedRun) error {
+	text := fmt.Sprintf(":raised_hand: *%v* wants to run *%v* on *%v* (run %v), approval required",
+		run.User, strings.Join(run.Commands, " "), run.Network, run.ID)
+	button := func(text, action, style string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": text},
+			"action_id": action,
+			"value":     run.ID,
+			"style":     style,
+		}
+	}
+
+	msg := map[string]interface{}{
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": text},
+			},
+			map[string]interface{}{
+				"type": "actions",
+				"elements": []interface{}{
+					button("Approve", slackApprove, "primary"),
+					button("Reject", slackReject, "danger"),
+				},
+			},
+		},
+	}
+	if s.Channel != "" {
+		msg["channel"] = s.Channel
+	}
+	return errors.Wrap(postJSON(os.ExpandEnv(s.WebhookURL), nil, msg), "slack")
+}
+
+// SlackAction is a click on a button of a Slack approval request.
+type SlackAction struct {
+	RunID   string
+	UserID  string // Slack user ID of the user who clicked, see Auth.SlackUsers.
+	Approve bool   // Whether the run was approved or rejected.
+
+	responseURL string
+}
+
+// ParseAction verifies the signature of an interaction request sent
+// by Slack and returns the approval action it carries.
+func (s *SlackNotifier) ParseAction(r *http.Request) (*SlackAction, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// See https://api.slack.com/authentication/verifying-requests-from-slack
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) > 5*time.Minute {
+		return nil, errors.New("slack: invalid request timestamp")
+	}
+	// An unset env var must not leave an empty key anyone can sign by.
+	secret := os.ExpandEnv(s.SigningSecret)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%v:%s", timestamp, body)
+	signature := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if secret == "" || !hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, errors.New("slack: invalid request signature")
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "slack: invalid request")
+	}
+	var payload struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+		ResponseURL string `json:"response_url"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		return nil, errors.Wrap(err, "slack: invalid payload")
+	}
+	if len(payload.Actions) == 0 {
+		return nil, errors.New("slack: no action")
+	}
+	action := payload.Actions[0]
+	if action.ActionID != slackApprove && action.ActionID != slackReject {
+		return nil, errors.Errorf("slack: unknown action %q", action.ActionID)
+	}
+	return &SlackAction{
+		RunID:       action.Value,
+		UserID:      payload.User.ID,
+		Approve:     action.ActionID == slackApprove,
+		responseURL: payload.ResponseURL,
+	}, nil
+}
+
+// Respond replaces the approval request by text.
+func (a *SlackAction) Respond(text string) error {
+	if a.responseURL == "" {
+		return nil
+	}
+	msg := map[string]interface{}{"replace_original": true, "text": text}
+	return errors.Wrap(postJSON(a.responseURL, nil, msg), "slack")
+}
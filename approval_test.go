@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackParseAction(t *testing.T) {
+	os.Setenv("SUP_TEST_SLACK_SECRET", "secret")
+	defer os.Unsetenv("SUP_TEST_SLACK_SECRET")
+	os.Unsetenv("SUP_TEST_UNSET_SLACK_SECRET")
+
+	payload := func(action string) string {
+		return url.Values{"payload": {fmt.Sprintf(
+			`{"user":{"id":"U1"},"actions":[{"action_id":%q,"value":"7"}],"response_url":"https://hooks.slack.com/x"}`, action)}}.Encode()
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		secret    string // Signing secret of the notifier.
+		key       string // Key signing the request.
+		timestamp int64
+		body      string
+		approve   bool
+		err       string // Expected error, if any.
+	}{
+		{"approve", "$SUP_TEST_SLACK_SECRET", "secret", now, payload(slackApprove), true, ""},
+		{"reject", "$SUP_TEST_SLACK_SECRET", "secret", now, payload(slackReject), false, ""},
+		{"wrong key", "$SUP_TEST_SLACK_SECRET", "guess", now, payload(slackApprove), false, "invalid request signature"},
+		{"empty secret", "$SUP_TEST_UNSET_SLACK_SECRET", "", now, payload(slackApprove), false, "invalid request signature"},
+		{"stale timestamp", "$SUP_TEST_SLACK_SECRET", "secret", now - 600, payload(slackApprove), false, "invalid request timestamp"},
+		{"unknown action", "$SUP_TEST_SLACK_SECRET", "secret", now, payload("merge"), false, "unknown action"},
+	}
+	for _, test := range tests {
+		timestamp := strconv.FormatInt(test.timestamp, 10)
+		mac := hmac.New(sha256.New, []byte(test.key))
+		fmt.Fprintf(mac, "v0:%v:%s", timestamp, test.body)
+		r := httptest.NewRequest("POST", "/slack/actions", strings.NewReader(test.body))
+		r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+
+		s := &SlackNotifier{SigningSecret: test.secret}
+		action, err := s.ParseAction(r)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if action.RunID != "7" || action.UserID != "U1" || action.Approve != test.approve {
+			t.Errorf("%v: action %+v", test.name, *action)
+		}
+	}
+}
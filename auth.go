@@ -0,0 +1,378 @@
+package sup
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // Hashes of the JWT algorithms.
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Auth authenticates the users the access rules (see AccessRule) and the
+// sup server act on behalf of: by static API tokens mapped to users and
+// groups, or by JWTs signed by a trusted key, e.g. the ID tokens of an
+// OIDC provider. Slack user IDs map onto the same users, for the approvals
+// by Slack.
+//
+//	auth:
+//	  tokens:
+//	    - token: $SUP_TOKEN_ALICE
+//	      user: alice
+//	      groups: [developers]
+//	  jwt:
+//	    jwks_url: https://accounts.example.com/.well-known/jwks.json
+//	    issuer: https://accounts.example.com
+//	    audience: sup
+//	  slack_users:
+//	    U024BE7LH: alice
+type Auth struct {
+	Tokens     []AuthToken       `yaml:"tokens"`      // Static API tokens.
+	JWT        *JWTAuth          `yaml:"jwt"`         // Signed JWTs, e.g. OIDC ID tokens.
+	SlackUsers map[string]string `yaml:"slack_users"` // Users by Slack user ID, in the groups of their tokens.
+}
+
+// AuthToken is a static API token of a user.
+type AuthToken struct {
+	Token  string   `yaml:"token"` // Expanded from the environment, e.g. "$SUP_TOKEN_ALICE".
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups"`
+}
+
+// JWTAuth authenticates users by JWTs signed by HMAC (HS256, HS384 or
+// HS512), RSA (RS256, ...) or ECDSA (ES256, ...). The tokens must not be
+// expired and must be of Issuer and Audience, if set.
+type JWTAuth struct {
+	Secret      string `yaml:"secret"`       // HMAC key of the HS* tokens, expanded from the environment.
+	PublicKey   string `yaml:"public_key"`   // PEM file of the RSA or ECDSA key of the RS* and ES* tokens.
+	JWKSURL     string `yaml:"jwks_url"`     // Keys of the RS* and ES* tokens by key ID instead, e.g. of an OIDC provider.
+	Issuer      string `yaml:"issuer"`       // Required "iss" claim.
+	Audience    string `yaml:"audience"`     // Required "aud" claim.
+	UserClaim   string `yaml:"user_claim"`   // Claim of the user name, "sub" by default, e.g. "email".
+	GroupsClaim string `yaml:"groups_claim"` // Claim of the groups, "groups" by default.
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // Of JWKSURL, by key ID.
+	fetched time.Time                   // When the keys were last fetched.
+}
+
+// Identity is an authenticated user.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// ErrUnauthenticated is returned for the callers not authenticated by Auth.
+type ErrUnauthenticated struct {
+	Reason string
+}
+
+func (e ErrUnauthenticated) Error() string {
+	return "authentication failed: " + e.Reason
+}
+
+// validate checks the settings of auth.
+func (auth *Auth) validate() error {
+	for _, t := range auth.Tokens {
+		if t.Token == "" || t.User == "" {
+			return errors.New("auth: tokens need a token and a user")
+		}
+	}
+	if j := auth.JWT; j != nil {
+		if j.Secret == "" && j.PublicKey == "" && j.JWKSURL == "" {
+			return errors.New("auth: jwt needs a secret, public_key or jwks_url")
+		}
+		if j.PublicKey != "" && j.JWKSURL != "" {
+			return errors.New("auth: jwt public_key and jwks_url are mutually exclusive")
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the user authenticated by credential, an API token
+// or a JWT, see Auth.
+func (conf *Supfile) Authenticate(credential string) (Identity, error) {
+	if conf.Auth == nil {
+		return Identity{}, ErrUnauthenticated{"no auth configured in Supfile"}
+	}
+	if credential == "" {
+		return Identity{}, ErrUnauthenticated{"missing token"}
+	}
+	for _, t := range conf.Auth.Tokens {
+		token := os.ExpandEnv(t.Token)
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(credential)) == 1 {
+			return Identity{User: t.User, Groups: t.Groups}, nil
+		}
+	}
+	if conf.Auth.JWT != nil && strings.Count(credential, ".") == 2 {
+		identity, err := conf.Auth.JWT.verify(credential, time.Now())
+		if err != nil {
+			return Identity{}, ErrUnauthenticated{err.Error()}
+		}
+		return identity, nil
+	}
+	return Identity{}, ErrUnauthenticated{"invalid token"}
+}
+
+// SlackUser returns the user of the Slack user ID, see Auth.SlackUsers,
+// in the groups of the API tokens of the user.
+func (conf *Supfile) SlackUser(id string) (Identity, bool) {
+	if conf.Auth == nil || id == "" {
+		return Identity{}, false
+	}
+	user := conf.Auth.SlackUsers[id]
+	if user == "" {
+		return Identity{}, false
+	}
+	identity := Identity{User: user}
+	for _, t := range conf.Auth.Tokens {
+		if t.User == user {
+			identity.Groups = append(identity.Groups, t.Groups...)
+		}
+	}
+	return identity, true
+}
+
+// verify verifies the signature and the claims of the JWT token at now,
+// returning the identity it carries.
+func (j *JWTAuth) verify(token string, now time.Time) (Identity, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return Identity{}, errors.Wrap(err, "invalid JWT header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "invalid JWT signature")
+	}
+	if err := j.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return Identity{}, errors.Wrap(err, "invalid JWT claims")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return Identity{}, errors.New("JWT without expiration")
+	}
+	if now.Unix() >= int64(exp) {
+		return Identity{}, errors.New("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return Identity{}, errors.New("JWT not valid yet")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return Identity{}, errors.Errorf("JWT of issuer %v, not %v", claims["iss"], j.Issuer)
+	}
+	if j.Audience != "" && !hasClaim(claims["aud"], j.Audience) {
+		return Identity{}, errors.Errorf("JWT not of audience %v", j.Audience)
+	}
+
+	userClaim, groupsClaim := j.UserClaim, j.GroupsClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	user, _ := claims[userClaim].(string)
+	if user == "" {
+		return Identity{}, errors.Errorf("JWT without %v claim", userClaim)
+	}
+	identity := Identity{User: user}
+	switch groups := claims[groupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, group)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// verifySignature verifies the signature of signed by the algorithm alg,
+// with the key of ID kid for RSA and ECDSA.
+func (j *JWTAuth) verifySignature(alg, kid string, signed, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) != 5 {
+		return errors.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 || (alg[:2] != "HS" && alg[:2] != "RS" && alg[:2] != "ES") {
+		return errors.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	if alg[:2] == "HS" {
+		// An unset env var must not leave an empty key anyone can sign by.
+		secret := os.ExpandEnv(j.Secret)
+		if secret == "" {
+			return errors.New("HMAC signed JWTs aren't trusted")
+		}
+		mac := hmac.New(hash.New, []byte(secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+
+	key, err := j.key(kid)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		n := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:n]), new(big.Int).SetBytes(signature[n:])
+		if alg[:2] == "ES" && ecdsa.Verify(key, digest, r, s) {
+			return nil
+		}
+	}
+	return errors.New("invalid JWT signature")
+}
+
+// key returns the public key of ID kid: the PublicKey, or the key of
+// JWKSURL. The keys are fetched again for unknown IDs, since providers
+// rotate them, but not more than once a minute.
+func (j *JWTAuth) key(kid string) (crypto.PublicKey, error) {
+	if j.PublicKey != "" {
+		data, err := ioutil.ReadFile(expandTilde(j.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("%v: no PEM encoded key", j.PublicKey)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		return key, errors.Wrap(err, j.PublicKey)
+	}
+	if j.JWKSURL == "" {
+		return nil, errors.New("RSA and ECDSA signed JWTs aren't trusted")
+	}
+
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetched) > time.Minute
+	j.mu.Unlock()
+	if ok || !stale {
+		if !ok {
+			return nil, errors.Errorf("unknown JWT key %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := fetchJWKS(j.JWKSURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching JWKS failed")
+	}
+	j.mu.Lock()
+	j.keys, j.fetched = keys, time.Now()
+	j.mu.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, errors.Errorf("unknown JWT key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchJWKS fetches the RSA and ECDSA keys of the JWK set at url.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := discoveryRequest(req, &jwks); err != nil {
+		return nil, err
+	}
+
+	number := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			keys[k.Kid] = &rsa.PublicKey{N: number(k.N), E: int(number(k.E).Int64())}
+		case "EC":
+			if curve, ok := curves[k.Crv]; ok {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: number(k.X), Y: number(k.Y)}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment of a JWT into v.
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasClaim reports whether the claim, a string or an array of strings,
+// is or holds value.
+func hasClaim(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, v := range claim {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
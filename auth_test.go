@@ -0,0 +1,137 @@
+package sup
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// signJWT returns a JWT of claims signed by HMAC of hash with key.
+func signJWT(t *testing.T, alg string, hash crypto.Hash, key string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(hash.New, []byte(key))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticateForgedByEmptySecret(t *testing.T) {
+	os.Unsetenv("SUP_TEST_UNSET_JWT_SECRET")
+	conf := &Supfile{Auth: &Auth{JWT: &JWTAuth{Secret: "$SUP_TEST_UNSET_JWT_SECRET"}}}
+	claims := map[string]interface{}{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()}
+	for _, alg := range []struct {
+		name string
+		hash crypto.Hash
+	}{{"HS256", crypto.SHA256}, {"HS384", crypto.SHA384}, {"HS512", crypto.SHA512}} {
+		token := signJWT(t, alg.name, alg.hash, "", claims)
+		if identity, err := conf.Authenticate(token); err == nil {
+			t.Errorf("%v token signed by an empty key authenticated %v", alg.name, identity.User)
+		}
+	}
+}
+
+func TestAuthenticateTokens(t *testing.T) {
+	os.Setenv("SUP_TEST_TOKEN_ALICE", "alice-token")
+	defer os.Unsetenv("SUP_TEST_TOKEN_ALICE")
+	os.Unsetenv("SUP_TEST_UNSET_TOKEN")
+	conf := &Supfile{Auth: &Auth{Tokens: []AuthToken{
+		{Token: "$SUP_TEST_TOKEN_ALICE", User: "alice", Groups: []string{"deployers"}},
+		{Token: "$SUP_TEST_UNSET_TOKEN", User: "mallory"},
+		{Token: "bob-token", User: "bob"},
+	}}}
+
+	tests := []struct {
+		credential string
+		user       string // Authenticated user, or "" if refused.
+	}{
+		{"alice-token", "alice"},
+		{"bob-token", "bob"},
+		{"$SUP_TEST_TOKEN_ALICE", ""}, // Not expanded.
+		{"alice-token ", ""},
+		{"", ""}, // Must not match the unset token.
+		{"invalid", ""},
+	}
+	for _, test := range tests {
+		identity, err := conf.Authenticate(test.credential)
+		if test.user == "" {
+			if err == nil {
+				t.Errorf("Authenticate(%q) = %v, want an error", test.credential, identity.User)
+			}
+			continue
+		}
+		if err != nil || identity.User != test.user {
+			t.Errorf("Authenticate(%q) = %v, %v, want %v", test.credential, identity.User, err, test.user)
+		}
+	}
+
+	if identity, _ := conf.Authenticate("alice-token"); len(identity.Groups) != 1 || identity.Groups[0] != "deployers" {
+		t.Errorf("groups of alice = %v, want [deployers]", identity.Groups)
+	}
+	if _, err := (&Supfile{}).Authenticate("alice-token"); err == nil {
+		t.Error("authenticated without auth in Supfile")
+	}
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	os.Setenv("SUP_TEST_JWT_SECRET", "secret")
+	defer os.Unsetenv("SUP_TEST_JWT_SECRET")
+	os.Unsetenv("SUP_TEST_UNSET_JWT_SECRET")
+
+	now := time.Now()
+	valid := func(claims map[string]interface{}) map[string]interface{} {
+		valid := map[string]interface{}{"exp": now.Add(time.Hour).Unix()}
+		for k, v := range claims {
+			valid[k] = v
+		}
+		return valid
+	}
+	sub := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name   string
+		jwt    *JWTAuth
+		alg    string
+		hash   crypto.Hash
+		key    string // Key signing the token.
+		claims map[string]interface{}
+		user   string // Authenticated user, or "" if refused.
+	}{
+		{"valid", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "secret", valid(sub), "alice"},
+		{"HS512", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS512", crypto.SHA512, "secret", valid(sub), "alice"},
+		{"user claim", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET", UserClaim: "email"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{"email": "alice@example.com"}), "alice@example.com"},
+		{"issuer and audience", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET", Issuer: "https://issuer", Audience: "sup"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{"sub": "alice", "iss": "https://issuer", "aud": []string{"other", "sup"}}), "alice"},
+		{"wrong issuer", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET", Issuer: "https://issuer"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{"sub": "alice", "iss": "https://other"}), ""},
+		{"wrong audience", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET", Audience: "sup"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{"sub": "alice", "aud": "other"}), ""},
+		{"expired", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "secret", map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Hour).Unix()}, ""},
+		{"no expiration", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "secret", sub, ""},
+		{"not valid yet", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{"sub": "alice", "nbf": now.Add(time.Minute).Unix()}), ""},
+		{"no user", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "secret", valid(map[string]interface{}{}), ""},
+		{"wrong key", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS256", crypto.SHA256, "guess", valid(sub), ""},
+		{"empty secret", &JWTAuth{Secret: "$SUP_TEST_UNSET_JWT_SECRET"}, "HS256", crypto.SHA256, "", valid(sub), ""},
+		{"unsupported algorithm", &JWTAuth{Secret: "$SUP_TEST_JWT_SECRET"}, "HS1", crypto.SHA256, "secret", valid(sub), ""},
+	}
+	for _, test := range tests {
+		conf := &Supfile{Auth: &Auth{JWT: test.jwt}}
+		identity, err := conf.Authenticate(signJWT(t, test.alg, test.hash, test.key, test.claims))
+		if test.user == "" {
+			if err == nil {
+				t.Errorf("%v: authenticated %v, want an error", test.name, identity.User)
+			}
+			continue
+		}
+		if err != nil || identity.User != test.user {
+			t.Errorf("%v: authenticated %v, %v, want %v", test.name, identity.User, err, test.user)
+		}
+	}
+}
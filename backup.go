@@ -0,0 +1,180 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backup archives remote paths of every host before destructive steps,
+// e.g. a migration: the paths are streamed as a tar.gz archive to a local
+// directory or to an object store, into HOST/COMMAND-TIMESTAMP.tar.gz. The backups
+// beyond the retention settings are removed once the host is backed up.
+type Backup struct {
+	Paths  []string `yaml:"paths"`   // Remote paths to back up, relative to the home directory unless absolute.
+	Dest   string   `yaml:"dest"`    // Local directory, "s3://BUCKET/PREFIX" or "gs://BUCKET/PREFIX" the archives are written to.
+	Keep   int      `yaml:"keep"`    // Number of backups of the command kept per host, all by default.
+	MaxAge Duration `yaml:"max_age"` // Remove the backups of the command older than this, e.g. "720h".
+}
+
+// backupTimeFormat is the format of the timestamps of the archives,
+// sorting like the times.
+const backupTimeFormat = "20060102T150405Z"
+
+// backupHostRegexp matches the characters of the hosts not kept in the
+// names of their backup directories.
+var backupHostRegexp = regexp.MustCompile(`[^A-Za-z0-9._@-]+`)
+
+// backupTask returns the task streaming the archive of the paths.
+func backupTask(paths []string) *Task {
+	args := []string{"tar", "-czf", "-"}
+	for _, p := range paths {
+		if strings.HasPrefix(p, "/") {
+			args = append(args, "-C", "/", shellQuote(strings.TrimLeft(p, "/")))
+		} else {
+			args = append(args, "-C", `"$HOME"`, shellQuote(p))
+		}
+	}
+	return &Task{Run: strings.Join(args, " ")}
+}
+
+// backup runs the backup command cmd on its hosts, in the batches of cmd.
+func (sup *Stackup) backup(r *runState, cmd *Command) error {
+	b := cmd.Backup
+	now := time.Now().UTC()
+	name := cmd.Name + "-" + now.Format(backupTimeFormat) + ".tar.gz"
+
+	for _, batch := range cmd.batches(r.commandClients(cmd)) {
+		var wg sync.WaitGroup
+		errCh := make(chan error, len(batch))
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c Client) {
+				defer wg.Done()
+				host := r.hostName(c)
+				dir := strings.TrimSuffix(b.Dest, "/") + "/" + backupHostRegexp.ReplaceAllString(host, "_")
+				size, err := sup.backupHost(r, c, b.Paths, dir, name)
+				if err == nil {
+					fmt.Fprintf(os.Stderr, "%vbacked up to %v/%v (%v)\n", sup.clientPrefix(c, r.maxLen), dir, name, formatSize(size))
+					err = pruneBackups(dir, cmd.Name, b, now)
+				}
+				if err != nil {
+					r.report.setHost(host, HostFailed, 0, err)
+					errCh <- errors.Wrap(err, sup.clientPrefix(c, r.maxLen)+"backup failed")
+				}
+			}(c)
+		}
+		wg.Wait()
+		close(errCh)
+		for err := range errCh {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupHost streams the archive of the paths of c to the file name of
+// dir, returning its size.
+func (sup *Stackup) backupHost(r *runState, c Client, paths []string, dir, name string) (int64, error) {
+	if err := c.Run(backupTask(paths)); err != nil {
+		return 0, err
+	}
+	c.WriteClose()
+
+	if isObjectURL(dir) {
+		object, err := createObject(dir + "/" + name)
+		if err != nil {
+			return 0, err
+		}
+		counter := &progressWriter{w: object}
+		err = waitTransfer(r.ctx, c, counter)
+		if closeErr := object.Close(); err == nil {
+			err = closeErr
+		}
+		return counter.n, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	// Written to a part file first, so failed backups don't count.
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	counter := &progressWriter{w: f}
+	err = waitTransfer(r.ctx, c, counter)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".part", path)
+	}
+	if err != nil {
+		os.Remove(path + ".part")
+	}
+	return counter.n, err
+}
+
+// pruneBackups removes the backups of the command in dir beyond the
+// retention settings of b.
+func pruneBackups(dir, command string, b *Backup, now time.Time) error {
+	if b.Keep <= 0 && b.MaxAge <= 0 {
+		return nil
+	}
+	names, err := listBackups(dir)
+	if err != nil {
+		return errors.Wrap(err, "listing backups failed")
+	}
+
+	// The names of the backups of the command, newest first.
+	var backups []string
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, command+"-"), ".tar.gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil && name == command+"-"+stamp+".tar.gz" {
+			backups = append(backups, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, name := range backups {
+		created, _ := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, command+"-"), ".tar.gz"))
+		expired := b.MaxAge > 0 && now.Sub(created) > time.Duration(b.MaxAge)
+		if i == 0 || (!expired && (b.Keep <= 0 || i < b.Keep)) {
+			continue // The backup just made is always kept.
+		}
+		if err := removeBackup(dir, name); err != nil {
+			return errors.Wrapf(err, "removing backup %v failed", name)
+		}
+	}
+	return nil
+}
+
+// listBackups lists the files of the backup directory dir.
+func listBackups(dir string) ([]string, error) {
+	if isObjectURL(dir) {
+		return listObjects(dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// removeBackup removes the backup name of dir.
+func removeBackup(dir, name string) error {
+	if isObjectURL(dir) {
+		return removeObject(dir + "/" + name)
+	}
+	return os.Remove(filepath.Join(dir, name))
+}
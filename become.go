@@ -0,0 +1,97 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// Commands with become run as root by the become method of the network:
+// sudo, su or doas, for the hosts not shipping sudo. su and doas read the
+// password from the terminal only, so sup answers the password prompt in
+// the output of the terminal of the task by the sudo password given to
+// sup, the password of root for su.
+
+// Become methods, see Network.BecomeMethod.
+const (
+	BecomeSudo = "sudo"
+	BecomeSu   = "su"
+	BecomeDoas = "doas"
+)
+
+// becomeCommand returns the command running command as root by method.
+// su keeps the shell (and environment) of the user, so the command isn't
+// run by root's shell, e.g. csh.
+func becomeCommand(method, command string) string {
+	switch method {
+	case BecomeSu:
+		return "su -m root -c " + shellQuote(command)
+	case BecomeDoas:
+		return "doas sh -c " + shellQuote(command)
+	}
+	return "sudo sh -c " + shellQuote(command)
+}
+
+// becomePrompt matches the password prompts of the become methods, e.g.
+// "[sudo] password for deploy: ", "Password:" or "doas (deploy@web1) password: ".
+var becomePrompt = regexp.MustCompile(`(?i)password[^\n]*: *$`)
+
+// maxPromptLen bounds the last line of the output matched by becomePrompt.
+const maxPromptLen = 256
+
+// becomeReader reads the output of the terminal of a task, answering the
+// password prompts of its become method, dropped from the output. The
+// first prompt is answered by the password; the next ones, e.g. after
+// a wrong password, interrupt the task, as does a prompt without password.
+type becomeReader struct {
+	r        io.Reader
+	stdin    io.Writer
+	password string
+
+	prompts int
+	line    []byte // The end of the last line of the output so far.
+	pending []byte // Messages to be read.
+}
+
+func (b *becomeReader) Read(p []byte) (int, error) {
+	for {
+		if len(b.pending) > 0 {
+			n := copy(p, b.pending)
+			b.pending = b.pending[n:]
+			return n, nil
+		}
+
+		n, err := b.r.Read(p)
+		inLine := n // Bytes of the last line in p.
+		if i := bytes.LastIndexByte(p[:n], '\n'); i >= 0 {
+			b.line, inLine = b.line[:0], n-i-1
+		}
+		b.line = append(b.line, p[n-inLine:n]...)
+		if len(b.line) > maxPromptLen {
+			b.line = b.line[len(b.line)-maxPromptLen:]
+		}
+		if becomePrompt.Match(b.line) {
+			n -= inLine
+			b.line = b.line[:0]
+			b.answer()
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// answer answers a password prompt.
+func (b *becomeReader) answer() {
+	b.prompts++
+	switch {
+	case b.prompts == 1 && b.password != "":
+		io.WriteString(b.stdin, b.password+"\n")
+	case b.password == "":
+		b.pending = append(b.pending, "sup: become password required, set $SUP_SUDO_PASSWORD, use -K or sudo_password\n"...)
+		io.WriteString(b.stdin, "\x03")
+	default:
+		b.pending = append(b.pending, "sup: become password rejected\n"...)
+		io.WriteString(b.stdin, "\x03")
+	}
+}
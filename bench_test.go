@@ -0,0 +1,94 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fanyang01/sup/suptest"
+)
+
+// Sizes of the output and the uploads of the benchmarks, per host.
+const (
+	benchOutputSize = 1 << 20
+	benchUploadSize = 1 << 20
+)
+
+// Numbers of simulated hosts of the benchmarks.
+var benchHosts = []int{10, 100}
+
+// benchRun runs cmd b.N times on every number of benchHosts simulated
+// hosts served by handler. The output of the hosts is discarded; bytes
+// is the data transferred per host, to report the throughput.
+func benchRun(b *testing.B, handler suptest.Handler, cmd *Command, bytes int64) {
+	server, err := suptest.NewServer(handler)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+
+	// Keep the journals of the runs out of the working tree.
+	state, err := ioutil.TempDir("", "sup-bench-state-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+
+	stdout, stderr := stdoutWriter.w, stderrWriter.w
+	stdoutWriter.w, stderrWriter.w = ioutil.Discard, ioutil.Discard
+	defer func() { stdoutWriter.w, stderrWriter.w = stdout, stderr }()
+
+	for _, hosts := range benchHosts {
+		b.Run(fmt.Sprintf("hosts=%d", hosts), func(b *testing.B) {
+			// All the simulated hosts are served by a single server,
+			// they differ by user names.
+			network := &Network{Name: "bench"}
+			for i := 0; i < hosts; i++ {
+				network.Hosts = append(network.Hosts, Host{Addr: fmt.Sprintf("host%d@%v", i, server.Addr())})
+			}
+			app, err := New(&Supfile{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			app.Prefix(true)
+			app.StateDir(state)
+
+			b.SetBytes(bytes * int64(hosts))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := app.Run(network, EnvList{}, cmd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFanout connects to all the hosts and runs a no-op.
+func BenchmarkFanout(b *testing.B) {
+	noop := func(string, io.Reader, io.Writer, io.Writer) int { return 0 }
+	benchRun(b, noop, &Command{Name: "fanout", Run: "true"}, 0)
+}
+
+// BenchmarkOutput streams the output of all the hosts.
+func BenchmarkOutput(b *testing.B) {
+	benchRun(b, suptest.Output(benchOutputSize), &Command{Name: "output", Run: "cat"}, benchOutputSize)
+}
+
+// BenchmarkUpload uploads a file to all the hosts.
+func BenchmarkUpload(b *testing.B) {
+	dir, err := ioutil.TempDir("", "sup-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upload")
+	if err := ioutil.WriteFile(file, make([]byte, benchUploadSize), 0644); err != nil {
+		b.Fatal(err)
+	}
+	cmd := &Command{Name: "upload", Upload: []Upload{{Src: file, Dst: "/tmp"}}}
+	benchRun(b, suptest.Discard, cmd, benchUploadSize)
+}
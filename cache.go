@@ -0,0 +1,138 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// buildCacheMu serializes the updates of the build cache, e.g. by
+// concurrent async commands.
+var buildCacheMu sync.Mutex
+
+// runCachedCommand runs cmd, unless it's a build (see Command.CacheKey)
+// whose inputs didn't change since its last successful run, and whose
+// outputs are still there.
+func (sup *Stackup) runCachedCommand(r *runState, span *Span, cmd *Command) error {
+	if len(cmd.CacheKey) == 0 || sup.mock != nil {
+		return sup.runCommand(r, span, cmd)
+	}
+	key, err := buildCacheKey(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "%v: cache_key", cmd.Name)
+	}
+	path := filepath.Join(sup.stateDirectory(), "builds.json")
+	if buildCacheHit(path, cmd, key) {
+		fmt.Fprintf(os.Stderr, "%v: inputs unchanged since the last build, skipped\n", cmd.Name)
+		return nil
+	}
+	if err := sup.runCommand(r, span, cmd); err != nil {
+		return err
+	}
+	if err := saveBuildCache(path, cmd, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "writing build cache failed"))
+	}
+	return nil
+}
+
+// buildCacheKey returns the SHA-256 checksum of the local command of cmd
+// and of the files matching its cache_key globs. Matched directories are
+// walked recursively.
+func buildCacheKey(cmd *Command) (string, error) {
+	var files []string
+	for _, pattern := range cmd.CacheKey {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	sort.Strings(files)
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%v\n", cmd.Local)
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(sum, "%v\n", filepath.ToSlash(file))
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+// readBuildCache reads the cache keys of the last successful builds,
+// by command name.
+func readBuildCache(path string) map[string]string {
+	keys := map[string]string{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		json.Unmarshal(data, &keys) // A corrupted cache just rebuilds.
+	}
+	return keys
+}
+
+// buildCacheHit reports whether the last successful build of cmd had the
+// same cache key, and all of its cache_paths exist.
+func buildCacheHit(path string, cmd *Command, key string) bool {
+	buildCacheMu.Lock()
+	defer buildCacheMu.Unlock()
+	if readBuildCache(path)[cmd.Name] != key {
+		return false
+	}
+	for _, output := range cmd.CachePaths {
+		matches, _ := filepath.Glob(output)
+		if len(matches) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// saveBuildCache records key as the cache key of the last successful
+// build of cmd.
+func saveBuildCache(path string, cmd *Command, key string) error {
+	buildCacheMu.Lock()
+	defer buildCacheMu.Unlock()
+	keys := readBuildCache(path)
+	keys[cmd.Name] = key
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
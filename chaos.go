@@ -0,0 +1,77 @@
+package sup
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaos injects failures and latency into the tasks run on the hosts,
+// so error handling (e.g. on_batch_failure rollbacks) can be tested
+// before it's relied on in production. See Stackup.Chaos.
+type chaos struct {
+	fail    float64       // Probability of failing a task on a host.
+	latency time.Duration // Max delay added to a task on a host.
+}
+
+// parseChaos parses a comma separated list of KEY=VALUE settings,
+// e.g. "fail=5%,latency=200ms".
+func parseChaos(spec string) (*chaos, error) {
+	c := &chaos{}
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		i := strings.Index(setting, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("chaos: invalid setting %q, expected KEY=VALUE", setting)
+		}
+		key, value := setting[:i], setting[i+1:]
+		switch key {
+		case "fail":
+			percent := strings.HasSuffix(value, "%")
+			fail, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err == nil && percent {
+				fail /= 100
+			}
+			if err != nil || fail < 0 || fail > 1 {
+				return nil, fmt.Errorf("chaos: invalid fail %q, expected a percentage like 5%%", value)
+			}
+			c.fail = fail
+		case "latency":
+			latency, err := time.ParseDuration(value)
+			if err != nil || latency < 0 {
+				return nil, fmt.Errorf("chaos: invalid latency %q, expected a duration like 200ms", value)
+			}
+			c.latency = latency
+		default:
+			return nil, fmt.Errorf("chaos: unknown setting %q, expected fail or latency", key)
+		}
+	}
+	return c, nil
+}
+
+// inject delays the end of a task on a host by a random latency and,
+// by chance, fails the task. It returns err unless a failure is injected.
+func (c *chaos) inject(err error) error {
+	if c == nil {
+		return err
+	}
+	if c.latency > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.latency) + 1)))
+	}
+	if err == nil && rand.Float64() < c.fail {
+		return ErrChaos{}
+	}
+	return err
+}
+
+// ErrChaos is the failure injected into a task by chaos testing.
+type ErrChaos struct{}
+
+func (e ErrChaos) Error() string {
+	return "chaos: injected failure"
+}
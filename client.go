@@ -1,6 +1,7 @@
 package sup
 
 import (
+	"context"
 	"io"
 	"os"
 )
@@ -17,4 +18,11 @@ type Client interface {
 	Stderr() io.Reader
 	Stdout() io.Reader
 	Signal(os.Signal) error
+
+	// Upload copies the local file or directory src into the directory
+	// dst of the host. The client must not be running a task.
+	Upload(ctx context.Context, src, dst string, opts TransferOptions) error
+	// Download copies the file or directory src of the host into
+	// the local directory dst. The client must not be running a task.
+	Download(ctx context.Context, src, dst string, opts TransferOptions) error
 }
@@ -0,0 +1,112 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Actions taken when the clock of a host is skewed, see Network.MaxClockSkew.
+const (
+	OnClockSkewWarn = "warn" // Print a warning (default).
+	OnClockSkewFail = "fail" // Fail the run before running any command.
+)
+
+// ErrClockSkew is returned when the clock of a host is off by more than
+// the max_clock_skew of the network.
+type ErrClockSkew struct {
+	Host string
+	Skew time.Duration
+	Max  time.Duration
+}
+
+func (e ErrClockSkew) Error() string {
+	return fmt.Sprintf("host %v: clock is off by %v, max_clock_skew is %v", e.Host, e.Skew, e.Max)
+}
+
+// checkClocks compares the clocks of the clients against the local one,
+// warning about (or failing on, by the network's on_clock_skew) the hosts
+// whose clock is off by more than the network's max_clock_skew.
+func (sup *Stackup) checkClocks(r *runState, network *Network) error {
+	max := network.maxClockSkew()
+	if max <= 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	skews := make([]time.Duration, len(r.clients))
+	for i, c := range r.clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			skews[i] = clockSkew(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var failed error
+	for i, c := range r.clients {
+		if skews[i] <= max && skews[i] >= -max {
+			continue
+		}
+		err := ErrClockSkew{r.hostName(c), skews[i], max}
+		if network.OnClockSkew != OnClockSkewFail {
+			fmt.Fprintf(os.Stderr, "%sWarning: %v\n", sup.clientPrefix(c, r.maxLen), err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s%v\n", sup.clientPrefix(c, r.maxLen), err)
+		r.report.setHost(r.hostName(c), HostFailed, 0, err)
+		if failed == nil {
+			failed = errors.Wrap(err, "clock skew check failed")
+		}
+	}
+	return failed
+}
+
+// clockSkew returns how much the clock of c is ahead of the local one,
+// less the uncertainty of the measurement (half the round trip), or 0
+// if it can't be told.
+func clockSkew(c Client) time.Duration {
+	started := time.Now()
+	if err := c.Run(&Task{Run: "date +%s.%N"}); err != nil {
+		return 0
+	}
+	go io.Copy(ioutil.Discard, c.Stderr())
+	out, _ := ioutil.ReadAll(c.Stdout())
+	if err := c.Wait(); err != nil {
+		return 0
+	}
+	rtt := time.Since(started)
+
+	// %N isn't supported everywhere, e.g. by BSD date printing "N".
+	value := strings.TrimSpace(string(out))
+	remote, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		if remote, err = strconv.ParseFloat(strings.Split(value, ".")[0], 64); err != nil {
+			return 0
+		}
+	}
+	local := started.Add(rtt / 2)
+	skew := time.Duration((remote - float64(local.UnixNano())/1e9) * 1e9)
+	margin := rtt / 2
+	switch {
+	case skew > margin:
+		return skew - margin
+	case skew < -margin:
+		return skew + margin
+	}
+	return 0
+}
+
+// maxClockSkew returns the max skew of the hosts' clocks, or 0 if the
+// clocks aren't checked.
+func (n *Network) maxClockSkew() time.Duration {
+	return time.Duration(n.MaxClockSkew)
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,17 +21,48 @@ import (
 
 var (
 	supfile     string
+	chdir       string
+	environment string
 	envVars     flagStringSlice
+	supVars     flagStringSlice
 	onlyHosts   string
 	exceptHosts string
-
-	debug         bool
+	hostLabels  flagStringSlice
+	failedFrom  string
+	reportFile  string
+	fromRef     string
+	stateDir    string
+
+	overrideFreeze  string
+	askSudoPass     bool
+	askPass         bool
+	resume          bool
+	interactive     bool
+	refresh         bool
+	noAgent         bool
+	hostKeyChecking string
+	connectTimeout  time.Duration
+	keepalive       time.Duration
+	frozenInventory bool
+	chaosSpec       string
+	transport       string
+	mockFile        string
+
+	rehearsal  bool
+	testImage  string
+	testSample int
+
+	serverAddr string
+	planOut    string
+
+	debug         debugFlag
+	debugFile     string
 	disablePrefix bool
 
 	showVersion bool
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [OPTIONS] NETWORK describe COMMAND [...]\n       sup [OPTIONS] NETWORK attach [ID]\n       sup [OPTIONS] test NETWORK COMMAND [...]\n       sup [OPTIONS] plan [--plan-out FILE] NETWORK COMMAND [...]\n       sup [OPTIONS] apply FILE\n       sup [OPTIONS] all NETWORK COMMAND [...]\n       sup [OPTIONS] serve\n       sup [OPTIONS] runs list|approve ID|cancel ID\n       sup agent\n       sup [ --help | -v | --version ]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
@@ -43,15 +80,74 @@ func (f *flagStringSlice) Set(value string) error {
 	return nil
 }
 
+// debugFlag is the value of --debug: either a bool enabling the debug mode
+// (tracing the commands by "set -x"), or a comma separated list of facets
+// of the detailed debug log.
+type debugFlag struct {
+	enabled bool
+	facets  []string
+}
+
+func (f *debugFlag) String() string {
+	if len(f.facets) > 0 {
+		return strings.Join(f.facets, ",")
+	}
+	return strconv.FormatBool(f.enabled)
+}
+
+func (f *debugFlag) Set(value string) error {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		f.enabled = enabled
+		return nil
+	}
+	for _, facet := range strings.Split(value, ",") {
+		f.facets = append(f.facets, strings.TrimSpace(facet))
+	}
+	return nil
+}
+
+func (f *debugFlag) IsBoolFlag() bool {
+	return true
+}
+
 func init() {
 	flag.StringVar(&supfile, "f", "Supfile.yaml", "Custom path to Supfile")
+	flag.StringVar(&chdir, "C", "", "Change to the directory before doing anything else")
+	flag.StringVar(&environment, "environment", "", "Apply Supfile environment overlay")
 	flag.Var(&envVars, "e", "Set environment variables")
 	flag.Var(&envVars, "env", "Set environment variables")
+	flag.Var(&supVars, "var", "Override Supfile vars, KEY=VALUE")
 	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
-
-	flag.BoolVar(&debug, "D", false, "Enable debug mode")
-	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
+	flag.Var(&hostLabels, "label", "Filter hosts labeled KEY=VALUE")
+	flag.StringVar(&failedFrom, "failed-from", "", "Run on the hosts that failed in the report of a previous run")
+	flag.BoolVar(&frozenInventory, "frozen-inventory", false, "Run on the inventory resolved by the last run, saved in .sup/state")
+	flag.StringVar(&reportFile, "report", "", "Write the report of the run to a JSON file, or an s3:// or gs:// URL")
+	flag.StringVar(&fromRef, "from-ref", "", "Run the Supfile and local files of a git ref, e.g. origin/main, not of the working copy")
+	flag.StringVar(&overrideFreeze, "override-freeze", "", "Run despite an active deploy freeze, giving a reason")
+	flag.BoolVar(&askSudoPass, "K", false, "Ask for sudo password")
+	flag.BoolVar(&askPass, "k", false, "Ask for SSH password")
+	flag.StringVar(&transport, "transport", "ssh", "Transport to the hosts: ssh or mock (simulated hosts)")
+	flag.StringVar(&mockFile, "mock", "", "Scripted responses of the simulated hosts (with --transport mock)")
+	flag.StringVar(&testImage, "test-image", "lscr.io/linuxserver/openssh-server", "Docker image of the hosts (sup test)")
+	flag.IntVar(&testSample, "test-sample", 0, "Number of hosts to rehearse on, 0 for all (sup test)")
+	flag.BoolVar(&askSudoPass, "ask-sudo-pass", false, "Ask for sudo password")
+	flag.BoolVar(&askPass, "ask-pass", false, "Ask for SSH password")
+	flag.BoolVar(&resume, "resume", false, "Resume the last run, skipping what it completed, and its interrupted uploads")
+	flag.BoolVar(&interactive, "i", false, "Interactive run: press s to skip the hosts still running, p to pause")
+	flag.BoolVar(&interactive, "interactive", false, "Interactive run: press s to skip the hosts still running, p to pause")
+	flag.BoolVar(&refresh, "refresh", false, "Probe all the hosts again, ignoring the host cache")
+	flag.StringVar(&hostKeyChecking, "strict-host-key-checking", "", "Check the host keys by known_hosts: yes, accept-new (add unknown hosts) or no")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 0, "Max time of connecting to a host, e.g. 10s, overriding connect_timeout")
+	flag.DurationVar(&keepalive, "keepalive-interval", 0, "Send keepalives to the hosts this often, e.g. 30s, overriding keepalive_interval")
+	flag.BoolVar(&noAgent, "no-agent", false, "Don't connect through the sup agent, even if it's running")
+	flag.StringVar(&chaosSpec, "chaos", "", "Inject failures and latency into the tasks, e.g. 'fail=5%,latency=200ms'")
+	flag.StringVar(&serverAddr, "addr", "localhost:8383", "Address of the sup server (sup serve, sup runs)")
+	flag.StringVar(&planOut, "plan-out", "", "Save the plan to a JSON file, to be run by sup apply (sup plan)")
+
+	flag.Var(&debug, "D", "Enable debug mode")
+	flag.Var(&debug, "debug", "Enable debug mode, or log the given facets (ssh,exec,env,upload or all) to the debug file")
+	flag.StringVar(&debugFile, "debug-file", "sup-debug.log", "Debug log file")
 	flag.BoolVar(&disablePrefix, "disable-prefix", false, "Disable hostname prefix")
 
 	flag.BoolVar(&showVersion, "v", false, "Print version")
@@ -60,78 +156,176 @@ func init() {
 	flag.BoolVar(&showHelp, "help", false, "Show help")
 }
 
-func networkUsage(conf *sup.Supfile) {
+// readPassword prompts for a password on the terminal, without echoing it.
+func readPassword(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	stty := func(args ...string) error {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return "", err
+	}
+	defer stty("echo")
+
+	fmt.Fprint(tty, prompt)
+	password, err := bufio.NewReader(tty).ReadString('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+func networkUsage(out io.Writer, conf *sup.Supfile) {
 	w := &tabwriter.Writer{}
-	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	w.Init(out, 4, 4, 2, ' ', 0)
 	defer w.Flush()
 
 	// Print available networks/hosts.
 	fmt.Fprintln(w, "Networks:\t")
-	for name, network := range conf.Networks {
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
 		fmt.Fprintf(w, "- %v\n", name)
 		for _, host := range network.Hosts {
+			if len(host.Roles) > 0 {
+				fmt.Fprintf(w, "\t- %v\t%v\n", host, strings.Join(host.Roles, " "))
+				continue
+			}
 			fmt.Fprintf(w, "\t- %v\n", host)
 		}
 	}
 	fmt.Fprintln(w)
 }
 
-func cmdUsage(conf *sup.Supfile) {
+func cmdUsage(out io.Writer, conf *sup.Supfile) {
 	w := &tabwriter.Writer{}
-	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	w.Init(out, 4, 4, 2, ' ', 0)
 	defer w.Flush()
 
 	// Print available targets/commands.
 	fmt.Fprintln(w, "Targets:\t")
-	for name, commands := range conf.Targets {
-		fmt.Fprintf(w, "- %v\t%v\n", name, strings.Join(commands, " "))
+	for _, name := range conf.Targets.Names {
+		commands, _ := conf.Targets.Get(name)
+		if commands.Deprecated != "" {
+			name += " (deprecated)"
+		}
+		fmt.Fprintf(w, "- %v\t%v\n", name, strings.Join(commands.Names(), " "))
 	}
 	fmt.Fprintln(w, "\t")
 	fmt.Fprintln(w, "Commands:\t")
-	for name, cmd := range conf.Commands {
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		if cmd.Deprecated != "" {
+			name += " (deprecated)"
+		}
 		fmt.Fprintf(w, "- %v\t%v\n", name, cmd.Desc)
 	}
 	fmt.Fprintln(w)
 }
 
+// localUser returns the name of the user running sup.
+func localUser() string {
+	if os.Getenv("SUP_USER") != "" {
+		return os.Getenv("SUP_USER")
+	}
+	if os.Getenv("USER") == "" {
+		if u, err := user.Current(); err == nil {
+			return u.Username
+		}
+	}
+	return os.Getenv("USER")
+}
+
+// callerIdentity returns the verified identity of the user running sup,
+// which the access rules apply to: the user of the token in $SUP_TOKEN if
+// the Supfile authenticates users (see sup.Auth), or the OS user otherwise.
+// Unlike $SUP_USER, it can't be set to anyone else.
+func callerIdentity(conf *sup.Supfile) (sup.Identity, error) {
+	if conf.Auth != nil {
+		return conf.Authenticate(os.Getenv("SUP_TOKEN"))
+	}
+	u, err := user.Current()
+	if err != nil {
+		return sup.Identity{}, err
+	}
+	groups, err := sup.LocalGroups()
+	if err != nil {
+		return sup.Identity{}, errors.Wrap(err, "resolving user groups failed")
+	}
+	return sup.Identity{User: u.Username, Groups: groups}, nil
+}
+
+// inventoryFunc resolves the hosts of the inventory and provider of a
+// network, see parseArgs.
+type inventoryFunc func(network *sup.Network) error
+
+// resolveInventory returns the inventoryFunc resolving the inventories,
+// or reusing the ones of the last run saved in dir if frozen.
+func resolveInventory(dir string, frozen bool) inventoryFunc {
+	return func(network *sup.Network) error {
+		if frozen {
+			return sup.FreezeInventory(dir, network)
+		}
+		return network.ResolveHosts()
+	}
+}
+
 // parseArgs parses args and returns network and commands to be run.
-// On error, it prints usage and exits.
-func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
+// The inventory of the network is resolved by inventory.
+// On error, it prints usage to the usage writer.
+func parseArgs(conf *sup.Supfile, args []string, usage io.Writer, inventory inventoryFunc) (*sup.Network, []*sup.Command, error) {
 	var commands []*sup.Command
 
-	args := flag.Args()
 	if len(args) < 1 {
-		networkUsage(conf)
+		networkUsage(usage, conf)
 		return nil, nil, ErrUsage
 	}
 
 	// Does the <network> exist?
-	network, ok := conf.Networks[args[0]]
+	network, ok := conf.Networks.Get(args[0])
 	if !ok {
-		networkUsage(conf)
+		networkUsage(usage, conf)
 		return nil, nil, ErrUnknownNetwork
 	}
 
+	// Resolve its inventory and provider, the ones of this network only.
+	if err := inventory(&network); err != nil {
+		return nil, nil, err
+	}
+
 	// Does the <network> have at least one host?
 	if len(network.Hosts) == 0 {
-		networkUsage(conf)
+		networkUsage(usage, conf)
 		return nil, nil, ErrNetworkNoHosts
 	}
 
-	// Check for the second argument
+	// Check for the second argument, run the network's default target otherwise.
 	if len(args) < 2 {
-		cmdUsage(conf)
-		return nil, nil, ErrUsage
+		if network.DefaultTarget == "" {
+			cmdUsage(usage, conf)
+			return nil, nil, ErrUsage
+		}
+		args = []string{args[0], network.DefaultTarget}
 	}
 
-	// In case of the network.Env needs an initialization
-	if network.Env == nil {
-		network.Env = make(sup.EnvList, 0)
-	}
+	// Don't modify the Supfile's env vars.
+	network.Env = network.Env.Clone()
 
 	// Add default env variable with current network
 	network.Env.Set("SUP_NETWORK", args[0])
 
+	// Add environment overlay name, if any
+	if conf.Environment != "" {
+		network.Env.Set("SUP_ENVIRONMENT", conf.Environment)
+	}
+
 	// Add default nonce
 	network.Env.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
 	if os.Getenv("SUP_TIME") != "" {
@@ -139,37 +333,35 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	}
 
 	// Add user
-	if os.Getenv("SUP_USER") != "" {
-		network.Env.Set("SUP_USER", os.Getenv("SUP_USER"))
-	} else {
-		network.Env.Set("SUP_USER", os.Getenv("USER"))
-	}
+	network.Env.Set("SUP_USER", localUser())
 
 	for _, cmd := range args[1:] {
 		// Target?
-		target, isTarget := conf.Targets[cmd]
+		name, isTarget := conf.Targets.Resolve(cmd)
 		if isTarget {
+			target, _ := conf.Targets.Get(name)
+			warnDeprecated("target", cmd, name, target.Deprecated)
+
 			// Loop over target's commands.
-			for _, cmd := range target {
-				command, isCommand := conf.Commands[cmd]
-				if !isCommand {
-					cmdUsage(conf)
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
-				}
-				command.Name = cmd
-				commands = append(commands, &command)
+			targetCommands, err := target.Resolve(conf, name)
+			if err != nil {
+				cmdUsage(usage, conf)
+				return nil, nil, fmt.Errorf("%v: %v", ErrCmd, err.(sup.ErrUnknownCommand).Name)
 			}
+			commands = append(commands, targetCommands...)
 		}
 
 		// Command?
-		command, isCommand := conf.Commands[cmd]
+		name, isCommand := conf.Commands.Resolve(cmd)
 		if isCommand {
-			command.Name = cmd
+			command, _ := conf.Commands.Get(name)
+			warnDeprecated("command", cmd, name, command.Deprecated)
+			command.Name = name
 			commands = append(commands, &command)
 		}
 
 		if !isTarget && !isCommand {
-			cmdUsage(conf)
+			cmdUsage(usage, conf)
 			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
 		}
 	}
@@ -177,9 +369,159 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	return &network, commands, nil
 }
 
+// warnDeprecated warns about invoking a command or target by one of its
+// aliases, or about invoking a deprecated one.
+func warnDeprecated(kind, invoked, name, deprecated string) {
+	if invoked != name {
+		fmt.Fprintf(os.Stderr, "Warning: %v %v was renamed to %v\n", kind, invoked, name)
+	}
+	if deprecated != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %v %v is deprecated: %v\n", kind, name, deprecated)
+	}
+}
+
+// newApp creates a Stackup configured by the flags,
+// along with the simulated hosts of the mock transport, if any.
+func newApp(conf *sup.Supfile) (*sup.Stackup, *sup.Mock, error) {
+	app, err := sup.New(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	app.Debug(debug.enabled)
+	if len(debug.facets) > 0 {
+		f, err := os.OpenFile(debugFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := app.DebugLog(f, debug.facets...); err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Writing debug log to %v\n", debugFile)
+	}
+	app.Prefix(!disablePrefix)
+	app.ResumeUploads(resume)
+	app.RefreshHostCache(refresh)
+	app.ReportFile(reportFile)
+	app.StateDir(stateDir)
+	if err := app.HostKeyChecking(hostKeyChecking); err != nil {
+		return nil, nil, err
+	}
+	app.Interactive(interactive)
+	app.ConnectTimeout(connectTimeout)
+	app.KeepaliveInterval(keepalive)
+	if !noAgent {
+		app.Agent(sup.DefaultAgentSocket())
+	}
+	if chaosSpec != "" {
+		if err := app.Chaos(chaosSpec); err != nil {
+			return nil, nil, err
+		}
+	}
+	app.Tracer(sup.NewTracerFromEnv())
+
+	var mock *sup.Mock
+	switch transport {
+	case "ssh":
+	case "mock":
+		if mockFile != "" {
+			mock, err = sup.NewMockFromFile(mockFile)
+		} else {
+			mock, err = sup.NewMock(nil)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		app.Mock(mock)
+	default:
+		return nil, nil, fmt.Errorf("unknown transport %q", transport)
+	}
+	return app, mock, nil
+}
+
+// runVars returns the env vars of a run against network: the Supfile's,
+// the network's and the ones given by the --env flags, defining $SUP_ENV.
+func runVars(conf *sup.Supfile, network *sup.Network, envVars []string) (sup.EnvList, error) {
+	var vars sup.EnvList
+	for _, val := range conf.Env {
+		vars.Set(val.Key, val.Value)
+	}
+	for _, val := range network.Env {
+		vars.Set(val.Key, val.Value)
+	}
+	if err := vars.ResolveValues(); err != nil {
+		return nil, err
+	}
+	if conf.SafeInterpolation {
+		// Resolved already, don't expand them again on the hosts.
+		for i, v := range vars {
+			vars[i] = &sup.EnvVar{Key: v.Key, Value: v.Value, Secret: v.Secret, Literal: true}
+		}
+	}
+	set := vars.Set
+	if conf.SafeInterpolation {
+		set = vars.SetLiteral
+	}
+
+	// Parse CLI --env flag env vars, define $SUP_ENV and override values defined in Supfile.
+	var cliVars sup.EnvList
+	for _, env := range envVars {
+		if len(env) == 0 {
+			continue
+		}
+		i := strings.Index(env, "=")
+		if i < 0 {
+			if len(env) > 0 {
+				set(env, "")
+			}
+			continue
+		}
+		set(env[:i], env[i+1:])
+		cliVars.Set(env[:i], env[i+1:])
+	}
+
+	// SUP_ENV is generated only from CLI env vars.
+	// Separate loop to omit duplicates.
+	supEnv := ""
+	for _, v := range cliVars {
+		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	}
+	set("SUP_ENV", strings.TrimSpace(supEnv))
+	return vars, nil
+}
+
+// atExit are called before sup exits, see exit.
+var atExit []func()
+
+// exit calls atExit, then exits with code.
+func exit(code int) {
+	for _, f := range atExit {
+		f()
+	}
+	os.Exit(code)
+}
+
 func main() {
 	flag.Parse()
 
+	// "sup test" rehearses the run on disposable containers,
+	// "sup plan" and "sup apply" plan the run and run the plan,
+	// "sup all" runs in all the projects of a workspace,
+	// "sup serve" and "sup runs" run and manage a sup server,
+	// "sup agent" holds the connections to the hosts for the next runs.
+	mode := flag.Arg(0)
+	switch mode {
+	case "test", "plan", "apply", "all", "serve", "runs", "agent":
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if chdir != "" {
+		if err := os.Chdir(chdir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+	}
+	rehearsal = mode == "test"
+
 	if showHelp {
 		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
 		flag.PrintDefaults()
@@ -191,17 +533,186 @@ func main() {
 		return
 	}
 
-	conf, err := sup.NewSupfile(supfile)
+	if mode == "agent" {
+		agent := sup.NewAgent(sup.DefaultAgentSocket(), sup.DefaultAgentIdle)
+		fmt.Fprintln(os.Stderr, agent.ListenAndServe())
+		exit(1)
+	}
+
+	if mode == "runs" {
+		if err := manageRuns(serverAddr, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		return
+	}
+
+	// --from-ref runs from a temporary worktree of the ref, keeping the
+	// state, reports and logs next to the working copy.
+	stateDir = sup.StateDir(supfile)
+	if fromRef != "" {
+		switch mode {
+		case "plan", "apply", "all", "serve":
+			fmt.Fprintf(os.Stderr, "--from-ref can't be used by sup %v\n", mode)
+			exit(sup.ExitConfig)
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		for _, path := range []*string{&stateDir, &reportFile, &failedFrom, &debugFile, &mockFile} {
+			if *path != "" && !strings.Contains(*path, "://") && !filepath.IsAbs(*path) {
+				*path = filepath.Join(wd, *path)
+			}
+		}
+
+		dir, commit, cleanup, err := sup.CheckoutRef(fromRef)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		atExit = append(atExit, cleanup)
+		defer cleanup()
+		if err := os.Chdir(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		fmt.Fprintf(os.Stderr, "Running from %v (%.12v)\n", fromRef, commit)
+	}
+
+	// "sup apply FILE" runs exactly what was planned.
+	var plan *sup.Plan
+	if mode == "apply" {
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, ErrUsage)
+			exit(sup.ExitConfig)
+		}
+		var err error
+		if plan, err = sup.ReadPlan(flag.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		if err := os.Chdir(plan.Dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		supfile, environment = plan.Supfile, plan.Environment
+		supVars, envVars = plan.Vars, plan.EnvArgs
+	}
+
+	conf, err := sup.NewSupfileEnvironment(supfile, environment)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		exit(sup.ExitConfig)
+	}
+	if err := conf.ApplyVars(supVars); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(sup.ExitConfig)
+	}
+
+	if mode == "all" {
+		projects, err := workspaceProjects(conf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		exit(runWorkspace(projects, flag.Args()))
+	}
+
+	if mode == "serve" {
+		app, _, err := newApp(conf)
+		if err == nil {
+			app.SudoPassword(os.Getenv("SUP_SUDO_PASSWORD"))
+			err = serve(serverAddr, conf, app, resolveInventory(stateDir, frozenInventory))
+		}
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	// "sup NETWORK describe COMMAND..." explains the run instead of running it,
+	// unless Supfile defines its own "describe".
+	args := flag.Args()
+	if plan != nil {
+		args = append([]string{plan.Network}, plan.Args...)
+	}
+	_, isTarget := conf.Targets.Resolve("describe")
+	_, isCommand := conf.Commands.Resolve("describe")
+	describe := len(args) > 1 && args[1] == "describe" && !isTarget && !isCommand
+	if describe {
+		args = append([]string{args[0]}, args[2:]...)
+	}
+
+	// "sup NETWORK attach [ID]" reattaches to a detached run of a command
+	// (see survive_disconnect), or lists them, unless Supfile defines its
+	// own "attach".
+	_, isTarget = conf.Targets.Resolve("attach")
+	_, isCommand = conf.Commands.Resolve("attach")
+	attach := len(args) > 1 && args[1] == "attach" && !isTarget && !isCommand && plan == nil
+	if attach {
+		if len(args) > 3 {
+			fmt.Fprintln(os.Stderr, ErrUsage)
+			exit(sup.ExitConfig)
+		}
+		id := ""
+		if len(args) > 2 {
+			id = args[2]
+		}
+		cmd, err := sup.AttachCommand(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		conf.Commands.Set(cmd.Name, *cmd)
+		args = args[:2]
 	}
 
 	// Parse network and commands to be run from args.
-	network, commands, err := parseArgs(conf)
+	// --frozen-inventory reuses the inventory of the last run.
+	network, commands, err := parseArgs(conf, args, os.Stderr, resolveInventory(stateDir, frozenInventory))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		exit(sup.ExitConfig)
+	}
+
+	// Keep the resolved inventory in the state directory of the project,
+	// for --frozen-inventory.
+	if !frozenInventory {
+		if err := sup.SaveInventory(stateDir, network); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+	}
+	inventory := network.Hosts // Before filters, see Plan.Checksum.
+
+	// Act on behalf of the verified user, if the Supfile restricts or
+	// authenticates the users, or has a policy, or a freeze override is to
+	// be audited, whatever $SUP_USER and -e say.
+	var identity *sup.Identity
+	if len(conf.Access) > 0 || conf.Auth != nil || conf.Policy != nil || overrideFreeze != "" {
+		id, err := callerIdentity(conf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		identity = &id
+		network.Env.Set("SUP_USER", id.User)
+	}
+
+	// Refuse to run during a deploy freeze, unless overridden.
+	// Rehearsals, descriptions, plans and attaching don't change the hosts, so they run anytime.
+	if err := conf.CheckFreeze(args[0], time.Now()); err != nil && !rehearsal && !describe && !attach && mode != "plan" {
+		if overrideFreeze == "" {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %v overridden: %v\n", strings.SplitN(err.Error(), "\n", 2)[0], overrideFreeze)
+		err := conf.Audit("freeze override: user=%q network=%q args=%q reason=%q",
+			identity.User, args[0], strings.Join(args[1:], " "), overrideFreeze)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
 	}
 
 	// --only flag filters hosts
@@ -209,18 +720,18 @@ func main() {
 		expr, err := regexp.CompilePOSIX(onlyHosts)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exit(sup.ExitConfig)
 		}
 
-		var hosts []string
+		var hosts []sup.Host
 		for _, host := range network.Hosts {
-			if expr.MatchString(host) {
+			if expr.MatchString(host.Addr) {
 				hosts = append(hosts, host)
 			}
 		}
 		if len(hosts) == 0 {
 			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts))
-			os.Exit(1)
+			exit(sup.ExitConfig)
 		}
 		network.Hosts = hosts
 	}
@@ -230,69 +741,222 @@ func main() {
 		expr, err := regexp.CompilePOSIX(exceptHosts)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exit(sup.ExitConfig)
 		}
 
-		var hosts []string
+		var hosts []sup.Host
 		for _, host := range network.Hosts {
-			if !expr.MatchString(host) {
+			if !expr.MatchString(host.Addr) {
 				hosts = append(hosts, host)
 			}
 		}
 		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts))
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", exceptHosts))
+			exit(sup.ExitConfig)
 		}
 		network.Hosts = hosts
 	}
 
-	var vars sup.EnvList
-	for _, val := range append(conf.Env, network.Env...) {
-		vars.Set(val.Key, val.Value)
+	// --label flags filter hosts by their labels, all of them
+	if len(hostLabels) > 0 {
+		var hosts []sup.Host
+	Hosts:
+		for _, host := range network.Hosts {
+			for _, label := range hostLabels {
+				kv := strings.SplitN(label, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					fmt.Fprintln(os.Stderr, fmt.Errorf("invalid --label '%v', expected KEY=VALUE", label))
+					exit(sup.ExitConfig)
+				}
+				if !host.HasLabel(kv[0], kv[1]) {
+					continue Hosts
+				}
+			}
+			hosts = append(hosts, host)
+		}
+		if len(hosts) == 0 {
+			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --label %v", strings.Join(hostLabels, " --label ")))
+			exit(sup.ExitConfig)
+		}
+		network.Hosts = hosts
 	}
-	if err := vars.ResolveValues(); err != nil {
+
+	// --failed-from flag reruns the hosts that failed in a previous run
+	if failedFrom != "" {
+		report, err := sup.ReadReport(failedFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+		if report.Network != network.Name {
+			fmt.Fprintln(os.Stderr, fmt.Errorf("%v is a report of network %v, not %v", failedFrom, report.Network, network.Name))
+			exit(sup.ExitConfig)
+		}
+
+		failed := report.FailedHosts()
+		var hosts []sup.Host
+		for _, host := range network.Hosts {
+			for _, addr := range failed {
+				if host.Addr == addr {
+					hosts = append(hosts, host)
+					break
+				}
+			}
+		}
+		if len(hosts) == 0 {
+			fmt.Fprintf(os.Stderr, "No hosts failed in %v\n", failedFrom)
+			return
+		}
+		network.Hosts = hosts
+	}
+
+	// A plan runs on the planned hosts only, whatever the inventory says now.
+	if plan != nil {
+		if err := plan.PinHosts(network); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitConfig)
+		}
+	}
+
+	// Refuse the runs denied by the policy, or requiring approval, which
+	// only a sup server gives. Like freezes, they don't apply to rehearsals,
+	// descriptions, plans and attaching.
+	if !rehearsal && !describe && !attach && mode != "plan" && identity != nil {
+		decision, err := conf.CheckPolicy(identity.User, network, commands, time.Now())
+		if err == nil {
+			err = decision.Err(network.Name, false)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+
+	vars, err := runVars(conf, network, envVars)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		exit(sup.ExitCode(err))
+	}
+	if identity != nil {
+		vars.Set("SUP_USER", identity.User)
 	}
 
-	// Parse CLI --env flag env vars, define $SUP_ENV and override values defined in Supfile.
-	var cliVars sup.EnvList
-	for _, env := range envVars {
-		if len(env) == 0 {
-			continue
+	// Refuse to apply a plan whose inputs changed since.
+	if plan != nil {
+		current, err := sup.NewPlan(network, vars, commands...)
+		if err == nil {
+			err = current.Checksum(supfile, inventory)
 		}
-		i := strings.Index(env, "=")
-		if i < 0 {
-			if len(env) > 0 {
-				vars.Set(env, "")
+		if err == nil {
+			err = plan.Verify(current)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(sup.ExitCode(err))
+		}
+	}
+
+	if mode == "plan" {
+		plan, err := sup.NewPlan(network, vars, commands...)
+		if err == nil {
+			err = plan.Checksum(supfile, inventory)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		if plan.Supfile, err = filepath.Abs(supfile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		plan.Environment = environment
+		plan.Vars, plan.EnvArgs = supVars, envVars
+		plan.Args = args[1:]
+		if len(plan.Args) == 0 {
+			plan.Args = []string{network.DefaultTarget}
+		}
+		plan.Write(os.Stdout)
+		if planOut != "" {
+			if err := plan.WriteFile(planOut); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				exit(1)
 			}
-			continue
+			fmt.Fprintf(os.Stderr, "\nSaved the plan to %v, run it by: sup apply %v\n", planOut, planOut)
 		}
-		vars.Set(env[:i], env[i+1:])
-		cliVars.Set(env[:i], env[i+1:])
+		return
 	}
 
-	// SUP_ENV is generated only from CLI env vars.
-	// Separate loop to omit duplicates.
-	supEnv := ""
-	for _, v := range cliVars {
-		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	if describe {
+		if err := sup.Describe(os.Stdout, network, vars, commands...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		return
 	}
-	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
 
 	// Create new Stackup app.
-	app, err := sup.New(conf)
+	app, mock, err := newApp(conf)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		exit(1)
+	}
+	if len(conf.Access) > 0 {
+		app.Authorizer(conf.Authorizer(identity.User, identity.Groups))
+	}
+	if askPass || network.AskPassword {
+		password, err := readPassword(fmt.Sprintf("SSH password (%v): ", network.Name))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading SSH password failed"))
+			exit(1)
+		}
+		app.SSHPassword(password)
+	}
+	for _, cmd := range commands {
+		if !cmd.Sudo && !cmd.Become {
+			continue
+		}
+		password := os.Getenv("SUP_SUDO_PASSWORD")
+		if askSudoPass {
+			password, err = readPassword("[sudo] password: ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading sudo password failed"))
+				exit(1)
+			}
+		}
+		app.SudoPassword(password)
+		break
+	}
+
+	cleanup := func() {}
+	if rehearsal {
+		// Don't page anyone or mark dashboards about a rehearsal.
+		conf.Notify, conf.Metrics = nil, nil
+		cleanup, err = rehearse(network, testImage, testSample)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
 	}
-	app.Debug(debug)
-	app.Prefix(!disablePrefix)
 
 	// Run all the commands in the given network.
 	err = app.Run(network, vars, commands...)
+	cleanup()
+	if mock != nil && debug.enabled {
+		for _, host := range append(network.Hosts, sup.Host{Addr: "localhost"}) {
+			for _, cmd := range mock.Commands(host.Addr) {
+				fmt.Fprintf(os.Stderr, "mock: %v: %v\n", host, cmd)
+			}
+		}
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		// Failed tasks have been reported already.
+		cause := errors.Cause(err)
+		if e, ok := cause.(sup.ErrCanceled); ok {
+			cause = errors.Cause(e.Err)
+		}
+		if _, ok := cause.(sup.ErrTaskExit); !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		exit(sup.ExitCode(err))
 	}
 }
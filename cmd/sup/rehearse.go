@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/fanyang01/sup"
+	"github.com/pkg/errors"
+)
+
+// Credentials of the rehearsal containers' SSH user.
+const (
+	rehearsalUser     = "sup"
+	rehearsalPassword = "sup"
+)
+
+// rehearse replaces the hosts of network by disposable Docker containers
+// running sshd, one per host, or one per sample of hosts. The containers
+// keep the roles of the hosts they replace. It returns a function
+// removing the containers.
+func rehearse(network *sup.Network, image string, sample int) (func(), error) {
+	hosts := network.Hosts
+	if sample > 0 && sample < len(hosts) {
+		hosts = hosts[:sample]
+	}
+
+	var containers []string
+	cleanup := func() {
+		if len(containers) == 0 {
+			return
+		}
+		args := append([]string{"rm", "-f"}, containers...)
+		if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "removing rehearsal containers failed: %v: %s", err, out)
+		}
+	}
+
+	var rehearsalHosts []sup.Host
+	for _, host := range hosts {
+		out, err := exec.Command("docker", "run", "-d", "-P",
+			"--label", "sup.test="+network.Name,
+			"-e", "USER_NAME="+rehearsalUser,
+			"-e", "USER_PASSWORD="+rehearsalPassword,
+			"-e", "PASSWORD_ACCESS=true",
+			"-e", "SUDO_ACCESS=true",
+			image).Output()
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "starting container for %v failed", host)
+		}
+		id := strings.TrimSpace(string(out))
+		containers = append(containers, id)
+
+		out, err = exec.Command("docker", "port", id, "2222/tcp").Output()
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "resolving SSH port of container for %v failed", host)
+		}
+		addr := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+		addr = strings.Replace(addr, "0.0.0.0", "127.0.0.1", 1)
+
+		fmt.Fprintf(os.Stderr, "Rehearsing %v on container %.12s (%v)\n", host, id, addr)
+		rehearsalHosts = append(rehearsalHosts, sup.Host{
+			Addr:  fmt.Sprintf("%v:%v@%v", rehearsalUser, rehearsalPassword, addr),
+			Roles: host.Roles,
+		})
+	}
+
+	// Wait for sshd to start in all the containers.
+	for _, host := range rehearsalHosts {
+		addr := host.Addr[strings.Index(host.Addr, "@")+1:]
+		if err := waitForSSH(addr, 60*time.Second); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	network.Hosts = rehearsalHosts
+	network.Bastion = ""
+	return cleanup, nil
+}
+
+// waitForSSH waits until a SSH server greets on addr.
+func waitForSSH(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			banner := make([]byte, 4)
+			_, err = conn.Read(banner)
+			conn.Close()
+			if err == nil && string(banner) == "SSH-" {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("waiting for SSH server on %v timed out", addr)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fanyang01/sup"
+	"github.com/pkg/errors"
+)
+
+// manageRuns implements "sup runs list", "sup runs approve ID"
+// and "sup runs cancel ID" against the sup server listening on addr.
+func manageRuns(addr string, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		var runs []sup.QueuedRun
+		if err := apiRequest(addr, "GET", "/runs", &runs); err != nil {
+			return err
+		}
+
+		w := &tabwriter.Writer{}
+		w.Init(os.Stdout, 4, 4, 2, ' ', 0)
+		defer w.Flush()
+		fmt.Fprintln(w, "ID\tNETWORK\tCOMMANDS\tUSER\tSTATUS\tAPPROVER\tQUEUED")
+		for _, run := range runs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", run.ID, run.Network, strings.Join(run.Commands, " "),
+				run.User, run.Status, run.Approver, run.Queued.Format("2006-01-02 15:04:05"))
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "approve":
+		var run sup.QueuedRun
+		if err := apiRequest(addr, "POST", "/runs/"+args[1]+"/approve", &run); err != nil {
+			return err
+		}
+		if run.Status == sup.RunRunning {
+			fmt.Fprintf(os.Stderr, "Run %v continued\n", run.ID)
+		} else {
+			fmt.Fprintf(os.Stderr, "Run %v approved\n", run.ID)
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "cancel":
+		var run sup.QueuedRun
+		if err := apiRequest(addr, "POST", "/runs/"+args[1]+"/cancel", &run); err != nil {
+			return err
+		}
+		if run.Status == sup.RunRunning || run.Status == sup.RunPaused {
+			fmt.Fprintf(os.Stderr, "Interrupting run %v\n", run.ID)
+		} else {
+			fmt.Fprintf(os.Stderr, "Run %v canceled\n", run.ID)
+		}
+		return nil
+
+	default:
+		return ErrUsage
+	}
+}
+
+// apiRequest sends a request to the sup server on behalf of the local user,
+// authenticated by the token in $SUP_TOKEN if any, and decodes its JSON
+// response into v.
+func apiRequest(addr, method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(userHeader, localUser())
+	if token := os.Getenv("SUP_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "connecting to sup server failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.Errorf("sup server: %v", resp.Status)
+		}
+		return errors.Errorf("sup server: %v", e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
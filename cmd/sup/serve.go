@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanyang01/sup"
+	"github.com/pkg/errors"
+)
+
+// userHeader carries the identity of the API users if the Supfile doesn't
+// authenticate them (see sup.Auth). The server trusts it then, so it's
+// meant to be set by an authenticating proxy in front of it.
+const userHeader = "X-Sup-User"
+
+// runRequest is the body of a POST /runs request.
+type runRequest struct {
+	Network  string   `json:"network"`
+	Commands []string `json:"commands"` // Commands and/or targets.
+	Env      []string `json:"env"`      // KEY=VALUE pairs, as given by --env.
+}
+
+// server implements the HTTP API of "sup serve":
+//
+//	GET  /runs             List the runs.
+//	POST /runs             Queue a run, see runRequest.
+//	GET  /runs/ID          Show a run.
+//	POST /runs/ID/approve  Approve a pending run, or continue a paused one.
+//	POST /runs/ID/cancel   Cancel a pending or queued run, or interrupt a running one.
+//	POST /slack/actions    Approve or reject a pending run by a Slack button.
+type server struct {
+	conf      *sup.Supfile
+	queue     *sup.Queue
+	inventory inventoryFunc
+
+	mu    sync.Mutex
+	hosts map[string][]sup.Host // Resolved inventories by network name.
+}
+
+// serve runs a sup server listening on addr, which runs the commands
+// submitted over HTTP by app. The inventory of every network is resolved
+// by inventory once per server. The access rules of the Supfile need
+// authenticated users, see sup.Auth.
+func serve(addr string, conf *sup.Supfile, app *sup.Stackup, inventory inventoryFunc) error {
+	if len(conf.Access) > 0 && conf.Auth == nil {
+		return errors.New("access rules need authenticated users, configure auth in Supfile")
+	}
+	if approvals(conf) && conf.Auth == nil {
+		return errors.New("approvals need authenticated users, configure auth in Supfile")
+	}
+	s := &server{
+		conf:      conf,
+		queue:     sup.NewQueue(app),
+		inventory: inventory,
+		hosts:     map[string][]sup.Host{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs", s.handleRuns)
+	mux.HandleFunc("/runs/", s.handleRun)
+	mux.HandleFunc("/slack/actions", s.handleSlackAction)
+
+	fmt.Fprintf(os.Stderr, "sup server listening on %v\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// authenticate returns the user of the request: the user of its bearer
+// token if the Supfile authenticates users, or of its userHeader otherwise.
+func (s *server) authenticate(r *http.Request) (sup.Identity, error) {
+	if s.conf.Auth != nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return s.conf.Authenticate(token)
+	}
+	user := r.Header.Get(userHeader)
+	if user == "" {
+		return sup.Identity{}, errors.Errorf("missing %v header", userHeader)
+	}
+	return sup.Identity{User: user}, nil
+}
+
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	identity, err := s.authenticate(r)
+	if err != nil && (s.conf.Auth != nil || r.Method == "POST") {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.queue.Runs())
+	case "POST":
+		var req runRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request"))
+			return
+		}
+		status, run, err := s.submit(identity, req)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, run)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// resolveInventory resolves the inventory of network on its first run,
+// and reuses it on the next ones, see parseArgs.
+func (s *server) resolveInventory(network *sup.Network) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts, ok := s.hosts[network.Name]
+	if !ok {
+		if err := s.inventory(network); err != nil {
+			return err
+		}
+		hosts = network.Hosts
+		s.hosts[network.Name] = hosts
+	}
+	network.Hosts = append([]sup.Host(nil), hosts...)
+	return nil
+}
+
+// submit queues the run requested by the user of identity. On error, it
+// returns the HTTP status of the response.
+func (s *server) submit(identity sup.Identity, req runRequest) (int, sup.QueuedRun, error) {
+	user := identity.User
+	args := append([]string{req.Network}, req.Commands...)
+	network, commands, err := parseArgs(s.conf, args, ioutil.Discard, s.resolveInventory)
+	if err != nil {
+		return http.StatusBadRequest, sup.QueuedRun{}, err
+	}
+	network.Env.Set("SUP_USER", user)
+
+	// Nobody overrides freezes over the API.
+	if err := s.conf.CheckFreeze(network.Name, time.Now()); err != nil {
+		return http.StatusConflict, sup.QueuedRun{}, errors.New(strings.SplitN(err.Error(), "\n", 2)[0])
+	}
+	if len(s.conf.Access) > 0 {
+		if err := s.conf.Authorizer(user, identity.Groups).Authorize(network, commands); err != nil {
+			return http.StatusForbidden, sup.QueuedRun{}, err
+		}
+	}
+	decision, err := s.conf.CheckPolicy(user, network, commands, time.Now())
+	if err != nil {
+		return http.StatusInternalServerError, sup.QueuedRun{}, err
+	}
+	if err := decision.Err(network.Name, true); err != nil {
+		return http.StatusForbidden, sup.QueuedRun{}, err
+	}
+
+	vars, err := runVars(s.conf, network, req.Env)
+	if err != nil {
+		return http.StatusBadRequest, sup.QueuedRun{}, err
+	}
+	// The env of the request doesn't override the authenticated user.
+	vars.Set("SUP_USER", user)
+
+	var run sup.QueuedRun
+	if len(decision.RequireApproval) > 0 {
+		run = s.queue.SubmitForApproval(user, strings.Join(decision.RequireApproval, "; "), network, vars, commands...)
+	} else {
+		run = s.queue.Submit(user, network, vars, commands...)
+	}
+	err = s.conf.Audit("run submitted: id=%q user=%q network=%q commands=%q status=%v",
+		run.ID, user, run.Network, strings.Join(req.Commands, " "), run.Status)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if slack := s.slack(); run.Status == sup.RunPending && slack != nil {
+		go func() {
+			if err := slack.RequestApproval(run); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+	return 0, run, nil
+}
+
+// approve approves or rejects a pending run on behalf of the user of
+// identity, who must be allowed to run it. On error, it returns the HTTP
+// status of the response.
+func (s *server) approve(id string, identity sup.Identity, via string, approve bool) (int, sup.QueuedRun, error) {
+	user := identity.User
+	auth := s.conf.Authorizer(user, identity.Groups)
+	var run sup.QueuedRun
+	var err error
+	if approve {
+		run, err = s.queue.Approve(id, user, auth)
+	} else {
+		run, err = s.queue.Reject(id, auth)
+	}
+	switch err.(type) {
+	case nil:
+	case sup.ErrUnknownRun:
+		return http.StatusNotFound, run, err
+	case sup.ErrSelfApproval, sup.ErrForbidden:
+		return http.StatusForbidden, run, err
+	default:
+		return http.StatusConflict, run, err
+	}
+
+	verdict := "approved"
+	if !approve {
+		verdict = "rejected"
+	}
+	err = s.conf.Audit("run %v: id=%q user=%q approver=%q via=%v", verdict, id, run.User, user, via)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return 0, run, nil
+}
+
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	id := path[0]
+	identity, err := s.authenticate(r)
+	if err != nil && (s.conf.Auth != nil || r.Method == "POST") {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == "GET":
+		run, err := s.queue.Run(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+
+	case len(path) == 2 && path[1] == "approve" && r.Method == "POST":
+		status, run, err := s.approve(id, identity, "api", true)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+
+	case len(path) == 2 && path[1] == "cancel" && r.Method == "POST":
+		run, err := s.queue.Cancel(id, s.conf.Authorizer(identity.User, identity.Groups))
+		switch err.(type) {
+		case nil:
+		case sup.ErrUnknownRun:
+			writeError(w, http.StatusNotFound, err)
+			return
+		case sup.ErrForbidden:
+			writeError(w, http.StatusForbidden, err)
+			return
+		default:
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err := s.conf.Audit("run canceled: id=%q user=%q", id, identity.User); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		writeJSON(w, http.StatusOK, run)
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// approvals reports whether the runs of conf may require approval, by
+// another user than the one who submitted them.
+func approvals(conf *sup.Supfile) bool {
+	if conf.Policy != nil {
+		return true
+	}
+	for _, name := range conf.Targets.Names {
+		if target, _ := conf.Targets.Get(name); target.RequiresApproval {
+			return true
+		}
+	}
+	return false
+}
+
+// slack returns the Slack notifier handling approvals, if configured.
+func (s *server) slack() *sup.SlackNotifier {
+	if s.conf.Notify == nil || s.conf.Notify.Slack == nil || s.conf.Notify.Slack.SigningSecret == "" {
+		return nil
+	}
+	return s.conf.Notify.Slack
+}
+
+// handleSlackAction handles the clicks on the buttons of the approval
+// requests posted to Slack, see sup.SlackNotifier.RequestApproval.
+func (s *server) handleSlackAction(w http.ResponseWriter, r *http.Request) {
+	slack := s.slack()
+	if slack == nil || r.Method != "POST" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	action, err := slack.ParseAction(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	// Slack users act as the users they're mapped to, so they can't
+	// approve their own runs by another name.
+	text := ""
+	identity, ok := s.conf.SlackUser(action.UserID)
+	user := identity.User
+	if !ok {
+		text = fmt.Sprintf(":warning: Slack user <@%v> isn't mapped to a sup user, see auth.slack_users", action.UserID)
+	} else if _, run, err := s.approve(action.RunID, identity, "slack", action.Approve); err != nil {
+		text = fmt.Sprintf(":warning: %v", err)
+	} else if action.Approve {
+		text = fmt.Sprintf(":white_check_mark: *%v* approved run %v of *%v* on *%v* by *%v*",
+			user, run.ID, strings.Join(run.Commands, " "), run.Network, run.User)
+	} else {
+		text = fmt.Sprintf(":no_entry: *%v* rejected run %v of *%v* on *%v* by *%v*",
+			user, run.ID, strings.Join(run.Commands, " "), run.Network, run.User)
+	}
+	go func() {
+		if err := action.Respond(text); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/fanyang01/sup"
+	"github.com/pkg/errors"
+)
+
+// runWorkspace implements "sup all NETWORK COMMAND...": it runs sup with
+// the same flags and args in every project of the workspace, in order,
+// stopping at the first failing project. It returns the exit code.
+func runWorkspace(projects []string, args []string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Pass the flags on, except the ones locating the root Supfile:
+	// every project runs its own Supfile.yaml.
+	var flags []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "C", "f":
+			return
+		}
+		if values, ok := f.Value.(*flagStringSlice); ok {
+			for _, value := range *values {
+				flags = append(flags, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		flags = append(flags, "-"+f.Name+"="+f.Value.String())
+	})
+
+	for _, project := range projects {
+		fmt.Fprintf(os.Stderr, "==> %v\n", project)
+		cmd := exec.Command(exe, append(flags, args...)...)
+		cmd.Dir = project
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrapf(err, "project %v failed", project))
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+				return exitErr.ExitCode()
+			}
+			return 1
+		}
+	}
+	return sup.ExitOK
+}
+
+// workspaceProjects returns the directories of the projects of the
+// workspace declared by conf, making sure they have a Supfile.
+func workspaceProjects(conf *sup.Supfile) ([]string, error) {
+	if len(conf.Workspace) == 0 {
+		return nil, errors.New("no projects in the workspace, see the \"workspace\" section of Supfile")
+	}
+	var projects []string
+	for _, project := range conf.Workspace {
+		if _, err := os.Stat(filepath.Join(project, "Supfile.yaml")); err != nil {
+			return nil, errors.Wrapf(err, "workspace project %v", project)
+		}
+		projects = append(projects, project)
+	}
+	return projects, nil
+}
@@ -0,0 +1,134 @@
+// Command supbench measures the performance of sup against simulated hosts
+// served by an in-process SSH server: connection fan-out, output throughput
+// and upload speed. The output of the hosts is written to STDOUT, the
+// results to STDERR:
+//
+//	$ supbench -hosts 100,1000 > /dev/null
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanyang01/sup"
+	"github.com/fanyang01/sup/suptest"
+	"github.com/pkg/errors"
+)
+
+var (
+	hostCounts  string
+	benchmarks  string
+	outputSize  int
+	uploadSize  int
+	concurrency int
+)
+
+func init() {
+	flag.StringVar(&hostCounts, "hosts", "100,1000", "Numbers of simulated hosts")
+	flag.StringVar(&benchmarks, "bench", "fanout,output,upload", "Benchmarks to run")
+	flag.IntVar(&outputSize, "output-size", 1<<20, "Bytes of output per host (output benchmark)")
+	flag.IntVar(&uploadSize, "upload-size", 1<<20, "Bytes uploaded to every host (upload benchmark)")
+	flag.IntVar(&concurrency, "connect-concurrency", 0, "Max number of hosts connected to in parallel (0 = sup's default)")
+}
+
+// benchmark returns the handler of the simulated hosts
+// and the command to be run on them.
+type benchmark func() (suptest.Handler, *sup.Command, error)
+
+var benches = map[string]benchmark{
+	// Connect to all hosts and run a no-op.
+	"fanout": func() (suptest.Handler, *sup.Command, error) {
+		noop := func(string, io.Reader, io.Writer, io.Writer) int { return 0 }
+		return noop, &sup.Command{Name: "fanout", Run: "true"}, nil
+	},
+	// Stream output of every host to STDOUT.
+	"output": func() (suptest.Handler, *sup.Command, error) {
+		return suptest.Output(outputSize), &sup.Command{Name: "output", Run: "cat"}, nil
+	},
+	// Upload a file to every host.
+	"upload": func() (suptest.Handler, *sup.Command, error) {
+		dir, err := ioutil.TempDir("", "supbench-")
+		if err != nil {
+			return nil, nil, err
+		}
+		file := filepath.Join(dir, "upload")
+		if err := ioutil.WriteFile(file, make([]byte, uploadSize), 0644); err != nil {
+			return nil, nil, err
+		}
+		cmd := &sup.Command{Name: "upload", Upload: []sup.Upload{{Src: file, Dst: "/tmp"}}}
+		return suptest.Discard, cmd, nil
+	},
+}
+
+func run(name string, hosts int) (time.Duration, error) {
+	bench, ok := benches[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown benchmark %v", name)
+	}
+	handler, cmd, err := bench()
+	if err != nil {
+		return 0, err
+	}
+	if len(cmd.Upload) > 0 {
+		defer os.RemoveAll(filepath.Dir(cmd.Upload[0].Src))
+	}
+
+	server, err := suptest.NewServer(handler)
+	if err != nil {
+		return 0, errors.Wrap(err, "starting SSH server failed")
+	}
+	defer server.Close()
+
+	// All the simulated hosts are served by a single server,
+	// they differ by user names.
+	network := &sup.Network{Name: "bench", ConnectConcurrency: concurrency}
+	for i := 0; i < hosts; i++ {
+		network.Hosts = append(network.Hosts, sup.Host{Addr: fmt.Sprintf("host%d@%v", i, server.Addr())})
+	}
+
+	app, err := sup.New(&sup.Supfile{})
+	if err != nil {
+		return 0, err
+	}
+	app.Prefix(true)
+
+	start := time.Now()
+	err = app.Run(network, sup.EnvList{}, cmd)
+	return time.Since(start), err
+}
+
+func main() {
+	flag.Parse()
+
+	for _, name := range strings.Split(benchmarks, ",") {
+		for _, count := range strings.Split(hostCounts, ",") {
+			hosts, err := strconv.Atoi(strings.TrimSpace(count))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errors.Wrap(err, "invalid -hosts"))
+				os.Exit(1)
+			}
+
+			d, err := run(strings.TrimSpace(name), hosts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errors.Wrap(err, name))
+				os.Exit(1)
+			}
+
+			result := fmt.Sprintf("%-8v hosts=%-6v %v", name, hosts, d)
+			switch name {
+			case "output":
+				result += fmt.Sprintf("\t%.1f MB/s", float64(outputSize*hosts)/d.Seconds()/(1<<20))
+			case "upload":
+				result += fmt.Sprintf("\t%.1f MB/s", float64(uploadSize*hosts)/d.Seconds()/(1<<20))
+			}
+			fmt.Fprintln(os.Stderr, result)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// copyTasks creates the tasks copying files between the hosts by the
+// copy_between directives of cmd. The files are copied to the clients
+// of cmd, except the source host, in batches of cmd.Serial.
+func (sup *Stackup) copyTasks(r *runState, cmd *Command, clients []Client) ([]*Task, error) {
+	var tasks []*Task
+	for i := range cmd.CopyBetween {
+		cp := &cmd.CopyBetween[i]
+
+		var source Client
+		from := regexp.MustCompilePOSIX(cp.From) // Validated by NewSupfile.
+		for _, c := range r.clients {
+			if from.MatchString(r.hostName(c)) {
+				source = c
+				break
+			}
+		}
+		if source == nil {
+			return nil, fmt.Errorf("copy_between: no host matches %q", cp.From)
+		}
+
+		var targets []Client
+		for _, c := range clients {
+			if c != source {
+				targets = append(targets, c)
+			}
+		}
+		for _, batch := range cmd.batches(targets) {
+			task := &Task{Clients: batch}
+			if cp.Direct {
+				task.Run = scpCommand(r.host(source), cp.Src, shellQuote(cp.Dst))
+			} else {
+				// Each batch streams the files from the source anew.
+				task.Run = RemoteTarCommand(cp.Dst)
+				task.Input = &remoteStream{c: source, task: downloadTask(cp.Src)}
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// seedTasks creates the tasks distributing an upload of the local path src
+// from the seeds, which received it already, to the peers. The files spread
+// in waves: every host having them passes them on to a host that doesn't
+// by scp, so the number of hosts having them doubles every wave.
+func seedTasks(r *runState, upload *Upload, src string, seeds, peers []Client) []*Task {
+	uploaded := path.Join(upload.Dst, path.Base(strings.TrimSuffix(src, "/")))
+
+	var tasks []*Task
+	sources := append([]Client(nil), seeds...)
+	for len(peers) > 0 {
+		n := len(sources)
+		if n > len(peers) {
+			n = len(peers)
+		}
+
+		// A single task fetching the files from a different source
+		// on every peer, by the peer's $SUP_HOST.
+		run := `case "$SUP_HOST" in`
+		label := ""
+		if cmd := selinuxCommand(upload, true, shellQuote(uploaded)); cmd != "" {
+			label = " && " + cmd
+		}
+		for i, c := range peers[:n] {
+			fetch := scpCommand(r.host(sources[i]), uploaded, `"$tmp"`)
+			run += fmt.Sprintf("\n%v) %v%v;;", shellQuote(r.hostName(c)), installCommand(upload, fetch), label)
+		}
+		run += "\n*) echo \"no seed for $SUP_HOST\" >&2; exit 1;;\nesac"
+		tasks = append(tasks, &Task{Run: run, Clients: peers[:n]})
+
+		sources = append(sources, peers[:n]...)
+		peers = peers[n:]
+	}
+	return tasks
+}
+
+// scpCommand returns the command fetching src of the host
+// into the directory dst, a shell word, by scp.
+func scpCommand(host Host, src, dst string) string {
+	args := []string{"scp", "-r", "-p", "-o", "BatchMode=yes"}
+	addr := host.Addr
+	if u, err := parseAddr(host.Addr); err == nil {
+		addr = u.Hostname()
+		if strings.Contains(addr, ":") {
+			addr = "[" + addr + "]" // IPv6, like scp expects it.
+		}
+		if u.User != nil && u.User.Username() != "" {
+			addr = u.User.Username() + "@" + addr
+		}
+		if u.Port() != "" {
+			args = append(args, "-P", u.Port())
+		}
+	}
+	args = append(args, shellQuote(addr+":"+src), dst)
+	return strings.Join(args, " ")
+}
+
+// remoteStream is the output of a task run on a client, which starts
+// when the stream is first read. Reading the stream to the end waits
+// for the task, failing if the task failed.
+type remoteStream struct {
+	c    Client
+	task *Task
+
+	started bool
+	done    bool
+	err     error
+	stderr  bytes.Buffer
+	copied  chan struct{}
+}
+
+func (s *remoteStream) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, s.err
+	}
+	if !s.started {
+		s.started = true
+		if err := s.c.Run(s.task); err != nil {
+			s.done, s.err = true, err
+			return 0, err
+		}
+		s.c.WriteClose()
+		s.copied = make(chan struct{})
+		go func() {
+			io.Copy(&s.stderr, s.c.Stderr())
+			close(s.copied)
+		}()
+	}
+
+	n, err := s.c.Stdout().Read(p)
+	if err == io.EOF {
+		s.finish()
+		err = s.err
+	} else if err != nil {
+		s.done, s.err = true, err
+	}
+	return n, err
+}
+
+// finish waits for the task, once its output was read.
+func (s *remoteStream) finish() {
+	<-s.copied
+	s.done, s.err = true, io.EOF
+	if err := s.c.Wait(); err != nil {
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			err = errors.Wrap(err, msg)
+		}
+		s.err = errors.Wrap(err, "reading from the source host failed")
+	}
+}
+
+// Close interrupts the task if it's still running, e.g. since the hosts
+// receiving the stream failed.
+func (s *remoteStream) Close() error {
+	if !s.started || s.done {
+		return nil
+	}
+	s.c.Signal(os.Interrupt)
+	io.Copy(ioutil.Discard, s.c.Stdout())
+	s.finish()
+	return nil
+}
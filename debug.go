@@ -0,0 +1,92 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Facets of the debug log, see Stackup.DebugLog.
+const (
+	DebugSSH    = "ssh"    // SSH connections: addresses, auth methods, server versions and timing.
+	DebugExec   = "exec"   // Exact commands run on the hosts, their exit statuses and timing.
+	DebugEnv    = "env"    // Env vars of the runs, with secrets masked.
+	DebugUpload = "upload" // Files uploaded to the hosts.
+)
+
+var debugFacets = []string{DebugSSH, DebugExec, DebugEnv, DebugUpload}
+
+// secretKey matches the names of env vars whose values are masked
+// in the debug log, in addition to the values of secrets.
+var secretKey = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth`)
+
+// debugLog writes timestamped lines of the enabled facets to w,
+// masking the values of secrets.
+type debugLog struct {
+	facets map[string]bool
+
+	mu      sync.Mutex
+	w       io.Writer
+	secrets []string
+}
+
+func (d *debugLog) enabled(facet string) bool {
+	return d != nil && d.facets[facet]
+}
+
+func (d *debugLog) logf(facet, format string, args ...interface{}) {
+	if !d.enabled(facet) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line := fmt.Sprintf(format, args...)
+	for _, secret := range d.secrets {
+		line = strings.Replace(line, secret, "****", -1)
+	}
+	fmt.Fprintf(d.w, "%v [%v] %v\n", time.Now().Format("15:04:05.000"), facet, line)
+}
+
+// mask masks the values of the secrets of env in all the lines
+// written from now on.
+func (d *debugLog) mask(env EnvList) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, v := range env {
+		if isSecret(v) && len(v.Value) >= 4 {
+			d.secrets = append(d.secrets, v.Value)
+		}
+	}
+}
+
+// isSecret reports whether the value of v is to be masked.
+func isSecret(v *EnvVar) bool {
+	return v.Secret || secretKey.MatchString(v.Key)
+}
+
+// clientEnv returns the env vars exported before the commands run by c.
+func clientEnv(c Client) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		return c.env
+	case *LocalhostClient:
+		return c.env
+	case *MockClient:
+		return c.env
+	}
+	return ""
+}
+
+// errorOrOK formats the result of a command for the debug log.
+func errorOrOK(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
@@ -0,0 +1,157 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Describe writes what running the commands on the network would do,
+// without connecting to the hosts: the hosts, the env vars (secrets
+// masked) and, for every command, its hosts, uploads and scripts.
+func Describe(w io.Writer, network *Network, env EnvList, commands ...*Command) error {
+	fmt.Fprintf(w, "Network: %v\n", network.Name)
+	for _, host := range network.Hosts {
+		if len(host.Roles) > 0 {
+			fmt.Fprintf(w, "  - %v (roles: %v)\n", host, strings.Join(host.Roles, ", "))
+		} else {
+			fmt.Fprintf(w, "  - %v\n", host)
+		}
+		for _, v := range host.Env {
+			value := v.Value
+			if isSecret(v) {
+				value = "****"
+			}
+			fmt.Fprintf(w, "      %v=%v\n", v.Key, value)
+		}
+	}
+	if jumpHosts := network.jumpHosts(); len(jumpHosts) > 0 {
+		fmt.Fprintf(w, "Bastion: %v\n", strings.Join(jumpHosts, " -> "))
+	}
+
+	fmt.Fprintln(w, "Env:")
+	for _, v := range env {
+		value := v.Value
+		if isSecret(v) {
+			value = "****"
+		}
+		fmt.Fprintf(w, "  %v=%v\n", v.Key, value)
+	}
+
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\nCommand: %v", cmd.Name)
+		if cmd.Target != "" {
+			fmt.Fprintf(w, " (target %v)", cmd.Target)
+		}
+		if cmd.Desc != "" {
+			fmt.Fprintf(w, ": %v", cmd.Desc)
+		}
+		fmt.Fprintln(w)
+
+		var hosts []string
+		for _, host := range network.Hosts {
+			if cmd.MatchHost(host) {
+				hosts = append(hosts, host.Addr)
+			}
+		}
+		switch {
+		case !cmd.isRemote():
+		case cmd.Once && len(hosts) > 0:
+			fmt.Fprintf(w, "  Hosts: %v (once)\n", hosts[0])
+		case cmd.Serial > 0:
+			fmt.Fprintf(w, "  Hosts: %v (%v at a time)\n", strings.Join(hosts, ", "), cmd.Serial)
+		default:
+			fmt.Fprintf(w, "  Hosts: %v\n", strings.Join(hosts, ", "))
+		}
+
+		var options []string
+		if cmd.Sudo {
+			options = append(options, "sudo")
+		}
+		if cmd.LoginShell {
+			options = append(options, "login shell")
+		}
+		if cmd.CleanEnv {
+			options = append(options, "clean env")
+		}
+		if cmd.Umask != "" {
+			options = append(options, "umask "+cmd.Umask)
+		}
+		if cmd.Stdin {
+			options = append(options, "stdin")
+		}
+		if cmd.Become {
+			options = append(options, "become")
+		}
+		if cmd.Async {
+			options = append(options, "async")
+		}
+		if len(options) > 0 {
+			fmt.Fprintf(w, "  Options: %v\n", strings.Join(options, ", "))
+		}
+
+		for _, upload := range cmd.Upload {
+			fmt.Fprintf(w, "  Upload: %v -> %v", upload.Src, upload.Dst)
+			if upload.Exc != "" {
+				fmt.Fprintf(w, " (exclude %v)", upload.Exc)
+			}
+			switch {
+			case upload.SEType != "":
+				fmt.Fprintf(w, " (setype %v)", upload.SEType)
+			case upload.SEContext != "":
+				fmt.Fprintf(w, " (secontext %v)", upload.SEContext)
+			case upload.Restorecon:
+				fmt.Fprint(w, " (restorecon)")
+			}
+			fmt.Fprintln(w)
+		}
+		for _, cp := range cmd.CopyBetween {
+			fmt.Fprintf(w, "  Copy: %v from the host matching %q -> %v\n", cp.Src, cp.From, cp.Dst)
+		}
+		if cmd.Local != "" {
+			fmt.Fprintf(w, "  Local:\n%v", indent(cmd.Local))
+		}
+		if cmd.Script != "" {
+			data, err := ioutil.ReadFile(cmd.Script)
+			if err != nil {
+				return errors.Wrap(err, "can't read script")
+			}
+			fmt.Fprintf(w, "  Script %v:\n%v", cmd.Script, indent(string(data)))
+		}
+		if cmd.Run != "" {
+			fmt.Fprintf(w, "  Run:\n%v", indent(cmd.Run))
+		}
+		if p := cmd.Pause; p != nil {
+			fmt.Fprintf(w, "  Pause: %v\n", p.Message)
+			if p.Timeout > 0 {
+				action := p.Default
+				if action == "" {
+					action = PauseAbort
+				}
+				fmt.Fprintf(w, "  Pause timeout: %v, then %v\n", p.Timeout, action)
+			}
+		}
+		if b := cmd.Backup; b != nil {
+			fmt.Fprintf(w, "  Backup: %v to %v\n", strings.Join(b.Paths, " "), b.Dest)
+			if b.Keep > 0 {
+				fmt.Fprintf(w, "  Backup keep: %v\n", b.Keep)
+			}
+			if b.MaxAge > 0 {
+				fmt.Fprintf(w, "  Backup max age: %v\n", b.MaxAge)
+			}
+		}
+	}
+	return nil
+}
+
+// indent indents the lines of a script for Describe.
+func indent(script string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(script, "\n"), "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+	return b.String()
+}
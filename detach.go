@@ -0,0 +1,113 @@
+package sup
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+)
+
+// Commands with survive_disconnect run detached from the SSH session, so
+// a dropped connection of sup doesn't kill them: the command runs in
+// a tmux or screen session, a systemd-run unit, or under nohup, whichever
+// the host has first, writing its output and then its exit status to
+// files in a directory of the run on the host. The SSH session follows
+// the files until the status is written, then removes the directory.
+// The length of the output sent so far is kept with the files, so
+// reattaching continues from where the previous session left off.
+//
+// Rerun with --resume, sup reattaches to the runs left on the hosts,
+// running or finished, instead of starting them again; "sup NETWORK
+// attach ID" reattaches to a run by its ID, the key of the run.
+
+// Detach is a detached run of a task, see detachedCommand.
+type Detach struct {
+	Key      string // ID of the run, see detachedKey.
+	Name     string // Name of the command.
+	Reattach bool   // Reattach to the run left by a previous sup run, if any.
+}
+
+// detachedKey returns the key of the detached runs of the command,
+// stable across sup runs so they can be reattached to.
+func detachedKey(cmd *Command, run string) string {
+	key := sha1.Sum([]byte(cmd.Name + "\x00" + run))
+	return fmt.Sprintf("%x", key[:8])
+}
+
+// detachedDir returns the directory of the detached run of key on the host.
+func detachedDir(key string) string {
+	return `"$HOME/.sup/detached/` + key + `"`
+}
+
+// detachedCommand returns the command running command detached, see
+// above, or reattaching to the run of the same key if d.Reattach is set
+// and there's one. Otherwise, it refuses to start while the previous run
+// of the key is still running.
+func detachedCommand(d *Detach, command string) string {
+	dir := detachedDir(d.Key)
+	name := "sup-" + d.Key
+
+	// The detached shell records its pid, and the status once done. The
+	// command runs in a subshell, since it may exec, e.g. a login shell.
+	runner := `dir=` + dir + `; echo $$ > "$dir/pid"; ` +
+		`( ` + command + "\n" + `) >> "$dir/out" 2>> "$dir/err" < /dev/null; ` +
+		`echo $? > "$dir/status.tmp"; mv "$dir/status.tmp" "$dir/status"`
+	sh := "sh -c " + shellQuote(runner)
+
+	start := `rm -rf "$dir" && mkdir -p "$dir" && : > "$dir/out" && : > "$dir/err" && ` +
+		`echo ` + shellQuote(d.Name) + ` > "$dir/name" && ` +
+		`{ { command -v tmux > /dev/null && tmux new-session -d -s ` + name + ` ` + shellQuote(sh) + `; } || ` +
+		`{ command -v screen > /dev/null && screen -dmS ` + name + ` ` + sh + `; } || ` +
+		`{ command -v systemd-run > /dev/null && systemd-run --user --quiet --unit ` + name + ` ` + sh + ` 2> /dev/null; } || ` +
+		`{ nohup ` + sh + ` > /dev/null 2>&1 < /dev/null & }; } || exit 1; ` +
+		`echo "sup: started detached run ` + d.Key + `" >&2; `
+
+	running := `{ [ -f "$dir/pid" ] && [ ! -f "$dir/status" ] && kill -0 "$(cat "$dir/pid")" 2> /dev/null; }`
+	if d.Reattach {
+		return `dir=` + dir + `; if [ -f "$dir/status" ] || ` + running + `; then ` +
+			`echo "sup: reattaching to detached run ` + d.Key + `" >&2; ` +
+			`else ` + start + `fi; ` + followDetached
+	}
+	return `dir=` + dir + `; if ` + running + `; then ` +
+		`echo "sup: detached run ` + d.Key + ` of the command is still running, rerun with --resume to reattach to it" >&2; exit 1; fi; ` +
+		start + followDetached
+}
+
+// followDetached follows the output of the detached run in $dir from
+// where the last session left off, until the run exits by its status.
+// It exits if the output can't be sent, e.g. once disconnected.
+const followDetached = `i=0; while [ ! -f "$dir/pid" ] && [ ! -f "$dir/status" ]; do ` +
+	`i=$((i+1)); [ $i -gt 30 ] && { echo "sup: the detached run didn't start" >&2; exit 1; }; sleep 1; done; ` +
+	`out=$(cat "$dir/out.sent" 2> /dev/null || echo 0); err=$(cat "$dir/err.sent" 2> /dev/null || echo 0); ` +
+	`while :; do finished=; [ -f "$dir/status" ] && finished=1; ` +
+	`n=$(wc -c < "$dir/out"); if [ "$n" -gt "$out" ]; then ` +
+	`tail -c +$((out+1)) "$dir/out" | head -c $((n-out)) || exit 1; out=$n; echo $out > "$dir/out.sent"; fi; ` +
+	`n=$(wc -c < "$dir/err"); if [ "$n" -gt "$err" ]; then ` +
+	`tail -c +$((err+1)) "$dir/err" | head -c $((n-err)) >&2 || exit 1; err=$n; echo $err > "$dir/err.sent"; fi; ` +
+	`[ -n "$finished" ] && break; sleep 1; done; ` +
+	`status=$(cat "$dir/status"); rm -rf "$dir"; exit "$status"`
+
+// listDetached lists the detached runs on the host: their ID, command
+// and state.
+const listDetached = `for dir in "$HOME"/.sup/detached/*/; do [ -d "$dir" ] || continue; ` +
+	`if [ -f "$dir/status" ]; then state="exited $(cat "$dir/status")"; ` +
+	`elif kill -0 "$(cat "$dir/pid" 2> /dev/null)" 2> /dev/null; then state=running; else state=died; fi; ` +
+	`echo "$(basename "$dir") $(cat "$dir/name" 2> /dev/null) $state"; done`
+
+var detachedIDRegexp = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// AttachCommand returns the command attaching to the detached run of id
+// on the hosts, streaming its output from where the last session left
+// off, or listing the detached runs on the hosts if id is empty.
+func AttachCommand(id string) (*Command, error) {
+	if id == "" {
+		return &Command{Name: "attach", Run: listDetached}, nil
+	}
+	if !detachedIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid detached run ID %q", id)
+	}
+	return &Command{
+		Name: "attach",
+		Run: `dir=` + detachedDir(id) + `; if [ ! -d "$dir" ]; then echo "sup: no detached run ` + id + `" >&2; exit 0; fi; ` +
+			followDetached,
+	}, nil
+}
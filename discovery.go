@@ -0,0 +1,327 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConsulDiscovery resolves the hosts of a network from the healthy
+// instances of a service registered in the Consul catalog, so sup targets
+// exactly the nodes currently serving it. The hosts have the name of
+// their node as a role and as their "Name" metadata, and the service
+// metadata of the instance.
+type ConsulDiscovery struct {
+	Service    string   `yaml:"service"`    // Name of the service, e.g. "web".
+	Tags       []string `yaml:"tags"`       // Tags the instances must all have, e.g. [production].
+	Address    string   `yaml:"address"`    // URL of the Consul agent, defaults to $CONSUL_HTTP_ADDR or http://127.0.0.1:8500.
+	Datacenter string   `yaml:"datacenter"` // Datacenter of the service, defaults to the agent's one.
+	User       string   `yaml:"user"`       // SSH user of the hosts, if not the default one.
+	TTL        Duration `yaml:"ttl"`        // Reuse the hosts resolved within this time, e.g. "1m", see discoveryCache.
+}
+
+// EtcdDiscovery resolves the hosts of a network from the keys under a
+// prefix of etcd, by its v3 HTTP gateway. The value of a key is the
+// address of its host, or a JSON object of its "address", "tags" and
+// string metadata; the last segment of the key is the "Name" metadata and
+// a role of the host.
+type EtcdDiscovery struct {
+	Prefix    string   `yaml:"prefix"`    // Prefix of the keys of the hosts, e.g. "/services/web/".
+	Tags      []string `yaml:"tags"`      // Tags the hosts must all have, e.g. [production].
+	Endpoints []string `yaml:"endpoints"` // URLs of the etcd members, defaults to $ETCD_ENDPOINTS or http://127.0.0.1:2379.
+	User      string   `yaml:"user"`      // SSH user of the hosts, if not the default one.
+	TTL       Duration `yaml:"ttl"`       // Reuse the hosts resolved within this time, e.g. "1m", see discoveryCache.
+}
+
+// hosts lists the healthy instances of the service of d.
+func (d *ConsulDiscovery) hosts() ([]Host, error) {
+	addr := d.Address
+	if addr == "" {
+		addr = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	query := url.Values{"passing": {"1"}}
+	for _, tag := range d.Tags {
+		query.Add("tag", tag)
+	}
+	if d.Datacenter != "" {
+		query.Set("dc", d.Datacenter)
+	}
+	u := strings.TrimSuffix(addr, "/") + "/v1/health/service/" + url.PathEscape(d.Service) + "?" + query.Encode()
+
+	return cachedDiscovery("consul "+u, d.TTL, func() ([]Host, error) {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+		var entries []struct {
+			Node struct {
+				Node       string
+				Address    string
+				Datacenter string
+			}
+			Service struct {
+				ID      string
+				Address string
+				Tags    []string
+				Meta    map[string]string
+			}
+		}
+		if err := discoveryRequest(req, &entries); err != nil {
+			return nil, errors.Wrap(err, "consul health query failed")
+		}
+
+		var hosts []Host
+		for _, e := range entries {
+			addr := e.Service.Address
+			if addr == "" {
+				addr = e.Node.Address
+			}
+			if d.User != "" {
+				addr = d.User + "@" + addr
+			}
+			host := Host{Addr: addr, Roles: []string{e.Node.Node}, Meta: map[string]string{}}
+			for key, value := range e.Service.Meta {
+				host.Meta[key] = value
+			}
+			host.Meta["Name"] = e.Node.Node
+			host.Meta["ID"] = e.Service.ID
+			host.Meta["Datacenter"] = e.Node.Datacenter
+			host.Meta["Tags"] = strings.Join(e.Service.Tags, ",")
+			hosts = append(hosts, host)
+		}
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Meta["ID"] < hosts[j].Meta["ID"] })
+		return hosts, nil
+	})
+}
+
+// hosts lists the hosts under the prefix of d.
+func (d *EtcdDiscovery) hosts() ([]Host, error) {
+	endpoints := d.Endpoints
+	if len(endpoints) == 0 && os.Getenv("ETCD_ENDPOINTS") != "" {
+		endpoints = strings.Split(os.Getenv("ETCD_ENDPOINTS"), ",")
+	}
+	if len(endpoints) == 0 {
+		endpoints = []string{"http://127.0.0.1:2379"}
+	}
+
+	return cachedDiscovery("etcd "+strings.Join(endpoints, ",")+" "+d.Prefix, d.TTL, func() ([]Host, error) {
+		// The range of the keys prefixed by Prefix ends at the prefix
+		// with its last byte incremented.
+		end := []byte(d.Prefix)
+		for i := len(end) - 1; i >= 0; i-- {
+			if end[i] < 0xff {
+				end[i]++
+				end = end[:i+1]
+				break
+			}
+		}
+		body, err := json.Marshal(map[string]string{
+			"key":       base64.StdEncoding.EncodeToString([]byte(d.Prefix)),
+			"range_end": base64.StdEncoding.EncodeToString(end),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Kvs []struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"kvs"`
+		}
+		err = errors.New("no etcd endpoints")
+		for _, endpoint := range endpoints {
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+			req, reqErr := http.NewRequest("POST", strings.TrimSuffix(strings.TrimSpace(endpoint), "/")+"/v3/kv/range", bytes.NewReader(body))
+			if reqErr != nil {
+				return nil, reqErr
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if err = discoveryRequest(req, &result); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "etcd range query failed")
+		}
+
+		var hosts []Host
+		for _, kv := range result.Kvs {
+			name := strings.TrimPrefix(string(kv.Key), d.Prefix)
+			if i := strings.LastIndex(name, "/"); i >= 0 {
+				name = name[i+1:]
+			}
+			host, tags, err := etcdHost(kv.Value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "etcd key %v", string(kv.Key))
+			}
+			if !hasTags(tags, d.Tags) {
+				continue
+			}
+			if d.User != "" {
+				host.Addr = d.User + "@" + host.Addr
+			}
+			if name != "" {
+				host.Roles = []string{name}
+				host.Meta["Name"] = name
+			}
+			hosts = append(hosts, host)
+		}
+		return hosts, nil
+	})
+}
+
+// etcdHost parses the value of the key of a host, see EtcdDiscovery,
+// returning the host and its tags.
+func etcdHost(value []byte) (Host, []string, error) {
+	value = bytes.TrimSpace(value)
+	if !bytes.HasPrefix(value, []byte("{")) {
+		return Host{Addr: string(value), Meta: map[string]string{}}, nil, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return Host{}, nil, err
+	}
+	host := Host{Meta: map[string]string{}}
+	var tags []string
+	for key, value := range fields {
+		switch value := value.(type) {
+		case string:
+			if key == "address" {
+				host.Addr = value
+			} else {
+				host.Meta[key] = value
+			}
+		case []interface{}:
+			if key == "tags" {
+				for _, tag := range value {
+					tags = append(tags, fmt.Sprint(tag))
+				}
+				host.Meta["Tags"] = strings.Join(tags, ",")
+			}
+		}
+	}
+	if host.Addr == "" {
+		return Host{}, nil, errors.New(`no "address"`)
+	}
+	return host, tags, nil
+}
+
+// hasTags reports whether tags has all of the wanted ones.
+func hasTags(tags, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// discoveryRequest sends req, decoding the JSON response into v.
+func discoveryRequest(req *http.Request, v interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// discoveryCache keeps the hosts resolved by service discovery with a TTL
+// in the user's cache directory, e.g. ~/.cache/sup/discovery.json, so
+// the repeated runs of a deploy don't query the catalog every time.
+type discoveryCache map[string]discoveryEntry
+
+type discoveryEntry struct {
+	Resolved time.Time        `json:"resolved"`
+	Hosts    []discoveredHost `json:"hosts"`
+}
+
+type discoveredHost struct {
+	Addr  string            `json:"addr"`
+	Roles []string          `json:"roles,omitempty"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+// cachedDiscovery returns the hosts of key resolved within ttl, or
+// resolves them by resolve, caching them if ttl isn't 0.
+func cachedDiscovery(key string, ttl Duration, resolve func() ([]Host, error)) ([]Host, error) {
+	if ttl <= 0 {
+		return resolve()
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return resolve()
+	}
+	path := filepath.Join(dir, "sup", "discovery.json")
+
+	cache := discoveryCache{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		// A corrupted cache is just resolved again.
+		json.Unmarshal(data, &cache)
+	}
+	if entry, ok := cache[key]; ok && time.Since(entry.Resolved) < time.Duration(ttl) {
+		var hosts []Host
+		for _, h := range entry.Hosts {
+			hosts = append(hosts, Host{Addr: h.Addr, Roles: h.Roles, Meta: h.Meta})
+		}
+		return hosts, nil
+	}
+
+	hosts, err := resolve()
+	if err != nil {
+		return nil, err
+	}
+	entry := discoveryEntry{Resolved: time.Now().UTC()}
+	for _, h := range hosts {
+		entry.Hosts = append(entry.Hosts, discoveredHost{h.Addr, h.Roles, h.Meta})
+	}
+	cache[key] = entry
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "caching discovered hosts failed"))
+	}
+	return hosts, nil
+}
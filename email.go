@@ -0,0 +1,94 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EmailNotifier sends an HTML summary of every run via SMTP,
+// e.g. for change-management processes requiring emailed deploy records.
+type EmailNotifier struct {
+	SMTP     string   `yaml:"smtp"` // SMTP server address, "host:port".
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	On       string   `yaml:"on"`       // "always" (default), "failure" or "success".
+	Link     string   `yaml:"link"`     // Optional link to the run logs, e.g. a CI job URL.
+	Template string   `yaml:"template"` // Optional html/template overriding the default body.
+}
+
+// emailTemplate is the default email body. Templates have access to
+// the RunReport fields and .Link.
+const emailTemplate = `<html><body>
+<h2>sup {{.Target}} on {{.Network}}: {{if .Failed}}failed{{else}}succeeded{{end}}</h2>
+<p>Started by <b>{{.User}}</b> at {{.Start.Format "2006-01-02 15:04:05 MST"}}, took {{.Duration}}.{{if .GitSHA}} Git SHA: <code>{{.GitSHA}}</code>.{{end}}</p>
+{{if .Error}}<p><b>Error:</b> <code>{{.Error}}</code></p>{{end}}
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Host</th><th>Status</th><th>Duration</th><th>Exit status</th><th>Error</th></tr>
+{{range .Hosts}}<tr><td>{{.Host}}</td><td>{{.Status}}</td><td>{{.Duration}}</td><td>{{.ExitStatus}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{if .Link}}<p><a href="{{.Link}}">Logs</a></p>{{end}}
+</body></html>
+`
+
+func (e *EmailNotifier) Notify(network *Network, report *RunReport) error {
+	if !notifyOn(e.On, report) {
+		return nil
+	}
+
+	addr := os.ExpandEnv(e.SMTP)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "email: invalid smtp address")
+	}
+	var to []string
+	for _, rcpt := range e.To {
+		to = append(to, os.ExpandEnv(rcpt))
+	}
+	from := os.ExpandEnv(e.From)
+
+	text := e.Template
+	if text == "" {
+		text = emailTemplate
+	}
+	tmpl, err := template.New("email").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return errors.Wrap(err, "email: parsing template failed")
+	}
+	var body bytes.Buffer
+	data := struct {
+		*RunReport
+		Link string
+	}{report, os.ExpandEnv(e.Link)}
+	if err := tmpl.Execute(&body, data); err != nil {
+		return errors.Wrap(err, "email: rendering template failed")
+	}
+
+	status := "succeeded"
+	if report.Failed() {
+		status = "failed"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", from)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: [sup] %v on %v %v\r\n", report.Target, report.Network, status)
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.Write(body.Bytes())
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", os.ExpandEnv(e.Username), os.ExpandEnv(e.Password), host)
+	}
+	return errors.Wrap(smtp.SendMail(addr, auth, from, to, msg.Bytes()), "email")
+}
@@ -0,0 +1,166 @@
+package sup
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// Encodings of the output of the commands, see Command.OutputEncoding.
+const (
+	EncodingUTF8        = "utf-8"        // Invalid bytes are replaced by U+FFFD.
+	EncodingLatin1      = "latin1"       // ISO-8859-1.
+	EncodingWindows1252 = "windows-1252" // CP-1252, the usual superset of Latin-1.
+	EncodingAuto        = "auto"         // UTF-8, falling back to Windows-1252 for invalid bytes.
+)
+
+// Handling of the ANSI escape sequences in the output, see Command.ANSI.
+const (
+	ANSIKeep  = "keep"  // Pass them through (default).
+	ANSIStrip = "strip" // Remove them, e.g. colors and cursor movements.
+)
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252, which differ
+// from Latin-1. The undefined ones map to the C1 controls, like Latin-1.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// decodeByte decodes a single byte of a legacy encoding.
+func decodeByte(b byte, encoding string) rune {
+	if encoding != EncodingLatin1 && b >= 0x80 && b < 0xa0 {
+		return windows1252[b-0x80]
+	}
+	return rune(b)
+}
+
+// States of the ANSI escape sequence parser of outputDecoder.
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI    // Control sequence, ESC [ ... final byte.
+	ansiString // OSC, DCS etc., ESC ] ... BEL or ESC \.
+	ansiStringEscape
+)
+
+// outputDecoder transcodes the output of a command to UTF-8 and strips
+// its ANSI escape sequences, if configured by the command.
+type outputDecoder struct {
+	r        io.Reader
+	encoding string
+	strip    bool
+
+	buf     []byte
+	partial []byte // Incomplete UTF-8 sequence at the end of the last read.
+	out     []byte // Decoded output to be read next.
+	err     error
+	state   int
+}
+
+// outputReader returns r decoding the output of cmd,
+// or r as is if cmd doesn't configure it.
+func outputReader(cmd *Command, r io.Reader) io.Reader {
+	if cmd.OutputEncoding == "" && cmd.ANSI != ANSIStrip {
+		return r
+	}
+	return &outputDecoder{
+		r:        r,
+		encoding: cmd.OutputEncoding,
+		strip:    cmd.ANSI == ANSIStrip,
+		buf:      make([]byte, outputBufferSize),
+	}
+}
+
+func (d *outputDecoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := d.r.Read(d.buf)
+		d.err = err
+		d.decode(append(d.partial, d.buf[:n]...), err != nil)
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// decode decodes data into d.out, keeping an incomplete UTF-8 sequence
+// at its end for the next read, unless it's the last one.
+func (d *outputDecoder) decode(data []byte, last bool) {
+	d.partial = nil
+	var out []byte
+	for i := 0; i < len(data); {
+		b := data[i]
+		if b < utf8.RuneSelf {
+			out = d.ansi(out, b)
+			i++
+			continue
+		}
+		switch d.encoding {
+		case EncodingLatin1, EncodingWindows1252:
+			out = utf8.AppendRune(out, decodeByte(b, d.encoding))
+			i++
+			continue
+		}
+		if !last && !utf8.FullRune(data[i:]) {
+			d.partial = append([]byte(nil), data[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case r != utf8.RuneError || size > 1:
+			out = append(out, data[i:i+size]...)
+		case d.encoding == EncodingAuto:
+			out = utf8.AppendRune(out, decodeByte(b, EncodingWindows1252))
+		default:
+			out = utf8.AppendRune(out, utf8.RuneError)
+		}
+		i += size
+	}
+	d.out = out
+}
+
+// ansi appends the ASCII byte b to out, unless it's part of an ANSI
+// escape sequence being stripped.
+func (d *outputDecoder) ansi(out []byte, b byte) []byte {
+	if !d.strip {
+		return append(out, b)
+	}
+	switch d.state {
+	case ansiEscape:
+		switch b {
+		case '[':
+			d.state = ansiCSI
+		case ']', 'P', 'X', '^', '_':
+			d.state = ansiString
+		default:
+			d.state = ansiText
+		}
+	case ansiCSI:
+		if b >= 0x40 && b <= 0x7e {
+			d.state = ansiText
+		}
+	case ansiString:
+		switch b {
+		case '\a':
+			d.state = ansiText
+		case 0x1b:
+			d.state = ansiStringEscape
+		}
+	case ansiStringEscape:
+		d.state = ansiString
+		if b == '\\' {
+			d.state = ansiText
+		}
+	default:
+		if b == 0x1b {
+			d.state = ansiEscape
+			break
+		}
+		out = append(out, b)
+	}
+	return out
+}
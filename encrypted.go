@@ -0,0 +1,95 @@
+package sup
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedPrefix marks the values tagged !encrypted in Supfile, since
+// the YAML decoder doesn't tell the tags of the values. See markEncrypted.
+const encryptedPrefix = "sup:encrypted:"
+
+// encryptedTag matches "KEY: !encrypted VALUE" lines.
+var encryptedTag = regexp.MustCompile(`^(\s*(?:- )?[^\s#][^#]*?:\s+)!encrypted(?:\s+(.*))?$`)
+
+// markEncrypted replaces the !encrypted tags of Supfile by encryptedPrefix
+// prepended to the tagged values, which are either inline or literal
+// block scalars:
+//
+//	env:
+//	  API_KEY: !encrypted YWdlLWVuY3J5cHRpb24ub3JnL3Yx...
+//	  DB_PASSWORD: !encrypted |
+//	    -----BEGIN PGP MESSAGE-----
+//	    ...
+func markEncrypted(data []byte) []byte {
+	if !bytes.Contains(data, []byte("!encrypted")) {
+		return data
+	}
+
+	lines := strings.Split(string(data), "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		m := encryptedTag.FindStringSubmatch(lines[i])
+		if m == nil {
+			out = append(out, lines[i])
+			continue
+		}
+		key, value := m[1], m[2]
+
+		switch {
+		case strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">"):
+			// Mark the block by a first line indented like the block.
+			out = append(out, key+value)
+			for j := i + 1; j < len(lines); j++ {
+				if strings.TrimSpace(lines[j]) != "" {
+					indent := lines[j][:len(lines[j])-len(strings.TrimLeft(lines[j], " \t"))]
+					out = append(out, indent+encryptedPrefix)
+					break
+				}
+			}
+		case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+			out = append(out, key+value[:1]+encryptedPrefix+value[1:])
+		default:
+			out = append(out, key+encryptedPrefix+value)
+		}
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// decryptValue decrypts a value tagged !encrypted: ASCII armored age files
+// by age, using the identity file $SUP_AGE_IDENTITY, and anything else
+// (ASCII armored or base64 encoded) by gpg.
+func decryptValue(value string) (string, error) {
+	ciphertext := strings.TrimSpace(strings.TrimPrefix(value, encryptedPrefix))
+
+	var cmd *exec.Cmd
+	if strings.HasPrefix(ciphertext, "-----BEGIN AGE ENCRYPTED FILE-----") {
+		identity := os.Getenv("SUP_AGE_IDENTITY")
+		if identity == "" {
+			return "", errors.New("age identity file not set, see $SUP_AGE_IDENTITY")
+		}
+		cmd = exec.Command("age", "--decrypt", "--identity", identity)
+	} else {
+		if !strings.HasPrefix(ciphertext, "-----BEGIN PGP MESSAGE-----") {
+			ciphertext = "-----BEGIN PGP MESSAGE-----\n\n" + ciphertext + "\n-----END PGP MESSAGE-----"
+		}
+		cmd = exec.Command("gpg", "--quiet", "--batch", "--decrypt")
+	}
+	cmd.Stdin = strings.NewReader(ciphertext + "\n")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Wrap(err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
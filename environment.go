@@ -0,0 +1,72 @@
+package sup
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// applyEnvironment patches the Supfile YAML document with the overlay
+// of the given environment, declared under the top-level "environments"
+// key, and returns the resulting document. Overlay maps are merged into
+// the base document recursively; any other values (strings, lists)
+// replace the base values.
+func applyEnvironment(data []byte, environment string) ([]byte, error) {
+	if environment == "" {
+		return data, nil
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var overlay interface{}
+	var base yaml.MapSlice
+	found := false
+	for _, item := range doc {
+		if item.Key != "environments" {
+			base = append(base, item)
+			continue
+		}
+		envs, _ := item.Value.(yaml.MapSlice)
+		for _, env := range envs {
+			if fmt.Sprint(env.Key) == environment {
+				overlay, found = env.Value, true
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown environment %q", environment)
+	}
+
+	patch, ok := overlay.(yaml.MapSlice)
+	if !ok && overlay != nil {
+		return nil, fmt.Errorf("environment %v: expected a mapping", environment)
+	}
+	return yaml.Marshal(mergeYAML(base, patch))
+}
+
+// mergeYAML merges the patch mapping into base, preserving the order
+// of the base keys and appending the new ones.
+func mergeYAML(base, patch yaml.MapSlice) yaml.MapSlice {
+	merged := append(yaml.MapSlice{}, base...)
+outer:
+	for _, item := range patch {
+		for i, existing := range merged {
+			if existing.Key != item.Key {
+				continue
+			}
+			baseMap, ok1 := existing.Value.(yaml.MapSlice)
+			patchMap, ok2 := item.Value.(yaml.MapSlice)
+			if ok1 && ok2 {
+				merged[i].Value = mergeYAML(baseMap, patchMap)
+			} else {
+				merged[i].Value = item.Value
+			}
+			continue outer
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
@@ -0,0 +1,54 @@
+package sup
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the sup command, see ExitCode.
+const (
+	ExitOK       = 0
+	ExitError    = 1   // Any other error.
+	ExitConfig   = 2   // Invalid Supfile, arguments or flags.
+	ExitConnect  = 3   // Connecting to the hosts failed.
+	ExitCommand  = 4   // A command failed on all of its hosts.
+	ExitPartial  = 5   // A command failed on some of its hosts only, or hosts were skipped.
+	ExitCanceled = 130 // The run was interrupted, canceled or aborted at a pause.
+)
+
+// ErrCanceled is returned when a run is interrupted, by a signal
+// or by canceling its context, before it finished.
+type ErrCanceled struct {
+	Err error // Error the run stopped with.
+}
+
+func (e ErrCanceled) Error() string {
+	return fmt.Sprintf("run canceled: %v", e.Err)
+}
+
+// ExitCode returns the exit code of the sup command for err,
+// the error returned by Stackup.Run.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	switch e := errors.Cause(err).(type) {
+	case ErrCanceled, ErrAborted:
+		return ExitCanceled
+	case ErrConnect, ErrClockSkew, ErrCachedUnreachable, ErrHostKeyChanged, ErrHostKeyUnknown, ErrHostKeyRevoked:
+		return ExitConnect
+	case ErrTaskExit:
+		if e.Partial {
+			return ExitPartial
+		}
+		return ExitCommand
+	case ErrRequirement:
+		return ExitCommand
+	case ErrSkipped:
+		return ExitPartial
+	case ErrHostEnv, ErrPasswordEnv, ErrUnknownCommand, ErrChecksum, ErrSecretRef, ErrDuplicateKey, ErrPlanChanged, ErrNoInventoryLock, ErrSecurityProfile:
+		return ExitConfig
+	}
+	return ExitError
+}
@@ -0,0 +1,211 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Freeze represents a deploy freeze (blackout window) during which runs
+// against the given networks are refused.
+//
+// The window is either a date range (From/To) or a cron-like expression
+// "minute hour day-of-month month day-of-week" matching the frozen minutes.
+// As in cron, the days matching either day field are frozen when both are
+// restricted.
+type Freeze struct {
+	Networks []string `yaml:"networks"` // Frozen networks; all networks if empty.
+	From     string   `yaml:"from"`     // Start of the window, "2006-01-02" or RFC3339.
+	To       string   `yaml:"to"`       // End of the window (inclusive), "2006-01-02" or RFC3339.
+	Cron     string   `yaml:"cron"`     // Cron-like expression, e.g. "* 16-23 * * 5".
+	Reason   string   `yaml:"reason"`   // Human readable reason shown when a run is refused.
+
+	from, to time.Time
+	cron     []cronField
+	cronOr   bool // Both day fields are restricted, matching either day is enough.
+}
+
+// ErrFreeze is returned when a run falls into an active deploy freeze.
+type ErrFreeze struct {
+	Network string
+	Freeze  *Freeze
+}
+
+func (e ErrFreeze) Error() string {
+	msg := fmt.Sprintf("network %v is frozen", e.Network)
+	if e.Freeze.Reason != "" {
+		msg += ": " + e.Freeze.Reason
+	}
+	return msg + "\n\nUse --override-freeze REASON to run anyway"
+}
+
+// parse validates the freeze window and prepares it for matching.
+func (f *Freeze) parse() error {
+	if f.Cron == "" && f.From == "" && f.To == "" {
+		return errors.New("freeze: either cron or from/to must be set")
+	}
+	if f.Cron != "" && (f.From != "" || f.To != "") {
+		return errors.New("freeze: cron can't be combined with from/to")
+	}
+
+	if f.Cron != "" {
+		fields := strings.Fields(f.Cron)
+		if len(fields) != 5 {
+			return errors.Errorf("freeze: cron %q: expected 5 fields", f.Cron)
+		}
+		limits := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+		for i, field := range fields {
+			cf, err := parseCronField(field, limits[i][0], limits[i][1])
+			if err != nil {
+				return errors.Wrapf(err, "freeze: cron %q", f.Cron)
+			}
+			f.cron = append(f.cron, cf)
+		}
+		if f.cron[4][7] { // Both 0 and 7 stand for Sunday.
+			f.cron[4][0] = true
+		}
+		// As in cron, "* * 1 * 5" matches the 1st and every Friday.
+		f.cronOr = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+		return nil
+	}
+
+	var err error
+	if f.From != "" {
+		if f.from, _, err = parseFreezeTime(f.From); err != nil {
+			return errors.Wrap(err, "freeze: from")
+		}
+	}
+	if f.To != "" {
+		var dateOnly bool
+		if f.to, dateOnly, err = parseFreezeTime(f.To); err != nil {
+			return errors.Wrap(err, "freeze: to")
+		}
+		if dateOnly { // The whole last day is frozen.
+			f.to = f.to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+	}
+	return nil
+}
+
+func parseFreezeTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// Active reports whether the freeze applies to network at time t.
+func (f *Freeze) Active(network string, t time.Time) bool {
+	if len(f.Networks) > 0 {
+		var found bool
+		for _, name := range f.Networks {
+			if name == network {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.cron != nil {
+		t = t.Local()
+		if !f.cron[0][t.Minute()] || !f.cron[1][t.Hour()] || !f.cron[3][int(t.Month())] {
+			return false
+		}
+		dom, dow := f.cron[2][t.Day()], f.cron[4][int(t.Weekday())]
+		if f.cronOr {
+			return dom || dow
+		}
+		return dom && dow
+	}
+
+	if !f.from.IsZero() && t.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && t.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// CheckFreeze returns ErrFreeze if a run against network at time t
+// falls into any of the Supfile's freeze windows.
+func (conf *Supfile) CheckFreeze(network string, t time.Time) error {
+	for i := range conf.Freeze {
+		if conf.Freeze[i].Active(network, t) {
+			return ErrFreeze{Network: network, Freeze: &conf.Freeze[i]}
+		}
+	}
+	return nil
+}
+
+// Audit appends a line to the Supfile's audit log, if one is configured.
+func (conf *Supfile) Audit(format string, args ...interface{}) error {
+	if conf.AuditLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(conf.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening audit log failed")
+	}
+	defer f.Close()
+
+	line := time.Now().UTC().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...) + "\n"
+	if _, err := f.WriteString(line); err != nil {
+		return errors.Wrap(err, "writing audit log failed")
+	}
+	return nil
+}
+
+// cronField is a set of values matched by a single cron field.
+type cronField map[int]bool
+
+// parseCronField parses a cron field of the form "*", "5", "1-5", "*/15",
+// "0-30/10" or a comma separated list of those.
+func parseCronField(field string, min, max int) (cronField, error) {
+	cf := cronField{}
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, errors.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if stepped { // "5/15" stands for "5-max/15".
+				hi = max
+			}
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.Errorf("invalid range %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, errors.Errorf("%q out of range %v-%v", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			cf[v] = true
+		}
+	}
+	return cf, nil
+}
@@ -0,0 +1,59 @@
+package sup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckoutRef checks out ref (e.g. "origin/main") of the git repository
+// of the current directory in a temporary worktree, so a run deploys what
+// is committed there, not the uncommitted changes of the working copy. It
+// returns the directory of the worktree corresponding to the current one,
+// the commit checked out, and cleanup removing the worktree.
+func CheckoutRef(ref string) (dir, commit string, cleanup func(), err error) {
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrap(err, "git "+strings.Join(args, " ")+": "+strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", "", nil, err
+	}
+	prefix, err := git("rev-parse", "--show-prefix")
+	if err != nil {
+		return "", "", nil, err
+	}
+	commit, err = git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", "", nil, errors.Errorf("unknown git ref %q", ref)
+	}
+
+	worktree, err := ioutil.TempDir("", "sup-ref-")
+	if err != nil {
+		return "", "", nil, err
+	}
+	// The run may have left the current directory in the worktree.
+	cleanup = func() {
+		git("-C", top, "worktree", "remove", "--force", worktree)
+		os.RemoveAll(worktree)
+		git("-C", top, "worktree", "prune")
+	}
+	if _, err := git("worktree", "add", "--quiet", "--detach", worktree, commit); err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	return filepath.Join(worktree, filepath.FromSlash(prefix)), commit, cleanup, nil
+}
@@ -0,0 +1,33 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// healthCheck runs the health check of cmd (see Command.HealthCheck)
+// on the clients of a batch just updated by cmd. A failing check fails
+// the batch, rolling back the updated hosts, see Command.OnBatchFailure.
+func (sup *Stackup) healthCheck(r *runState, cmd *Command, clients []Client) error {
+	task := &Task{
+		Run:        cmd.HealthCheck,
+		Clients:    clients,
+		TTY:        true,
+		LoginShell: cmd.LoginShell,
+		Umask:      cmd.Umask,
+		CleanEnv:   cmd.CleanEnv,
+	}
+	if sup.debug {
+		task.Run = "set -x;" + task.Run
+	}
+
+	check := *cmd
+	check.Capture = false // The output of the check isn't a result of the command.
+	if err := sup.runTask(r, &check, task); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: health check failed on %v host(s)\n", cmd.Name, len(clients))
+		return errors.Wrap(err, "health check failed")
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Host is a single host of a network. In Supfile, it's either a plain
+// "[ssh://][user@]host[:port]" string, optionally followed by fields like
+// the lines of inventories (see inventoryHost), or a mapping with extra
+// settings:
+//
+//	hosts:
+//	  - api1.example.com
+//	  - deploy@10.0.1.5 key=~/.ssh/prod_rsa
+//	  - deploy@[2001:db8::1]:2222
+//	  - host: db1.example.com
+//	    roles: [db, db-primary]
+//	    user: ${DEPLOY_USER}
+//
+// The user, port, identity file and password may reference env vars as
+// ${VAR}, resolved when connecting to the host; "$$" stands for a "$".
+type Host struct {
+	Addr         string   `yaml:"host"`          // Address of the host, "[ssh://][user@]host[:port]".
+	Roles        []string `yaml:"roles"`         // Roles of the host, see TargetCommand.
+	IdentityFile string   `yaml:"identity_file"` // Private key to authenticate by, in addition to the default ones; overrides the network's one.
+	User         string   `yaml:"user"`          // Overrides the user of the address.
+	Port         string   `yaml:"port"`          // Overrides the port of the address.
+	Password     string   `yaml:"password"`      // Password to authenticate by.
+	When         string   `yaml:"when"`          // Condition on the vars, e.g. '${{ eq .region "eu" }}', see Supfile.ApplyVars.
+
+	Meta map[string]string `yaml:"meta"` // Metadata of the host, e.g. instance ID, AZ or tags, see Network.Prefix.
+	Env  EnvList           `yaml:"env"`  // Env vars of the host, overriding the network's ones.
+}
+
+func (h *Host) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		*h = Host{Addr: addr}
+		if len(strings.Fields(addr)) > 1 {
+			*h = inventoryHost(addr)
+		}
+		return nil
+	}
+
+	type host Host // Prevent recursion.
+	if err := unmarshal((*host)(h)); err != nil {
+		return err
+	}
+	if h.Addr == "" {
+		return fmt.Errorf("host: missing address")
+	}
+	return nil
+}
+
+func (h Host) String() string {
+	return h.Addr
+}
+
+// ErrHostEnv is returned when a host's setting references
+// an undefined env var.
+type ErrHostEnv struct {
+	Host string
+	Var  string
+}
+
+func (e ErrHostEnv) Error() string {
+	return fmt.Sprintf("host %v: env var %v is not set", e.Host, e.Var)
+}
+
+// credentials returns the SSH address of the host, including its user,
+// port and password, and its identity file. The env vars referenced by them
+// as ${VAR} are looked up in env, then in the environment of sup.
+func (h Host) credentials(env EnvList) (addr, identityFile string, err error) {
+	expand := func(value string) string {
+		return expandRefs(value, func(key string) string {
+			for _, v := range env {
+				if v.Key == key {
+					return v.Value
+				}
+			}
+			v, ok := os.LookupEnv(key)
+			if !ok && err == nil {
+				err = ErrHostEnv{Host: h.Addr, Var: key}
+			}
+			return v
+		})
+	}
+	user, port, password := expand(h.User), expand(h.Port), expand(h.Password)
+	identityFile = expandTilde(expand(h.IdentityFile))
+	if err != nil {
+		return "", "", err
+	}
+	if user == "" && port == "" && password == "" {
+		return h.Addr, identityFile, nil
+	}
+
+	u, err := parseAddr(h.Addr)
+	if err != nil {
+		return "", "", err
+	}
+	if user == "" {
+		user = u.User.Username()
+	}
+	if password == "" {
+		password, _ = u.User.Password()
+	}
+	if password != "" {
+		u.User = url.UserPassword(user, password)
+	} else if user != "" {
+		u.User = url.User(user)
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.String(), identityFile, nil
+}
+
+// expandRefs replaces the ${VAR} references in s by mapping, and "$$" by
+// "$". Any other "$" is kept as is, so literal values like passwords
+// aren't mangled.
+func expandRefs(s string, mapping func(string) string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			buf.WriteByte('$')
+			i++
+			continue
+		}
+		if s[i+1] == '{' {
+			if end := strings.IndexByte(s[i+2:], '}'); end > 0 && isEnvName(s[i+2:i+2+end]) {
+				buf.WriteString(mapping(s[i+2 : i+2+end]))
+				i += 2 + end
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// isEnvName reports whether s is a valid name of an env var.
+func isEnvName(s string) bool {
+	for i, c := range s {
+		letter := c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseAddr parses the address of an SSH host,
+// "[ssh://][user[:password]@]host[:port]". IPv6 addresses are bracketed,
+// like in URLs, e.g. "deploy@[2001:db8::1]:2222", but may be bare without
+// a port, and their zones needn't be escaped: "fe80::1%eth0".
+func parseAddr(addr string) (*url.URL, error) {
+	userinfo, hostport := "", strings.TrimPrefix(addr, "ssh://")
+	if i := strings.LastIndex(hostport, "@"); i >= 0 {
+		userinfo, hostport = hostport[:i+1], hostport[i+1:]
+	}
+	if ip := strings.SplitN(hostport, "%", 2)[0]; strings.Contains(ip, ":") && net.ParseIP(ip) != nil {
+		hostport = "[" + hostport + "]"
+	}
+	if strings.HasPrefix(hostport, "[") && !strings.Contains(hostport, "%25") {
+		hostport = strings.Replace(hostport, "%", "%25", 1)
+	}
+	u, err := url.Parse("ssh://" + userinfo + hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host address %q", addr)
+	}
+	return u, nil
+}
+
+// inventoryHost parses a line of an inventory's output:
+// the address of the host, optionally followed by its metadata
+// as KEY=VALUE fields, e.g. "10.0.1.5 AZ=eu-west-1a ID=i-0abc".
+// The "key" field is the identity file of the host instead.
+func inventoryHost(line string) Host {
+	fields := strings.Fields(line)
+	host := Host{Addr: fields[0]}
+	for _, field := range fields[1:] {
+		i := strings.Index(field, "=")
+		if i <= 0 {
+			continue
+		}
+		if field[:i] == "key" {
+			host.IdentityFile = field[i+1:]
+			continue
+		}
+		if host.Meta == nil {
+			host.Meta = map[string]string{}
+		}
+		host.Meta[field[:i]] = field[i+1:]
+	}
+	return host
+}
+
+// HasLabel reports whether the host is labeled key=value by its metadata,
+// or, for the "role" key, by its roles.
+func (h Host) HasLabel(key, value string) bool {
+	if v, ok := h.Meta[key]; ok && v == value {
+		return true
+	}
+	if key == "role" {
+		for _, role := range h.Roles {
+			if role == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// label returns the name of the host in the output prefixes and in the
+// run summary, by the given template (see Network.Prefix), or its address.
+func (h Host) label(prefix *template.Template) string {
+	if prefix == nil {
+		return h.Addr
+	}
+	var buf bytes.Buffer
+	if err := prefix.Execute(&buf, h.templateData()); err != nil {
+		return h.Addr
+	}
+	return buf.String()
+}
+
+// templateData returns the fields of the host in the templates of its
+// network: its metadata, Host and Roles.
+func (h Host) templateData() map[string]string {
+	data := map[string]string{}
+	for key, value := range h.Meta {
+		data[key] = value
+	}
+	data["Host"] = h.Addr
+	data["Roles"] = strings.Join(h.Roles, ",")
+	return data
+}
+
+// HasRole reports whether the host has any of the given roles.
+func (h Host) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		for _, r := range h.Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostRangeRegexp matches the ranges of host patterns, see
+// expandHostRange: numeric or alphabetic bounds, unlike the brackets of
+// IPv6 addresses.
+var hostRangeRegexp = regexp.MustCompile(`\[([0-9]+:[0-9]+|[A-Za-z]:[A-Za-z])\]`)
+
+// maxHostRange is the max number of hosts a host pattern expands into,
+// so a typo like "web[0:99999999]" fails instead of exhausting memory.
+const maxHostRange = 10000
+
+// expandHostRange expands the ranges of a host pattern, e.g.
+// "web[01:20].example.com" or "db-[a:c].internal", into its hosts, in
+// order. Zero-padded numeric bounds keep their width, alphabetic bounds
+// must be of the same case.
+func expandHostRange(pattern string) ([]string, error) {
+	loc := hostRangeRegexp.FindStringSubmatchIndex(pattern)
+	if loc == nil {
+		return []string{pattern}, nil
+	}
+	prefix, spec, suffix := pattern[:loc[0]], pattern[loc[2]:loc[3]], pattern[loc[1]:]
+	bounds := strings.SplitN(spec, ":", 2)
+	from, to := bounds[0], bounds[1]
+
+	var items []string
+	if from[0] <= '9' {
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host range %q", pattern)
+		}
+		end, err := strconv.Atoi(to)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid host range %q", pattern)
+		}
+		if end-start >= maxHostRange {
+			return nil, fmt.Errorf("host range %q: more than %d hosts", pattern, maxHostRange)
+		}
+		format := "%d"
+		if len(from) > 1 && from[0] == '0' {
+			format = fmt.Sprintf("%%0%dd", len(from))
+		}
+		for n := start; n <= end; n++ {
+			items = append(items, fmt.Sprintf(format, n))
+		}
+	} else if (from[0] >= 'a') == (to[0] >= 'a') && from[0] <= to[0] { // Letters of the same case.
+		for c := from[0]; c <= to[0]; c++ {
+			items = append(items, string(c))
+		}
+	} else {
+		return nil, fmt.Errorf("invalid host range %q", pattern)
+	}
+
+	rest, err := expandHostRange(suffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)*len(rest) > maxHostRange {
+		return nil, fmt.Errorf("host range %q: more than %d hosts", pattern, maxHostRange)
+	}
+	var hosts []string
+	for _, item := range items {
+		for _, r := range rest {
+			hosts = append(hosts, prefix+item+r)
+		}
+	}
+	return hosts, nil
+}
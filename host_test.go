@@ -0,0 +1,45 @@
+package sup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandHostRange(t *testing.T) {
+	tests := []struct {
+		pattern string
+		hosts   string // Space separated, or the expected error.
+		err     bool
+	}{
+		{"web.example.com", "web.example.com", false},
+		{"web[1:3].example.com", "web1.example.com web2.example.com web3.example.com", false},
+		{"web[08:10]", "web08 web09 web10", false},
+		{"web[8:10]", "web8 web9 web10", false},
+		{"db-[a:c].internal", "db-a.internal db-b.internal db-c.internal", false},
+		{"db-[X:Y]", "db-X db-Y", false},
+		{"rack[1:2]-node[a:b]", "rack1-nodea rack1-nodeb rack2-nodea rack2-nodeb", false},
+		{"[::1]:22", "[::1]:22", false}, // IPv6 address, not a range.
+		{"user@web[1:2]:2222", "user@web1:2222 user@web2:2222", false},
+		{"web[3:1]", `invalid host range "web[3:1]"`, true},
+		{"db-[c:a]", `invalid host range "db-[c:a]"`, true},
+		{"db-[a:Z]", `invalid host range "db-[a:Z]"`, true},
+		{"web[0:99999999]", `host range "web[0:99999999]": more than 10000 hosts`, true},
+		{"web[0:999]-[0:99]", `host range "web[0:999]-[0:99]": more than 10000 hosts`, true},
+	}
+	for _, test := range tests {
+		hosts, err := expandHostRange(test.pattern)
+		if test.err {
+			if err == nil || err.Error() != test.hosts {
+				t.Errorf("expandHostRange(%q) error = %v, want %v", test.pattern, err, test.hosts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandHostRange(%q): %v", test.pattern, err)
+			continue
+		}
+		if got := strings.Join(hosts, " "); got != test.hosts {
+			t.Errorf("expandHostRange(%q) = %v, want %v", test.pattern, got, test.hosts)
+		}
+	}
+}
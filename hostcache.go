@@ -0,0 +1,179 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hostCache remembers the reachability and the facts of the hosts between
+// runs, see Network.HostCache, so repeated runs (e.g. during an incident)
+// don't probe the hosts known to be dead, nor check their binaries again.
+// It's kept in the user's cache directory, e.g. ~/.cache/sup/hosts.json.
+type hostCache struct {
+	path    string
+	ttl     time.Duration
+	refresh bool // Don't use the cached facts, but update them.
+
+	mu    sync.Mutex
+	hosts map[string]*hostFacts
+}
+
+// hostFacts are the cached facts of a host.
+type hostFacts struct {
+	Checked   time.Time `json:"checked"` // When the host was connected to.
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"` // Why it wasn't.
+
+	// Binaries found on the host by requirement checks, by name:
+	// their path and the first line of their "--version" output.
+	Binaries        map[string][2]string `json:"binaries,omitempty"`
+	BinariesChecked time.Time            `json:"binaries_checked,omitempty"`
+}
+
+// openHostCache reads the host cache of the user, dropping the facts
+// older than ttl. It returns nil if ttl is 0.
+func openHostCache(ttl time.Duration, refresh bool) (*hostCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	c := &hostCache{
+		path:    filepath.Join(dir, "sup", "hosts.json"),
+		ttl:     ttl,
+		refresh: refresh,
+		hosts:   map[string]*hostFacts{},
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.hosts); err != nil {
+		// A corrupted cache is just probed again.
+		c.hosts = map[string]*hostFacts{}
+	}
+	for host, facts := range c.hosts {
+		if time.Since(facts.Checked) > ttl && time.Since(facts.BinariesChecked) > ttl {
+			delete(c.hosts, host)
+		}
+	}
+	return c, nil
+}
+
+// unreachable returns the error of connecting to host, if it was
+// unreachable within the TTL.
+func (c *hostCache) unreachable(host string) error {
+	if c == nil || c.refresh {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	facts, ok := c.hosts[host]
+	if !ok || facts.Reachable || time.Since(facts.Checked) > c.ttl {
+		return nil
+	}
+	return ErrCachedUnreachable{host, facts.Checked, facts.Error}
+}
+
+// connected records the result of connecting to host.
+func (c *hostCache) connected(host string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	facts := c.facts(host)
+	facts.Checked = time.Now()
+	facts.Reachable = err == nil
+	facts.Error = ""
+	if err != nil {
+		facts.Error = err.Error()
+	}
+}
+
+// binaries returns the cached binaries of host, if all the given ones
+// were checked within the TTL.
+func (c *hostCache) binaries(host string, names []string) (map[string][2]string, bool) {
+	if c == nil || c.refresh {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	facts, ok := c.hosts[host]
+	if !ok || time.Since(facts.BinariesChecked) > c.ttl {
+		return nil, false
+	}
+	for _, name := range names {
+		if _, ok := facts.Binaries[name]; !ok {
+			return nil, false
+		}
+	}
+	return facts.Binaries, true
+}
+
+// setBinaries records the binaries found on host.
+func (c *hostCache) setBinaries(host string, binaries map[string][2]string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	facts := c.facts(host)
+	if facts.Binaries == nil || time.Since(facts.BinariesChecked) > c.ttl {
+		facts.Binaries = map[string][2]string{}
+	}
+	for name, found := range binaries {
+		facts.Binaries[name] = found
+	}
+	facts.BinariesChecked = time.Now()
+}
+
+// facts returns the facts of host, creating them if needed.
+// c.mu must be held.
+func (c *hostCache) facts(host string) *hostFacts {
+	facts, ok := c.hosts[host]
+	if !ok {
+		facts = &hostFacts{}
+		c.hosts[host] = facts
+	}
+	return facts
+}
+
+// save writes the cache back to the user's cache directory.
+func (c *hostCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.hosts, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, append(data, '\n'), 0644)
+}
+
+// ErrCachedUnreachable is returned for the hosts skipped because they
+// were unreachable recently, see Network.HostCache.
+type ErrCachedUnreachable struct {
+	Host    string
+	Checked time.Time
+	Reason  string
+}
+
+func (e ErrCachedUnreachable) Error() string {
+	return fmt.Sprintf("%v was unreachable %v ago (%v), skipped until --refresh", e.Host, time.Since(e.Checked).Round(time.Second), e.Reason)
+}
@@ -0,0 +1,30 @@
+package sup
+
+import "fmt"
+
+// Uploads are installed atomically: the files are extracted to a temporary
+// directory in the destination, i.e. on the same file system, then renamed
+// into place one by one, so services never read half-written files. New
+// directories are renamed into place as a whole. With backup, the previous
+// version of every file changed by the upload is kept as
+// "NAME.bak.TIMESTAMP", a hard link to it where possible.
+
+// installCommand returns the command installing the files fetch writes to
+// the directory "$tmp" into the destination of upload, see above.
+func installCommand(upload *Upload, fetch string) string {
+	backup := ""
+	if upload.Backup {
+		backup = "1"
+	}
+	return fmt.Sprintf(`dst="%s"; backup=%s; tmp=$(mktemp -d "$dst/.sup-upload.XXXXXX") && `+
+		`{ %v && %v; status=$?; rm -rf "$tmp"; [ $status -eq 0 ]; }`, upload.Dst, backup, fetch, installFiles)
+}
+
+// installFiles renames the files in $tmp into $dst, merging the
+// directories existing in $dst already.
+const installFiles = `ts=$(date +%Y%m%d%H%M%S); ( cd "$tmp" && find . ! -name . ) | { moved=; while IFS= read -r f; do f=${f#./}; ` +
+	`case "$f" in "$moved"/*) continue;; esac; ` +
+	`if [ -d "$tmp/$f" ] && [ ! -L "$tmp/$f" ]; then [ -d "$dst/$f" ] && continue; moved=$f; ` +
+	`elif [ -n "$backup" ] && [ -f "$dst/$f" ] && [ ! -L "$dst/$f" ] && ! cmp -s "$tmp/$f" "$dst/$f"; then ` +
+	`ln -f "$dst/$f" "$dst/$f.bak.$ts" 2> /dev/null || cp -p "$dst/$f" "$dst/$f.bak.$ts" || exit 1; fi; ` +
+	`mv -f "$tmp/$f" "$dst/$f" || exit 1; done; }`
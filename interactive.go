@@ -0,0 +1,251 @@
+package sup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Interactive runs read keys from the terminal while running, giving the
+// operator control of the run without killing it: "s" skips the hosts
+// still running the current task, e.g. a hung one, which are disconnected
+// and marked failed, and the run goes on without them; "p" pauses the run
+// before its next batch (or command), until "p" is pressed again. The
+// pauses of the run (see Pause) are answered by "y" or "n".
+
+// controls are the interactive controls of a run, see above.
+type controls struct {
+	tty *os.File
+
+	mu      sync.Mutex
+	paused  chan struct{}  // Closed on resuming, if paused.
+	answer  chan bool      // Receives the answer to the question asked, if any.
+	onSkip  map[int]func() // Called on "s", see skipping.
+	next    int
+	skipped map[Client]bool
+	hosts   []string // Skipped hosts.
+}
+
+// openControls starts reading the keys from the terminal.
+func openControls() (*controls, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Read the keys as they're pressed, but keep Ctrl-C interrupting.
+	if err := stty(tty, "-icanon", "-echo"); err != nil {
+		tty.Close()
+		return nil, err
+	}
+	c := &controls{tty: tty, onSkip: map[int]func(){}, skipped: map[Client]bool{}}
+	fmt.Fprintln(os.Stderr, "Interactive run: press s to skip the hosts still running, p to pause before the next batch")
+	go c.read()
+	return c, nil
+}
+
+func stty(tty *os.File, args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
+
+// read reads the keys until the terminal is closed.
+func (c *controls) read() {
+	key := make([]byte, 1)
+	for {
+		if _, err := c.tty.Read(key); err != nil {
+			return
+		}
+		switch key[0] {
+		case 's', 'S':
+			c.mu.Lock()
+			var skips []func()
+			for _, skip := range c.onSkip {
+				skips = append(skips, skip)
+			}
+			c.mu.Unlock()
+			if len(skips) == 0 {
+				fmt.Fprintln(os.Stderr, "sup: no hosts running")
+			}
+			for _, skip := range skips {
+				skip()
+			}
+		case 'p', 'P':
+			c.mu.Lock()
+			if c.paused == nil {
+				c.paused = make(chan struct{})
+				fmt.Fprintln(os.Stderr, "sup: pausing before the next batch, press p to resume")
+			} else {
+				close(c.paused)
+				c.paused = nil
+				fmt.Fprintln(os.Stderr, "sup: resumed")
+			}
+			c.mu.Unlock()
+		case 'y', 'Y', 'n', 'N':
+			c.mu.Lock()
+			if c.answer != nil {
+				fmt.Fprintln(os.Stderr, string(key))
+				select {
+				case c.answer <- key[0] == 'y' || key[0] == 'Y':
+				default:
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// ask returns the channel receiving the answer to a yes or no question,
+// until done is called.
+func (c *controls) ask() (answer <-chan bool, done func()) {
+	ch := make(chan bool, 1)
+	c.mu.Lock()
+	c.answer = ch
+	c.mu.Unlock()
+	return ch, func() {
+		c.mu.Lock()
+		c.answer = nil
+		c.mu.Unlock()
+	}
+}
+
+// close stops reading the keys, and restores the terminal.
+func (c *controls) close() {
+	if c == nil {
+		return
+	}
+	stty(c.tty, "icanon", "echo")
+	c.tty.Close()
+}
+
+// wait blocks while the run is paused, or until ctx is canceled.
+func (c *controls) wait(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	paused := c.paused
+	c.mu.Unlock()
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// skipping calls skip whenever "s" is pressed, until stop is called.
+func (c *controls) skipping(skip func()) (stop func()) {
+	if c == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.next
+	c.next++
+	c.onSkip[id] = skip
+	return func() {
+		c.mu.Lock()
+		delete(c.onSkip, id)
+		c.mu.Unlock()
+	}
+}
+
+// skip marks the host of cl skipped, reporting whether it wasn't already.
+func (c *controls) skip(cl Client, host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.skipped[cl] {
+		return false
+	}
+	c.skipped[cl] = true
+	c.hosts = append(c.hosts, host)
+	return true
+}
+
+// isSkipped reports whether the host of cl was skipped.
+func (c *controls) isSkipped(cl Client) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skipped[cl]
+}
+
+// active returns the clients of the hosts not skipped.
+func (c *controls) active(clients []Client) []Client {
+	if c == nil {
+		return clients
+	}
+	var active []Client
+	for _, cl := range clients {
+		if !c.isSkipped(cl) {
+			active = append(active, cl)
+		}
+	}
+	return active
+}
+
+// skippedHosts returns the skipped hosts.
+func (c *controls) skippedHosts() []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.hosts...)
+}
+
+// writer returns w, discarding the writes once the host of cl is
+// skipped, so writing the input of a task to all of its hosts goes on
+// without it.
+func (c *controls) writer(cl Client, w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &skippableWriter{w: w, skipped: func() bool { return c.isSkipped(cl) }}
+}
+
+type skippableWriter struct {
+	w       io.Writer
+	skipped func() bool
+}
+
+func (w *skippableWriter) Write(p []byte) (int, error) {
+	if w.skipped() {
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	if err != nil && w.skipped() {
+		return len(p), nil
+	}
+	return n, err
+}
+
+// abandon stops cl running its task for good, once its host is skipped.
+// A hung host may not even reply to signals, so it's disconnected.
+func abandon(cl Client) {
+	switch cl := cl.(type) {
+	case *SSHClient:
+		cl.conn.Close() // Closed again at the end of the run.
+	case *LocalhostClient:
+		cl.cmd.Process.Kill()
+	default:
+		cl.Signal(os.Interrupt)
+	}
+}
+
+// ErrSkipped is returned when a run succeeded, but on the hosts skipped
+// by the operator, see controls.
+type ErrSkipped struct {
+	Hosts []string
+}
+
+func (e ErrSkipped) Error() string {
+	return fmt.Sprintf("skipped %v host(s): %v", len(e.Hosts), strings.Join(e.Hosts, ", "))
+}
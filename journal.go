@@ -0,0 +1,197 @@
+package sup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The journal of a run records its progress in an append-only file of the
+// state directory, one JSON record per line, synced to disk as it goes:
+// the commands of the run, the hosts every command completed on (or was
+// rolled back on), the completed commands, and the end of the run. If sup
+// itself dies mid-run (OOM, power loss), or the run fails, "sup --resume"
+// reads the journal of the last run of the network and skips what it
+// completed, provided it ran the same commands.
+
+// Journal events.
+const (
+	journalStart   = "start"
+	journalResume  = "resume"
+	journalHost    = "host"    // The command completed on the host.
+	journalUndone  = "undone"  // The command was rolled back on the host.
+	journalCommand = "command" // The command completed.
+	journalEnd     = "end"
+)
+
+// journalRecord is a line of the journal.
+type journalRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Commands []string  `json:"commands,omitempty"` // Of start.
+	Command  *int      `json:"command,omitempty"`  // Index of the command in the run.
+	Name     string    `json:"name,omitempty"`     // Name of the command.
+	Host     string    `json:"host,omitempty"`
+	Error    string    `json:"error,omitempty"` // Of end, if the run failed.
+}
+
+// journal is the journal of a run.
+type journal struct {
+	mu    sync.Mutex
+	f     *os.File
+	index map[*Command]int // Index of the commands in the run.
+
+	// Completed by the resumed run: "i" for the commands and "i host"
+	// for the hosts of command i.
+	done map[string]bool
+}
+
+// journalPath returns the journal of the runs on network in dir.
+func journalPath(dir, network string) string {
+	return filepath.Join(dir, "journal", network+".jsonl")
+}
+
+// openJournal starts the journal at path for a run of the commands.
+// If resume is set, and the journal at path is of an unfinished or
+// failed run of the same commands, it's continued instead, and what it
+// completed is skipped, see journal.completed.
+func openJournal(path string, commands []*Command, resume bool) (*journal, error) {
+	j := &journal{index: map[*Command]int{}, done: map[string]bool{}}
+	var names []string
+	for i, cmd := range commands {
+		j.index[cmd] = i
+		names = append(names, cmd.Name)
+	}
+
+	var records []journalRecord
+	if resume {
+		records = readJournal(path)
+		if len(records) > 0 && !reflect.DeepEqual(records[0].Commands, names) {
+			fmt.Fprintf(os.Stderr, "Warning: the last run in %v ran other commands, not resuming it\n", path)
+			records = nil
+		}
+		if n := len(records); n > 0 && records[n-1].Event == journalEnd && records[n-1].Error == "" {
+			records = nil // Completed.
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if len(records) > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+
+	if len(records) == 0 {
+		return j, j.write(journalRecord{Event: journalStart, Commands: names})
+	}
+	for _, record := range records {
+		switch {
+		case record.Command == nil:
+		case record.Event == journalHost:
+			j.done[fmt.Sprintf("%v %v", *record.Command, record.Host)] = true
+		case record.Event == journalUndone:
+			delete(j.done, fmt.Sprintf("%v %v", *record.Command, record.Host))
+		case record.Event == journalCommand:
+			j.done[fmt.Sprint(*record.Command)] = true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Resuming the run of %v, skipping what it completed\n", records[0].Time.Local().Format(time.RFC1123))
+	return j, j.write(journalRecord{Event: journalResume})
+}
+
+// readJournal reads the records of the journal at path, if any.
+// A record cut short by a crash ends the journal.
+func readJournal(path string) []journalRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var records []journalRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		if len(records) == 0 && record.Event != journalStart {
+			return nil
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// write appends the record to the journal, and syncs it to disk.
+func (j *journal) write(record journalRecord) error {
+	record.Time = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// record records the event of cmd, warning if it fails, since the run
+// goes on without its journal. Commands not run by the run itself, e.g.
+// rollbacks, aren't recorded.
+func (j *journal) record(event string, cmd *Command, host string) {
+	if j == nil {
+		return
+	}
+	i, ok := j.index[cmd]
+	if !ok {
+		return
+	}
+	if err := j.write(journalRecord{Event: event, Command: &i, Name: cmd.Name, Host: host}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: writing journal failed: %v\n", err)
+	}
+}
+
+// completed reports whether the resumed run completed cmd, on host if
+// it's not empty.
+func (j *journal) completed(cmd *Command, host string) bool {
+	if j == nil {
+		return false
+	}
+	i, ok := j.index[cmd]
+	if !ok {
+		return false
+	}
+	if host == "" {
+		return j.done[fmt.Sprint(i)]
+	}
+	return j.done[fmt.Sprintf("%v %v", i, host)]
+}
+
+// end records the end of the run, and closes the journal.
+func (j *journal) end(err error) {
+	if j == nil {
+		return
+	}
+	record := journalRecord{Event: journalEnd}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := j.write(record); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: writing journal failed: %v\n", err)
+	}
+	j.f.Close()
+}
@@ -0,0 +1,253 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key checking modes, see Network.StrictHostKeyChecking.
+const (
+	HostKeyCheckingYes       = "yes"        // Reject the hosts missing in known_hosts.
+	HostKeyCheckingAcceptNew = "accept-new" // Add the hosts missing in known_hosts (trust on first use).
+	HostKeyCheckingNo        = "no"         // Don't check the host keys at all.
+)
+
+// knownHosts checks the host keys of the hosts against a known_hosts file,
+// like OpenSSH. By default, the hosts missing in the file are accepted
+// (and not added), but the keys of the known ones must match.
+type knownHosts struct {
+	path string
+	mode string
+
+	mu      sync.Mutex
+	entries []knownHostsEntry
+}
+
+// knownHostsEntry is a line of a known_hosts file.
+type knownHostsEntry struct {
+	patterns []string // Host patterns, or a single hashed host "|1|SALT|HASH".
+	key      ssh.PublicKey
+	revoked  bool
+	line     int
+}
+
+// defaultKnownHosts returns the user's known_hosts file.
+func defaultKnownHosts() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// loadKnownHosts reads the known_hosts file at path, or the user's one,
+// for checking the host keys by mode. It returns nil if mode is "no".
+func loadKnownHosts(path, mode string) (*knownHosts, error) {
+	if mode == HostKeyCheckingNo {
+		return nil, nil
+	}
+	if path == "" {
+		path = defaultKnownHosts()
+	}
+	k := &knownHosts{path: expandTilde(path), mode: mode}
+	f, err := os.Open(k.path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := knownHostsEntry{line: line}
+		switch fields[0] {
+		case "@revoked":
+			entry.revoked = true
+			fields = fields[1:]
+		case "@cert-authority":
+			continue // Host certificates aren't supported.
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		if err != nil {
+			continue
+		}
+		entry.patterns = strings.Split(fields[0], ",")
+		entry.key = key
+		k.entries = append(k.entries, entry)
+	}
+	return k, scanner.Err()
+}
+
+// knownHostsName returns the name of the address "host:port" in
+// known_hosts: the host, or "[host]:port" for other ports than 22.
+func knownHostsName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.ToLower(addr)
+	}
+	host = strings.ToLower(host)
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// match reports whether the entry is of the host name.
+func (e knownHostsEntry) match(name string) bool {
+	if len(e.patterns) == 1 && strings.HasPrefix(e.patterns[0], "|1|") {
+		parts := strings.Split(e.patterns[0], "|")
+		if len(parts) != 4 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[3]
+	}
+	var patterns []string
+	for _, pattern := range e.patterns {
+		patterns = append(patterns, strings.ToLower(pattern))
+	}
+	return matchSSHPatterns(patterns, name)
+}
+
+// algorithms returns the types of the known keys of the host at addr,
+// so the host is asked for a key that can be checked.
+func (k *knownHosts) algorithms(addr string) []string {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	name := knownHostsName(addr)
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, e := range k.entries {
+		if !e.revoked && e.match(name) && !seen[e.key.Type()] {
+			seen[e.key.Type()] = true
+			algorithms = append(algorithms, e.key.Type())
+		}
+	}
+	return algorithms
+}
+
+// check checks key is the host key of the host at addr.
+func (k *knownHosts) check(addr string, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	name := knownHostsName(addr)
+	data := key.Marshal()
+	var changed *knownHostsEntry
+	for i, e := range k.entries {
+		if !e.match(name) {
+			continue
+		}
+		if e.revoked {
+			if bytes.Equal(e.key.Marshal(), data) {
+				return ErrHostKeyRevoked{name, fingerprint(key), k.path, e.line}
+			}
+			continue
+		}
+		if e.key.Type() != key.Type() {
+			continue
+		}
+		if bytes.Equal(e.key.Marshal(), data) {
+			return nil
+		}
+		if changed == nil {
+			changed = &k.entries[i]
+		}
+	}
+	if changed != nil {
+		return ErrHostKeyChanged{name, fingerprint(key), k.path, changed.line}
+	}
+
+	switch k.mode {
+	case HostKeyCheckingYes:
+		return ErrHostKeyUnknown{name, fingerprint(key), k.path}
+	case HostKeyCheckingAcceptNew:
+		if err := k.add(name, key); err != nil {
+			return fmt.Errorf("adding host key of %v to %v failed: %v", name, k.path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: permanently added %v (%v %v) to %v\n", name, key.Type(), fingerprint(key), k.path)
+	}
+	return nil
+}
+
+// add appends the key of the host name to the known_hosts file.
+// k.mu must be held.
+func (k *knownHosts) add(name string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%v %s", name, ssh.MarshalAuthorizedKey(key)); err != nil {
+		return err
+	}
+	k.entries = append(k.entries, knownHostsEntry{patterns: []string{name}, key: key})
+	return nil
+}
+
+// ErrHostKeyChanged is returned when the host key of a host doesn't match
+// its key in known_hosts: either the key was replaced, or the connection
+// is being intercepted.
+type ErrHostKeyChanged struct {
+	Host        string
+	Fingerprint string
+	File        string
+	Line        int
+}
+
+func (e ErrHostKeyChanged) Error() string {
+	return fmt.Sprintf("host key of %v changed, possibly an attack: got %v, which doesn't match %v:%v; "+
+		"if the key was replaced on purpose, remove the old one by: ssh-keygen -R %q -f %v",
+		e.Host, e.Fingerprint, e.File, e.Line, e.Host, e.File)
+}
+
+// ErrHostKeyUnknown is returned by strict host key checking for the hosts
+// missing in known_hosts.
+type ErrHostKeyUnknown struct {
+	Host        string
+	Fingerprint string
+	File        string
+}
+
+func (e ErrHostKeyUnknown) Error() string {
+	return fmt.Sprintf("host key of %v (%v) is not in %v, and strict host key checking is enabled", e.Host, e.Fingerprint, e.File)
+}
+
+// ErrHostKeyRevoked is returned for the host keys marked @revoked
+// in known_hosts.
+type ErrHostKeyRevoked struct {
+	Host        string
+	Fingerprint string
+	File        string
+	Line        int
+}
+
+func (e ErrHostKeyRevoked) Error() string {
+	return fmt.Sprintf("host key of %v (%v) is revoked by %v:%v", e.Host, e.Fingerprint, e.File, e.Line)
+}
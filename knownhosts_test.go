@@ -0,0 +1,152 @@
+package sup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newHostKey returns a new ECDSA host key.
+func newHostKey(t *testing.T) ssh.PublicKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// hostKeyResult names the result of knownHosts.check.
+func hostKeyResult(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case ErrHostKeyChanged:
+		return "changed"
+	case ErrHostKeyRevoked:
+		return "revoked"
+	case ErrHostKeyUnknown:
+		return "unknown"
+	}
+	return err.Error()
+}
+
+func TestKnownHostsModes(t *testing.T) {
+	key, other := newHostKey(t), newHostKey(t)
+	marshal := func(key ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("[hashed.example.com]:2222"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	file := fmt.Sprintf(`# Test hosts
+known.example.com,alias.example.com %v
+*.wildcard.example.com %v
+@revoked revoked.example.com %v
+%v %v
+`, marshal(key), marshal(key), marshal(other), hashed, marshal(key))
+
+	tests := []struct {
+		addr string
+		key  ssh.PublicKey
+		want map[string]string // Results by mode.
+	}{
+		{"known.example.com:22", key, map[string]string{"": "ok", "yes": "ok", "accept-new": "ok"}},
+		{"ALIAS.example.com:22", key, map[string]string{"": "ok", "yes": "ok", "accept-new": "ok"}},
+		{"host.wildcard.example.com:22", key, map[string]string{"": "ok", "yes": "ok", "accept-new": "ok"}},
+		{"hashed.example.com:2222", key, map[string]string{"": "ok", "yes": "ok", "accept-new": "ok"}},
+		{"known.example.com:22", other, map[string]string{"": "changed", "yes": "changed", "accept-new": "changed"}},
+		{"known.example.com:2222", key, map[string]string{"": "ok", "yes": "unknown", "accept-new": "ok"}},
+		{"revoked.example.com:22", other, map[string]string{"": "revoked", "yes": "revoked", "accept-new": "revoked"}},
+		{"new.example.com:22", key, map[string]string{"": "ok", "yes": "unknown", "accept-new": "ok"}},
+	}
+	for _, mode := range []string{"", HostKeyCheckingYes, HostKeyCheckingAcceptNew} {
+		dir, err := ioutil.TempDir("", "sup-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := loadKnownHosts(path, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range tests {
+			if got := hostKeyResult(k.check(test.addr, test.key)); got != test.want[mode] {
+				t.Errorf("mode %q: key of %v %v, want %v", mode, test.addr, got, test.want[mode])
+			}
+		}
+
+		// Only accept-new adds the unknown hosts, trusted from then on.
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := strings.Contains(string(data), "new.example.com "+marshal(key))
+		if added != (mode == HostKeyCheckingAcceptNew) {
+			t.Errorf("mode %q: new host added: %v", mode, added)
+		}
+		if mode == HostKeyCheckingAcceptNew {
+			if got := hostKeyResult(k.check("new.example.com:22", other)); got != "changed" {
+				t.Errorf("mode %q: other key of an added host %v, want changed", mode, got)
+			}
+		}
+	}
+
+	if k, err := loadKnownHosts("", HostKeyCheckingNo); k != nil || err != nil {
+		t.Errorf("mode no: known hosts %v, %v, want none", k, err)
+	}
+}
+
+func TestKnownHostsAlgorithms(t *testing.T) {
+	key := newHostKey(t)
+	dir, err := ioutil.TempDir("", "sup-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+	data := "known.example.com " + string(ssh.MarshalAuthorizedKey(key))
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadKnownHosts(path, HostKeyCheckingYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"known.example.com:22", ssh.KeyAlgoECDSA256},
+		{"known.example.com:2222", ""},
+		{"unknown.example.com:22", ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(k.algorithms(test.addr), ","); got != test.want {
+			t.Errorf("algorithms(%v) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+	if got := (*knownHosts)(nil).algorithms("known.example.com:22"); got != nil {
+		t.Errorf("algorithms without known hosts = %v, want none", got)
+	}
+}
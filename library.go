@@ -0,0 +1,184 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// CommandsFrom imports the commands of a Supfile kept in a git repository,
+// e.g. "github.com/org/sup-commands//postgres@v1.2.0": the Supfile of the
+// postgres directory of the repository at tag v1.2.0. In Supfile, it's
+// either the source string, or a mapping pinning the checksum of the file:
+//
+//	commands_from:
+//	  - github.com/org/sup-commands//postgres@v1.2.0
+//	  - source: github.com/org/sup-commands//redis@v0.3.0
+//	    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+type CommandsFrom struct {
+	Source string `yaml:"source"` // "REPO[//DIR][@REF]", the repository is cloned by git.
+	SHA256 string `yaml:"sha256"` // Expected checksum of the imported Supfile.
+}
+
+func (c *CommandsFrom) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var source string
+	if err := unmarshal(&source); err == nil {
+		*c = CommandsFrom{Source: source}
+		return nil
+	}
+
+	type commandsFrom CommandsFrom // Prevent recursion.
+	if err := unmarshal((*commandsFrom)(c)); err != nil {
+		return err
+	}
+	if c.Source == "" {
+		return fmt.Errorf("commands_from: missing source")
+	}
+	return nil
+}
+
+// ErrChecksum is returned when an imported Supfile doesn't match
+// its pinned checksum.
+type ErrChecksum struct {
+	Source   string
+	Expected string
+	Actual   string
+}
+
+func (e ErrChecksum) Error() string {
+	return fmt.Sprintf("commands_from %v: checksum mismatch, expected sha256 %v, got %v", e.Source, e.Expected, e.Actual)
+}
+
+// parse splits the source into the git repository URL, the directory
+// of the Supfile in the repository and the git ref.
+func (c CommandsFrom) parse() (repo, dir, ref string) {
+	repo = c.Source
+	if i := strings.LastIndex(repo, "@"); i > strings.LastIndex(repo, "/") {
+		repo, ref = repo[:i], repo[i+1:]
+	}
+	scheme := ""
+	if i := strings.Index(repo, "://"); i >= 0 {
+		scheme, repo = repo[:i+3], repo[i+3:]
+	}
+	if i := strings.Index(repo, "//"); i >= 0 {
+		repo, dir = repo[:i], repo[i+2:]
+	}
+	if scheme == "" && !strings.Contains(repo, ":") {
+		scheme = "https://"
+	}
+	return scheme + repo, dir, ref
+}
+
+// supfileNames are the names of the imported Supfile, in the order tried.
+var supfileNames = []string{"Supfile.yml", "Supfile.yaml", "Supfile"}
+
+// load returns the commands of the imported Supfile. Sources at a ref
+// are cached in the user's cache directory, see fetch.
+func (c CommandsFrom) load() (Commands, error) {
+	repo, dir, ref := c.parse()
+	checkout, cleanup, err := c.fetch(repo, ref)
+	if err != nil {
+		return Commands{}, errors.Wrap(err, "commands_from "+c.Source)
+	}
+	defer cleanup()
+
+	var data []byte
+	for _, name := range supfileNames {
+		data, err = ioutil.ReadFile(filepath.Join(checkout, filepath.FromSlash(dir), name))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return Commands{}, fmt.Errorf("commands_from %v: no Supfile found", c.Source)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	switch {
+	case c.SHA256 == "":
+		fmt.Fprintf(os.Stderr, "Warning: commands_from %v is not pinned, its sha256 is %v\n", c.Source, sum)
+	case !strings.EqualFold(c.SHA256, sum):
+		return Commands{}, ErrChecksum{c.Source, c.SHA256, sum}
+	}
+
+	var imported struct {
+		Commands Commands `yaml:"commands"`
+	}
+	if err := yaml.Unmarshal(data, &imported); err != nil {
+		return Commands{}, errors.Wrap(err, "commands_from "+c.Source)
+	}
+	return imported.Commands, nil
+}
+
+// fetch clones the repository at ref, returning the directory of the clone.
+// Clones of a ref are kept for later use; without a ref, the default branch
+// is cloned into a temporary directory, removed by cleanup.
+func (c CommandsFrom) fetch(repo, ref string) (checkout string, cleanup func(), err error) {
+	cleanup = func() {}
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if ref != "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", nil, err
+		}
+		key := strings.NewReplacer("://", "/", ":", "/", "@", "/").Replace(repo) + "@" + ref
+		checkout = filepath.Join(cache, "sup", "commands", filepath.FromSlash(key))
+		if _, err := os.Stat(checkout); err == nil {
+			return checkout, cleanup, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(checkout), 0755); err != nil {
+			return "", nil, err
+		}
+		args = append(args, "--branch", ref)
+	} else {
+		checkout, err = ioutil.TempDir("", "sup-commands-")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup = func() { os.RemoveAll(checkout) }
+	}
+
+	// Clone into a temporary directory first, so failed clones aren't cached.
+	tmp := checkout + ".tmp"
+	os.RemoveAll(tmp)
+	cmd := exec.Command("git", append(args, repo, tmp)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(tmp)
+		cleanup()
+		return "", nil, errors.Wrap(err, "git clone: "+strings.TrimSpace(stderr.String()))
+	}
+	os.RemoveAll(checkout)
+	if err := os.Rename(tmp, checkout); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return checkout, cleanup, nil
+}
+
+// importCommands adds the commands imported by commands_from to conf.
+// Commands defined by the Supfile itself take precedence.
+func (conf *Supfile) importCommands() error {
+	for _, from := range conf.CommandsFrom {
+		commands, err := from.load()
+		if err != nil {
+			return err
+		}
+		for _, name := range commands.Names {
+			if _, ok := conf.Commands.Get(name); !ok {
+				cmd, _ := commands.Get(name)
+				conf.Commands.Set(name, cmd)
+			}
+		}
+	}
+	return nil
+}
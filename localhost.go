@@ -1,6 +1,7 @@
 package sup
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -19,6 +20,12 @@ type LocalhostClient struct {
 	stderr  io.Reader
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+	label   string // Output prefix, if not user@localhost.
+	color   string
+
+	// Command line running a command, by "bash -c" if nil,
+	// e.g. by docker exec for docker:// hosts, see Host.Transport.
+	args func(command string) []string
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -38,7 +45,11 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return fmt.Errorf("Command already running")
 	}
 
-	cmd := exec.Command("bash", "-c", c.env+task.Run)
+	args := []string{"bash", "-c", task.Command(c.env)}
+	if c.args != nil {
+		args = c.args(task.Command(c.env))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
 	c.cmd = cmd
 
 	c.stdout, err = cmd.StdoutPipe()
@@ -91,6 +102,12 @@ func (c *LocalhostClient) Stdout() io.Reader {
 
 func (c *LocalhostClient) Prefix() (string, int) {
 	host := c.user + "@localhost" + " | "
+	if c.label != "" {
+		host = c.label + " | "
+	}
+	if c.color != "" {
+		return c.color + host + ResetColor, len(host)
+	}
 	return ResetColor + host, len(host)
 }
 
@@ -117,3 +134,11 @@ func ResolveLocalPath(cwd, path, env string) (string, error) {
 
 	return string(resolvedFilename), nil
 }
+
+func (c *LocalhostClient) Upload(ctx context.Context, src, dst string, opts TransferOptions) error {
+	return upload(ctx, c, src, dst, opts)
+}
+
+func (c *LocalhostClient) Download(ctx context.Context, src, dst string, opts TransferOptions) error {
+	return download(ctx, c, src, dst, opts)
+}
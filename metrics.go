@@ -0,0 +1,71 @@
+package sup
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Metrics configures emission of run events and timings to statsd.
+// With Datadog enabled, metrics carry DogStatsD tags and every run
+// also sends a DogStatsD event, which shows up as a deploy marker.
+type Metrics struct {
+	Statsd  string   `yaml:"statsd"`  // Address of the statsd server, e.g. "127.0.0.1:8125".
+	Prefix  string   `yaml:"prefix"`  // Metric name prefix, defaults to "sup.".
+	Tags    []string `yaml:"tags"`    // Extra tags, e.g. "team:infra" (Datadog only).
+	Datadog bool     `yaml:"datadog"` // Use DogStatsD extensions (tags, events).
+}
+
+// RunFinished sends the run count, duration and (with Datadog) an event.
+func (m *Metrics) RunFinished(network, target string, start time.Time, runErr error) error {
+	if m == nil || m.Statsd == "" {
+		return nil
+	}
+
+	status := "success"
+	if runErr != nil {
+		status = "failure"
+	}
+	prefix := m.Prefix
+	if prefix == "" {
+		prefix = "sup."
+	}
+
+	var suffix string
+	if m.Datadog {
+		tags := append([]string{"network:" + network, "target:" + target, "status:" + status}, m.Tags...)
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	packets := []string{
+		fmt.Sprintf("%vrun.count:1|c%v", prefix, suffix),
+		fmt.Sprintf("%vrun.duration:%d|ms%v", prefix, time.Since(start)/time.Millisecond, suffix),
+	}
+	if m.Datadog {
+		title := fmt.Sprintf("sup %v %v: %v", network, target, status)
+		text := fmt.Sprintf("sup %v on %v finished with %v after %v", target, network, status, time.Since(start))
+		if runErr != nil {
+			text += ": " + strings.Replace(runErr.Error(), "\n", " ", -1)
+		}
+		alert := "success"
+		if runErr != nil {
+			alert = "error"
+		}
+		packets = append(packets, fmt.Sprintf("_e{%d,%d}:%v|%v|t:%v%v", len(title), len(text), title, text, alert, suffix))
+	}
+
+	conn, err := net.Dial("udp", m.Statsd)
+	if err != nil {
+		return errors.Wrap(err, "connecting to statsd failed")
+	}
+	defer conn.Close()
+	for _, packet := range packets {
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			return errors.Wrap(err, "sending metrics failed")
+		}
+	}
+	return nil
+}
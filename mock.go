@@ -0,0 +1,204 @@
+package sup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// MockResponse is a scripted response of simulated hosts
+// to the commands matching it.
+type MockResponse struct {
+	Match  string `yaml:"match"`  // Regexp matching the command, including the exported env vars.
+	Host   string `yaml:"host"`   // Regexp matching the host, all hosts by default.
+	Stdout string `yaml:"stdout"` // Output of the command.
+	Stderr string `yaml:"stderr"` // Error output of the command.
+	Exit   int    `yaml:"exit"`   // Exit status of the command.
+
+	match, host *regexp.Regexp
+}
+
+// Mock simulates hosts responding to commands by the first matching
+// response, or by success without any output if none matches.
+// It records the commands run on each host.
+type Mock struct {
+	Responses []MockResponse
+
+	mu       sync.Mutex
+	commands map[string][]string
+}
+
+// NewMock returns a Mock responding by responses.
+func NewMock(responses []MockResponse) (*Mock, error) {
+	for i := range responses {
+		r := &responses[i]
+		var err error
+		if r.match, err = regexp.Compile(r.Match); err != nil {
+			return nil, errors.Wrap(err, "mock: invalid match regexp")
+		}
+		if r.host, err = regexp.Compile(r.Host); err != nil {
+			return nil, errors.Wrap(err, "mock: invalid host regexp")
+		}
+	}
+	return &Mock{Responses: responses, commands: map[string][]string{}}, nil
+}
+
+// NewMockFromFile returns a Mock responding by the list
+// of responses read from a YAML file.
+func NewMockFromFile(file string) (*Mock, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var responses []MockResponse
+	if err := yaml.Unmarshal(data, &responses); err != nil {
+		return nil, errors.Wrap(err, "mock: parsing "+file+" failed")
+	}
+	return NewMock(responses)
+}
+
+// Commands returns the commands run on host so far.
+func (m *Mock) Commands(host string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands[host]...)
+}
+
+func (m *Mock) run(host, command string) *MockResponse {
+	m.mu.Lock()
+	m.commands[host] = append(m.commands[host], command)
+	m.mu.Unlock()
+
+	for i := range m.Responses {
+		r := &m.Responses[i]
+		if r.match.MatchString(command) && r.host.MatchString(host) {
+			return r
+		}
+	}
+	return &MockResponse{}
+}
+
+// ErrMockExit is returned by MockClient.Wait when the scripted
+// response has a non-zero exit status.
+type ErrMockExit struct {
+	Status int
+}
+
+func (e ErrMockExit) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+// ExitStatus returns the exit status of the simulated command.
+func (e ErrMockExit) ExitStatus() int {
+	return e.Status
+}
+
+// MockClient is a Client of a host simulated by Mock.
+type MockClient struct {
+	mock     *Mock
+	host     string
+	env      string //export FOO="bar"; export BAR="baz";
+	color    string
+	label    string // Output prefix, if not the host.
+	stdout   io.Reader
+	stderr   io.Reader
+	response *MockResponse
+	running  bool
+}
+
+func (c *MockClient) Connect(host string) error {
+	c.host = host
+	return nil
+}
+
+func (c *MockClient) Run(task *Task) error {
+	if c.running {
+		return fmt.Errorf("Command already running")
+	}
+	c.response = c.mock.run(c.host, task.Command(c.env))
+	c.stdout = bytes.NewBufferString(c.response.Stdout)
+	c.stderr = bytes.NewBufferString(c.response.Stderr)
+	c.running = true
+	return nil
+}
+
+func (c *MockClient) Wait() error {
+	if !c.running {
+		return fmt.Errorf("Trying to wait on stopped command")
+	}
+	c.running = false
+	if c.response.Exit != 0 {
+		return ErrMockExit{c.response.Exit}
+	}
+	return nil
+}
+
+func (c *MockClient) Close() error {
+	return nil
+}
+
+func (c *MockClient) Stdin() io.WriteCloser {
+	return nopWriteCloser{ioutil.Discard}
+}
+
+func (c *MockClient) Stderr() io.Reader {
+	return c.stderr
+}
+
+func (c *MockClient) Stdout() io.Reader {
+	return c.stdout
+}
+
+func (c *MockClient) Prefix() (string, int) {
+	host := c.host + " | "
+	if c.label != "" {
+		host = c.label + " | "
+	}
+	return c.color + host + ResetColor, len(host)
+}
+
+func (c *MockClient) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+func (c *MockClient) WriteClose() error {
+	return nil
+}
+
+func (c *MockClient) Signal(sig os.Signal) error {
+	return nil
+}
+
+// Upload records the command receiving the files on the host,
+// without reading src.
+func (c *MockClient) Upload(ctx context.Context, src, dst string, opts TransferOptions) error {
+	if err := c.Run(&Task{Run: RemoteTarCommand(dst)}); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Download records the command sending the files from the host,
+// without writing dst.
+func (c *MockClient) Download(ctx context.Context, src, dst string, opts TransferOptions) error {
+	if err := c.Run(downloadTask(src)); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,302 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notify configures the notification sinks receiving run reports.
+// String values may reference environment variables ($VAR or ${VAR}),
+// so secrets don't have to be stored in the Supfile.
+type Notify struct {
+	PagerDuty   *PagerDutyNotifier   `yaml:"pagerduty"`
+	Opsgenie    *OpsgenieNotifier    `yaml:"opsgenie"`
+	Email       *EmailNotifier       `yaml:"email"`
+	Webhook     *WebhookNotifier     `yaml:"webhook"`
+	Slack       *SlackNotifier       `yaml:"slack"`
+	Grafana     *GrafanaNotifier     `yaml:"grafana"`
+	Pushgateway *PushgatewayNotifier `yaml:"pushgateway"`
+}
+
+// Notifier delivers a run report to a single sink.
+type Notifier interface {
+	Notify(network *Network, report *RunReport) error
+}
+
+// StartNotifier is implemented by sinks that also need to know
+// when a run starts, e.g. to mark its beginning on a dashboard.
+type StartNotifier interface {
+	NotifyStart(network *Network, report *RunReport) error
+}
+
+// Notifiers returns all the configured sinks.
+func (n *Notify) Notifiers() []Notifier {
+	if n == nil {
+		return nil
+	}
+	var notifiers []Notifier
+	if n.PagerDuty != nil {
+		notifiers = append(notifiers, n.PagerDuty)
+	}
+	if n.Opsgenie != nil {
+		notifiers = append(notifiers, n.Opsgenie)
+	}
+	if n.Email != nil {
+		notifiers = append(notifiers, n.Email)
+	}
+	if n.Webhook != nil {
+		notifiers = append(notifiers, n.Webhook)
+	}
+	if n.Slack != nil {
+		notifiers = append(notifiers, n.Slack)
+	}
+	if n.Grafana != nil {
+		notifiers = append(notifiers, n.Grafana)
+	}
+	if n.Pushgateway != nil {
+		notifiers = append(notifiers, n.Pushgateway)
+	}
+	return notifiers
+}
+
+// Send delivers report to all the configured sinks
+// and returns the errors of the sinks that failed.
+func (n *Notify) Send(network *Network, report *RunReport) []error {
+	var errs []error
+	for _, notifier := range n.Notifiers() {
+		if err := notifier.Notify(network, report); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// SendStart notifies the configured sinks implementing StartNotifier
+// that a run started, and returns the errors of the sinks that failed.
+func (n *Notify) SendStart(network *Network, report *RunReport) []error {
+	var errs []error
+	for _, notifier := range n.Notifiers() {
+		if sn, ok := notifier.(StartNotifier); ok {
+			if err := sn.NotifyStart(network, report); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// PagerDutyNotifier triggers a PagerDuty incident (Events API v2)
+// when a run against a critical network fails.
+type PagerDutyNotifier struct {
+	RoutingKey string `yaml:"routing_key"`
+	Severity   string `yaml:"severity"` // Defaults to "critical".
+	URL        string `yaml:"url"`      // Defaults to the public Events API endpoint.
+}
+
+func (p *PagerDutyNotifier) Notify(network *Network, report *RunReport) error {
+	if !network.Critical || !report.Failed() {
+		return nil
+	}
+
+	url := os.ExpandEnv(p.URL)
+	if url == "" {
+		url = "https://events.pagerduty.com/v2/enqueue"
+	}
+	severity := p.Severity
+	if severity == "" {
+		severity = "critical"
+	}
+
+	event := map[string]interface{}{
+		"routing_key":  os.ExpandEnv(p.RoutingKey),
+		"event_action": "trigger",
+		"payload": map[string]interface{}{
+			"summary":        fmt.Sprintf("sup %v on %v failed", report.Target, report.Network),
+			"source":         "sup",
+			"severity":       severity,
+			"timestamp":      report.Start.Format(time.RFC3339),
+			"custom_details": map[string]string{"summary": report.Summary()},
+		},
+	}
+	return errors.Wrap(postJSON(url, nil, event), "pagerduty")
+}
+
+// OpsgenieNotifier creates an Opsgenie alert when a run against
+// a critical network fails.
+type OpsgenieNotifier struct {
+	APIKey   string   `yaml:"api_key"`
+	Priority string   `yaml:"priority"` // Defaults to "P1".
+	Tags     []string `yaml:"tags"`
+	URL      string   `yaml:"url"` // Defaults to the public (US) Alert API endpoint.
+}
+
+func (o *OpsgenieNotifier) Notify(network *Network, report *RunReport) error {
+	if !network.Critical || !report.Failed() {
+		return nil
+	}
+
+	url := os.ExpandEnv(o.URL)
+	if url == "" {
+		url = "https://api.opsgenie.com/v2/alerts"
+	}
+	priority := o.Priority
+	if priority == "" {
+		priority = "P1"
+	}
+
+	alert := map[string]interface{}{
+		"message":     fmt.Sprintf("sup %v on %v failed", report.Target, report.Network),
+		"description": report.Summary(),
+		"priority":    priority,
+		"tags":        append([]string{"sup", report.Network}, o.Tags...),
+		"source":      "sup",
+	}
+	header := http.Header{"Authorization": {"GenieKey " + os.ExpandEnv(o.APIKey)}}
+	return errors.Wrap(postJSON(url, header, alert), "opsgenie")
+}
+
+// WebhookNotifier posts every run to an HTTP endpoint. The body is
+// rendered from Template, or is the JSON encoded RunReport by default.
+type WebhookNotifier struct {
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers"`
+	ContentType string            `yaml:"content_type"` // Defaults to "application/json".
+	Template    string            `yaml:"template"`
+	On          string            `yaml:"on"` // "always" (default), "failure" or "success".
+}
+
+func (w *WebhookNotifier) Notify(network *Network, report *RunReport) error {
+	if !notifyOn(w.On, report) {
+		return nil
+	}
+
+	var body []byte
+	if w.Template != "" {
+		text, err := renderTemplate(w.Template, report)
+		if err != nil {
+			return errors.Wrap(err, "webhook")
+		}
+		body = []byte(text)
+	} else {
+		var err error
+		if body, err = json.Marshal(report); err != nil {
+			return errors.Wrap(err, "webhook")
+		}
+	}
+
+	header := http.Header{}
+	for k, v := range w.Headers {
+		header.Set(k, os.ExpandEnv(v))
+	}
+	if w.ContentType != "" {
+		header.Set("Content-Type", w.ContentType)
+	}
+	return errors.Wrap(post(os.ExpandEnv(w.URL), header, body), "webhook")
+}
+
+// SlackNotifier posts a message about every run to a Slack incoming webhook.
+type SlackNotifier struct {
+	WebhookURL string `yaml:"webhook_url"`
+	Channel    string `yaml:"channel"`  // Overrides the webhook's default channel.
+	Template   string `yaml:"template"` // Message text template.
+	On         string `yaml:"on"`       // "always" (default), "failure" or "success".
+
+	SigningSecret string `yaml:"signing_secret"` // Signing secret of the Slack app receiving approvals, see RequestApproval.
+}
+
+const slackTemplate = `{{if .Failed}}:x:{{else}}:white_check_mark:{{end}} *{{.User}}* ran *{{.Target}}* on *{{.Network}}*` +
+	`{{if .GitSHA}} ({{.GitSHA}}){{end}}: {{if .Failed}}failed{{else}}succeeded{{end}} after {{.Duration}}` +
+	`{{range .Hosts}}{{if ne .Status "ok"}}` + "\n" + `• {{.Host}}: {{.Status}}{{end}}{{end}}`
+
+func (s *SlackNotifier) Notify(network *Network, report *RunReport) error {
+	if !notifyOn(s.On, report) {
+		return nil
+	}
+
+	tmpl := s.Template
+	if tmpl == "" {
+		tmpl = slackTemplate
+	}
+	text, err := renderTemplate(tmpl, report)
+	if err != nil {
+		return errors.Wrap(err, "slack")
+	}
+
+	msg := map[string]string{"text": text}
+	if s.Channel != "" {
+		msg["channel"] = s.Channel
+	}
+	return errors.Wrap(postJSON(os.ExpandEnv(s.WebhookURL), nil, msg), "slack")
+}
+
+// templateFuncs are the functions available in notification templates.
+var templateFuncs = map[string]interface{}{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// renderTemplate renders a notification text/template with the report.
+func renderTemplate(text string, report *RunReport) (string, error) {
+	tmpl, err := template.New("notification").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing template failed")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, report); err != nil {
+		return "", errors.Wrap(err, "rendering template failed")
+	}
+	return buf.String(), nil
+}
+
+// notifyOn reports whether a sink configured with on ("always",
+// "failure" or "success") should be notified about report.
+func notifyOn(on string, report *RunReport) bool {
+	switch on {
+	case "failure":
+		return report.Failed()
+	case "success":
+		return !report.Failed()
+	default:
+		return true
+	}
+}
+
+// postJSON posts v encoded as JSON to url and checks the response status.
+func postJSON(url string, header http.Header, v interface{}) error {
+	return doJSON("POST", url, header, v, nil)
+}
+
+// post posts body to url and checks the response status.
+// The Content-Type defaults to "application/json".
+func post(url string, header http.Header, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %v: %v", url, resp.Status)
+	}
+	return nil
+}
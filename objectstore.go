@@ -0,0 +1,119 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Artifacts of the runs, e.g. backups and reports, may be written to an
+// object store instead of the local disk, so they land in durable storage
+// from CI runners with ephemeral disks: the destinations "s3://BUCKET/KEY"
+// and "gs://BUCKET/KEY" are written by the aws CLI and gsutil, and their
+// credentials.
+
+// isObjectURL reports whether dst is an object store URL, see above.
+func isObjectURL(dst string) bool {
+	return strings.HasPrefix(dst, "s3://") || strings.HasPrefix(dst, "gs://")
+}
+
+// objectCommand returns the command of the CLI of the object store of url
+// running the args, e.g. "cp - URL".
+func objectCommand(url string, args ...string) *exec.Cmd {
+	if strings.HasPrefix(url, "gs://") {
+		return exec.Command("gsutil", args...)
+	}
+	return exec.Command("aws", append([]string{"s3"}, args...)...)
+}
+
+// runObjectCommand runs cmd, returning its output.
+func runObjectCommand(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v failed: %v", strings.Join(cmd.Args[:2], " "), strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// objectWriter writes the object url, streamed to the CLI of its store.
+// The object is complete once the writer is closed without error.
+type objectWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+// createObject starts writing the object url.
+func createObject(url string) (*objectWriter, error) {
+	w := &objectWriter{cmd: objectCommand(url, "cp", "-", url)}
+	w.cmd.Stderr = &w.stderr
+	stdin, err := w.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.WriteCloser = stdin
+	if err := w.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "%v failed", strings.Join(w.cmd.Args[:2], " "))
+	}
+	return w, nil
+}
+
+func (w *objectWriter) Close() error {
+	w.WriteCloser.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "%v failed: %v", strings.Join(w.cmd.Args[:2], " "), strings.TrimSpace(w.stderr.String()))
+	}
+	return nil
+}
+
+// writeObject writes data to the object url.
+func writeObject(url string, data []byte) error {
+	cmd := objectCommand(url, "cp", "-", url)
+	cmd.Stdin = bytes.NewReader(data)
+	_, err := runObjectCommand(cmd)
+	return err
+}
+
+// readObject reads the object url.
+func readObject(url string) ([]byte, error) {
+	return runObjectCommand(objectCommand(url, "cp", url, "-"))
+}
+
+// listObjects lists the names of the objects in the "directory" url.
+func listObjects(url string) ([]string, error) {
+	url = strings.TrimSuffix(url, "/") + "/"
+	output, err := runObjectCommand(objectCommand(url, "ls", url))
+	if err != nil {
+		// gsutil fails to list a prefix without objects.
+		if strings.HasPrefix(url, "gs://") && strings.Contains(err.Error(), "matched no objects") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// "2026-10-15 08:00:00    1234 NAME" by aws, "gs://BUCKET/PREFIX/NAME" by gsutil.
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1 && strings.HasPrefix(fields[0], url) && !strings.HasSuffix(fields[0], "/"):
+			names = append(names, path.Base(fields[0]))
+		case len(fields) == 4:
+			names = append(names, fields[3])
+		}
+	}
+	return names, scanner.Err()
+}
+
+// removeObject removes the object url.
+func removeObject(url string) error {
+	_, err := runObjectCommand(objectCommand(url, "rm", url))
+	return err
+}
@@ -0,0 +1,161 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Actions taken when a command exceeds its max_output.
+const (
+	MaxOutputTruncate = "truncate" // Drop the rest of the output (default).
+	MaxOutputFile     = "file"     // Spill the rest of the output to a temporary file.
+	MaxOutputFail     = "fail"     // Interrupt the command and fail.
+)
+
+// ErrMaxOutput is returned when a command with on_max_output "fail"
+// exceeds its max_output.
+type ErrMaxOutput struct {
+	Max string
+}
+
+func (e ErrMaxOutput) Error() string {
+	return "output exceeded max_output of " + e.Max
+}
+
+// outputLimit bounds the output (STDOUT and STDERR together) of a command
+// on a single host, taking the command's on_max_output action once the
+// limit is exceeded.
+type outputLimit struct {
+	cmd      *Command
+	max      int64
+	onExceed func() // Called once, when the limit is exceeded.
+
+	mu       sync.Mutex
+	n        int64
+	exceeded bool
+	spill    *os.File
+	spillErr error
+}
+
+// newOutputLimit returns the output limit of cmd, or nil if cmd has no limit.
+func newOutputLimit(cmd *Command, onExceed func()) *outputLimit {
+	if cmd.MaxOutput == 0 {
+		return nil
+	}
+	return &outputLimit{cmd: cmd, max: int64(cmd.MaxOutput), onExceed: onExceed}
+}
+
+// Reader returns a reader limiting r. A nil *outputLimit returns r as is.
+func (l *outputLimit) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{limit: l, r: r}
+}
+
+// Exceeded reports whether the limit was exceeded.
+func (l *outputLimit) Exceeded() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+// Close closes the spill file, if any.
+func (l *outputLimit) Close() error {
+	if l == nil || l.spill == nil {
+		return nil
+	}
+	return l.spill.Close()
+}
+
+// consume accounts p read from the command's output. It returns the part
+// of p to be passed through, and a marker to be appended after it once
+// the limit is exceeded.
+func (l *outputLimit) consume(p []byte) (pass []byte, marker string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowed := l.max - l.n
+	if allowed < 0 {
+		allowed = 0
+	}
+	l.n += int64(len(p))
+	if int64(len(p)) <= allowed {
+		return p, ""
+	}
+	pass, rest := p[:allowed], p[allowed:]
+
+	first := !l.exceeded
+	l.exceeded = true
+	switch l.cmd.OnMaxOutput {
+	case MaxOutputFile:
+		if first {
+			l.spill, l.spillErr = ioutil.TempFile("", "sup-output-")
+			if l.spillErr == nil {
+				marker = fmt.Sprintf("[output exceeded %v, the rest is written to %v]\n", l.cmd.MaxOutput, l.spill.Name())
+			} else {
+				marker = fmt.Sprintf("[output truncated at %v: %v]\n", l.cmd.MaxOutput, errors.Wrap(l.spillErr, "creating spill file failed"))
+			}
+		}
+		if l.spillErr == nil {
+			l.spill.Write(rest)
+		}
+	case MaxOutputFail:
+		if first {
+			marker = fmt.Sprintf("[output exceeded %v, interrupting]\n", l.cmd.MaxOutput)
+			if l.onExceed != nil {
+				go l.onExceed()
+			}
+		}
+	default:
+		if first {
+			marker = fmt.Sprintf("[output truncated at %v]\n", l.cmd.MaxOutput)
+		}
+	}
+	return pass, marker
+}
+
+// limitedReader reads from r, passing through the output allowed by limit.
+// The output over the limit is still read, so the command doesn't block.
+type limitedReader struct {
+	limit   *outputLimit
+	r       io.Reader
+	pending []byte // Marker to be read next.
+	err     error  // Error of r, returned after the pending marker.
+	midLine bool   // The passed output doesn't end with a newline.
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	for {
+		if len(lr.pending) > 0 {
+			n := copy(p, lr.pending)
+			lr.pending = lr.pending[n:]
+			return n, nil
+		}
+		if lr.err != nil {
+			return 0, lr.err
+		}
+
+		n, err := lr.r.Read(p)
+		pass, marker := lr.limit.consume(p[:n])
+		if len(pass) > 0 {
+			lr.midLine = pass[len(pass)-1] != '\n'
+		}
+		if marker != "" && lr.midLine {
+			marker = "\n" + marker
+		}
+		lr.pending = append(lr.pending, marker...)
+		lr.err = err
+		if len(pass) > 0 {
+			return len(pass), nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package sup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Pause halts a run until the operator confirms it should go on, e.g. to
+// check the dashboards between the steps of a deploy: on the terminal,
+// or by approving the paused run in server mode, see Queue.Approve.
+type Pause struct {
+	Message string   `yaml:"message"` // Shown to the operator, e.g. "Check dashboards, then continue".
+	Timeout Duration `yaml:"timeout"` // Max time to wait for the operator, e.g. "30m", forever by default.
+	Default string   `yaml:"default"` // Action on timeout: "abort" (default) or "continue".
+}
+
+// Pause actions.
+const (
+	PauseAbort    = "abort"
+	PauseContinue = "continue"
+)
+
+// UnmarshalYAML accepts the message alone too, e.g.
+// `pause: "Check dashboards, then continue"`.
+func (p *Pause) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var message string
+	if err := unmarshal(&message); err == nil {
+		*p = Pause{Message: message}
+		return nil
+	}
+
+	type pause Pause // Prevent recursion.
+	return unmarshal((*pause)(p))
+}
+
+// ErrAborted is returned when the operator (or the timeout) aborts a run
+// at a pause.
+type ErrAborted struct {
+	Command string
+	Reason  string
+}
+
+func (e ErrAborted) Error() string {
+	return fmt.Sprintf("%v: run aborted %v", e.Command, e.Reason)
+}
+
+// pauser decides the pauses of a run instead of the terminal, e.g. the
+// approvals of a run of a Queue.
+type pauser interface {
+	// pause returns the channel receiving the decision of the pause of
+	// cmd, whether to continue, and done, called once decided.
+	pause(cmd *Command) (decision <-chan bool, done func())
+}
+
+type pauserKey struct{}
+
+// withPauser returns ctx making the runs decide their pauses by p.
+func withPauser(ctx context.Context, p pauser) context.Context {
+	return context.WithValue(ctx, pauserKey{}, p)
+}
+
+// pause halts the run at cmd until the operator continues it (see Pause),
+// returning ErrAborted if they abort it.
+func (sup *Stackup) pause(r *runState, cmd *Command) error {
+	p := cmd.Pause
+	fmt.Fprintf(os.Stderr, "%v: paused: %v\n", cmd.Name, p.Message)
+
+	var decision <-chan bool
+	if pauser, ok := r.ctx.Value(pauserKey{}).(pauser); ok {
+		var done func()
+		decision, done = pauser.pause(cmd)
+		defer done()
+		fmt.Fprintf(os.Stderr, "%v: waiting for the run to be approved\n", cmd.Name)
+	} else if r.controls != nil {
+		var done func()
+		decision, done = r.controls.ask()
+		defer done()
+		fmt.Fprintf(os.Stderr, "%v: continue? [y/n] ", cmd.Name)
+	} else if ch, err := askTerminal(cmd.Name + ": continue? [y/N] "); err == nil {
+		decision = ch
+	} else if p.Timeout == 0 {
+		return errors.Wrap(err, cmd.Name+": can't ask the operator to continue")
+	}
+
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(p.Timeout))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ok := <-decision:
+		if !ok {
+			return ErrAborted{cmd.Name, "by the operator"}
+		}
+		fmt.Fprintf(os.Stderr, "%v: continuing\n", cmd.Name)
+	case <-timeout:
+		if p.Default != PauseContinue {
+			return ErrAborted{cmd.Name, "after waiting for " + p.Timeout.String()}
+		}
+		fmt.Fprintf(os.Stderr, "%v: continuing after waiting for %v\n", cmd.Name, p.Timeout)
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	return nil
+}
+
+// askTerminal prompts the question on the terminal, returning the channel
+// receiving whether it was answered yes.
+func askTerminal(prompt string) (<-chan bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(tty, prompt)
+	answer := make(chan bool, 1)
+	go func() {
+		defer tty.Close()
+		line, _ := bufio.NewReader(tty).ReadString('\n')
+		line = strings.ToLower(strings.TrimSpace(line))
+		answer <- line == "y" || line == "yes"
+	}()
+	return answer, nil
+}
@@ -0,0 +1,297 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Plan is what a run would do, computed without connecting to the hosts:
+// the hosts, the env vars and, for every command, its hosts, batches and
+// uploads. Saved as JSON, it's executed as is by "sup apply", on the
+// planned hosts only, and only if its inputs didn't change since, see
+// Plan.Verify.
+type Plan struct {
+	Created     time.Time `json:"created"`
+	Dir         string    `json:"dir"` // Working directory, relative paths are resolved from.
+	Supfile     string    `json:"supfile"`
+	Environment string    `json:"environment,omitempty"`
+	Vars        []string  `json:"vars,omitempty"`     // Vars overridden by --var.
+	EnvArgs     []string  `json:"env_args,omitempty"` // Env vars set by -e.
+	Network     string    `json:"network"`
+	Args        []string  `json:"args"` // Targets and commands to run.
+
+	Hosts    []string      `json:"hosts"`
+	Env      []PlanEnvVar  `json:"env"` // Secrets are masked.
+	Commands []PlanCommand `json:"commands"`
+
+	Checksums PlanChecksums `json:"checksums"`
+}
+
+// PlanChecksums are the SHA-256 checksums of the inputs of a Plan.
+type PlanChecksums struct {
+	Supfile   string            `json:"supfile"`
+	Inventory string            `json:"inventory"`           // Hosts of the network, before --only and --except.
+	Artifacts map[string]string `json:"artifacts,omitempty"` // Uploaded paths and scripts.
+}
+
+// PlanEnvVar is an env var of a Plan.
+type PlanEnvVar struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PlanCommand is a command of a Plan.
+type PlanCommand struct {
+	Name    string       `json:"name"`
+	Target  string       `json:"target,omitempty"`
+	Local   string       `json:"local,omitempty"`
+	Script  string       `json:"script,omitempty"`
+	Run     string       `json:"run,omitempty"`
+	Pause   string       `json:"pause,omitempty"`  // Message of the pause, see Command.Pause.
+	Backup  string       `json:"backup,omitempty"` // Paths backed up and their destination, see Command.Backup.
+	Hosts   []string     `json:"hosts,omitempty"`
+	Batches [][]string   `json:"batches,omitempty"` // Hosts run at once, in order.
+	Uploads []PlanUpload `json:"uploads,omitempty"`
+}
+
+// PlanUpload is an upload of a PlanCommand.
+type PlanUpload struct {
+	Src   string `json:"src"`
+	Dst   string `json:"dst"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// NewPlan plans running the commands on the network. The invocation
+// (Supfile, vars, args etc.) is left to be filled in by the caller.
+func NewPlan(network *Network, env EnvList, commands ...*Command) (*Plan, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving CWD failed")
+	}
+
+	p := &Plan{
+		Created:   time.Now().UTC(),
+		Dir:       cwd,
+		Network:   network.Name,
+		Checksums: PlanChecksums{Artifacts: map[string]string{}},
+	}
+	for _, host := range network.Hosts {
+		p.Hosts = append(p.Hosts, host.Addr)
+	}
+	for _, v := range env {
+		value := v.Value
+		if isSecret(v) {
+			value = "****"
+		}
+		p.Env = append(p.Env, PlanEnvVar{v.Key, value})
+	}
+
+	for _, cmd := range commands {
+		pc := PlanCommand{
+			Name:   cmd.Name,
+			Target: cmd.Target,
+			Local:  cmd.Local,
+			Script: cmd.Script,
+			Run:    cmd.Run,
+		}
+		if cmd.Pause != nil {
+			pc.Pause = cmd.Pause.Message
+		}
+		if cmd.Backup != nil {
+			pc.Backup = strings.Join(cmd.Backup.Paths, " ") + " to " + cmd.Backup.Dest
+		}
+		if cmd.Script != "" {
+			data, err := ioutil.ReadFile(cmd.Script)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't read script")
+			}
+			p.Checksums.Artifacts[cmd.Script] = fmt.Sprintf("%x", sha256.Sum256(data))
+		}
+		if cmd.isRemote() {
+			for _, host := range network.Hosts {
+				if cmd.MatchHost(host) {
+					pc.Hosts = append(pc.Hosts, host.Addr)
+				}
+			}
+			for _, b := range cmd.batchRanges(len(pc.Hosts)) {
+				pc.Batches = append(pc.Batches, pc.Hosts[b[0]:b[1]])
+			}
+		}
+		for _, upload := range cmd.Upload {
+			pu := PlanUpload{Src: upload.Src, Dst: upload.Dst}
+			sum := sha256.New()
+			var readErr error
+			walkUpload(cwd, upload.Src, upload.Exc, func(file string, info os.FileInfo) {
+				rel, _ := filepath.Rel(cwd, file)
+				fmt.Fprintf(sum, "%v %v\n", rel, info.Mode())
+				if !info.Mode().IsRegular() || readErr != nil {
+					return
+				}
+				pu.Files++
+				pu.Bytes += info.Size()
+				f, err := os.Open(file)
+				if err != nil {
+					readErr = err
+					return
+				}
+				defer f.Close()
+				_, readErr = io.Copy(sum, f)
+			})
+			if readErr != nil {
+				return nil, errors.Wrapf(readErr, "upload %v", upload.Src)
+			}
+			p.Checksums.Artifacts[upload.Src] = fmt.Sprintf("%x", sum.Sum(nil))
+			pc.Uploads = append(pc.Uploads, pu)
+		}
+		p.Commands = append(p.Commands, pc)
+	}
+	return p, nil
+}
+
+// Write writes the plan in a human readable form.
+func (p *Plan) Write(w io.Writer) {
+	fmt.Fprintf(w, "Plan: %v on %v (%v hosts)\n", strings.Join(p.Args, " "), p.Network, len(p.Hosts))
+	for _, host := range p.Hosts {
+		fmt.Fprintf(w, "  - %v\n", host)
+	}
+	fmt.Fprintln(w, "Env:")
+	for _, v := range p.Env {
+		fmt.Fprintf(w, "  %v=%v\n", v.Key, v.Value)
+	}
+
+	for i, cmd := range p.Commands {
+		fmt.Fprintf(w, "\n%v. %v", i+1, cmd.Name)
+		if cmd.Target != "" {
+			fmt.Fprintf(w, " (target %v)", cmd.Target)
+		}
+		fmt.Fprintln(w)
+		if len(cmd.Batches) > 1 {
+			fmt.Fprintf(w, "  Hosts: %v in %v batches\n", len(cmd.Hosts), len(cmd.Batches))
+			for j, batch := range cmd.Batches {
+				fmt.Fprintf(w, "    %v: %v\n", j+1, strings.Join(batch, ", "))
+			}
+		} else if len(cmd.Batches) == 1 {
+			fmt.Fprintf(w, "  Hosts: %v\n", strings.Join(cmd.Batches[0], ", "))
+		}
+		for _, upload := range cmd.Uploads {
+			fmt.Fprintf(w, "  Upload: %v -> %v (%v files, %v)\n", upload.Src, upload.Dst, upload.Files, formatSize(upload.Bytes))
+		}
+		if cmd.Local != "" {
+			fmt.Fprintf(w, "  Local:\n%v", indent(cmd.Local))
+		}
+		if cmd.Script != "" {
+			fmt.Fprintf(w, "  Script: %v\n", cmd.Script)
+		}
+		if cmd.Run != "" {
+			fmt.Fprintf(w, "  Run:\n%v", indent(cmd.Run))
+		}
+		if cmd.Pause != "" {
+			fmt.Fprintf(w, "  Pause: %v\n", cmd.Pause)
+		}
+		if cmd.Backup != "" {
+			fmt.Fprintf(w, "  Backup: %v\n", cmd.Backup)
+		}
+	}
+}
+
+// WriteFile writes the plan to path, encoded as JSON.
+func (p *Plan) WriteFile(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ReadPlan reads a plan written by Plan.WriteFile.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrapf(err, "%v: invalid plan", path)
+	}
+	return p, nil
+}
+
+// Checksum sets the checksums of the Supfile and of the inventory, i.e.
+// the hosts of the network before --only and --except.
+func (p *Plan) Checksum(supfile string, inventory []Host) error {
+	data, err := ioutil.ReadFile(supfile)
+	if err != nil {
+		return err
+	}
+	p.Checksums.Supfile = fmt.Sprintf("%x", sha256.Sum256(data))
+	sum := sha256.New()
+	for _, host := range inventory {
+		fmt.Fprintln(sum, host.Addr)
+	}
+	p.Checksums.Inventory = fmt.Sprintf("%x", sum.Sum(nil))
+	return nil
+}
+
+// Verify makes sure the inputs of the plan didn't change, by the current
+// plan of the same run: the Supfile, the inventory and the artifacts.
+func (p *Plan) Verify(current *Plan) error {
+	if p.Checksums.Supfile != current.Checksums.Supfile {
+		return ErrPlanChanged{"the Supfile"}
+	}
+	if p.Checksums.Inventory != current.Checksums.Inventory {
+		return ErrPlanChanged{"the inventory of network " + p.Network}
+	}
+	var artifacts []string
+	for artifact := range p.Checksums.Artifacts {
+		artifacts = append(artifacts, artifact)
+	}
+	sort.Strings(artifacts)
+	for _, artifact := range artifacts {
+		if p.Checksums.Artifacts[artifact] != current.Checksums.Artifacts[artifact] {
+			return ErrPlanChanged{artifact}
+		}
+	}
+	return nil
+}
+
+// ErrPlanChanged is returned when the inputs of a plan changed
+// since it was planned.
+type ErrPlanChanged struct {
+	What string
+}
+
+func (e ErrPlanChanged) Error() string {
+	return fmt.Sprintf("%v changed since the plan was made, plan again", e.What)
+}
+
+// PinHosts restricts the hosts of network to the planned ones. It fails
+// if any of them isn't in the network anymore.
+func (p *Plan) PinHosts(network *Network) error {
+	var hosts []Host
+	for _, addr := range p.Hosts {
+		found := false
+		for _, host := range network.Hosts {
+			if host.Addr == addr {
+				hosts = append(hosts, host)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("planned host %v isn't in network %v anymore", addr, network.Name)
+		}
+	}
+	network.Hosts = hosts
+	return nil
+}
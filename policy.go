@@ -0,0 +1,207 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Policy evaluates organization-wide rules written in Rego by OPA (Open
+// Policy Agent) against every run, e.g. "no prod deploys on Fridays": the
+// rules of Query get the run as input (see PolicyInput), and their "deny"
+// and "require_approval" sets of messages deny the run, or make it wait
+// for approval on a sup server. The rules are evaluated by the opa CLI
+// from local Files, or by an OPA server at URL, so they can be managed
+// centrally.
+//
+//	package sup
+//
+//	deny[msg] {
+//	    input.network == "production"
+//	    input.weekday == "Friday"
+//	    msg := "no production deploys on Fridays"
+//	}
+type Policy struct {
+	Files []string `yaml:"files"` // Rego files (or directories) evaluated by "opa eval".
+	URL   string   `yaml:"url"`   // Data API of the rules on an OPA server instead, e.g. "http://opa:8181/v1/data/sup".
+	Query string   `yaml:"query"` // Rules of the files, "data.sup" by default.
+}
+
+// PolicyInput is the input of the policy rules: the run, resolved.
+type PolicyInput struct {
+	Network  string       `json:"network"`
+	Hosts    []PolicyHost `json:"hosts"`
+	Commands []string     `json:"commands"`
+	Targets  []string     `json:"targets"` // Targets the commands were invoked by, if any.
+	User     string       `json:"user"`
+	Time     string       `json:"time"`    // Local time of the run, RFC3339.
+	Weekday  string       `json:"weekday"` // Day of the week of Time, e.g. "Friday".
+	Hour     int          `json:"hour"`    // Hour of Time, 0-23.
+}
+
+// PolicyHost is a host of a PolicyInput.
+type PolicyHost struct {
+	Host  string            `json:"host"`
+	Roles []string          `json:"roles,omitempty"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+// PolicyDecision is the decision of the policy rules about a run.
+type PolicyDecision struct {
+	Deny            []string // Reasons to deny the run, if any.
+	RequireApproval []string // Reasons the run requires approval, if any.
+}
+
+// ErrPolicyDenied is returned for the runs denied by the policy.
+type ErrPolicyDenied struct {
+	Network string
+	Reasons []string
+}
+
+func (e ErrPolicyDenied) Error() string {
+	return fmt.Sprintf("run on network %v denied by policy: %v", e.Network, strings.Join(e.Reasons, "; "))
+}
+
+// ErrPolicyApproval is returned for the runs the policy requires approval
+// of, unless they're submitted to a sup server.
+type ErrPolicyApproval struct {
+	Network string
+	Reasons []string
+}
+
+func (e ErrPolicyApproval) Error() string {
+	return fmt.Sprintf("run on network %v requires approval by policy: %v\n\nSubmit it to a sup server to be approved", e.Network, strings.Join(e.Reasons, "; "))
+}
+
+// CheckPolicy evaluates the policy of the Supfile against the run of
+// commands on network by user at t. It returns an empty decision if the
+// Supfile has no policy.
+func (conf *Supfile) CheckPolicy(user string, network *Network, commands []*Command, t time.Time) (PolicyDecision, error) {
+	if conf.Policy == nil {
+		return PolicyDecision{}, nil
+	}
+
+	input := PolicyInput{
+		Network: network.Name,
+		User:    user,
+		Time:    t.Format(time.RFC3339),
+		Weekday: t.Weekday().String(),
+		Hour:    t.Hour(),
+	}
+	for _, host := range network.Hosts {
+		input.Hosts = append(input.Hosts, PolicyHost{host.Addr, host.Roles, host.Meta})
+	}
+	seen := map[string]bool{}
+	for _, cmd := range commands {
+		input.Commands = append(input.Commands, cmd.Name)
+		if cmd.Target != "" && !seen[cmd.Target] {
+			seen[cmd.Target] = true
+			input.Targets = append(input.Targets, cmd.Target)
+		}
+	}
+
+	result, err := conf.Policy.eval(input)
+	if err != nil {
+		return PolicyDecision{}, errors.Wrap(err, "evaluating policy failed")
+	}
+	return PolicyDecision{
+		Deny:            policyMessages(result["deny"], "denied by policy"),
+		RequireApproval: policyMessages(result["require_approval"], "approval required by policy"),
+	}, nil
+}
+
+// Err returns the error of the decision about the run on network, if
+// it's denied, or requires approval unless approvable.
+func (d PolicyDecision) Err(network string, approvable bool) error {
+	if len(d.Deny) > 0 {
+		return ErrPolicyDenied{network, d.Deny}
+	}
+	if len(d.RequireApproval) > 0 && !approvable {
+		return ErrPolicyApproval{network, d.RequireApproval}
+	}
+	return nil
+}
+
+// eval evaluates the rules of p with input, returning their values.
+func (p *Policy) eval(input PolicyInput) (map[string]interface{}, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.URL != "" {
+		body, err := json.Marshal(map[string]json.RawMessage{"input": data})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		var response struct {
+			Result map[string]interface{} `json:"result"`
+		}
+		if err := discoveryRequest(req, &response); err != nil {
+			return nil, errors.Wrap(err, "OPA server")
+		}
+		return response.Result, nil
+	}
+
+	query := p.Query
+	if query == "" {
+		query = "data.sup"
+	}
+	args := []string{"eval", "--format", "json", "--stdin-input"}
+	for _, file := range p.Files {
+		args = append(args, "--data", expandTilde(file))
+	}
+	cmd := exec.Command("opa", append(args, query)...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "opa eval: "+strings.TrimSpace(stderr.String()))
+	}
+	var response struct {
+		Result []struct {
+			Expressions []struct {
+				Value map[string]interface{} `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return nil, errors.Wrap(err, "parsing opa eval output failed")
+	}
+	if len(response.Result) == 0 || len(response.Result[0].Expressions) == 0 {
+		return nil, nil // The rules are undefined.
+	}
+	return response.Result[0].Expressions[0].Value, nil
+}
+
+// policyMessages returns the messages of the value of a rule: a set (or
+// array) of messages, a message, or true for the default message.
+func policyMessages(value interface{}, message string) []string {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return []string{message}
+		}
+	case string:
+		return []string{value}
+	case []interface{}:
+		var messages []string
+		for _, v := range value {
+			messages = append(messages, fmt.Sprint(v))
+		}
+		return messages
+	}
+	return nil
+}
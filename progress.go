@@ -0,0 +1,145 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress of uploads
+// is shown on the terminal.
+const progressInterval = time.Second
+
+// uploadProgress tracks an upload task streaming to its clients.
+type uploadProgress struct {
+	upload  *Upload
+	stream  *uploadStream
+	started time.Time
+	hosts   map[Client]*hostUpload
+	order   []*hostUpload
+}
+
+// hostUpload writes an upload to a single host, counting the bytes written.
+// It starts by the offset the host resumes the upload from and skips
+// the bytes the host already has, see remoteUploadCommand.
+type hostUpload struct {
+	w        io.Writer
+	stream   *uploadStream
+	host     string
+	prefix   string
+	offset   int64
+	started  bool
+	skip     int64
+	sent     int64 // Compressed bytes written to the host, accessed atomically.
+	archived int64 // Bytes archived when last written to the host, accessed atomically.
+	done     int32 // Set once finished, accessed atomically.
+}
+
+func (h *hostUpload) Write(p []byte) (int, error) {
+	if !h.started {
+		if _, err := fmt.Fprintf(h.w, "%d\n", h.offset); err != nil {
+			return 0, err
+		}
+		h.started, h.skip = true, h.offset
+	}
+	if h.skip >= int64(len(p)) {
+		h.skip -= int64(len(p))
+		return len(p), nil
+	}
+	skipped := int(h.skip)
+	h.skip = 0
+
+	n, err := h.w.Write(p[skipped:])
+	atomic.AddInt64(&h.sent, int64(n))
+	archived, _ := h.stream.progress()
+	atomic.StoreInt64(&h.archived, archived)
+	return skipped + n, err
+}
+
+func newUploadProgress(upload *Upload, stream *uploadStream) *uploadProgress {
+	return &uploadProgress{
+		upload:  upload,
+		stream:  stream,
+		started: time.Now(),
+		hosts:   map[Client]*hostUpload{},
+	}
+}
+
+// writer returns the STDIN of c, resuming the upload from offset.
+func (p *uploadProgress) writer(c Client, host, prefix string, offset int64) io.Writer {
+	if offset > 0 {
+		fmt.Fprintf(stderrWriter, "%sresuming upload %v after %v\n", prefix, p.upload.Src, formatSize(offset))
+	}
+	h := &hostUpload{w: c.Stdin(), stream: p.stream, host: host, prefix: prefix, offset: offset}
+	p.hosts[c] = h
+	p.order = append(p.order, h)
+	return h
+}
+
+// show prints the progress of the unfinished hosts to the terminal
+// periodically, until stop is closed. It prints nothing if STDERR is
+// not a terminal.
+func (p *uploadProgress) show(stop <-chan struct{}) {
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, h := range p.order {
+				if atomic.LoadInt32(&h.done) == 0 {
+					fmt.Fprint(stderrWriter, p.line(h, false))
+				}
+			}
+		}
+	}
+}
+
+// finish prints the final stats of the upload to c and records them
+// in report.
+func (p *uploadProgress) finish(c Client, report *RunReport, ok bool) {
+	h := p.hosts[c]
+	atomic.StoreInt32(&h.done, 1)
+	fmt.Fprint(stderrWriter, p.line(h, ok))
+	report.addTransfer(h.host, TransferStats{
+		Src:      p.upload.Src,
+		Dst:      p.upload.Dst,
+		Bytes:    atomic.LoadInt64(&h.sent),
+		Duration: time.Since(p.started),
+	})
+}
+
+// line formats the progress of an upload to a single host, e.g.
+// "host | upload ./dist: 45%, 12.3 MB sent, 3.1 MB/s".
+func (p *uploadProgress) line(h *hostUpload, done bool) string {
+	sent := atomic.LoadInt64(&h.sent)
+	percent := 100
+	if !done {
+		archived, size := atomic.LoadInt64(&h.archived), p.stream.size
+		percent = int(archived * 100 / size)
+		if percent > 99 {
+			percent = 99
+		}
+	}
+	rate := float64(sent) / time.Since(p.started).Seconds()
+	return fmt.Sprintf("%supload %v: %d%%, %v sent, %v/s\n", h.prefix, p.upload.Src, percent, formatSize(sent), formatSize(int64(rate)))
+}
+
+// formatSize formats a number of bytes in units of 1024, like parseSize parses.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
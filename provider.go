@@ -0,0 +1,327 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProviderHosts resolves the hosts of the local VMs managed by the network's
+// provider: "vagrant" (see `vagrant ssh-config`) or "multipass". The hosts
+// have the name of their VM as a role and as their "Name" metadata.
+// Networks on EC2 or managed by Terraform resolve the hosts of their
+// instances instead, see EC2Provider and TerraformProvider, and networks
+// discovered by Consul or etcd the hosts registered there, see
+// ConsulDiscovery and EtcdDiscovery.
+func (n Network) ProviderHosts() ([]Host, error) {
+	if n.AWS != nil {
+		return n.AWS.hosts()
+	}
+	if n.Terraform != nil {
+		return n.Terraform.hosts()
+	}
+	if n.Consul != nil {
+		return n.Consul.hosts()
+	}
+	if n.Etcd != nil {
+		return n.Etcd.hosts()
+	}
+	switch n.Provider {
+	case "":
+		return nil, nil
+	case "vagrant":
+		return vagrantHosts()
+	case "multipass":
+		return multipassHosts()
+	default:
+		return nil, fmt.Errorf("unsupported provider %q", n.Provider)
+	}
+}
+
+// vagrantHosts parses the output of `vagrant ssh-config`.
+func vagrantHosts() ([]Host, error) {
+	cmd := exec.Command("vagrant", "ssh-config")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "vagrant ssh-config failed")
+	}
+
+	var hosts []Host
+	var name, hostname, user, port, identityFile string
+	flush := func() {
+		if name == "" || hostname == "" {
+			return
+		}
+		addr := hostname
+		if user != "" {
+			addr = user + "@" + addr
+		}
+		if port != "" {
+			addr += ":" + port
+		}
+		hosts = append(hosts, Host{Addr: addr, Roles: []string{name}, IdentityFile: identityFile, Meta: map[string]string{"Name": name}})
+		name, hostname, user, port, identityFile = "", "", "", "", ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value := strings.Trim(strings.Join(fields[1:], " "), `"`)
+		switch fields[0] {
+		case "Host":
+			flush()
+			name = value
+		case "HostName":
+			hostname = value
+		case "User":
+			user = value
+		case "Port":
+			port = value
+		case "IdentityFile":
+			if identityFile == "" {
+				identityFile = value
+			}
+		}
+	}
+	flush()
+	return hosts, scanner.Err()
+}
+
+// multipassKeys are the paths of the SSH key of multipass instances.
+var multipassKeys = []string{
+	"/var/snap/multipass/common/data/multipassd/ssh-keys/id_rsa",
+	"/var/root/Library/Application Support/multipassd/ssh-keys/id_rsa",
+	`C:\ProgramData\Multipass\data\ssh-keys\id_rsa`,
+}
+
+// multipassHosts lists the running multipass instances.
+func multipassHosts() ([]Host, error) {
+	cmd := exec.Command("multipass", "list", "--format", "json")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "multipass list failed")
+	}
+
+	var list struct {
+		List []struct {
+			Name    string   `json:"name"`
+			State   string   `json:"state"`
+			IPv4    []string `json:"ipv4"`
+			Release string   `json:"release"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, errors.Wrap(err, "parsing multipass list failed")
+	}
+
+	identityFile := os.Getenv("MULTIPASS_SSH_KEY")
+	for _, key := range multipassKeys {
+		if identityFile != "" {
+			break
+		}
+		if _, err := os.Stat(key); err == nil {
+			identityFile = key
+		}
+	}
+
+	var hosts []Host
+	for _, vm := range list.List {
+		if vm.State != "Running" || len(vm.IPv4) == 0 {
+			continue
+		}
+		meta := map[string]string{"Name": vm.Name, "Release": vm.Release}
+		hosts = append(hosts, Host{Addr: "ubuntu@" + vm.IPv4[0], Roles: []string{vm.Name}, IdentityFile: identityFile, Meta: meta})
+	}
+	return hosts, nil
+}
+
+// EC2Provider resolves the hosts of a network from the running EC2
+// instances matching its tags, by the aws CLI and its default credential
+// chain, so the hosts of autoscaled fleets are never stale. The hosts have
+// the tags of their instance as metadata, and its ID, AZ and Type; the
+// Name tag is their role too.
+type EC2Provider struct {
+	Region  string            `yaml:"region"`  // Region of the instances, defaults to the aws CLI's one.
+	Tags    map[string]string `yaml:"tags"`    // Tags of the instances, e.g. {Role: web}; values may hold "*" wildcards.
+	Address string            `yaml:"address"` // Address of the hosts: "private" (default) or "public" IP.
+	User    string            `yaml:"user"`    // SSH user of the hosts, if not the default one.
+}
+
+// EC2 addresses.
+const (
+	EC2Private = "private"
+	EC2Public  = "public"
+)
+
+// hosts lists the running instances matching the tags of p.
+func (p *EC2Provider) hosts() ([]Host, error) {
+	type filter struct {
+		Name   string
+		Values []string
+	}
+	filters := []filter{{"instance-state-name", []string{"running"}}}
+	for key, value := range p.Tags {
+		filters = append(filters, filter{"tag:" + key, []string{value}})
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Name < filters[j].Name })
+	data, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"ec2", "describe-instances", "--filters", string(data), "--output", "json"}
+	if p.Region != "" {
+		args = append(args, "--region", p.Region)
+	}
+	cmd := exec.Command("aws", args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "aws ec2 describe-instances failed")
+	}
+
+	var result struct {
+		Reservations []struct {
+			Instances []struct {
+				InstanceId       string
+				InstanceType     string
+				PrivateIpAddress string
+				PublicIpAddress  string
+				Placement        struct{ AvailabilityZone string }
+				Tags             []struct{ Key, Value string }
+			}
+		}
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, errors.Wrap(err, "parsing aws ec2 describe-instances failed")
+	}
+
+	address := p.Address
+	if address == "" {
+		address = EC2Private
+	}
+	var hosts []Host
+	for _, reservation := range result.Reservations {
+		for _, vm := range reservation.Instances {
+			addr := vm.PrivateIpAddress
+			if address == EC2Public {
+				addr = vm.PublicIpAddress
+			}
+			if addr == "" {
+				fmt.Fprintf(os.Stderr, "Warning: EC2 instance %v has no %v IP, skipping it\n", vm.InstanceId, address)
+				continue
+			}
+			if p.User != "" {
+				addr = p.User + "@" + addr
+			}
+
+			host := Host{Addr: addr, Meta: map[string]string{}}
+			for _, tag := range vm.Tags {
+				host.Meta[tag.Key] = tag.Value
+			}
+			host.Meta["ID"] = vm.InstanceId
+			host.Meta["AZ"] = vm.Placement.AvailabilityZone
+			host.Meta["Type"] = vm.InstanceType
+			if name := host.Meta["Name"]; name != "" {
+				host.Roles = []string{name}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	// The instances are listed in no particular order.
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Meta["ID"] < hosts[j].Meta["ID"] })
+	return hosts, nil
+}
+
+// TerraformProvider resolves the hosts of a network from an output of the
+// Terraform configuration managing them, so their addresses aren't copied
+// into the Supfile. The output holds an address, a list of them, or a map
+// of them by name; the names are the "Name" metadata and a role of their
+// hosts.
+type TerraformProvider struct {
+	Output string `yaml:"output"` // Name of the output holding the hosts, e.g. "web_ips".
+	Dir    string `yaml:"dir"`    // Directory "terraform output" runs in, defaults to the current one.
+	State  string `yaml:"state"`  // Local state file to read the output from instead, without terraform.
+	User   string `yaml:"user"`   // SSH user of the hosts, if not the default one.
+}
+
+// hosts reads the hosts of the output of p.
+func (p *TerraformProvider) hosts() ([]Host, error) {
+	var value json.RawMessage
+	if p.State != "" {
+		data, err := ioutil.ReadFile(expandTilde(p.State))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading terraform state failed")
+		}
+		var state struct {
+			Outputs map[string]struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"outputs"`
+		}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, errors.Wrap(err, "parsing terraform state failed")
+		}
+		output, ok := state.Outputs[p.Output]
+		if !ok {
+			return nil, fmt.Errorf("terraform state %v has no output %q", p.State, p.Output)
+		}
+		value = output.Value
+	} else {
+		cmd := exec.Command("terraform", "output", "-json", p.Output)
+		cmd.Dir = p.Dir
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Wrap(err, "terraform output failed")
+		}
+		value = output
+	}
+
+	host := func(addr string) Host {
+		if p.User != "" {
+			addr = p.User + "@" + addr
+		}
+		return Host{Addr: addr}
+	}
+	var addr string
+	var addrs []string
+	var named map[string]string
+	switch {
+	case json.Unmarshal(value, &addr) == nil:
+		return []Host{host(addr)}, nil
+	case json.Unmarshal(value, &addrs) == nil:
+		var hosts []Host
+		for _, addr := range addrs {
+			hosts = append(hosts, host(addr))
+		}
+		return hosts, nil
+	case json.Unmarshal(value, &named) == nil:
+		var names []string
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var hosts []Host
+		for _, name := range names {
+			h := host(named[name])
+			h.Roles = []string{name}
+			h.Meta = map[string]string{"Name": name}
+			hosts = append(hosts, h)
+		}
+		return hosts, nil
+	}
+	return nil, fmt.Errorf("terraform output %q is neither an address, a list nor a map of them", p.Output)
+}
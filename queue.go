@@ -0,0 +1,363 @@
+package sup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Statuses of the runs of a Queue.
+const (
+	RunPending  = "pending"  // Waiting for approval, see Target.RequiresApproval and Policy.
+	RunQueued   = "queued"   // Waiting for the previous runs against the network.
+	RunRunning  = "running"  // Being run.
+	RunPaused   = "paused"   // Running, waiting for approval at a pause, see Command.Pause.
+	RunDone     = "done"     // Finished successfully.
+	RunFailed   = "failed"   // Finished with an error.
+	RunCanceled = "canceled" // Canceled (or rejected) while pending, queued or running.
+)
+
+// maxFinishedRuns is the number of finished runs a Queue remembers.
+const maxFinishedRuns = 100
+
+// QueuedRun describes a run submitted to a Queue.
+type QueuedRun struct {
+	ID       string    `json:"id"`
+	Network  string    `json:"network"`
+	Commands []string  `json:"commands"`
+	User     string    `json:"user"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Approver string    `json:"approver,omitempty"` // User who approved the run, if it required approval.
+	Approval string    `json:"approval,omitempty"` // Why the policy requires approval of the run, if it does.
+	Pause    string    `json:"pause,omitempty"`    // Message of the pause the run is waiting at, if paused.
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// ErrUnknownRun is returned for IDs of runs a Queue doesn't know.
+type ErrUnknownRun struct {
+	ID string
+}
+
+func (e ErrUnknownRun) Error() string {
+	return fmt.Sprintf("unknown run %v", e.ID)
+}
+
+// ErrSelfApproval is returned when users try to approve their own runs.
+type ErrSelfApproval struct {
+	ID   string
+	User string
+}
+
+func (e ErrSelfApproval) Error() string {
+	return fmt.Sprintf("run %v must be approved by another user than %v", e.ID, e.User)
+}
+
+type queuedRun struct {
+	QueuedRun
+
+	network  *Network
+	env      EnvList
+	commands []*Command
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	decision chan bool // Receives the decision of the pause, if paused.
+}
+
+// Queue runs commands by a Stackup in a long-lived process. Runs against
+// the same network are serialized in the order they were submitted,
+// while runs against different networks proceed concurrently.
+type Queue struct {
+	app *Stackup
+
+	mu   sync.Mutex
+	runs []*queuedRun
+	busy map[string]bool // Networks being run against.
+	seq  int
+}
+
+// NewQueue returns an empty Queue running commands by app.
+func NewQueue(app *Stackup) *Queue {
+	return &Queue{app: app, busy: map[string]bool{}}
+}
+
+// Submit queues a run of commands against network on behalf of user.
+// Runs of targets requiring approval are pending until approved.
+func (q *Queue) Submit(user string, network *Network, envVars EnvList, commands ...*Command) QueuedRun {
+	return q.submit(user, "", network, envVars, commands)
+}
+
+// SubmitForApproval is like Submit, but the run is pending until approved
+// anyway, e.g. because the policy requires approval of it, for reason.
+func (q *Queue) SubmitForApproval(user, reason string, network *Network, envVars EnvList, commands ...*Command) QueuedRun {
+	return q.submit(user, reason, network, envVars, commands)
+}
+
+func (q *Queue) submit(user, approval string, network *Network, envVars EnvList, commands []*Command) QueuedRun {
+	var names []string
+	status := RunQueued
+	if approval != "" {
+		status = RunPending
+	}
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+		if target, _ := q.app.conf.Targets.Get(cmd.Target); target.RequiresApproval {
+			status = RunPending
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	run := &queuedRun{
+		QueuedRun: QueuedRun{
+			ID:       strconv.Itoa(q.seq),
+			Network:  network.Name,
+			Commands: names,
+			User:     user,
+			Status:   status,
+			Approval: approval,
+			Queued:   time.Now(),
+		},
+		network:  network,
+		env:      envVars,
+		commands: commands,
+		done:     make(chan struct{}),
+	}
+	run.ctx, run.cancel = context.WithCancel(context.Background())
+	q.runs = append(q.runs, run)
+	q.schedule()
+	return run.QueuedRun
+}
+
+// Runs returns the pending, queued, running and recently finished runs,
+// in the order they were submitted.
+func (q *Queue) Runs() []QueuedRun {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	runs := make([]QueuedRun, 0, len(q.runs))
+	for _, run := range q.runs {
+		runs = append(runs, run.QueuedRun)
+	}
+	return runs
+}
+
+// Run returns the run with the given ID.
+func (q *Queue) Run(id string) (QueuedRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	run, err := q.find(id)
+	if err != nil {
+		return QueuedRun{}, err
+	}
+	return run.QueuedRun, nil
+}
+
+// Wait waits for the run with the given ID to finish.
+func (q *Queue) Wait(id string) (QueuedRun, error) {
+	q.mu.Lock()
+	run, err := q.find(id)
+	q.mu.Unlock()
+	if err != nil {
+		return QueuedRun{}, err
+	}
+
+	<-run.done
+	return q.Run(id)
+}
+
+// Approve approves a pending run on behalf of user, who must not be
+// the user who submitted it, and queues it. Both are expected to be
+// authenticated alike, see Auth. Paused runs are continued, whoever
+// approves them. If auth isn't nil, it must allow the run, so users can't
+// approve runs they aren't allowed to run themselves.
+func (q *Queue) Approve(id, user string, auth Authorizer) (QueuedRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	run, err := q.authorize(id, auth)
+	if err != nil {
+		return QueuedRun{}, err
+	}
+	if run.Status == RunPaused {
+		run.decide(true)
+		return run.QueuedRun, nil
+	}
+	if run.Status != RunPending {
+		return run.QueuedRun, fmt.Errorf("run %v is %v, not pending approval", id, run.Status)
+	}
+	if user == run.User {
+		return run.QueuedRun, ErrSelfApproval{ID: id, User: user}
+	}
+	run.Status, run.Approver = RunQueued, user
+	q.schedule()
+	return run.QueuedRun, nil
+}
+
+// Reject rejects a pending run, canceling it, or aborts a paused one.
+// If auth isn't nil, it must allow the run, see Approve.
+func (q *Queue) Reject(id string, auth Authorizer) (QueuedRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	run, err := q.authorize(id, auth)
+	if err != nil {
+		return QueuedRun{}, err
+	}
+	if run.Status == RunPaused {
+		run.decide(false)
+		return run.QueuedRun, nil
+	}
+	if run.Status != RunPending {
+		return run.QueuedRun, fmt.Errorf("run %v is %v, not pending approval", id, run.Status)
+	}
+	run.Status, run.Finished = RunCanceled, time.Now()
+	close(run.done)
+	run.cancel()
+	return run.QueuedRun, nil
+}
+
+// Cancel cancels a pending or queued run, or interrupts a running one.
+// If auth isn't nil, it must allow the run, see Approve.
+func (q *Queue) Cancel(id string, auth Authorizer) (QueuedRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	run, err := q.authorize(id, auth)
+	if err != nil {
+		return QueuedRun{}, err
+	}
+	switch run.Status {
+	case RunPending, RunQueued:
+		run.Status, run.Finished = RunCanceled, time.Now()
+		close(run.done)
+	case RunRunning, RunPaused:
+	default:
+		return run.QueuedRun, fmt.Errorf("run %v already %v", id, run.Status)
+	}
+	run.cancel()
+	return run.QueuedRun, nil
+}
+
+func (run *queuedRun) finished() bool {
+	return run.Status != RunPending && run.Status != RunQueued && run.Status != RunRunning && run.Status != RunPaused
+}
+
+// decide decides the pause the run is waiting at.
+// It must be called with q.mu held.
+func (run *queuedRun) decide(ok bool) {
+	select {
+	case run.decision <- ok:
+	default:
+	}
+	run.Status, run.Pause, run.decision = RunRunning, "", nil
+}
+
+// queuePauser makes the pauses of a run of a Queue wait for the run
+// to be approved, see Queue.Approve.
+type queuePauser struct {
+	q   *Queue
+	run *queuedRun
+}
+
+func (p queuePauser) pause(cmd *Command) (<-chan bool, func()) {
+	p.q.mu.Lock()
+	defer p.q.mu.Unlock()
+	decision := make(chan bool, 1)
+	p.run.Status, p.run.Pause, p.run.decision = RunPaused, cmd.Pause.Message, decision
+	return decision, func() {
+		p.q.mu.Lock()
+		defer p.q.mu.Unlock()
+		if p.run.decision == decision {
+			p.run.Status, p.run.Pause, p.run.decision = RunRunning, "", nil
+		}
+	}
+}
+
+// authorize returns the run with the given ID if auth, unless nil,
+// allows it. It must be called with q.mu held.
+func (q *Queue) authorize(id string, auth Authorizer) (*queuedRun, error) {
+	run, err := q.find(id)
+	if err != nil || auth == nil {
+		return run, err
+	}
+	if err := auth.Authorize(run.network, run.commands); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func (q *Queue) find(id string) (*queuedRun, error) {
+	for _, run := range q.runs {
+		if run.ID == id {
+			return run, nil
+		}
+	}
+	return nil, ErrUnknownRun{ID: id}
+}
+
+// schedule starts the oldest queued run of every idle network.
+// It must be called with q.mu held.
+func (q *Queue) schedule() {
+	for _, run := range q.runs {
+		if run.Status != RunQueued || q.busy[run.Network] {
+			continue
+		}
+		q.busy[run.Network] = true
+		run.Status, run.Started = RunRunning, time.Now()
+		go q.execute(run)
+	}
+}
+
+func (q *Queue) execute(run *queuedRun) {
+	ctx := withPauser(run.ctx, queuePauser{q, run})
+	err := q.app.RunContext(ctx, run.network, run.env, run.commands...)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	run.Finished = time.Now()
+	switch {
+	case run.ctx.Err() != nil:
+		run.Status = RunCanceled
+	case err != nil:
+		run.Status, run.Error = RunFailed, err.Error()
+	default:
+		run.Status = RunDone
+	}
+	run.cancel()
+	close(run.done)
+	delete(q.busy, run.Network)
+
+	q.prune()
+	q.schedule()
+}
+
+// prune forgets the oldest finished runs over maxFinishedRuns.
+// It must be called with q.mu held.
+func (q *Queue) prune() {
+	finished := 0
+	for _, run := range q.runs {
+		if run.finished() {
+			finished++
+		}
+	}
+
+	runs := q.runs[:0]
+	for _, run := range q.runs {
+		if finished > maxFinishedRuns && run.finished() {
+			finished--
+			continue
+		}
+		runs = append(runs, run)
+	}
+	q.runs = runs
+}
@@ -0,0 +1,189 @@
+package sup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fanyang01/sup/suptest"
+)
+
+// queueTest is a Queue running a "deploy" command on a simulated host,
+// submitted by alice. The access rules allow alice and carol, not bob.
+type queueTest struct {
+	conf    *Supfile
+	queue   *Queue
+	network *Network
+	deploy  *Command
+}
+
+func newQueueTest(t *testing.T) (*queueTest, func()) {
+	server, err := suptest.NewServer(func(string, io.Reader, io.Writer, io.Writer) int { return 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := ioutil.TempDir("", "sup-test-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := stdoutWriter.w, stderrWriter.w
+	stdoutWriter.w, stderrWriter.w = ioutil.Discard, ioutil.Discard
+
+	conf := &Supfile{Access: []AccessRule{{
+		Users:    []string{"alice", "carol"},
+		Networks: []string{"test"},
+		Commands: []string{"deploy"},
+	}}}
+	app, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.StateDir(state)
+	qt := &queueTest{
+		conf:    conf,
+		queue:   NewQueue(app),
+		network: &Network{Name: "test", Hosts: []Host{{Addr: "host@" + server.Addr()}}},
+		deploy:  &Command{Name: "deploy", Run: "deploy-step"},
+	}
+	return qt, func() {
+		// Let the approved runs finish first, and cancel the pending ones.
+		for _, run := range qt.queue.Runs() {
+			if run.Status == RunPending {
+				qt.queue.Cancel(run.ID, nil)
+			}
+			qt.queue.Wait(run.ID)
+		}
+		stdoutWriter.w, stderrWriter.w = stdout, stderr
+		os.RemoveAll(state)
+		server.Close()
+	}
+}
+
+// submit returns the ID of a run of the given status: "pending" for a
+// run waiting for approval, "done" for a finished one, or "unknown" for
+// an ID the queue doesn't know.
+func (qt *queueTest) submit(t *testing.T, status string) string {
+	switch status {
+	case RunPending:
+		return qt.queue.SubmitForApproval("alice", "prod deploy", qt.network, EnvList{}, qt.deploy).ID
+	case RunDone:
+		run := qt.queue.Submit("alice", qt.network, EnvList{}, qt.deploy)
+		if run, err := qt.queue.Wait(run.ID); err != nil || run.Status != RunDone {
+			t.Fatalf("run = %+v, %v", run, err)
+		}
+		return run.ID
+	default:
+		return "42"
+	}
+}
+
+// authorizer returns the Authorizer of user, or nil if user is empty.
+func (qt *queueTest) authorizer(user string) Authorizer {
+	if user == "" {
+		return nil
+	}
+	return qt.conf.Authorizer(user, nil)
+}
+
+// checkRun checks the result of an action on a run: its error contains
+// wantErr, or it succeeded and the run has status wantStatus.
+func checkRun(t *testing.T, name string, run QueuedRun, err error, wantStatus, wantErr string) {
+	t.Helper()
+	switch {
+	case wantErr != "":
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%v: error %v, want %q", name, err, wantErr)
+		}
+	case err != nil:
+		t.Errorf("%v: %v", name, err)
+	case run.Status != wantStatus:
+		t.Errorf("%v: run %v, want %v", name, run.Status, wantStatus)
+	}
+}
+
+func TestQueueApprove(t *testing.T) {
+	qt, cleanup := newQueueTest(t)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		run      string // Status of the run approved.
+		approver string
+		auth     string // User of the Authorizer, if any.
+		status   string // Once finished.
+		err      string
+	}{
+		{name: "another user", run: RunPending, approver: "carol", status: RunDone},
+		{name: "allowed user", run: RunPending, approver: "carol", auth: "carol", status: RunDone},
+		{name: "self approval", run: RunPending, approver: "alice", err: "must be approved by another user"},
+		{name: "forbidden user", run: RunPending, approver: "bob", auth: "bob", err: "user bob is not allowed"},
+		{name: "finished run", run: RunDone, approver: "carol", err: "not pending approval"},
+		{name: "unknown run", run: "unknown", approver: "carol", err: "unknown run 42"},
+	}
+	for _, test := range tests {
+		id := qt.submit(t, test.run)
+		run, err := qt.queue.Approve(id, test.approver, qt.authorizer(test.auth))
+		if err == nil {
+			run, err = qt.queue.Wait(id) // Approved runs are queued.
+		}
+		checkRun(t, test.name, run, err, test.status, test.err)
+		if err == nil && run.Approver != test.approver {
+			t.Errorf("%v: approved by %q, want %q", test.name, run.Approver, test.approver)
+		}
+		if test.err != "" && test.run == RunPending {
+			if run, _ := qt.queue.Run(id); run.Status != RunPending {
+				t.Errorf("%v: run %v, want it still pending", test.name, run.Status)
+			}
+		}
+	}
+}
+
+func TestQueueReject(t *testing.T) {
+	qt, cleanup := newQueueTest(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		run    string // Status of the run rejected.
+		auth   string // User of the Authorizer, if any.
+		status string
+		err    string
+	}{
+		{name: "pending run", run: RunPending, status: RunCanceled},
+		{name: "allowed user", run: RunPending, auth: "carol", status: RunCanceled},
+		{name: "forbidden user", run: RunPending, auth: "bob", err: "user bob is not allowed"},
+		{name: "finished run", run: RunDone, err: "not pending approval"},
+		{name: "unknown run", run: "unknown", err: "unknown run 42"},
+	}
+	for _, test := range tests {
+		id := qt.submit(t, test.run)
+		run, err := qt.queue.Reject(id, qt.authorizer(test.auth))
+		checkRun(t, test.name, run, err, test.status, test.err)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	qt, cleanup := newQueueTest(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		run    string // Status of the run canceled.
+		auth   string // User of the Authorizer, if any.
+		status string
+		err    string
+	}{
+		{name: "pending run", run: RunPending, status: RunCanceled},
+		{name: "allowed user", run: RunPending, auth: "alice", status: RunCanceled},
+		{name: "forbidden user", run: RunPending, auth: "bob", err: "user bob is not allowed"},
+		{name: "finished run", run: RunDone, err: "already done"},
+		{name: "unknown run", run: "unknown", err: "unknown run 42"},
+	}
+	for _, test := range tests {
+		id := qt.submit(t, test.run)
+		run, err := qt.queue.Cancel(id, qt.authorizer(test.auth))
+		checkRun(t, test.name, run, err, test.status, test.err)
+	}
+}
@@ -0,0 +1,250 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunReport summarizes a single run, host by host.
+type RunReport struct {
+	Network  string        `json:"network"`
+	Target   string        `json:"target"`
+	User     string        `json:"user"`
+	GitSHA   string        `json:"git_sha,omitempty"` // HEAD of the local git repository, if any.
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Hosts    []*HostReport `json:"hosts"`
+
+	// Per-host results of the commands, keyed by command name.
+	Results map[string][]*CommandResult `json:"results,omitempty"`
+
+	mu sync.Mutex
+}
+
+// CommandResult is the result of a command on a single host.
+type CommandResult struct {
+	Host       string `json:"host"`
+	Status     string `json:"status"`
+	ExitStatus int    `json:"exit_status,omitempty"`
+	Output     string `json:"output,omitempty"` // Captured STDOUT, see Command.Capture.
+}
+
+// Host statuses reported by HostReport.
+const (
+	HostPending     = "pending"     // Nothing was run on the host (yet).
+	HostOK          = "ok"          // All tasks finished successfully.
+	HostFailed      = "failed"      // A task failed on the host.
+	HostUnreachable = "unreachable" // Connecting to the host failed.
+)
+
+// HostReport is the result of a run on a single host.
+type HostReport struct {
+	Host       string        `json:"host"`
+	Status     string        `json:"status"`
+	ExitStatus int           `json:"exit_status,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`        // Time spent running tasks on the host.
+	Label      string        `json:"label,omitempty"` // Name of the host in the output, see Network.Prefix.
+
+	Identity *ConnIdentity `json:"identity,omitempty"` // Who the host was connected as, by SSH.
+
+	Transfers []TransferStats `json:"transfers,omitempty"` // Uploads to the host.
+}
+
+// TransferStats summarizes an upload to a single host.
+type TransferStats struct {
+	Src      string        `json:"src"`
+	Dst      string        `json:"dst"`
+	Bytes    int64         `json:"bytes"` // Compressed bytes sent.
+	Duration time.Duration `json:"duration"`
+}
+
+// gitSHA returns the commit SHA of HEAD of the git repository
+// in the current working directory, or an empty string.
+func gitSHA() string {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Failed reports whether the run failed.
+func (r *RunReport) Failed() bool {
+	return r.Error != ""
+}
+
+// Summary returns a short human readable summary of the run,
+// listing the hosts that didn't succeed.
+func (r *RunReport) Summary() string {
+	status := "succeeded"
+	if r.Failed() {
+		status = "failed"
+	}
+	summary := fmt.Sprintf("sup %v on %v %v after %v", r.Target, r.Network, status, r.Duration)
+	if r.Failed() {
+		summary += ": " + strings.Replace(r.Error, "\n", " ", -1)
+	}
+	for _, h := range r.Hosts {
+		switch h.Status {
+		case HostFailed, HostUnreachable:
+			name := h.Host
+			if h.Label != "" {
+				name = h.Label
+			}
+			summary += fmt.Sprintf("\n- %v: %v", name, h.Status)
+			if h.Error != "" {
+				summary += " (" + h.Error + ")"
+			}
+		}
+	}
+	return summary
+}
+
+// host returns the report of the given host, creating it if needed.
+func (r *RunReport) host(host string) *HostReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range r.Hosts {
+		if h.Host == host {
+			return h
+		}
+	}
+	h := &HostReport{Host: host, Status: HostPending}
+	r.Hosts = append(r.Hosts, h)
+	return h
+}
+
+// addHostDuration adds d to the time spent running tasks on host.
+func (r *RunReport) addHostDuration(host string, d time.Duration) {
+	h := r.host(host)
+	r.mu.Lock()
+	h.Duration += d
+	r.mu.Unlock()
+}
+
+// addTransfer records the stats of an upload to host.
+func (r *RunReport) addTransfer(host string, stats TransferStats) {
+	h := r.host(host)
+	r.mu.Lock()
+	h.Transfers = append(h.Transfers, stats)
+	r.mu.Unlock()
+}
+
+// setResult records the result of command on a host. Results of multiple
+// tasks of the same command are merged; a failed result stays failed.
+func (r *RunReport) setResult(command string, result *CommandResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Results == nil {
+		r.Results = map[string][]*CommandResult{}
+	}
+	for _, existing := range r.Results[command] {
+		if existing.Host != result.Host {
+			continue
+		}
+		existing.Output += result.Output
+		if existing.Status != HostFailed {
+			existing.Status, existing.ExitStatus = result.Status, result.ExitStatus
+		}
+		return
+	}
+	r.Results[command] = append(r.Results[command], result)
+}
+
+// resultsJSON returns the command results encoded as JSON.
+func (r *RunReport) resultsJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := r.Results
+	if results == nil {
+		results = map[string][]*CommandResult{}
+	}
+	data, err := json.Marshal(results)
+	return append(data, '\n'), err
+}
+
+// setIdentity records who host was connected as.
+func (r *RunReport) setIdentity(host string, identity ConnIdentity) {
+	h := r.host(host)
+	r.mu.Lock()
+	h.Identity = &identity
+	r.mu.Unlock()
+}
+
+// setLabel sets the name of host in the output.
+func (r *RunReport) setLabel(host, label string) {
+	h := r.host(host)
+	r.mu.Lock()
+	h.Label = label
+	r.mu.Unlock()
+}
+
+// setHost updates the status of host. A failed host stays failed.
+func (r *RunReport) setHost(host, status string, exitStatus int, err error) {
+	h := r.host(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h.Status == HostFailed || h.Status == HostUnreachable {
+		return
+	}
+	h.Status = status
+	h.ExitStatus = exitStatus
+	if err != nil {
+		h.Error = err.Error()
+	}
+}
+
+// FailedHosts returns the hosts that failed or were unreachable.
+func (r *RunReport) FailedHosts() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var hosts []string
+	for _, h := range r.Hosts {
+		if h.Status == HostFailed || h.Status == HostUnreachable {
+			hosts = append(hosts, h.Host)
+		}
+	}
+	return hosts
+}
+
+// writeFile writes the report to path, encoded as JSON. path may be an
+// object store URL, see isObjectURL.
+func (r *RunReport) writeFile(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if isObjectURL(path) {
+		return writeObject(path, append(data, '\n'))
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ReadReport reads the report of a previous run, written by
+// Stackup.ReportFile.
+func ReadReport(path string) (*RunReport, error) {
+	read := ioutil.ReadFile
+	if isObjectURL(path) {
+		read = readObject
+	}
+	data, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &RunReport{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrapf(err, "%v: invalid report", path)
+	}
+	return r, nil
+}
@@ -0,0 +1,143 @@
+package sup
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// uploadChunkSize is the granularity of resuming interrupted uploads.
+// The chunk being sent when an upload got interrupted is sent again.
+const uploadChunkSize = 1 << 20
+
+// Uploads are resumable: hosts keep the archive of every upload in a part
+// file until it's extracted, so an interrupted upload can continue from the
+// last complete chunk of the part file which matches the local archive.
+//
+// The local side starts the stream by the offset it continues from,
+// on a line of its own. Offset 0 starts over.
+
+// uploadPart returns the remote path of the part file of upload.
+func uploadPart(upload *Upload) string {
+	key := sha1.Sum([]byte(upload.Src + "\x00" + upload.Dst))
+	return fmt.Sprintf(`"$HOME/.sup/uploads/%x.tgz"`, key[:8])
+}
+
+// remoteUploadCommand returns the command receiving the archive of upload,
+// keeping it in the part file until it's extracted and installed (see
+// installCommand). The files listed by the archive are labeled for SELinux
+// then, if required, see selinuxCommand.
+func remoteUploadCommand(upload *Upload) string {
+	part := uploadPart(upload)
+	label := ""
+	if cmd := selinuxCommand(upload, false, ""); cmd != "" {
+		label = fmt.Sprintf(` && ( cd "$dst" && tar -tzf "$part" | tr '\n' '\000' | { %v; } )`, cmd)
+	}
+	return fmt.Sprintf(`read -r offset; part=%s; `+
+		`if [ "$offset" -gt 0 ] 2>/dev/null; then head -c "$offset" "$part" > "$part.tmp" && mv "$part.tmp" "$part"; `+
+		`else mkdir -p "$(dirname "$part")" && : > "$part"; fi && `+
+		`%v%v && rm -f "$part"`, part, installCommand(upload, `{ cat "$part"; tee -a "$part"; } | tar -C "$tmp" -xzf -`), label)
+}
+
+// uploadStatusCommand returns the command printing the length of the complete
+// chunks of the part file of upload and their SHA-256, if there's any.
+func uploadStatusCommand(upload *Upload) string {
+	return fmt.Sprintf(`part=%s; [ -f "$part" ] || exit 0; `+
+		`offset=$(( $(wc -c < "$part") / %d * %d )); echo "$offset"; `+
+		`head -c "$offset" "$part" | { sha256sum 2>/dev/null || shasum -a 256; }`,
+		uploadPart(upload), uploadChunkSize, uploadChunkSize)
+}
+
+// resumeOffsets returns the offsets the clients of an upload task can resume
+// the upload from, leaving out the clients that have to start over.
+func (sup *Stackup) resumeOffsets(task *Task, stream *uploadStream) map[Client]int64 {
+	type status struct {
+		offset int64
+		sum    string
+	}
+	statuses := map[Client]status{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range task.Clients {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			if err := c.Run(&Task{Run: uploadStatusCommand(task.Upload)}); err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c.Stderr())
+			out, _ := ioutil.ReadAll(c.Stdout())
+			if err := c.Wait(); err != nil {
+				return
+			}
+			fields := strings.Fields(string(out))
+			if len(fields) < 2 {
+				return
+			}
+			offset, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil || offset <= 0 {
+				return
+			}
+			mu.Lock()
+			statuses[c] = status{offset, fields[1]}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	// Checksum the same prefixes of the local archive.
+	var offsets []int64
+	for _, s := range statuses {
+		offsets = append(offsets, s.offset)
+	}
+	sums, err := stream.prefixSums(offsets)
+	if err != nil {
+		return nil
+	}
+
+	resume := map[Client]int64{}
+	for c, s := range statuses {
+		if sums[s.offset] == s.sum {
+			resume[c] = s.offset
+		}
+	}
+	return resume
+}
+
+// prefixSums returns the SHA-256 of the prefixes of the given lengths
+// of a new archive of the stream's path, which is the same as the stream's
+// unless the files changed.
+func (s *uploadStream) prefixSums(lengths []int64) (map[int64]string, error) {
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i] < lengths[j] })
+
+	stream, err := newUploadStream(s.cwd, s.path, s.exclude)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	r := bufio.NewReader(stream)
+	h := sha256.New()
+	sums := map[int64]string{}
+	var read int64
+	for _, n := range lengths {
+		if n > read {
+			if _, err := io.CopyN(h, r, n-read); err != nil {
+				break // The archive is shorter than the part file.
+			}
+			read = n
+		}
+		sums[n] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums, nil
+}
@@ -0,0 +1,346 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SecretResolver resolves references to secrets kept in a secret backend.
+// Env vars whose value is "SCHEME:REF", where SCHEME is the scheme
+// the resolver is registered for, get the value of the secret REF.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolverFunc is a function used as a SecretResolver.
+type SecretResolverFunc func(ref string) (string, error)
+
+func (f SecretResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretResolversMu sync.RWMutex
+	secretResolvers   = map[string]SecretResolver{
+		"vault":  SecretResolverFunc(vaultSecret),
+		"sops":   SecretResolverFunc(sopsSecret),
+		"aws-sm": cachingResolverFunc(awsSecret),
+		"ssm":    cachingResolverFunc(ssmSecret),
+		"gcp-sm": SecretResolverFunc(gcpSecret),
+		"op":     SecretResolverFunc(onePasswordSecret),
+		"bw":     SecretResolverFunc(bitwardenSecret),
+		"exec":   SecretResolverFunc(execSecret),
+	}
+)
+
+// RegisterSecretResolver registers resolver for the values prefixed
+// by "scheme:", replacing the resolver registered before, if any.
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversMu.Lock()
+	defer secretResolversMu.Unlock()
+	secretResolvers[scheme] = resolver
+}
+
+// cachingResolverFunc is a SecretResolver of a built-in scheme reading
+// the secrets through the cache of the run, see EnvList.ResolveValues.
+type cachingResolverFunc func(ref string, cache *secretCache) (string, error)
+
+func (f cachingResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref, nil)
+}
+
+// ResolveSecret resolves value if it references a secret of a registered
+// scheme. It reports whether value is such a reference.
+func ResolveSecret(value string) (string, bool, error) {
+	return resolveSecret(value, nil)
+}
+
+// resolveSecret is like ResolveSecret, reading the secrets of the caching
+// resolvers through cache, if not nil.
+func resolveSecret(value string, cache *secretCache) (string, bool, error) {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return "", false, nil
+	}
+	scheme, ref := value[:i], value[i+1:]
+
+	secretResolversMu.RLock()
+	resolver, ok := secretResolvers[scheme]
+	secretResolversMu.RUnlock()
+	if !ok {
+		return "", false, nil
+	}
+
+	var secret string
+	var err error
+	if f, ok := resolver.(cachingResolverFunc); ok {
+		secret, err = f(ref, cache)
+	} else {
+		secret, err = resolver.Resolve(ref)
+	}
+	if err != nil {
+		return "", true, errors.Wrapf(err, "resolving %v secret failed", scheme)
+	}
+	return secret, true, nil
+}
+
+// ErrSecretRef is returned for malformed secret references.
+type ErrSecretRef struct {
+	Ref  string
+	Hint string
+}
+
+func (e ErrSecretRef) Error() string {
+	return fmt.Sprintf("invalid secret reference %q, expected %v", e.Ref, e.Hint)
+}
+
+// splitField splits "PATH#FIELD" references.
+func splitField(ref string) (path, field string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// secretOutput runs a secret backend's CLI and returns its output,
+// without the trailing newline. The CLI may prompt on the terminal.
+func secretOutput(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Wrap(err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// jsonField returns the field of a JSON object holding secrets.
+func jsonField(data, field string) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return "", errors.Wrap(err, "secret is not a JSON object")
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// vaultSecret reads "PATH#FIELD" by the vault CLI, e.g. "secret/db#password".
+func vaultSecret(ref string) (string, error) {
+	path, field := splitField(ref)
+	if path == "" || field == "" {
+		return "", ErrSecretRef{ref, "vault:PATH#FIELD"}
+	}
+	return secretOutput("vault", "kv", "get", "-field="+field, path)
+}
+
+// sopsSecret decrypts "FILE#KEY" by the sops CLI, e.g. "secrets.yaml#db.password".
+func sopsSecret(ref string) (string, error) {
+	file, key := splitField(ref)
+	if file == "" || key == "" {
+		return "", ErrSecretRef{ref, "sops:FILE#KEY"}
+	}
+	var extract string
+	for _, k := range strings.Split(key, ".") {
+		extract += fmt.Sprintf("[%q]", k)
+	}
+	return secretOutput("sops", "--decrypt", "--extract", extract, file)
+}
+
+// awsRef parses "[//]NAME[?region=REGION][#FIELD]" references
+// to AWS secrets and returns the region flags of the aws CLI.
+func awsRef(ref string) (name, field string, flags []string) {
+	name, field = splitField(strings.TrimPrefix(ref, "//"))
+	if i := strings.Index(name, "?"); i >= 0 {
+		if query, err := url.ParseQuery(name[i+1:]); err == nil && query.Get("region") != "" {
+			flags = []string{"--region", query.Get("region")}
+		}
+		name = name[:i]
+	}
+	return name, field, flags
+}
+
+// awsSecret reads "[//]NAME[?region=REGION][#FIELD]" from AWS Secrets Manager
+// by the aws CLI, using its default credential chain. FIELD picks a field
+// of a JSON secret. The secrets are read once per cache, so the env vars
+// picking fields of the same secret don't read it over and over in a run.
+func awsSecret(ref string, cache *secretCache) (string, error) {
+	name, field, flags := awsRef(ref)
+	if name == "" {
+		return "", ErrSecretRef{ref, "aws-sm://NAME[?region=REGION][#FIELD]"}
+	}
+	secret, err := cache.get("aws-sm:"+strings.Join(flags, " ")+":"+name, func() (string, error) {
+		args := append([]string{"secretsmanager", "get-secret-value",
+			"--secret-id", name, "--query", "SecretString", "--output", "text"}, flags...)
+		return secretOutput("aws", args...)
+	})
+	if err != nil || field == "" {
+		return secret, err
+	}
+	return jsonField(secret, field)
+}
+
+// ssmSecret reads "[//]NAME[?region=REGION]" from AWS Systems Manager
+// Parameter Store by the aws CLI, decrypting SecureString parameters.
+// Hierarchical names may omit the leading slash: "ssm://prod/db/password".
+func ssmSecret(ref string, cache *secretCache) (string, error) {
+	name, _, flags := awsRef(ref)
+	if name == "" {
+		return "", ErrSecretRef{ref, "ssm://NAME[?region=REGION]"}
+	}
+	if strings.Contains(name, "/") && !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return cache.get("ssm:"+strings.Join(flags, " ")+":"+name, func() (string, error) {
+		args := append([]string{"ssm", "get-parameter", "--name", name,
+			"--with-decryption", "--query", "Parameter.Value", "--output", "text"}, flags...)
+		return secretOutput("aws", args...)
+	})
+}
+
+// secretCache caches the secrets read during a run, see
+// EnvList.ResolveValues, so secrets aren't shared between runs and
+// rotated ones are read again by the next run.
+type secretCache struct {
+	mu      sync.Mutex
+	secrets map[string]*cachedSecret
+}
+
+type cachedSecret struct {
+	value string
+	err   error
+	done  chan struct{} // Closed once read.
+}
+
+// get returns the cached secret of key, reading it by read if it's not
+// cached yet, or every time if c is nil. The secret is read once by
+// concurrent callers, outside the lock, so a slow or prompting CLI doesn't
+// hold up the other keys. Failed reads aren't cached.
+func (c *secretCache) get(key string, read func() (string, error)) (string, error) {
+	if c == nil {
+		return read()
+	}
+	c.mu.Lock()
+	secret, ok := c.secrets[key]
+	if !ok {
+		secret = &cachedSecret{done: make(chan struct{})}
+		if c.secrets == nil {
+			c.secrets = map[string]*cachedSecret{}
+		}
+		c.secrets[key] = secret
+		c.mu.Unlock()
+
+		secret.value, secret.err = read()
+		if secret.err != nil {
+			c.mu.Lock()
+			delete(c.secrets, key)
+			c.mu.Unlock()
+		}
+		close(secret.done)
+		return secret.value, secret.err
+	}
+	c.mu.Unlock()
+
+	<-secret.done
+	return secret.value, secret.err
+}
+
+// gcpSecret reads "[projects/PROJECT/secrets/]NAME[/versions/VERSION]"
+// from Google Cloud Secret Manager by the gcloud CLI.
+func gcpSecret(ref string) (string, error) {
+	var project, version string
+	name := ref
+	if strings.HasPrefix(name, "projects/") {
+		parts := strings.SplitN(name, "/", 4)
+		if len(parts) != 4 || parts[2] != "secrets" {
+			return "", ErrSecretRef{ref, "gcp-sm:[projects/PROJECT/secrets/]NAME[/versions/VERSION]"}
+		}
+		project, name = parts[1], parts[3]
+	}
+	if i := strings.Index(name, "/versions/"); i >= 0 {
+		name, version = name[:i], name[i+len("/versions/"):]
+	}
+	if name == "" {
+		return "", ErrSecretRef{ref, "gcp-sm:[projects/PROJECT/secrets/]NAME[/versions/VERSION]"}
+	}
+	if version == "" {
+		version = "latest"
+	}
+
+	args := []string{"secrets", "versions", "access", version, "--secret", name}
+	if project != "" {
+		args = append(args, "--project", project)
+	}
+	return secretOutput("gcloud", args...)
+}
+
+// onePasswordSecret reads "//VAULT/ITEM/FIELD" secret references
+// by the 1Password CLI.
+func onePasswordSecret(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "//") || strings.Count(ref, "/") < 4 {
+		return "", ErrSecretRef{ref, "op://VAULT/ITEM/FIELD"}
+	}
+	return secretOutput("op", "read", "--no-newline", "op:"+ref)
+}
+
+// bitwardenSecret reads "[//]ITEM[#FIELD]" by the Bitwarden CLI, which must
+// be unlocked ($BW_SESSION). FIELD is password (default), username, totp,
+// notes or the name of a custom field of the item.
+func bitwardenSecret(ref string) (string, error) {
+	item, field := splitField(strings.TrimPrefix(ref, "//"))
+	if item == "" {
+		return "", ErrSecretRef{ref, "bw://ITEM[#FIELD]"}
+	}
+	switch field {
+	case "":
+		return secretOutput("bw", "get", "password", item)
+	case "password", "username", "totp", "notes":
+		return secretOutput("bw", "get", field, item)
+	}
+
+	out, err := secretOutput("bw", "get", "item", item)
+	if err != nil {
+		return "", err
+	}
+	var data struct {
+		Fields []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(out), &data); err != nil {
+		return "", errors.Wrap(err, "parsing bw item failed")
+	}
+	for _, f := range data.Fields {
+		if f.Name == field {
+			return f.Value, nil
+		}
+	}
+	return "", fmt.Errorf("bw item %v has no field %q", item, field)
+}
+
+// execSecret returns the output of a local command, e.g. "exec:pass show db".
+func execSecret(ref string) (string, error) {
+	if strings.TrimSpace(ref) == "" {
+		return "", ErrSecretRef{ref, "exec:COMMAND"}
+	}
+	return secretOutput("bash", "-c", ref)
+}
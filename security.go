@@ -0,0 +1,77 @@
+package sup
+
+import "golang.org/x/crypto/ssh"
+
+// SecurityStrict is the hardened security profile of a Supfile, see
+// Supfile.SecurityProfile: the hosts are authenticated by the keys of the
+// ssh-agent only, never by passwords or by key files read from disk, the
+// connections negotiate FIPS 140-2 approved algorithms only, and the host
+// keys must be known: host key checking defaults to "yes", and can't be
+// turned off or trust new hosts.
+const SecurityStrict = "strict"
+
+// Algorithms negotiated by the connections of the strict security profile.
+var (
+	strictCiphers      = []string{"aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"}
+	strictKeyExchanges = []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"}
+	strictMACs         = []string{"hmac-sha2-256"}
+	strictHostKeyAlgos = []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521}
+)
+
+// ErrSecurityProfile is returned for the settings forbidden by the strict
+// security profile.
+type ErrSecurityProfile struct {
+	Reason string
+}
+
+func (e ErrSecurityProfile) Error() string {
+	return "security_profile strict: " + e.Reason
+}
+
+// checkStrict checks the network allows the strict security profile.
+func (n *Network) checkStrict() error {
+	if err := checkStrictHostKeys(n.StrictHostKeyChecking); err != nil {
+		return err
+	}
+	if n.PasswordEnv != "" || n.PasswordFile != "" || n.AskPassword {
+		return ErrSecurityProfile{"password auth is forbidden"}
+	}
+	if n.IdentityFile != "" {
+		return ErrSecurityProfile{"identity files are forbidden, add the keys to the ssh-agent"}
+	}
+	for _, host := range n.Hosts {
+		if host.Password != "" {
+			return ErrSecurityProfile{"host " + host.Addr + ": password auth is forbidden"}
+		}
+		if host.IdentityFile != "" {
+			return ErrSecurityProfile{"host " + host.Addr + ": identity files are forbidden, add the keys to the ssh-agent"}
+		}
+	}
+	return nil
+}
+
+// checkStrictHostKeys checks the host key checking mode allows the strict
+// security profile: "yes", or the default, which is "yes" then.
+func checkStrictHostKeys(mode string) error {
+	if mode != "" && mode != HostKeyCheckingYes {
+		return ErrSecurityProfile{"host key checking must be " + HostKeyCheckingYes + ", not " + mode}
+	}
+	return nil
+}
+
+// strictAlgorithms returns the host key algorithms of algorithms approved
+// by the strict security profile, or all of those if there are none.
+func strictAlgorithms(algorithms []string) []string {
+	var approved []string
+	for _, algo := range algorithms {
+		for _, strict := range strictHostKeyAlgos {
+			if algo == strict {
+				approved = append(approved, algo)
+			}
+		}
+	}
+	if len(approved) == 0 {
+		return strictHostKeyAlgos
+	}
+	return approved
+}
@@ -0,0 +1,35 @@
+package sup
+
+import "strings"
+
+// Uploads with setype, secontext or restorecon label the uploaded files for
+// SELinux once they're extracted, so e.g. configs uploaded to RHEL hosts
+// are readable by their services. The hosts without SELinux enabled are
+// left as they are, so the same upload works on mixed fleets.
+
+// selinuxCommand returns the command labeling the files (shell words) of
+// upload, recursively if recursive is set, or "" if upload isn't labeled.
+// The files are read from STDIN, NUL separated, if files is empty.
+func selinuxCommand(upload *Upload, recursive bool, files string) string {
+	var args []string
+	switch {
+	case upload.SEType != "":
+		args = []string{"chcon", "-h", "-t", shellQuote(upload.SEType)}
+	case upload.SEContext != "":
+		args = []string{"chcon", "-h", shellQuote(upload.SEContext)}
+	case upload.Restorecon:
+		args = []string{"restorecon"}
+	default:
+		return ""
+	}
+	if recursive {
+		args = append(args, "-R")
+	}
+	label := strings.Join(args, " ") + " -- "
+	if files == "" {
+		label = "xargs -0 " + label
+	} else {
+		label += files
+	}
+	return `if command -v selinuxenabled > /dev/null && selinuxenabled; then ` + label + `; fi`
+}
@@ -1,15 +1,18 @@
 package sup
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
-	"net/url"
 	"os"
 	"os/user"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -30,6 +33,21 @@ type SSHClient struct {
 	running      bool
 	env          string //export FOO="bar"; export BAR="baz";
 	color        string
+	identityFile string        // Private key to authenticate by, if any.
+	password     string        // Password to authenticate by, if any.
+	forwardAgent bool          // Forward the local ssh-agent to all sessions, see Network.AgentForwarding.
+	becomePass   string        // Password answering the prompts of Task.Become, see becomeReader.
+	timeout      time.Duration // Max time of connecting, including the SSH handshake, if any.
+	keepalive    time.Duration // Interval of the keepalive requests, if any.
+	agentForward bool          // The ssh-agent is forwarded on the connection.
+	sshConfig    sshHostConfig // Options of ~/.ssh/config for the host.
+	jump         *SSHClient    // Jump host connected through, by ProxyJump.
+	knownHosts   *knownHosts   // Host keys to check the host's key against, if any.
+	hostKeyErr   error         // Why the host key was rejected, if it was.
+	label        string        // Output prefix of the host, if not its address.
+	identity     ConnIdentity  // Who the host was connected as.
+	strict       bool          // Authenticate by the ssh-agent only, by approved algorithms, see SecurityStrict.
+	log          *debugLog
 }
 
 type ErrConnect struct {
@@ -42,19 +60,50 @@ func (e ErrConnect) Error() string {
 	return fmt.Sprintf(`Connect("%v@%v"): %v`, e.User, e.Host, e.Reason)
 }
 
+// transient reports whether connecting may succeed if retried: after a
+// timeout, or a connection refused or reset by a rebooting host. Unknown
+// hosts, unreachable networks, host key mismatches and rejected credentials
+// are permanent.
+func (e ErrConnect) transient() bool {
+	for _, reason := range transientReasons {
+		if strings.Contains(e.Reason, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons of the transient connection errors, see ErrConnect.transient.
+var transientReasons = []string{
+	"timeout",
+	"timed out",
+	"connection refused",
+	"connection reset",
+}
+
 // parseHost parses and normalizes <user>@<host:port> from a given string.
+// The host name, user and port default to the ones of ~/.ssh/config.
 func (c *SSHClient) parseHost(host string) error {
-	if !strings.HasPrefix(host, "ssh://") {
-		host = "ssh://" + host
-	}
-	u, err := url.Parse(host)
+	u, err := parseAddr(host)
 	if err != nil {
 		return err
 	}
-	if c.host = u.Host; !strings.ContainsRune(c.host, ':') {
-		c.host += ":22"
+	c.sshConfig = lookupSSHConfig(u.Hostname())
+	hostname, port := u.Hostname(), u.Port()
+	if c.sshConfig.HostName != "" {
+		hostname = c.sshConfig.HostName
 	}
+	if port == "" {
+		port = c.sshConfig.Port
+	}
+	if port == "" {
+		port = "22"
+	}
+	c.host = net.JoinHostPort(hostname, port)
 	if c.user = u.User.Username(); c.user == "" {
+		c.user = c.sshConfig.User
+	}
+	if c.user == "" {
 		usr, err := user.Current()
 		if err != nil {
 			return err
@@ -62,24 +111,27 @@ func (c *SSHClient) parseHost(host string) error {
 		c.user = usr.Username
 	}
 	if pwd, _ := u.User.Password(); pwd != "" {
-		c.auth = append(c.auth, ssh.Password(pwd))
+		c.password = pwd
 	}
 	return nil
 }
 
-var initAuthMethodOnce sync.Once
-var authMethod ssh.AuthMethod
+var initAuthMethodOnce, initKeyFilesOnce sync.Once
+var agentSigners, keyFileSigners []ssh.Signer
 
 // initAuthMethod initiates SSH authentication method.
 func initAuthMethod() {
-	var signers []ssh.Signer
-
 	// If there's a running SSH Agent, try to use its Private keys.
 	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 	if err == nil {
 		agent := agent.NewClient(sock)
-		signers, _ = agent.Signers()
+		agentSigners, _ = agent.Signers()
 	}
+}
+
+// initKeyFiles reads user's SSH private keys, not held by the ssh-agent.
+func initKeyFiles() {
+	var signers []ssh.Signer
 
 	// Try to read user's SSH private keys form the standard paths.
 	files := []string{
@@ -98,7 +150,7 @@ func initAuthMethod() {
 		signers = append(signers, signer)
 
 	}
-	authMethod = ssh.PublicKeys(signers...)
+	keyFileSigners = signers
 }
 
 // SSHDialFunc can dial an ssh server and return a client
@@ -106,8 +158,115 @@ type SSHDialFunc func(net, addr string, config *ssh.ClientConfig) (*ssh.Client,
 
 // Connect creates SSH connection to a specified host.
 // It expects the host of the form "[ssh://]host[:port]".
+// It connects through the jump hosts of the ProxyJump of ~/.ssh/config.
 func (c *SSHClient) Connect(host string) error {
-	return c.ConnectWith(host, ssh.Dial)
+	return c.connect(host, 0)
+}
+
+// connect connects to host, through its ProxyJump hosts, if any.
+// depth is the number of jump hosts connected so far, to break loops.
+func (c *SSHClient) connect(host string, depth int) error {
+	u, err := parseAddr(host)
+	if err != nil {
+		return err
+	}
+	alias := u.Hostname()
+	proxyJump := lookupSSHConfig(alias).ProxyJump
+	if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+		return c.ConnectWith(host, ssh.Dial)
+	}
+	if depth >= 8 {
+		return ErrConnect{c.user, alias, "too many jump hosts, ProxyJump loop in ~/.ssh/config?"}
+	}
+
+	jump, err := connectJumpHosts(strings.Split(proxyJump, ","), c, depth+1)
+	if err != nil {
+		return err
+	}
+	c.jump = jump
+	if err := c.ConnectWith(host, jump.DialThrough); err != nil {
+		jump.Close()
+		c.jump = nil
+		return err
+	}
+	return nil
+}
+
+// connectJumpHosts connects to the jump hosts in turn, each through the
+// previous one, like OpenSSH's ProxyJump, with the options of the client of
+// the host behind them. It returns the client of the last one, which closes
+// the others when closed. depth is as of connect.
+func connectJumpHosts(hosts []string, c *SSHClient, depth int) (*SSHClient, error) {
+	var jump *SSHClient
+	for _, host := range hosts {
+		next := c.jumpClient()
+		var err error
+		if jump == nil {
+			err = next.connect(host, depth)
+		} else {
+			next.jump = jump
+			err = next.ConnectWith(host, jump.DialThrough)
+		}
+		if err != nil {
+			if jump != nil {
+				jump.Close()
+			}
+			return nil, err
+		}
+		c.log.logf(DebugSSH, "%v@%v: connected to jump host", next.user, next.host)
+		jump = next
+	}
+	return jump, nil
+}
+
+// jumpClient returns a client of a jump host of c, checking its host key,
+// timing out, keeping alive and authenticating like c.
+func (c *SSHClient) jumpClient() *SSHClient {
+	return &SSHClient{log: c.log, knownHosts: c.knownHosts, timeout: c.timeout, keepalive: c.keepalive, strict: c.strict}
+}
+
+// answer answers the keyboard-interactive questions of the host, by which
+// many hosts ask for the password instead of the password auth: the
+// password is the answer to the hidden questions, e.g. "Password: ".
+func (c *SSHClient) answer(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		if echos[i] {
+			return nil, fmt.Errorf("can't answer keyboard-interactive question %q", question)
+		}
+		answers[i] = c.password
+	}
+	c.identity.AuthMethod, c.identity.KeyFingerprint = "keyboard-interactive", ""
+	return answers, nil
+}
+
+// ConnIdentity is who a host was connected as, kept in the run report
+// for audits: the user, how it authenticated, and the host's key and
+// SSH server version.
+type ConnIdentity struct {
+	User           string    `json:"user"`
+	AuthMethod     string    `json:"auth_method,omitempty"`     // "publickey", "password", "keyboard-interactive", or "sup agent" if connected through it.
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"` // Of the key authenticated by, with publickey.
+	HostKey        string    `json:"host_key,omitempty"`        // Type and fingerprint of the host's key.
+	ServerVersion  string    `json:"server_version,omitempty"`
+	Connected      time.Time `json:"connected"`
+}
+
+// Identity returns who the host was connected as.
+func (c *SSHClient) Identity() ConnIdentity {
+	return c.identity
+}
+
+// identitySigner records the key a client authenticates by, which is
+// only asked to sign once the host accepts it.
+type identitySigner struct {
+	ssh.Signer
+	c *SSHClient
+}
+
+func (s identitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.c.identity.AuthMethod, s.c.identity.KeyFingerprint = "publickey", fingerprint(s.PublicKey())
+	return s.Signer.Sign(rand, data)
 }
 
 // ConnectWith creates a SSH connection to a specified host. It will use dialer to establish the
@@ -119,22 +278,109 @@ func (c *SSHClient) ConnectWith(host string, dialer SSHDialFunc) error {
 	}
 
 	initAuthMethodOnce.Do(initAuthMethod)
+	if !c.strict {
+		initKeyFilesOnce.Do(initKeyFiles)
+	}
 
 	err := c.parseHost(host)
 	if err != nil {
 		return err
 	}
 
+	if c.strict && (c.identityFile != "" || c.password != "") {
+		return ErrSecurityProfile{fmt.Sprintf("%v@%v: only the ssh-agent may authenticate", c.user, c.host)}
+	}
+	if c.identityFile != "" {
+		data, err := ioutil.ReadFile(c.identityFile)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("%v: %v", c.identityFile, err)
+		}
+		c.auth = append(c.auth, ssh.PublicKeys(identitySigner{signer, c}))
+	}
+	// Like ssh, skip the identity files of ~/.ssh/config that can't be used.
+	identityFiles := c.sshConfig.IdentityFiles
+	if c.strict && len(identityFiles) > 0 {
+		c.log.logf(DebugSSH, "%v@%v: skipping identity files of ~/.ssh/config, forbidden by security_profile strict", c.user, c.host)
+		identityFiles = nil
+	}
+	for _, file := range identityFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			c.log.logf(DebugSSH, "%v@%v: skipping identity file %q: %v", c.user, c.host, file, err)
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			c.log.logf(DebugSSH, "%v@%v: skipping identity file %q: %v", c.user, c.host, file, err)
+			continue
+		}
+		c.auth = append(c.auth, ssh.PublicKeys(identitySigner{signer, c}))
+	}
+	if c.password != "" {
+		password := ssh.PasswordCallback(func() (string, error) {
+			c.identity.AuthMethod, c.identity.KeyFingerprint = "password", ""
+			return c.password, nil
+		})
+		c.auth = append(c.auth, password, ssh.KeyboardInteractive(c.answer))
+	}
+	// Strict clients never use the key files, even if others loaded them.
+	var signers []ssh.Signer
+	for _, signer := range agentSigners {
+		signers = append(signers, identitySigner{signer, c})
+	}
+	if !c.strict {
+		for _, signer := range keyFileSigners {
+			signers = append(signers, identitySigner{signer, c})
+		}
+	}
+
 	config := &ssh.ClientConfig{
 		User: c.user,
-		Auth: append(c.auth, authMethod),
+		Auth: append(c.auth, ssh.PublicKeys(signers...)),
+
+		// Ask for a key that can be checked, if the host is known.
+		HostKeyAlgorithms: c.knownHosts.algorithms(c.host),
+	}
+	if c.strict {
+		config.Ciphers, config.KeyExchanges, config.MACs = strictCiphers, strictKeyExchanges, strictMACs
+		config.HostKeyAlgorithms = strictAlgorithms(config.HostKeyAlgorithms)
+	}
+	c.log.logf(DebugSSH, "%v@%v: connecting, %v auth method(s), identity file %q", c.user, c.host, len(config.Auth), c.identityFile)
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		c.log.logf(DebugSSH, "%v@%v: host key %v %v (%v)", c.user, c.host, key.Type(), fingerprint(key), remote)
+		c.identity.HostKey = key.Type() + " " + fingerprint(key)
+		if c.knownHosts == nil {
+			return nil
+		}
+		c.hostKeyErr = c.knownHosts.check(c.host, key)
+		return c.hostKeyErr
+	}
+
+	if c.timeout > 0 {
+		config.Timeout = c.timeout
+		dialer = dialTimeout(dialer, c.timeout)
 	}
 
+	started := time.Now()
 	c.conn, err = dialer("tcp", c.host, config)
 	if err != nil {
+		c.log.logf(DebugSSH, "%v@%v: connecting failed after %v: %v", c.user, c.host, time.Since(started), err)
+		if c.hostKeyErr != nil {
+			// Not worth retrying, see Network.retryConnect.
+			return c.hostKeyErr
+		}
 		return ErrConnect{c.user, c.host, err.Error()}
 	}
 	c.connOpened = true
+	c.identity.User, c.identity.ServerVersion, c.identity.Connected = c.user, string(c.conn.ServerVersion()), time.Now()
+	c.log.logf(DebugSSH, "%v@%v: connected after %v, server %q, client %q", c.user, c.host, time.Since(started), c.conn.ServerVersion(), c.conn.ClientVersion())
+	if c.keepalive > 0 {
+		go c.sendKeepalives(c.conn)
+	}
 
 	return nil
 }
@@ -167,6 +413,9 @@ func (c *SSHClient) Run(task *Task) error {
 	if err != nil {
 		return err
 	}
+	if task.Become != "" && task.TTY {
+		c.remoteStdout = &becomeReader{r: c.remoteStdout, stdin: c.remoteStdin, password: c.becomePass}
+	}
 
 	if task.TTY {
 		// Set up terminal modes
@@ -181,8 +430,15 @@ func (c *SSHClient) Run(task *Task) error {
 		}
 	}
 
+	if task.AgentForwarding || c.forwardAgent {
+		if err := c.requestAgentForwarding(sess); err != nil {
+			sess.Close()
+			return err
+		}
+	}
+
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	if err := sess.Start(task.Command(c.env)); err != nil {
 		return ErrTask{task, err.Error()}
 	}
 
@@ -192,6 +448,26 @@ func (c *SSHClient) Run(task *Task) error {
 	return nil
 }
 
+// requestAgentForwarding forwards the local ssh-agent to the session,
+// proxying the agent channels the host opens on the connection to
+// $SSH_AUTH_SOCK.
+func (c *SSHClient) requestAgentForwarding(sess *ssh.Session) error {
+	if !c.agentForward {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return fmt.Errorf("agent forwarding: no ssh-agent running, SSH_AUTH_SOCK is not set")
+		}
+		if err := agent.ForwardToRemote(c.conn, sock); err != nil {
+			return fmt.Errorf("agent forwarding: %v", err)
+		}
+		c.agentForward = true
+	}
+	if err := agent.RequestAgentForwarding(sess); err != nil {
+		return fmt.Errorf("agent forwarding: %v", err)
+	}
+	return nil
+}
+
 // Wait waits until the remote command finishes and exits.
 // It closes the SSH session.
 func (c *SSHClient) Wait() error {
@@ -207,6 +483,64 @@ func (c *SSHClient) Wait() error {
 	return err
 }
 
+// dialTimeout returns dialer, failing if connecting, including the SSH
+// handshake, takes longer than timeout. Hosts that accept connections but
+// hang would block the run for good otherwise.
+func dialTimeout(dialer SSHDialFunc, timeout time.Duration) SSHDialFunc {
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		type result struct {
+			client *ssh.Client
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			client, err := dialer(network, addr, config)
+			done <- result{client, err}
+		}()
+		select {
+		case r := <-done:
+			return r.client, r.err
+		case <-time.After(timeout):
+			go func() {
+				if r := <-done; r.client != nil {
+					r.client.Close()
+				}
+			}()
+			return nil, fmt.Errorf("timed out after %v", timeout)
+		}
+	}
+}
+
+// keepaliveCountMax is the number of keepalive requests in a row a host
+// may not reply to before it's disconnected, like OpenSSH's
+// ServerAliveCountMax.
+const keepaliveCountMax = 3
+
+// sendKeepalives sends keepalive requests to the host every c.keepalive,
+// so idle connections survive NATs and VPNs dropping them, and closes conn
+// once the host stops replying, so its sessions fail instead of hanging.
+// It returns once conn is closed.
+func (c *SSHClient) sendKeepalives(conn *ssh.Client) {
+	for {
+		time.Sleep(c.keepalive)
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				return // Closed.
+			}
+		case <-time.After(keepaliveCountMax * c.keepalive):
+			fmt.Fprintf(os.Stderr, "%v@%v: no reply to keepalives for %v, disconnecting\n", c.user, c.host, keepaliveCountMax*c.keepalive)
+			conn.Close()
+			return
+		}
+	}
+}
+
 // DialThrough will create a new connection from the ssh server sc is connected to. DialThrough is an SSHDialer.
 func (sc *SSHClient) DialThrough(net, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
 	conn, err := sc.conn.Dial(net, addr)
@@ -234,6 +568,10 @@ func (c *SSHClient) Close() error {
 	err := c.conn.Close()
 	c.connOpened = false
 	c.running = false
+	if c.jump != nil {
+		c.jump.Close()
+		c.jump = nil
+	}
 
 	return err
 }
@@ -252,6 +590,9 @@ func (c *SSHClient) Stdout() io.Reader {
 
 func (c *SSHClient) Prefix() (string, int) {
 	host := c.user + "@" + c.host + " | "
+	if c.label != "" {
+		host = c.label + " | "
+	}
 	return c.color + host + ResetColor, len(host)
 }
 
@@ -281,3 +622,17 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		return fmt.Errorf("%v not supported", sig)
 	}
 }
+
+func (c *SSHClient) Upload(ctx context.Context, src, dst string, opts TransferOptions) error {
+	return upload(ctx, c, src, dst, opts)
+}
+
+func (c *SSHClient) Download(ctx context.Context, src, dst string, opts TransferOptions) error {
+	return download(ctx, c, src, dst, opts)
+}
+
+// fingerprint returns the SHA256 fingerprint of key, as printed by ssh-keygen.
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
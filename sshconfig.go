@@ -0,0 +1,170 @@
+package sup
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sshConfig is the user's ~/.ssh/config, applied to the hosts the way
+// ssh does: the first value of every option wins, in the order of the
+// matching Host blocks. Match blocks aren't supported, and never match.
+type sshConfig struct {
+	blocks []sshConfigBlock
+}
+
+// sshConfigBlock is a Host (or Match) block of sshConfig.
+type sshConfigBlock struct {
+	patterns []string // Nil for Match blocks.
+	options  [][2]string
+}
+
+// sshHostConfig are the options of sshConfig applied to a host.
+type sshHostConfig struct {
+	HostName      string
+	User          string
+	Port          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+var loadSSHConfigOnce sync.Once
+var userSSHConfig *sshConfig
+
+// loadSSHConfig reads the user's ~/.ssh/config, if any.
+func loadSSHConfig() {
+	userSSHConfig = &sshConfig{}
+	userSSHConfig.read(filepath.Join(os.Getenv("HOME"), ".ssh", "config"), []string{"*"}, 0)
+}
+
+// lookupSSHConfig returns the options of the user's ~/.ssh/config
+// for the host alias.
+func lookupSSHConfig(alias string) sshHostConfig {
+	loadSSHConfigOnce.Do(loadSSHConfig)
+	return userSSHConfig.lookup(alias)
+}
+
+// read appends the blocks of the config file, the lines before its first
+// Host block applying to the hosts matching patterns. Like ssh, files that
+// can't be read are ignored; Include directives are followed up to a depth.
+func (cfg *sshConfig) read(file string, patterns []string, depth int) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	cfg.blocks = append(cfg.blocks, sshConfigBlock{patterns: patterns})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value := parseSSHConfigLine(scanner.Text())
+		switch key {
+		case "":
+		case "host":
+			cfg.blocks = append(cfg.blocks, sshConfigBlock{patterns: strings.Fields(value)})
+		case "match":
+			cfg.blocks = append(cfg.blocks, sshConfigBlock{})
+		case "include":
+			if depth >= 8 {
+				continue
+			}
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandTilde(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(os.Getenv("HOME"), ".ssh", pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, file := range files {
+					block := cfg.blocks[len(cfg.blocks)-1]
+					cfg.read(file, block.patterns, depth+1)
+					// The included blocks end at the end of the file.
+					cfg.blocks = append(cfg.blocks, sshConfigBlock{patterns: block.patterns})
+				}
+			}
+		default:
+			block := &cfg.blocks[len(cfg.blocks)-1]
+			block.options = append(block.options, [2]string{key, value})
+		}
+	}
+}
+
+// parseSSHConfigLine returns the lowercased keyword and the value of a
+// line of ssh_config, which are separated by spaces or "=".
+func parseSSHConfigLine(line string) (key, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key, value = strings.ToLower(line[:i]), strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	return key, strings.Trim(value, `"`)
+}
+
+// lookup returns the options applied to the host alias.
+func (cfg *sshConfig) lookup(alias string) sshHostConfig {
+	var hc sshHostConfig
+	for _, block := range cfg.blocks {
+		if !matchSSHPatterns(block.patterns, alias) {
+			continue
+		}
+		for _, option := range block.options {
+			key, value := option[0], option[1]
+			switch key {
+			case "hostname":
+				if hc.HostName == "" {
+					hc.HostName = strings.Replace(value, "%h", alias, -1)
+				}
+			case "user":
+				if hc.User == "" {
+					hc.User = value
+				}
+			case "port":
+				if hc.Port == "" {
+					hc.Port = value
+				}
+			case "identityfile":
+				// Unlike the other options, identity files add up.
+				hc.IdentityFiles = append(hc.IdentityFiles, expandTilde(value))
+			case "proxyjump":
+				if hc.ProxyJump == "" {
+					hc.ProxyJump = value
+				}
+			}
+		}
+	}
+	return hc
+}
+
+// sshPatternEscaper escapes the characters of ssh patterns which are
+// special to path.Match, but not to ssh, e.g. in "[host]:port".
+var sshPatternEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`)
+
+// matchSSHPatterns reports whether host matches the patterns of a Host
+// line: any of them matches, and none of the negated ("!") ones.
+func matchSSHPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(sshPatternEscaper.Replace(strings.TrimPrefix(pattern, "!")), host)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// expandTilde expands a leading "~" of file to the user's home directory.
+func expandTilde(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		return os.Getenv("HOME") + file[1:]
+	}
+	return file
+}
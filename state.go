@@ -0,0 +1,129 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StateDir returns the state directory of the project of supfile,
+// ".sup/state" next to it, e.g. keeping the inventory locks.
+func StateDir(supfile string) string {
+	return filepath.Join(filepath.Dir(supfile), ".sup", "state")
+}
+
+// InventoryLock is the inventory of a network resolved by the last run,
+// reused by --frozen-inventory, so e.g. a deploy in progress doesn't pick
+// up the instances scaled in since it started.
+type InventoryLock struct {
+	Network  string       `json:"network"`
+	Resolved time.Time    `json:"resolved"`
+	Hosts    []LockedHost `json:"hosts"`
+}
+
+// LockedHost is a host of an InventoryLock. Passwords aren't kept.
+type LockedHost struct {
+	Addr         string            `json:"host"`
+	Roles        []string          `json:"roles,omitempty"`
+	IdentityFile string            `json:"identity_file,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Port         string            `json:"port,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+}
+
+// inventoryLockPath returns the path of the inventory lock of network.
+func inventoryLockPath(dir, network string) string {
+	return filepath.Join(dir, network+".inventory.json")
+}
+
+// dynamic reports whether the hosts of the network are resolved when
+// it's loaded, by its inventory or a provider.
+func (n *Network) dynamic() bool {
+	return n.Inventory != "" || n.Provider != "" || n.AWS != nil || n.Terraform != nil || n.Consul != nil || n.Etcd != nil
+}
+
+// SaveInventory saves the hosts of network to its inventory lock in dir,
+// if the network has a dynamic inventory, see Network.dynamic.
+func SaveInventory(dir string, network *Network) error {
+	if !network.dynamic() {
+		return nil
+	}
+	lock := InventoryLock{Network: network.Name, Resolved: time.Now().UTC()}
+	for _, host := range network.Hosts {
+		lock.Hosts = append(lock.Hosts, LockedHost{
+			Addr:         host.Addr,
+			Roles:        host.Roles,
+			IdentityFile: host.IdentityFile,
+			User:         host.User,
+			Port:         host.Port,
+			Meta:         host.Meta,
+		})
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "creating state directory failed")
+	}
+	return ioutil.WriteFile(inventoryLockPath(dir, network.Name), append(data, '\n'), 0644)
+}
+
+// FreezeInventory replaces the hosts of network by the ones of its
+// inventory lock in dir, instead of resolving its inventory and provider
+// (see Network.ResolveHosts), which aren't run then. The hosts still in the
+// network keep their current settings, e.g. env vars and password. Static
+// networks are left as they are.
+func FreezeInventory(dir string, network *Network) error {
+	if !network.dynamic() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(inventoryLockPath(dir, network.Name))
+	if os.IsNotExist(err) {
+		return ErrNoInventoryLock{network.Name}
+	}
+	if err != nil {
+		return err
+	}
+	var lock InventoryLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return errors.Wrapf(err, "network %v: invalid inventory lock", network.Name)
+	}
+
+	current := map[string]Host{}
+	for _, host := range network.Hosts {
+		current[host.Addr] = host
+	}
+	var hosts []Host
+	for _, locked := range lock.Hosts {
+		if host, ok := current[locked.Addr]; ok {
+			hosts = append(hosts, host)
+			continue
+		}
+		hosts = append(hosts, Host{
+			Addr:         locked.Addr,
+			Roles:        locked.Roles,
+			IdentityFile: locked.IdentityFile,
+			User:         locked.User,
+			Port:         locked.Port,
+			Meta:         locked.Meta,
+		})
+	}
+	network.Hosts = hosts
+	return nil
+}
+
+// ErrNoInventoryLock is returned by FreezeInventory when no run resolved
+// the inventory of the network yet.
+type ErrNoInventoryLock struct {
+	Network string
+}
+
+func (e ErrNoInventoryLock) Error() string {
+	return fmt.Sprintf("network %v: no inventory saved yet, run once without --frozen-inventory", e.Network)
+}
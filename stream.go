@@ -0,0 +1,70 @@
+package sup
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+)
+
+// outputBufferSize is the size of the buffer used to read the output
+// of a single host. Longer lines are written in multiple chunks, so the
+// memory used per host is bounded no matter what the host outputs.
+const outputBufferSize = 32 * 1024
+
+// syncWriter serializes writes to w, so the lines of multiple hosts
+// don't interleave. While w blocks (e.g. on a slow terminal), the writers
+// of all hosts block too: the hosts' output stops being read and the
+// remote commands get throttled by the SSH flow control, instead of the
+// output piling up in memory.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Outputs shared by all hosts.
+var (
+	stdoutWriter = &syncWriter{w: os.Stdout}
+	stderrWriter = &syncWriter{w: os.Stderr}
+)
+
+// copyPrefixed copies src to dst line by line, prepending every line
+// with prefix. A last line without newline is terminated by one.
+func copyPrefixed(dst io.Writer, src io.Reader, prefix string) error {
+	r := bufio.NewReaderSize(src, outputBufferSize)
+	buf := make([]byte, 0, len(prefix)+outputBufferSize+1)
+	lineStart := true
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) > 0 {
+			buf = buf[:0]
+			if lineStart {
+				buf = append(buf, prefix...)
+			}
+			buf = append(buf, chunk...)
+			lineStart = chunk[len(chunk)-1] == '\n'
+			if err == io.EOF && !lineStart {
+				buf = append(buf, '\n')
+			}
+			if _, err := dst.Write(buf); err != nil {
+				return err
+			}
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sudoTimeout is how long a validated sudo timestamp is trusted before
+// it's validated again. It's below sudo's default timestamp_timeout.
+const sudoTimeout = 4 * time.Minute
+
+// validateSudo validates the sudo credentials ("sudo -v") on the clients
+// whose host wasn't validated within sudoTimeout, so the sudo commands
+// of the run don't prompt for a password. The password, the host's own
+// one if resolved by the network's sudo_password, is written to the STDIN
+// of the validation command only; without a password, it's expected to be
+// cached already or not required at all.
+func (sup *Stackup) validateSudo(r *runState, clients []Client) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(clients))
+
+	for _, c := range clients {
+		host := r.hostName(c)
+		r.sudoMu.Lock()
+		validated, ok := r.sudo[host]
+		r.sudoMu.Unlock()
+		if ok && time.Since(validated) < sudoTimeout {
+			continue
+		}
+
+		password, ok := r.sudoPass[c]
+		if !ok {
+			password = sup.sudoPassword
+		}
+
+		wg.Add(1)
+		go func(c Client, host, password string) {
+			defer wg.Done()
+			started := time.Now()
+			if err := sup.sudoValidate(c, password); err != nil {
+				r.report.setHost(host, HostFailed, 0, err)
+				errCh <- errors.Wrap(err, sup.clientPrefix(c, r.maxLen)+"sudo validation failed")
+				return
+			}
+			r.sudoMu.Lock()
+			r.sudo[host] = started
+			r.sudoMu.Unlock()
+		}(c, host, password)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		return err
+	}
+	return nil
+}
+
+// sudoValidate runs "sudo -v" on c, by password if it's not empty.
+func (sup *Stackup) sudoValidate(c Client, password string) error {
+	task := &Task{Run: "sudo -n -v"}
+	if password != "" {
+		task.Run = "sudo -S -p '' -v"
+	}
+	if err := c.Run(task); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ioutil.Discard, c.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&stderr, c.Stderr())
+	}()
+
+	if password != "" {
+		io.WriteString(c.Stdin(), password+"\n")
+	}
+	c.WriteClose()
+	wg.Wait()
+
+	if err := c.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -1,24 +1,53 @@
 package sup
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh"
 )
 
 const VERSION = "0.5"
 
+// Stackup runs commands of a Supfile. Once configured by its setters,
+// a Stackup is safe for concurrent use: every Run keeps its own state
+// and doesn't modify the network, the env vars or the commands given.
 type Stackup struct {
 	conf   *Supfile
 	debug  bool
 	prefix bool
+	auth   Authorizer
+	tracer *Tracer
+	mock   *Mock
+	resume bool
+	log    *debugLog
+	chaos  *chaos
+
+	sudoPassword string
+	sshPassword  string
+	reportFile   string
+	refresh      bool
+	stateDir     string
+	agentSocket  string
+
+	hostKeyChecking string // Overrides Network.StrictHostKeyChecking.
+
+	interactive bool // Read the controls of the runs from the terminal, see controls.
+
+	connectTimeout    time.Duration // Overrides Network.ConnectTimeout.
+	keepaliveInterval time.Duration // Overrides Network.KeepaliveInterval.
 }
 
 func New(conf *Supfile) (*Stackup, error) {
@@ -31,218 +60,1105 @@ func New(conf *Supfile) (*Stackup, error) {
 // TODO: This megamoth method needs a big refactor and should be split
 //       to multiple smaller methods.
 func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
+	return sup.RunContext(context.Background(), network, envVars, commands...)
+}
+
+// RunContext is like Run, but it stops when ctx is canceled: the running
+// commands are interrupted, as on Ctrl-C, and no further commands are run.
+func (sup *Stackup) RunContext(ctx context.Context, network *Network, envVars EnvList, commands ...*Command) error {
 	if len(commands) == 0 {
 		return errors.New("no commands to be run")
 	}
 
-	env := envVars.AsExport()
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	r := &runState{
+		ctx:  ctx,
+		span: sup.tracer.Start(nil, "sup.run", "sup.network", network.Name, "sup.commands", strings.Join(names, " ")),
+		report: &RunReport{
+			Network: network.Name,
+			Target:  targetName(commands),
+			User:    envVars.Get("SUP_USER"),
+			Start:   time.Now(),
+		},
+		hosts:    map[Client]Host{},
+		sudo:     map[string]time.Time{},
+		sudoPass: map[Client]string{},
+	}
+	if sup.conf.Notify != nil {
+		r.report.GitSHA = gitSHA()
+	}
+	for _, err := range sup.conf.Notify.SendStart(network, r.report) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	// Journal the progress of the run, see openJournal.
+	if sup.mock == nil {
+		j, err := openJournal(journalPath(sup.stateDirectory(), network.Name), commands, sup.resume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "opening journal failed"))
+		}
+		r.journal = j
+	}
+
+	// Let the operator skip hosts and pause the run, see controls.
+	if sup.interactive {
+		c, err := openControls()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "enabling interactive controls failed"))
+		}
+		r.controls = c
+		defer c.close()
+	}
+
+	err := sup.run(r, network, envVars, commands...)
+	if err != nil && (ctx.Err() != nil || atomic.LoadInt32(&r.interrupted) != 0) {
+		err = ErrCanceled{err}
+	}
+	r.journal.end(err)
+	if r.results != "" {
+		os.Remove(r.results)
+	}
+
+	r.span.End(err)
+	r.report.Duration = time.Since(r.report.Start)
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	if err := r.span.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := sup.conf.Metrics.RunFinished(network.Name, r.report.Target, r.report.Start, err); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	for _, err := range sup.conf.Notify.Send(network, r.report) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if sup.reportFile != "" {
+		if err := r.report.writeFile(sup.reportFile); err != nil {
+			fmt.Fprintf(os.Stderr, "writing report failed: %v\n", err)
+		}
+	}
+	return err
+}
+
+// runState holds the state of a single Run.
+type runState struct {
+	ctx     context.Context
+	span    *Span
+	report  *RunReport
+	env     string
+	clients []Client        // Connected once per run, the tasks run in sessions of their connections.
+	hosts   map[Client]Host // Hosts of the connected clients.
+	maxLen  int             // Max length of the clients' prefixes.
+
+	async    sync.WaitGroup // Async local commands running in background.
+	asyncMu  sync.Mutex
+	asyncErr error  // First error of the async commands.
+	results  string // Path of the $SUP_RESULTS file, if any.
+
+	hostCache *hostCache // Facts of the hosts cached between runs, if enabled.
+	journal   *journal   // Journal of the progress of the run, if any.
+	controls  *controls  // Interactive controls of the run, if enabled.
+	become    string     // Become method of the network, see Network.BecomeMethod.
+
+	sudoMu   sync.Mutex
+	sudo     map[string]time.Time // Last sudo validation of each host.
+	sudoPass map[Client]string    // Sudo passwords of the hosts by the network's sudo_password, if any.
+
+	interrupted int32 // Set atomically when a signal interrupted the run.
+}
+
+// writeResults writes the results of the commands run so far
+// as JSON to a temporary file and returns its path.
+func (r *runState) writeResults() (string, error) {
+	r.asyncMu.Lock()
+	defer r.asyncMu.Unlock()
+
+	if r.results == "" {
+		f, err := ioutil.TempFile("", "sup-results-")
+		if err != nil {
+			return "", errors.Wrap(err, "creating results file failed")
+		}
+		f.Close()
+		r.results = f.Name()
+	}
+
+	data, err := r.report.resultsJSON()
+	if err != nil {
+		return "", errors.Wrap(err, "encoding results failed")
+	}
+	if err := ioutil.WriteFile(r.results, data, 0600); err != nil {
+		return "", errors.Wrap(err, "writing results file failed")
+	}
+	return r.results, nil
+}
+
+// host returns the host c was connected to.
+func (r *runState) host(c Client) Host {
+	if host, ok := r.hosts[c]; ok {
+		return host
+	}
+	return Host{Addr: "localhost"}
+}
+
+// hostName returns the address of the host c was connected to.
+func (r *runState) hostName(c Client) string {
+	return r.host(c).Addr
+}
+
+// commandClients returns the clients of the hosts cmd runs on, not skipped.
+func (r *runState) commandClients(cmd *Command) []Client {
+	clients := r.controls.active(r.clients)
+	if len(cmd.Roles) == 0 && cmd.OnlyHosts == "" && cmd.ExceptHosts == "" {
+		return clients
+	}
+	var matched []Client
+	for _, c := range clients {
+		if cmd.MatchHost(r.host(c)) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// targetName returns a comma separated list of the targets (or commands,
+// if not invoked by a target) the commands were invoked by.
+func targetName(commands []*Command) string {
+	var names []string
+	seen := map[string]bool{}
+	for _, cmd := range commands {
+		name := cmd.Target
+		if name == "" {
+			name = cmd.Name
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (sup *Stackup) run(r *runState, network *Network, envVars EnvList, commands ...*Command) error {
+	if sup.auth != nil {
+		if err := sup.auth.Authorize(network, commands); err != nil {
+			return err
+		}
+	}
+
+	r.become = network.BecomeMethod
+	if r.become == "" {
+		r.become = BecomeSudo
+	}
+
+	// Every host gets its own snapshot of the env vars, isolated
+	// from the caller and from the other hosts.
+	envVars = envVars.Clone()
+	hostEnv := func(h Host) string {
+		env := envVars.Clone()
+		for _, v := range h.Env {
+			env.set(v)
+		}
+		env.Set("SUP_HOST", h.Addr)
+		return env.AsExport()
+	}
+	r.env = envVars.AsExport()
+	sup.log.mask(envVars)
+	for _, v := range envVars {
+		sup.log.logf(DebugEnv, "%v=%v", v.Key, v.Value)
+	}
+	for _, h := range network.Hosts {
+		sup.log.mask(h.Env)
+		for _, v := range h.Env {
+			sup.log.logf(DebugEnv, "%v: %v=%v", h.Addr, v.Key, v.Value)
+		}
+	}
+
+	if sup.mock == nil {
+		if cache, err := openHostCache(network.hostCacheTTL(), sup.refresh); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "reading host cache failed"))
+		} else {
+			r.hostCache = cache
+		}
+	}
+	defer func() {
+		if err := r.hostCache.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "writing host cache failed"))
+		}
+	}()
+
+	// Connect through the sup agent, if it's running, see Agent. Forwarding
+	// the ssh-agent takes connections of our own, though.
+	forwardAgent := network.AgentForwarding
+	for _, cmd := range commands {
+		forwardAgent = forwardAgent || cmd.AgentForwarding
+	}
+	// The agent's pooled connections may not be strict, see SecurityStrict.
+	strict := sup.conf.SecurityProfile == SecurityStrict
+	useAgent := sup.agentSocket != "" && sup.mock == nil && !forwardAgent && !strict && agentRunning(sup.agentSocket)
+
+	// Check the host keys, see Network.StrictHostKeyChecking.
+	hostKeyChecking := network.StrictHostKeyChecking
+	if sup.hostKeyChecking != "" {
+		hostKeyChecking = sup.hostKeyChecking
+	}
+	if strict {
+		if err := checkStrictHostKeys(hostKeyChecking); err != nil {
+			return err
+		}
+		hostKeyChecking = HostKeyCheckingYes
+	}
+	knownHosts, khErr := loadKnownHosts(network.KnownHosts, hostKeyChecking)
+	if khErr != nil {
+		return errors.Wrap(khErr, "reading known_hosts failed")
+	}
+
+	// Resolve the sudo passwords of the hosts, if the commands need them
+	// and none was given, see Network.SudoPassword.
+	resolveSudo := sup.sudoPassword == "" && network.SudoPassword != ""
+	if resolveSudo {
+		resolveSudo = false
+		for _, cmd := range commands {
+			resolveSudo = resolveSudo || cmd.Sudo || cmd.Become
+		}
+	}
+
+	// Authenticate by a password the hosts without one of their own.
+	password := sup.sshPassword
+	if password == "" {
+		var pwErr error
+		if password, pwErr = network.password(envVars); pwErr != nil {
+			return pwErr
+		}
+	}
+	if strict && password != "" {
+		return ErrSecurityProfile{"password auth is forbidden"}
+	}
+
+	// Time out connecting to, and keep alive the connections of, the hosts.
+	connectTimeout, keepalive := time.Duration(network.ConnectTimeout), time.Duration(network.KeepaliveInterval)
+	if sup.connectTimeout > 0 {
+		connectTimeout = sup.connectTimeout
+	}
+	if sup.keepaliveInterval > 0 {
+		keepalive = sup.keepaliveInterval
+	}
 
 	// Create clients for every host (either SSH or Localhost).
 	var bastion *SSHClient
-	if network.Bastion != "" {
-		bastion = &SSHClient{}
-		if err := bastion.Connect(network.Bastion); err != nil {
+	if jumpHosts := network.jumpHosts(); len(jumpHosts) > 0 && !useAgent {
+		err := network.retryConnect(sup.log, func() (err error) {
+			jumps := &SSHClient{knownHosts: knownHosts, timeout: connectTimeout, keepalive: keepalive, strict: strict, log: sup.log}
+			bastion, err = connectJumpHosts(jumpHosts, jumps, 0)
+			return err
+		})
+		if err != nil {
 			return errors.Wrap(err, "connecting to bastion failed")
 		}
+		defer bastion.Close()
+	}
+
+	type hostClient struct {
+		i        int // Index of the host in the network.
+		host     Host
+		client   Client
+		sudoPass string // Resolved by the network's sudo_password, if any.
 	}
 
 	var wg sync.WaitGroup
-	clientCh := make(chan Client, len(network.Hosts))
+	clientCh := make(chan hostClient, len(network.Hosts))
 	errCh := make(chan error, len(network.Hosts))
+	skippedCh := make(chan error, len(network.Hosts))
 
-	for i, host := range network.Hosts {
-		wg.Add(1)
-		go func(i int, host string) {
-			defer wg.Done()
+	prefix, _ := network.prefixTemplate() // Validated by NewSupfile.
+	connect := func(i int, h Host) {
+		host := h.Addr
+		label := ""
+		if prefix != nil {
+			label = h.label(prefix)
+			r.report.setLabel(host, label)
+		}
 
-			// Localhost client.
-			if host == "localhost" {
-				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
-				}
-				if err := local.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to localhost failed")
-					return
-				}
-				clientCh <- local
-				return
+		connSpan := sup.tracer.Start(r.span, "sup.connect", "sup.host", host)
+		var err error
+		defer func() {
+			connSpan.End(err)
+			if err != nil {
+				r.report.setHost(host, HostUnreachable, 0, err)
 			}
+		}()
 
-			// SSH client.
-			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
+		// Simulated client.
+		if sup.mock != nil {
+			mock := &MockClient{
+				mock:  sup.mock,
+				env:   hostEnv(h),
 				color: Colors[i%len(Colors)],
+				label: label,
 			}
+			mock.Connect(host)
+			clientCh <- hostClient{i, h, mock, ""}
+			return
+		}
 
-			if bastion != nil {
-				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
-					return
-				}
-			} else {
-				if err := remote.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host failed")
-					return
+		// Localhost client, running the commands locally, or in a container
+		// or an SSM session by a local process, depending on the transport.
+		transport, err := h.Transport()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if transport != TransportSSH {
+			var args func(string) []string
+			if args, err = h.execArgs(transport); err != nil {
+				errCh <- err
+				return
+			}
+			local := &LocalhostClient{
+				env:   hostEnv(h),
+				label: label,
+				args:  args,
+			}
+			if host != "localhost" {
+				// Virtual hosts, e.g. local://arm64, are prefixed like remote hosts.
+				local.color = Colors[i%len(Colors)]
+				if label == "" {
+					local.label = host
 				}
 			}
-			clientCh <- remote
-		}(i, host)
+			if err = local.Connect(host); err != nil {
+				errCh <- errors.Wrap(err, "connecting to localhost failed")
+				return
+			}
+			clientCh <- hostClient{i, h, local, ""}
+			return
+		}
+
+		// Skip the hosts known to be dead, instead of waiting for them
+		// to time out again.
+		if err = r.hostCache.unreachable(host); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			skippedCh <- err
+			return
+		}
+
+		// Spread the connections in time, so sshd doesn't throttle them.
+		if jitter := network.connectJitter(); jitter > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+		}
+
+		// SSH client.
+		if h.IdentityFile == "" {
+			h.IdentityFile = network.IdentityFile
+		}
+		addr, identityFile, err := h.credentials(envVars)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		sudoPass := sup.sudoPassword
+		if resolveSudo {
+			if sudoPass, err = network.sudoPassword(h); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		var remote *SSHClient
+		err = network.retryConnect(sup.log, func() error {
+			remote = &SSHClient{
+				env:          hostEnv(h),
+				color:        Colors[i%len(Colors)],
+				identityFile: identityFile,
+				password:     password,
+				forwardAgent: network.AgentForwarding,
+				becomePass:   sudoPass,
+				knownHosts:   knownHosts,
+				timeout:      connectTimeout,
+				keepalive:    keepalive,
+				label:        label,
+				strict:       strict,
+				log:          sup.log,
+			}
+			if useAgent {
+				dial := agentDialer(sup.agentSocket, agentTarget{addr, identityFile, password, network.jumpHosts(), network.KnownHosts, hostKeyChecking, connectTimeout, keepalive})
+				return errors.Wrap(remote.ConnectWith(addr, dial), "connecting to remote host through sup agent failed")
+			}
+			if bastion != nil {
+				return errors.Wrap(remote.ConnectWith(addr, bastion.DialThrough), "connecting to remote host through bastion failed")
+			}
+			return errors.Wrap(remote.Connect(addr), "connecting to remote host failed")
+		})
+		if _, ok := errors.Cause(err).(ErrConnect); ok || err == nil {
+			r.hostCache.connected(host, err)
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		identity := remote.Identity()
+		if useAgent {
+			// The agent authenticated to the host, not this connection.
+			identity = ConnIdentity{User: identity.User, AuthMethod: "sup agent", Connected: identity.Connected}
+		}
+		r.report.setIdentity(host, identity)
+		clientCh <- hostClient{i, h, remote, sudoPass}
 	}
+
+	// Connect to the hosts by a pool of workers, instead of dialing
+	// all of them at once.
+	hostCh := make(chan int)
+	for w := 0; w < network.connectConcurrency(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range hostCh {
+				connect(i, network.Hosts[i])
+			}
+		}()
+	}
+	for i, h := range network.Hosts {
+		r.report.host(h.Addr)
+		hostCh <- i
+	}
+	close(hostCh)
 	wg.Wait()
 	close(clientCh)
 	close(errCh)
+	close(skippedCh)
 
-	maxLen := 0
-	var clients []Client
-	for client := range clientCh {
+	// Keep the clients in the order of the network's hosts, rather than
+	// the order they connected in, so "once" and "serial" are predictable.
+	var connected []hostClient
+	for hc := range clientCh {
+		connected = append(connected, hc)
+	}
+	sort.Slice(connected, func(i, j int) bool { return connected[i].i < connected[j].i })
+	for _, hc := range connected {
+		client := hc.client
 		if remote, ok := client.(*SSHClient); ok {
 			defer remote.Close()
 		}
 		_, prefixLen := client.Prefix()
-		if prefixLen > maxLen {
-			maxLen = prefixLen
+		if prefixLen > r.maxLen {
+			r.maxLen = prefixLen
+		}
+		r.clients = append(r.clients, client)
+		r.hosts[client] = hc.host
+		if hc.sudoPass != "" {
+			r.sudoPass[client] = hc.sudoPass
 		}
-		clients = append(clients, client)
 	}
 	for err := range errCh {
 		return errors.Wrap(err, "connecting to clients failed")
 	}
+	for err := range skippedCh {
+		if len(r.clients) == 0 {
+			return errors.Wrap(err, "no reachable hosts")
+		}
+	}
+	if err := sup.checkClocks(r, network); err != nil {
+		return err
+	}
 
 	// Run command or run multiple commands defined by target sequentially.
+	// Async commands run in background and are waited for at the end.
+	var err error
 	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
+		if err = r.ctx.Err(); err != nil {
+			break
+		}
+		if cmd.Async {
+			sup.runAsync(r, cmd)
+			continue
+		}
+		cmdSpan := sup.tracer.Start(r.span, "sup.command", "sup.command", cmd.Name)
+		err = sup.runCachedCommand(r, cmdSpan, cmd)
+		cmdSpan.End(err)
 		if err != nil {
-			return errors.Wrap(err, "creating task failed")
+			break
 		}
+	}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+	r.async.Wait()
+	if err == nil {
+		err = r.asyncErr
+	}
+	if hosts := r.controls.skippedHosts(); err == nil && len(hosts) > 0 {
+		err = ErrSkipped{hosts}
+	}
+	return err
+}
 
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
+// runAsync runs cmd in background.
+func (sup *Stackup) runAsync(r *runState, cmd *Command) {
+	r.async.Add(1)
+	go func() {
+		defer r.async.Done()
+
+		cmdSpan := sup.tracer.Start(r.span, "sup.command", "sup.command", cmd.Name)
+		err := sup.runCachedCommand(r, cmdSpan, cmd)
+		cmdSpan.End(err)
+		if err != nil {
+			r.asyncMu.Lock()
+			if r.asyncErr == nil {
+				r.asyncErr = errors.Wrap(err, cmd.Name)
+			}
+			r.asyncMu.Unlock()
+		}
+	}()
+}
+
+// runCommand translates cmd into task(s) and runs them sequentially.
+func (sup *Stackup) runCommand(r *runState, span *Span, cmd *Command) error {
+	if r.journal.completed(cmd, "") {
+		fmt.Fprintf(os.Stderr, "%v: completed by the resumed run, skipped\n", cmd.Name)
+		return nil
+	}
+	var err error
+	if cmd.Pause != nil {
+		err = sup.pause(r, cmd)
+	} else if cmd.Backup != nil {
+		err = sup.backup(r, cmd)
+	} else {
+		err = sup.runCommandTasks(r, span, cmd)
+	}
+	if err == nil && len(r.controls.skippedHosts()) == 0 {
+		r.journal.record(journalCommand, cmd, "")
+	}
+	return err
+}
+
+// runCommandTasks runs the tasks of cmd, see runCommand.
+func (sup *Stackup) runCommandTasks(r *runState, span *Span, cmd *Command) error {
+	env := r.env
+	if cmd.Local != "" {
+		// Let local commands consume the results of the previous commands.
+		results, err := r.writeResults()
+		if err != nil {
+			return err
+		}
+		env += `export SUP_RESULTS="` + results + `";`
+	}
+
+	clients := r.commandClients(cmd)
+
+	// Skip the hosts the resumed run completed the command on. "once"
+	// commands are completed by any of them.
+	var pending []Client
+	for _, c := range clients {
+		if !r.journal.completed(cmd, r.hostName(c)) {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) < len(clients) {
+		if cmd.Once || len(pending) == 0 {
+			fmt.Fprintf(os.Stderr, "%v: completed by the resumed run, skipped\n", cmd.Name)
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "%v: completed on %v host(s) by the resumed run, skipped there\n", cmd.Name, len(clients)-len(pending))
+		clients = pending
+	}
+
+	clients, err := sup.checkRequires(r, cmd, clients)
+	if err != nil {
+		return err
+	}
+
+	tasks, err := sup.createTasks(r, cmd, clients, env)
+	if err != nil {
+		return errors.Wrap(err, "creating task failed")
+	}
+	copies, err := sup.copyTasks(r, cmd, clients)
+	if err != nil {
+		return errors.Wrap(err, "creating task failed")
+	}
+	tasks = append(copies, tasks...)
+
+	// The hosts complete the command by their last task.
+	last := map[Client]*Task{}
+	for _, task := range tasks {
+		for _, c := range task.Clients {
+			last[c] = task
+		}
+	}
+	for c, task := range last {
+		if _, ok := r.hosts[c]; ok {
+			if task.completes == nil {
+				task.completes = map[Client]bool{}
+			}
+			task.completes[c] = true
+		}
+	}
+
+	var updated []Client
+	for _, task := range tasks {
+		r.controls.wait(r.ctx)
+		if task.Clients = r.controls.active(task.Clients); len(task.Clients) == 0 {
+			continue
+		}
+		// Hosts are updated by their last task, the ones only uploaded
+		// to by earlier tasks aren't rolled back.
+		var batch []Client
+		for _, c := range task.Clients {
+			if task.completes[c] {
+				batch = append(batch, c)
+			}
+		}
+		updated = append(updated, batch...)
+
+		var taskSpan *Span
+		if task.Upload != nil {
+			taskSpan = sup.tracer.Start(span, "sup.upload", "sup.upload.src", task.Upload.Src, "sup.upload.dst", task.Upload.Dst)
+		}
+		err := r.ctx.Err()
+		if err == nil && cmd.Sudo {
+			err = sup.validateSudo(r, task.Clients)
+		}
+		if err == nil {
+			err = sup.runTask(r, cmd, task)
+		}
+		taskSpan.End(err)
+		if err == nil && cmd.HealthCheck != "" && len(batch) > 0 {
+			err = sup.healthCheck(r, cmd, batch)
+		}
+		if err != nil {
+			if cmd.Serial > 0 && cmd.OnBatchFailure != "" && r.ctx.Err() == nil {
+				updated = r.controls.active(updated)
+				sup.rollback(r, cmd, updated)
+				for _, c := range updated {
+					r.journal.record(journalUndone, cmd, r.hostName(c))
 				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// runTask runs a single task on all of its clients in parallel and waits
+// for them to finish. It returns ErrTaskExit if the task fails on any host.
+func (sup *Stackup) runTask(r *runState, cmd *Command, task *Task) error {
+	var writers []io.Writer
+	ioDone := map[Client]*sync.WaitGroup{}
+	started := time.Now()
+	outputs := map[Client]*bytes.Buffer{}
+	limits := map[Client]*outputLimit{}
+
+	// Show the progress of uploads, see uploadProgress.
+	// Resume interrupted uploads, see remoteUploadCommand.
+	var progress *uploadProgress
+	var offsets map[Client]int64
+	if stream, ok := task.Input.(*uploadStream); ok && task.Upload != nil {
+		if sup.resume {
+			offsets = sup.resumeOffsets(task, stream)
+		}
+		progress = newUploadProgress(task.Upload, stream)
+	}
+
+	// Run tasks on the provided clients.
+	for _, c := range task.Clients {
+		prefix := sup.clientPrefix(c, r.maxLen)
+
+		sup.log.logf(DebugExec, "%v: %v", r.hostName(c), task.Command(clientEnv(c)))
+		err := c.Run(task)
+		if err != nil {
+			r.report.setHost(r.hostName(c), HostFailed, 0, err)
+			return errors.Wrap(err, prefix+"task failed")
+		}
+
+		// Bound the output of the command, see Command.MaxOutput.
+		limit := newOutputLimit(cmd, func(c Client) func() {
+			return func() { c.Signal(os.Interrupt) }
+		}(c))
+		limits[c] = limit
+
+		// Copy over tasks's STDOUT, capturing it if requested.
+		stdout := limit.Reader(outputReader(cmd, c.Stdout()))
+		if cmd.Capture {
+			outputs[c] = &bytes.Buffer{}
+			stdout = io.TeeReader(stdout, outputs[c])
+		}
+		wg := &sync.WaitGroup{}
+		ioDone[c] = wg
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			if err := copyPrefixed(stdoutWriter, stdout, prefix); err != nil {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
+			}
+		}(c)
 
-				err := c.Run(task)
+		// Copy over tasks's STDERR.
+		wg.Add(1)
+		go func(c Client, limit *outputLimit) {
+			defer wg.Done()
+			if err := copyPrefixed(stderrWriter, limit.Reader(outputReader(cmd, c.Stderr())), prefix); err != nil {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
+			}
+		}(c, limit)
+
+		if progress != nil {
+			writers = append(writers, r.controls.writer(c, progress.writer(c, r.hostName(c), prefix, offsets[c])))
+		} else {
+			writers = append(writers, r.controls.writer(c, c.Stdin()))
+		}
+	}
+	stopProgress := make(chan struct{})
+	if progress != nil {
+		go progress.show(stopProgress)
+	}
+
+	// Copy over task's STDIN. The files copied from another host
+	// fail the task if reading them fails, see copyTasks.
+	stream, fromHost := task.Input.(*remoteStream)
+	streamErr := make(chan error, 1)
+	if task.Input != nil {
+		go func() {
+			writer := io.MultiWriter(writers...)
+			_, err := io.Copy(writer, task.Input)
+			if fromHost {
+				stream.Close()
+				streamErr <- err
+			} else if err != nil && err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
+			}
+			// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+			for _, c := range task.Clients {
+				c.WriteClose()
+			}
+		}()
+	}
+
+	// Catch OS signals and pass them to all active clients.
+	// Canceling the run interrupts them the same way.
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	go func() {
+		done := r.ctx.Done()
+		for {
+			sig, ok := os.Signal(os.Interrupt), true
+			select {
+			case sig, ok = <-trap:
+				if !ok {
+					return
+				}
+				atomic.StoreInt32(&r.interrupted, 1)
+			case <-done:
+				done = nil
+			}
+			for _, c := range task.Clients {
+				err := c.Signal(sig)
 				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
+					fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
 				}
+			}
+		}
+	}()
+	// Stop catching signals for the currently active clients.
+	defer func() {
+		signal.Stop(trap)
+		close(trap)
+	}()
+
+	// Make sure each client finishes the task, after all of its I/O,
+	// collect the exit statuses. The hosts skipped meanwhile (see
+	// controls) are no longer waited for.
+	var mu sync.Mutex
+	finished := map[Client]bool{}
+	finishedCh := make(chan struct{}, len(task.Clients))
+	statusCh := make(chan int, len(task.Clients))
+	for _, c := range task.Clients {
+		go func(c Client) {
+			ioDone[c].Wait()
+			err := sup.chaos.inject(c.Wait())
+			limits[c].Close()
+			mu.Lock()
+			skipped := r.controls.isSkipped(c)
+			finished[c] = !skipped
+			mu.Unlock()
+			if skipped {
+				return
+			}
+			defer func() { finishedCh <- struct{}{} }()
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
-
-				writers = append(writers, c.Stdin())
-			}
-
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
-					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
-			}
-
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
-			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
-						}
-					}
+			if limits[c].Exceeded() && cmd.OnMaxOutput == MaxOutputFail {
+				err = ErrMaxOutput{cmd.MaxOutput.String()}
+			}
+			host := r.hostName(c)
+			r.report.addHostDuration(host, time.Since(started))
+			sup.log.logf(DebugExec, "%v: finished after %v: %v", host, time.Since(started), errorOrOK(err))
+			if progress != nil {
+				progress.finish(c, r.report, err == nil)
+			}
+			result := &CommandResult{Host: host, Status: HostOK}
+			if buf, ok := outputs[c]; ok {
+				result.Output = buf.String()
+			}
+			if err == nil {
+				r.report.setHost(host, HostOK, 0, nil)
+				r.report.setResult(cmd.Name, result)
+				if task.completes[c] {
+					r.journal.record(journalHost, cmd, host)
 				}
-			}()
+				return
+			}
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+			prefix := sup.clientPrefix(c, r.maxLen)
+			status := 1
+			if e, ok := err.(interface{ ExitStatus() int }); ok && e.ExitStatus() != 15 {
+				status = e.ExitStatus()
+			}
+			fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
+			r.report.setHost(host, HostFailed, status, err)
+			result.Status, result.ExitStatus = HostFailed, status
+			r.report.setResult(cmd.Name, result)
+			statusCh <- status
+		}(c)
+	}
 
-			// Make sure each client finishes the task, return on failure.
+	// Wait for all commands to finish.
+	skipCh := make(chan struct{}, 1)
+	stopSkipping := r.controls.skipping(func() {
+		select {
+		case skipCh <- struct{}{}:
+		default:
+		}
+	})
+	for pending := len(task.Clients); pending > 0; {
+		select {
+		case <-finishedCh:
+			pending--
+		case <-skipCh:
+			var skipped []Client
+			mu.Lock()
 			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
-
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
-			}
-
-			// Wait for all commands to finish.
-			wg.Wait()
-
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+				if !finished[c] && r.controls.skip(c, r.hostName(c)) {
+					skipped = append(skipped, c)
+				}
+			}
+			mu.Unlock()
+			for _, c := range skipped {
+				host := r.hostName(c)
+				fmt.Fprintf(os.Stderr, "%sskipped\n", sup.clientPrefix(c, r.maxLen))
+				r.report.setHost(host, HostFailed, 0, errors.New("skipped by the operator"))
+				r.report.setResult(cmd.Name, &CommandResult{Host: host, Status: HostFailed})
+				abandon(c)
+				pending--
+			}
 		}
 	}
+	stopSkipping()
+	close(stopProgress)
+	close(statusCh)
 
+	if fromHost {
+		if err := <-streamErr; err != nil {
+			return err
+		}
+	}
+	if failed := len(statusCh); failed > 0 {
+		return ErrTaskExit{Status: <-statusCh, Partial: failed < len(task.Clients)}
+	}
 	return nil
 }
 
+// rollback runs the rollback target configured by cmd.OnBatchFailure
+// on the clients that were already updated by cmd: the ones of the batches
+// run so far, including the failed one. Failures are reported
+// to STDERR only, since the original batch failure is what gets returned.
+func (sup *Stackup) rollback(r *runState, cmd *Command, clients []Client) {
+	target := cmd.RollbackTarget()
+	fmt.Fprintf(os.Stderr, "%v: batch failed, running rollback target %v on %v host(s)\n", cmd.Name, target, len(clients))
+
+	rollback, _ := sup.conf.Targets.Get(target)
+	rollbackCmds, err := rollback.Resolve(sup.conf, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "rollback"))
+		return
+	}
+	for _, rollbackCmd := range rollbackCmds {
+		var matching []Client
+		for _, c := range clients {
+			if rollbackCmd.MatchHost(r.host(c)) {
+				matching = append(matching, c)
+			}
+		}
+
+		tasks, err := sup.createTasks(r, rollbackCmd, matching, r.env)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "rollback: creating task failed"))
+			return
+		}
+		for _, task := range tasks {
+			if err := sup.runTask(r, rollbackCmd, task); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "rollback: "+rollbackCmd.Name))
+				return
+			}
+		}
+	}
+}
+
+// clientPrefix returns the left-padded output prefix of c,
+// or an empty string if prefixing is disabled.
+func (sup *Stackup) clientPrefix(c Client, maxLen int) string {
+	if !sup.prefix {
+		return ""
+	}
+	prefix, prefixLen := c.Prefix()
+	if prefixLen < maxLen { // Left padding.
+		prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
+	}
+	return prefix
+}
+
+// ErrTaskExit is returned when a task exits with a non-zero status on
+// at least one host. The failure itself has already been reported to STDERR.
+type ErrTaskExit struct {
+	Status  int
+	Partial bool // The task succeeded on some of its hosts.
+}
+
+func (e ErrTaskExit) Error() string {
+	return fmt.Sprintf("task exited with status %v", e.Status)
+}
+
 func (sup *Stackup) Debug(value bool) {
 	sup.debug = value
 }
 
+// DebugLog writes the detailed debug log of the given facets (DebugSSH,
+// DebugExec, DebugEnv, DebugUpload or "all") to w.
+func (sup *Stackup) DebugLog(w io.Writer, facets ...string) error {
+	enabled := map[string]bool{}
+	for _, facet := range facets {
+		switch facet {
+		case "all":
+			for _, f := range debugFacets {
+				enabled[f] = true
+			}
+		case DebugSSH, DebugExec, DebugEnv, DebugUpload:
+			enabled[facet] = true
+		default:
+			return fmt.Errorf("unknown debug facet %q, expected %v or all", facet, strings.Join(debugFacets, ", "))
+		}
+	}
+	sup.log = &debugLog{w: w, facets: enabled}
+	return nil
+}
+
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// Tracer sets the tracer receiving spans of every run.
+func (sup *Stackup) Tracer(tracer *Tracer) {
+	sup.tracer = tracer
+}
+
+// Authorizer sets the authorization layer consulted before every run.
+func (sup *Stackup) Authorizer(auth Authorizer) {
+	sup.auth = auth
+}
+
+// Mock makes the runs simulate the hosts (including localhost)
+// by mock, instead of connecting to them.
+func (sup *Stackup) Mock(mock *Mock) {
+	sup.mock = mock
+}
+
+// ResumeUploads makes the uploads continue from where they got interrupted
+// before, as long as the uploaded files didn't change.
+func (sup *Stackup) ResumeUploads(value bool) {
+	sup.resume = value
+}
+
+// Chaos injects failures and latency into the tasks run on the hosts,
+// by a spec like "fail=5%,latency=200ms": fail the tasks on 5% of the hosts
+// and delay them by up to 200ms. Use it with the mock transport, or in
+// staging, to test that error handling behaves as intended.
+func (sup *Stackup) Chaos(spec string) error {
+	c, err := parseChaos(spec)
+	if err != nil {
+		return err
+	}
+	sup.chaos = c
+	return nil
+}
+
+// ReportFile makes the runs write their RunReport to path, as JSON,
+// e.g. to rerun the failed hosts only, see ReadReport. path may be an
+// "s3://" or "gs://" URL too.
+func (sup *Stackup) ReportFile(path string) {
+	sup.reportFile = path
+}
+
+// RefreshHostCache makes the runs probe all the hosts again, ignoring
+// the facts cached by the previous runs, see Network.HostCache.
+func (sup *Stackup) RefreshHostCache(value bool) {
+	sup.refresh = value
+}
+
+// StateDir sets the state directory of the project, see StateDir,
+// keeping e.g. the build cache of the commands, see Command.CacheKey.
+// Defaults to ".sup/state".
+func (sup *Stackup) StateDir(dir string) {
+	sup.stateDir = dir
+}
+
+func (sup *Stackup) stateDirectory() string {
+	if sup.stateDir != "" {
+		return sup.stateDir
+	}
+	return filepath.Join(".sup", "state")
+}
+
+// Agent makes the runs connect to the hosts through the sup agent
+// listening on socket, if it's running, see Agent.
+func (sup *Stackup) Agent(socket string) {
+	sup.agentSocket = socket
+}
+
+// HostKeyChecking overrides the strict_host_key_checking of the networks:
+// "yes", "accept-new" or "no", see Network.StrictHostKeyChecking.
+func (sup *Stackup) HostKeyChecking(mode string) error {
+	switch mode {
+	case "", HostKeyCheckingYes, HostKeyCheckingAcceptNew, HostKeyCheckingNo:
+	default:
+		return fmt.Errorf("unsupported host key checking %q", mode)
+	}
+	sup.hostKeyChecking = mode
+	return nil
+}
+
+// Interactive makes the runs read keys from the terminal, letting the
+// operator skip the hosts still running and pause the runs, see controls.
+func (sup *Stackup) Interactive(value bool) {
+	sup.interactive = value
+}
+
+// ConnectTimeout overrides the connect_timeout of the networks,
+// see Network.ConnectTimeout.
+func (sup *Stackup) ConnectTimeout(d time.Duration) {
+	sup.connectTimeout = d
+}
+
+// KeepaliveInterval overrides the keepalive_interval of the networks,
+// see Network.KeepaliveInterval.
+func (sup *Stackup) KeepaliveInterval(d time.Duration) {
+	sup.keepaliveInterval = d
+}
+
+// SSHPassword sets the password authenticating to the hosts without
+// a password of their own, overriding the password of the networks.
+func (sup *Stackup) SSHPassword(password string) {
+	sup.sshPassword = password
+}
+
+// SudoPassword sets the password used to validate sudo credentials
+// on the hosts before running commands with sudo enabled.
+func (sup *Stackup) SudoPassword(password string) {
+	sup.sudoPassword = password
+}
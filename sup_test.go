@@ -0,0 +1,155 @@
+package sup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fanyang01/sup/suptest"
+)
+
+func TestRunDialsEveryHostOnce(t *testing.T) {
+	handler := func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(command, "tar") {
+			return suptest.Discard(command, stdin, stdout, stderr)
+		}
+		return 0
+	}
+
+	// Every simulated host has a server of its own, counting its dials.
+	network := &Network{Name: "test"}
+	var servers []*suptest.Server
+	for i := 0; i < 3; i++ {
+		server, err := suptest.NewServer(handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+		network.Hosts = append(network.Hosts, Host{Addr: "host@" + server.Addr()})
+	}
+
+	dir, err := ioutil.TempDir("", "sup-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upload")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := stdoutWriter.w, stderrWriter.w
+	stdoutWriter.w, stderrWriter.w = ioutil.Discard, ioutil.Discard
+	defer func() { stdoutWriter.w, stderrWriter.w = stdout, stderr }()
+
+	commands := []*Command{
+		{Name: "first", Run: "echo first"},
+		{Name: "upload", Upload: []Upload{{Src: file, Dst: "/tmp"}}},
+		{Name: "serial", Run: "echo serial", Serial: 1},
+		{Name: "upload-and-run", Upload: []Upload{{Src: file, Dst: "/tmp"}}, Run: "echo done"},
+	}
+	app, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.StateDir(filepath.Join(dir, "state"))
+	if err := app.Run(network, EnvList{}, commands...); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, server := range servers {
+		if n := len(server.Commands()); n < len(commands)+1 {
+			t.Errorf("host %d: %d commands run, want at least %d", i, n, len(commands)+1)
+		}
+		if n := server.Connections(); n != 1 {
+			t.Errorf("host %d: dialed %d times, want once", i, n)
+		}
+	}
+}
+
+func TestHealthCheckRollsBackBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sup-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	supfile := filepath.Join(dir, "Supfile")
+	err = ioutil.WriteFile(supfile, []byte(`
+version: 0.5
+commands:
+  deploy:
+    run: deploy-step
+    serial: 1
+    health_check: health-probe
+    on_batch_failure: rollback-target=rollback
+  undo:
+    run: undo-step
+targets:
+  rollback:
+    - undo
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewSupfile(supfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The health of the second host regresses once deployed.
+	network := &Network{Name: "test"}
+	var servers []*suptest.Server
+	for i := 0; i < 3; i++ {
+		unhealthy := i == 1
+		server, err := suptest.NewServer(func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			if unhealthy && strings.Contains(command, "health-probe") {
+				return 1
+			}
+			return 0
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+		network.Hosts = append(network.Hosts, Host{Addr: "host@" + server.Addr()})
+	}
+
+	stdout, stderr := stdoutWriter.w, stderrWriter.w
+	stdoutWriter.w, stderrWriter.w = ioutil.Discard, ioutil.Discard
+	defer func() { stdoutWriter.w, stderrWriter.w = stdout, stderr }()
+
+	app, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.StateDir(filepath.Join(dir, "state"))
+	deploy, _ := conf.Commands.Get("deploy")
+	deploy.Name = "deploy"
+	if err := app.Run(network, EnvList{}, &deploy); err == nil {
+		t.Fatal("run succeeded, want the health check to fail it")
+	}
+
+	want := [][]string{
+		{"deploy-step", "health-probe", "undo-step"},
+		{"deploy-step", "health-probe", "undo-step"},
+		nil, // Never deployed.
+	}
+	for i, server := range servers {
+		var got []string
+		for _, command := range server.Commands() {
+			for _, step := range []string{"deploy-step", "health-probe", "undo-step"} {
+				if strings.Contains(command, step) {
+					got = append(got, step)
+				}
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("host %d ran %v, want %v", i, got, want[i])
+		}
+	}
+}
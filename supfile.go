@@ -7,7 +7,12 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -16,49 +21,525 @@ import (
 
 // Supfile represents the Stack Up configuration YAML file.
 type Supfile struct {
-	Networks map[string]Network  `yaml:"networks"`
-	Commands map[string]Command  `yaml:"commands"`
-	Targets  map[string][]string `yaml:"targets"`
-	Env      EnvList             `yaml:"env"`
-	Version  string              `yaml:"version"`
+	Networks Networks     `yaml:"networks"`
+	Commands Commands     `yaml:"commands"`
+	Targets  Targets      `yaml:"targets"`
+	Env      EnvList      `yaml:"env"`
+	Vars     Vars         `yaml:"vars"`
+	Version  string       `yaml:"version"`
+	Freeze   []Freeze     `yaml:"freeze"`
+	AuditLog string       `yaml:"audit_log"`
+	Access   []AccessRule `yaml:"access"`
+	Auth     *Auth        `yaml:"auth"`
+	Policy   *Policy      `yaml:"policy"`
+	Metrics  *Metrics     `yaml:"metrics"`
+	Notify   *Notify      `yaml:"notify"`
+
+	CommandsFrom []CommandsFrom `yaml:"commands_from"` // Commands imported from git repositories.
+	Workspace    []string       `yaml:"workspace"`     // Directories of the sub-projects, each with its own Supfile, run by "sup all".
+
+	AnsibleInventory string `yaml:"ansible_inventory"` // Ansible inventory whose groups are networks too, see importAnsibleInventory.
+
+	// Quote the vars expanded into commands and the env vars given by -e,
+	// so values from CI or user input can't inject shell code.
+	SafeInterpolation bool `yaml:"safe_interpolation"`
+
+	SecurityProfile string `yaml:"security_profile"` // "strict" hardens the SSH connections, see SecurityStrict.
+
+	Environment string `yaml:"-"` // Name of the applied environment overlay, if any.
+}
+
+// Networks is a list of user-defined networks,
+// in the order they're declared in Supfile.
+type Networks struct {
+	Names []string
+	nets  map[string]Network
+}
+
+func (n *Networks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&n.nets); err != nil {
+		return err
+	}
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	var keys []string
+	for name := range n.nets {
+		keys = append(keys, name)
+	}
+	names, err := mapSliceKeys("networks", items, keys)
+	n.Names = names
+	return err
+}
+
+// Get returns the network of the given name.
+func (n *Networks) Get(name string) (Network, bool) {
+	net, ok := n.nets[name]
+	return net, ok
+}
+
+// Set sets the network of the given name, appending new names.
+func (n *Networks) Set(name string, net Network) {
+	if n.nets == nil {
+		n.nets = map[string]Network{}
+	}
+	if _, ok := n.nets[name]; !ok {
+		n.Names = append(n.Names, name)
+	}
+	n.nets[name] = net
+}
+
+// Commands is a list of user-defined commands,
+// in the order they're declared in Supfile.
+type Commands struct {
+	Names []string
+	cmds  map[string]Command
+}
+
+func (c *Commands) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.cmds); err != nil {
+		return err
+	}
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	var keys []string
+	for name := range c.cmds {
+		keys = append(keys, name)
+	}
+	names, err := mapSliceKeys("commands", items, keys)
+	c.Names = names
+	return err
+}
+
+// Get returns the command of the given name.
+func (c *Commands) Get(name string) (Command, bool) {
+	cmd, ok := c.cmds[name]
+	return cmd, ok
+}
+
+// Resolve returns the name of the command having the given name
+// or alias, and whether there's one.
+func (c *Commands) Resolve(name string) (string, bool) {
+	if _, ok := c.cmds[name]; ok {
+		return name, true
+	}
+	for _, n := range c.Names {
+		if containsString(c.cmds[n].Aliases, name) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// Set sets the command of the given name, appending new names.
+func (c *Commands) Set(name string, cmd Command) {
+	if c.cmds == nil {
+		c.cmds = map[string]Command{}
+	}
+	if _, ok := c.cmds[name]; !ok {
+		c.Names = append(c.Names, name)
+	}
+	c.cmds[name] = cmd
+}
+
+// Targets is a list of user-defined targets,
+// in the order they're declared in Supfile.
+type Targets struct {
+	Names   []string
+	targets map[string]Target
+}
+
+func (t *Targets) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.targets); err != nil {
+		return err
+	}
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	var keys []string
+	for name := range t.targets {
+		keys = append(keys, name)
+	}
+	names, err := mapSliceKeys("targets", items, keys)
+	t.Names = names
+	return err
+}
+
+// Get returns the target of the given name.
+func (t *Targets) Get(name string) (Target, bool) {
+	target, ok := t.targets[name]
+	return target, ok
+}
+
+// Resolve returns the name of the target having the given name
+// or alias, and whether there's one.
+func (t *Targets) Resolve(name string) (string, bool) {
+	if _, ok := t.targets[name]; ok {
+		return name, true
+	}
+	for _, n := range t.Names {
+		if containsString(t.targets[n].Aliases, name) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mapSliceKeys returns the keys of a YAML mapping of the given section,
+// in order. It returns ErrDuplicateKey if a key is defined twice, instead
+// of silently keeping the last definition.
+//
+// Keys that aren't strings in the MapSlice, e.g. "n" or "on" resolved
+// to booleans by YAML 1.1, are matched back to the string keys of the
+// same mapping, if given.
+func mapSliceKeys(section string, items yaml.MapSlice, keys []string) ([]string, error) {
+	sort.Strings(keys)
+	names := make([]string, len(items))
+	seen := map[string]bool{}
+	for i, item := range items {
+		if key, ok := item.Key.(string); ok {
+			if seen[key] {
+				return nil, ErrDuplicateKey{section, key}
+			}
+			names[i] = key
+			seen[key] = true
+		}
+	}
+	for i, item := range items {
+		if _, ok := item.Key.(string); ok {
+			continue
+		}
+		names[i] = fmt.Sprint(item.Key)
+		for _, key := range keys {
+			var value interface{}
+			if !seen[key] && yaml.Unmarshal([]byte(key), &value) == nil && value == item.Key {
+				names[i] = key
+				break
+			}
+		}
+		if seen[names[i]] {
+			return nil, ErrDuplicateKey{section, names[i]}
+		}
+		seen[names[i]] = true
+	}
+	return names, nil
+}
+
+// ErrDuplicateKey is returned when a network, command, target
+// or env var is defined more than once in Supfile.
+type ErrDuplicateKey struct {
+	Section string
+	Key     string
+}
+
+func (e ErrDuplicateKey) Error() string {
+	return fmt.Sprintf("%v: %v is defined more than once", e.Section, e.Key)
 }
 
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env       EnvList  `yaml:"env"`
-	Inventory string   `yaml:"inventory"`
-	Hosts     []string `yaml:"hosts"`
-	Bastion   string   `yaml:"bastion"` // Jump host for the environment
+	Name      string  `yaml:"-"` // Network name.
+	Env       EnvList `yaml:"env"`
+	Inventory string  `yaml:"inventory"`
+	Provider  string  `yaml:"provider"` // Resolve hosts of local VMs: "vagrant" or "multipass".
+	Hosts     []Host  `yaml:"hosts"`
+	Bastion   string  `yaml:"bastion"`    // Jump host for the environment
+	ProxyJump string  `yaml:"proxy_jump"` // Jump hosts reached in turn, e.g. "jump1,user@jump2:2222", like OpenSSH's ProxyJump.
+
+	AWS       *EC2Provider       `yaml:"aws"`       // Resolve hosts of EC2 instances by their tags.
+	Terraform *TerraformProvider `yaml:"terraform"` // Resolve hosts of a Terraform output.
+	Consul    *ConsulDiscovery   `yaml:"consul"`    // Resolve hosts of the instances of a Consul service.
+	Etcd      *EtcdDiscovery     `yaml:"etcd"`      // Resolve hosts of the keys under an etcd prefix.
+
+	IdentityFile    string `yaml:"identity_file"`    // Private key of the hosts without an identity_file of their own.
+	AgentForwarding bool   `yaml:"agent_forwarding"` // Forward the local ssh-agent to the commands, e.g. for "git pull" on the hosts.
+	BecomeMethod    string `yaml:"become_method"`    // Run the become commands as root by "sudo" (default), "su" or "doas".
+
+	KnownHosts            string `yaml:"known_hosts"`              // Host keys of the hosts, defaults to ~/.ssh/known_hosts.
+	StrictHostKeyChecking string `yaml:"strict_host_key_checking"` // "yes", "accept-new" (add unknown hosts) or "no"; unknown hosts are accepted by default.
+	PasswordEnv           string `yaml:"password_env"`             // Env var holding the SSH password of the hosts, for hosts without key auth.
+	PasswordFile          string `yaml:"password_file"`            // File holding the SSH password of the hosts.
+	AskPassword           bool   `yaml:"ask_password"`             // Ask for the SSH password of the hosts on the terminal.
+	SudoPassword          string `yaml:"sudo_password"`            // Secret reference of the hosts' sudo password, e.g. "vault:secret/hosts/{{.Host}}#password".
+	Critical              bool   `yaml:"critical"`                 // Failed runs trigger incident alerts.
+
+	DefaultTarget string `yaml:"default_target"` // Target or command run when none is given, e.g. "status".
+	Prefix        string `yaml:"prefix"`         // Template of the hosts' output prefix, e.g. "{{.Host}}({{.AZ}})", see Host.Meta.
+
+	ConnectConcurrency int      `yaml:"connect_concurrency"` // Max number of hosts connected to in parallel, defaults to 10.
+	ConnectJitter      Duration `yaml:"connect_jitter"`      // Max random delay before connecting to a host, e.g. "200ms".
+	ConnectRetries     int      `yaml:"connect_retries"`     // Number of retries of failed connections, with backoff.
+	ConnectBackoff     Duration `yaml:"connect_backoff"`     // Delay before the first retry, doubled on every further one, defaults to 1s.
+	ConnectTimeout     Duration `yaml:"connect_timeout"`     // Max time of connecting to a host, including the SSH handshake, e.g. "10s".
+	KeepaliveInterval  Duration `yaml:"keepalive_interval"`  // Send keepalives to the hosts this often, e.g. "30s"; unresponsive hosts are disconnected after 3.
+	HostCache          Duration `yaml:"host_cache"`          // Cache the reachability and facts of the hosts between runs for this long, e.g. "10m".
+
+	MaxClockSkew Duration `yaml:"max_clock_skew"` // Check the hosts' clocks are off by no more than this, e.g. "2s".
+	OnClockSkew  string   `yaml:"on_clock_skew"`  // "warn" (default) or "fail" when they're off by more.
+}
+
+// defaultConnectConcurrency matches the default MaxStartups of sshd,
+// so connecting to many hosts (or through a bastion) isn't throttled.
+const defaultConnectConcurrency = 10
+
+func (n *Network) connectConcurrency() int {
+	if n.ConnectConcurrency > 0 {
+		return n.ConnectConcurrency
+	}
+	return defaultConnectConcurrency
+}
+
+// jumpHosts returns the hosts of the bastion or the proxy_jump of the
+// network, if any, in the order they're connected to.
+func (n *Network) jumpHosts() []string {
+	jumps := n.Bastion
+	if jumps == "" {
+		jumps = n.ProxyJump
+	}
+	if jumps == "" {
+		return nil
+	}
+	var hosts []string
+	for _, host := range strings.Split(jumps, ",") {
+		hosts = append(hosts, strings.TrimSpace(host))
+	}
+	return hosts
+}
+
+// password returns the SSH password of the hosts of the network, read
+// from its password_env (looked up in env first) or its password_file,
+// if any. The hosts' own passwords take precedence.
+func (n *Network) password(env EnvList) (string, error) {
+	if n.PasswordEnv != "" {
+		for _, v := range env {
+			if v.Key == n.PasswordEnv {
+				return v.Value, nil
+			}
+		}
+		password, ok := os.LookupEnv(n.PasswordEnv)
+		if !ok {
+			return "", ErrPasswordEnv{n.Name, n.PasswordEnv}
+		}
+		return password, nil
+	}
+	if n.PasswordFile != "" {
+		data, err := ioutil.ReadFile(expandTilde(n.PasswordFile))
+		if err != nil {
+			return "", errors.Wrapf(err, "network %v: reading password_file failed", n.Name)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// ErrPasswordEnv is returned when the password_env of a network
+// isn't set.
+type ErrPasswordEnv struct {
+	Network string
+	Var     string
+}
+
+func (e ErrPasswordEnv) Error() string {
+	return fmt.Sprintf("network %v: password_env %v is not set", e.Network, e.Var)
+}
+
+// sudoPasswordTemplate parses the template of the hosts' sudo password,
+// or returns nil if the network has none.
+func (n *Network) sudoPasswordTemplate() (*template.Template, error) {
+	if n.SudoPassword == "" {
+		return nil, nil
+	}
+	return template.New("sudo_password").Option("missingkey=error").Parse(n.SudoPassword)
+}
+
+// sudoPassword returns the sudo password of host h by the sudo_password
+// of the network, if any: the secret it references once expanded for h,
+// e.g. "vault:secret/hosts/{{.Host}}#password", so hosts with their own
+// passwords can be driven unattended too.
+func (n *Network) sudoPassword(h Host) (string, error) {
+	tmpl, _ := n.sudoPasswordTemplate() // Validated by NewSupfile.
+	if tmpl == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, h.templateData()); err != nil {
+		return "", errors.Wrapf(err, "host %v: expanding sudo_password failed", h.Addr)
+	}
+	password, ok, err := ResolveSecret(buf.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "host %v: sudo_password", h.Addr)
+	}
+	if !ok {
+		return "", ErrSecretRef{buf.String(), "SCHEME:REF of a secret backend, e.g. vault:PATH#FIELD"}
+	}
+	return password, nil
+}
+
+func (n *Network) connectJitter() time.Duration {
+	return time.Duration(n.ConnectJitter)
+}
+
+func (n *Network) hostCacheTTL() time.Duration {
+	return time.Duration(n.HostCache)
+}
+
+// defaultConnectBackoff is the delay before the first retry of a failed
+// connection, doubled on every further retry.
+const defaultConnectBackoff = time.Second
+
+func (n *Network) connectBackoff() time.Duration {
+	if n.ConnectBackoff > 0 {
+		return time.Duration(n.ConnectBackoff)
+	}
+	return defaultConnectBackoff
+}
+
+// retryConnect calls connect, retrying it up to n.ConnectRetries times
+// while it fails to connect (ErrConnect) for a transient reason. Other
+// errors, and errors of the commands, which run only once connected,
+// aren't retried.
+func (n *Network) retryConnect(log *debugLog, connect func() error) error {
+	err := connect()
+	for retry := 0; retry < n.ConnectRetries; retry++ {
+		if e, ok := errors.Cause(err).(ErrConnect); !ok || !e.transient() {
+			break
+		}
+		backoff := n.connectBackoff() << uint(retry)
+		log.logf(DebugSSH, "%v, retrying in %v (%v/%v)", err, backoff, retry+1, n.ConnectRetries)
+		time.Sleep(backoff)
+		err = connect()
+	}
+	return err
 }
 
 // Command represents command(s) to be run remotely.
 type Command struct {
 	Name   string   `yaml:"-"`      // Command name.
+	Target string   `yaml:"-"`      // Name of the target the command was invoked by, if any.
 	Desc   string   `yaml:"desc"`   // Command description.
 	Local  string   `yaml:"local"`  // Command(s) to be run locally.
 	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
 	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
 	Upload []Upload `yaml:"upload"` // See Upload struct.
+	Pause  *Pause   `yaml:"pause"`  // Halt the run until the operator continues it, see Pause.
+	Backup *Backup  `yaml:"backup"` // Back up remote paths of the hosts, see Backup.
 	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
 	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
 	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
 
+	CopyBetween []CopyBetween `yaml:"copy_between"` // See CopyBetween struct.
+
+	LoginShell bool   `yaml:"login_shell"` // Run command(s) in a login shell, sourcing profile files.
+	Umask      string `yaml:"umask"`       // File mode creation mask, e.g. "022".
+	CleanEnv   bool   `yaml:"clean_env"`   // Start from an empty environment, ignoring shell rc files.
+	Sudo       bool   `yaml:"sudo"`        // Validate sudo credentials on the hosts before running the command.
+
+	SurviveDisconnect bool `yaml:"survive_disconnect"` // Run detached from the SSH session, reattached to by --resume if sup got disconnected.
+	AgentForwarding   bool `yaml:"agent_forwarding"`   // Forward the local ssh-agent to the command.
+	Become            bool `yaml:"become"`             // Run as root by the become_method of the network.
+
+	MaxOutput   Size   `yaml:"max_output"`    // Max size of the output on a single host, e.g. "10MB".
+	OnMaxOutput string `yaml:"on_max_output"` // "truncate" (default), "file" or "fail".
+
+	OutputEncoding string `yaml:"output_encoding"` // Transcode the output to UTF-8 from "utf-8", "latin1", "windows-1252" or "auto".
+	ANSI           string `yaml:"ansi"`            // "keep" (default) or "strip" the ANSI escape sequences of the output.
+
+	Requires  []Requirement `yaml:"requires"`   // Binaries required on the hosts, e.g. "docker>=24", checked before running.
+	OnMissing string        `yaml:"on_missing"` // "fail" (default) or "skip" the hosts missing a requirement.
+
+	Roles       []string `yaml:"roles"`        // Run only on hosts having one of the roles.
+	OnlyHosts   string   `yaml:"only_hosts"`   // Run only on hosts matching regexp.
+	ExceptHosts string   `yaml:"except_hosts"` // Don't run on hosts matching regexp.
+
+	Aliases    []string `yaml:"aliases"`    // Former names the command can still be invoked by.
+	Deprecated string   `yaml:"deprecated"` // Warning printed when the command is invoked, e.g. "use deploy-v2".
+
+	Async   bool `yaml:"async"`   // Run local command in background, concurrently with the next commands.
+	Capture bool `yaml:"capture"` // Capture STDOUT into the results available to local commands.
+
+	CacheKey   []string `yaml:"cache_key"`   // Globs of the inputs of a local build, skipped while they don't change.
+	CachePaths []string `yaml:"cache_paths"` // Globs of the outputs of the build, rebuilt if any is missing.
+
+	// Action to take when a "serial" batch fails, e.g. "rollback-target=rollback".
+	OnBatchFailure string `yaml:"on_batch_failure"`
+	// Command run on the hosts of every batch once updated, e.g. "curl -fs localhost/health";
+	// its failure fails the batch.
+	HealthCheck string `yaml:"health_check"`
+
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
 }
 
+var umaskRegexp = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// RollbackTarget returns the name of the target to be run on already
+// updated hosts when a serial batch fails, or an empty string.
+func (c Command) RollbackTarget() string {
+	const prefix = "rollback-target="
+	if !strings.HasPrefix(c.OnBatchFailure, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(c.OnBatchFailure, prefix))
+}
+
+// MatchHost reports whether the command should be run on host,
+// according to its roles and its only_hosts and except_hosts regexps.
+func (c Command) MatchHost(host Host) bool {
+	if len(c.Roles) > 0 && !host.HasRole(c.Roles...) {
+		return false
+	}
+	if c.OnlyHosts != "" && !regexp.MustCompilePOSIX(c.OnlyHosts).MatchString(host.Addr) {
+		return false
+	}
+	if c.ExceptHosts != "" && regexp.MustCompilePOSIX(c.ExceptHosts).MatchString(host.Addr) {
+		return false
+	}
+	return true
+}
+
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
-	Src string `yaml:"src"`
-	Dst string `yaml:"dst"`
-	Exc string `yaml:"exclude"`
+	Src    string `yaml:"src"`
+	Dst    string `yaml:"dst"`
+	Exc    string `yaml:"exclude"`
+	Seeds  int    `yaml:"seeds"`  // Upload to this many hosts only, which pass the files on to the others.
+	Backup bool   `yaml:"backup"` // Keep the files changed by the upload as "NAME.bak.TIMESTAMP".
+
+	SEType     string `yaml:"setype"`     // SELinux type of the uploaded files, e.g. "httpd_config_t", set by chcon.
+	SEContext  string `yaml:"secontext"`  // SELinux context of the uploaded files, e.g. "system_u:object_r:httpd_config_t:s0".
+	Restorecon bool   `yaml:"restorecon"` // Label the uploaded files by the policy, incl. its semanage fcontext rules.
+}
+
+// CopyBetween represents file copy operation from Src path of the host
+// matching From to Dst path of the other hosts the command runs on.
+type CopyBetween struct {
+	From   string `yaml:"from"`   // Regexp matching the source host, the first matching host is used.
+	Src    string `yaml:"src"`    // File or directory on the source host.
+	Dst    string `yaml:"dst"`    // Directory on the other hosts.
+	Direct bool   `yaml:"direct"` // Let the other hosts fetch Src by scp, rather than streaming it through sup.
 }
 
 // EnvVar represents an environment variable
 type EnvVar struct {
-	Key   string
-	Value string
+	Key     string
+	Value   string
+	Secret  bool // The value was decrypted or resolved from a secret backend.
+	Literal bool // The value is exported as is, without shell expansion.
 }
 
 func (e EnvVar) String() string {
@@ -67,6 +548,9 @@ func (e EnvVar) String() string {
 
 // AsExport returns the environment variable as a bash export statement
 func (e EnvVar) AsExport() string {
+	if e.Literal {
+		return `export ` + e.Key + `=` + shellQuote(e.Value) + `;`
+	}
 	return `export ` + e.Key + `="` + e.Value + `";`
 }
 
@@ -82,37 +566,97 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if _, err := mapSliceKeys("env", items, nil); err != nil {
+		return err
+	}
+
 	*e = make(EnvList, 0, len(items))
 
 	for _, v := range items {
-		e.Set(fmt.Sprintf("%v", v.Key), fmt.Sprintf("%v", v.Value))
+		key, value := fmt.Sprintf("%v", v.Key), fmt.Sprintf("%v", v.Value)
+		if strings.HasPrefix(value, encryptedPrefix) {
+			if value, err = decryptValue(value); err != nil {
+				return errors.Wrapf(err, "decrypting env var %v failed", key)
+			}
+			// The plaintext is exported as is, never evaluated by a shell.
+			e.set(&EnvVar{Key: key, Value: value, Secret: true, Literal: true})
+			continue
+		}
+		e.Set(key, value)
 	}
 
 	return nil
 }
 
-// Set key to be equal value in this list.
+// Set key to be equal value in this list. The variables are never
+// modified in place, so lists sharing them (see Clone) stay independent.
 func (e *EnvList) Set(key, value string) {
+	e.set(&EnvVar{Key: key, Value: value})
+}
+
+// SetLiteral is like Set, but the value is exported as is, without
+// expanding variables or commands in it.
+func (e *EnvList) SetLiteral(key, value string) {
+	e.set(&EnvVar{Key: key, Value: value, Literal: true})
+}
+
+func (e *EnvList) set(env *EnvVar) {
 	for i, v := range *e {
-		if v.Key == key {
-			(*e)[i].Value = value
+		if v.Key == env.Key {
+			(*e)[i] = env
 			return
 		}
 	}
 
-	*e = append(*e, &EnvVar{
-		Key:   key,
-		Value: value,
-	})
+	*e = append(*e, env)
 }
 
+// Clone returns a copy of the list, which can be modified
+// without affecting the original one.
+func (e EnvList) Clone() EnvList {
+	if e == nil {
+		return nil
+	}
+	return append(make(EnvList, 0, len(e)), e...)
+}
+
+// Get returns the value of key, or an empty string if it's not set.
+func (e EnvList) Get(key string) string {
+	for _, v := range e {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// ResolveValues resolves the secret references of the values, and
+// evaluates the other values by bash, e.g. "$(git rev-parse HEAD)".
+// Literal values are kept as is.
 func (e *EnvList) ResolveValues() error {
 	if len(*e) == 0 {
 		return nil
 	}
 
 	exports := ""
+	cache := &secretCache{} // Secrets read during this run.
 	for i, v := range *e {
+		if v.Literal {
+			exports += v.AsExport()
+			continue
+		}
+
+		// Secret references are resolved by their scheme's resolver.
+		secret, ok, err := resolveSecret(v.Value, cache)
+		if err != nil {
+			return errors.Wrapf(err, "resolving env var %v failed", v.Key)
+		}
+		if ok {
+			(*e)[i] = &EnvVar{Key: v.Key, Value: secret, Secret: true, Literal: true}
+			exports += (*e)[i].AsExport()
+			continue
+		}
+
 		exports += v.AsExport()
 
 		cmd := exec.Command("bash", "-c", exports+"echo -n "+v.Value+";")
@@ -126,7 +670,7 @@ func (e *EnvList) ResolveValues() error {
 			return errors.Wrapf(err, "resolving env var %v failed", v.Key)
 		}
 
-		(*e)[i].Value = string(resolvedValue)
+		(*e)[i] = &EnvVar{Key: v.Key, Value: string(resolvedValue), Secret: v.Secret}
 	}
 
 	return nil
@@ -152,15 +696,33 @@ func (e ErrMustUpdate) Error() string {
 
 // NewSupfile parses configuration file and returns Supfile or error.
 func NewSupfile(file string) (*Supfile, error) {
+	return NewSupfileEnvironment(file, "")
+}
+
+// NewSupfileEnvironment parses configuration file, patched by the overlay
+// of the given environment (see "environments"), and returns Supfile or error.
+func NewSupfileEnvironment(file, environment string) (*Supfile, error) {
 	var conf Supfile
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
+	data, err = applyEnvironment(markEncrypted(data), environment)
+	if err != nil {
+		return nil, err
+	}
 	err = yaml.Unmarshal(data, &conf)
 	if err != nil {
 		return nil, err
 	}
+	conf.Environment = environment
+
+	if err := conf.importCommands(); err != nil {
+		return nil, err
+	}
+	if err := conf.importAnsibleInventory(); err != nil {
+		return nil, err
+	}
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	switch conf.Version {
@@ -169,15 +731,16 @@ func NewSupfile(file string) (*Supfile, error) {
 		fallthrough
 
 	case "0.1":
-		for _, cmd := range conf.Commands {
-			if cmd.RunOnce {
+		for _, name := range conf.Commands.Names {
+			if cmd, _ := conf.Commands.Get(name); cmd.RunOnce {
 				return nil, ErrMustUpdate{"command.run_once is not supported in Supfile v" + conf.Version}
 			}
 		}
 		fallthrough
 
 	case "0.2":
-		for _, cmd := range conf.Commands {
+		for _, name := range conf.Commands.Names {
+			cmd, _ := conf.Commands.Get(name)
 			if cmd.Once {
 				return nil, ErrMustUpdate{"command.once is not supported in Supfile v" + conf.Version}
 			}
@@ -188,8 +751,8 @@ func NewSupfile(file string) (*Supfile, error) {
 				return nil, ErrMustUpdate{"command.serial is not supported in Supfile v" + conf.Version}
 			}
 		}
-		for _, network := range conf.Networks {
-			if network.Inventory != "" {
+		for _, name := range conf.Networks.Names {
+			if network, _ := conf.Networks.Get(name); network.Inventory != "" {
 				return nil, ErrMustUpdate{"network.inventory is not supported in Supfile v" + conf.Version}
 			}
 		}
@@ -197,15 +760,16 @@ func NewSupfile(file string) (*Supfile, error) {
 
 	case "0.3":
 		var warning string
-		for key, cmd := range conf.Commands {
+		for _, name := range conf.Commands.Names {
+			cmd, _ := conf.Commands.Get(name)
 			if cmd.RunOnce {
 				warning = "Warning: command.run_once was deprecated by command.once in Supfile v" + conf.Version + "\n"
 				cmd.Once = true
-				conf.Commands[key] = cmd
+				conf.Commands.Set(name, cmd)
 			}
 		}
 		if warning != "" {
-			fmt.Fprintf(os.Stderr, warning)
+			fmt.Fprint(os.Stderr, warning)
 		}
 
 		fallthrough
@@ -216,20 +780,322 @@ func NewSupfile(file string) (*Supfile, error) {
 		return nil, ErrMustUpdate{"unsupported version " + conf.Version}
 	}
 
-	for i, network := range conf.Networks {
-		hosts, err := network.ParseInventory()
-		if err != nil {
+	for i := range conf.Freeze {
+		if err := conf.Freeze[i].parse(); err != nil {
 			return nil, err
 		}
-		network.Hosts = append(network.Hosts, hosts...)
-		conf.Networks[i] = network
+	}
+	if conf.Auth != nil {
+		if err := conf.Auth.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if p := conf.Policy; p != nil && (len(p.Files) > 0) == (p.URL != "") {
+		return nil, errors.New("policy: either files or url must be set")
+	}
+	switch conf.SecurityProfile {
+	case "", SecurityStrict:
+	default:
+		return nil, fmt.Errorf("unsupported security_profile %q", conf.SecurityProfile)
+	}
+
+	if err := conf.checkAliases(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		if cmd.Umask != "" && !umaskRegexp.MatchString(cmd.Umask) {
+			return nil, fmt.Errorf("command %v: invalid umask %q", name, cmd.Umask)
+		}
+		switch cmd.OnMaxOutput {
+		case "", MaxOutputTruncate, MaxOutputFile, MaxOutputFail:
+		default:
+			return nil, fmt.Errorf("command %v: unsupported on_max_output %q", name, cmd.OnMaxOutput)
+		}
+		switch cmd.OutputEncoding {
+		case "", EncodingUTF8, EncodingLatin1, EncodingWindows1252, EncodingAuto:
+		default:
+			return nil, fmt.Errorf("command %v: unsupported output_encoding %q", name, cmd.OutputEncoding)
+		}
+		switch cmd.ANSI {
+		case "", ANSIKeep, ANSIStrip:
+		default:
+			return nil, fmt.Errorf("command %v: unsupported ansi %q", name, cmd.ANSI)
+		}
+		switch cmd.OnMissing {
+		case "", OnMissingFail, OnMissingSkip:
+		default:
+			return nil, fmt.Errorf("command %v: unsupported on_missing %q", name, cmd.OnMissing)
+		}
+		if len(cmd.Requires) > 0 && cmd.Run == "" && cmd.Script == "" && len(cmd.Upload) == 0 && len(cmd.CopyBetween) == 0 {
+			return nil, fmt.Errorf("command %v: requires is only supported by remote commands", name)
+		}
+		if cmd.CleanEnv && cmd.LoginShell {
+			return nil, fmt.Errorf("command %v: clean_env can't be combined with login_shell", name)
+		}
+		for _, expr := range []string{cmd.OnlyHosts, cmd.ExceptHosts} {
+			if _, err := regexp.CompilePOSIX(expr); err != nil {
+				return nil, errors.Wrapf(err, "command %v: invalid host regexp", name)
+			}
+		}
+		for _, upload := range cmd.Upload {
+			if upload.Seeds < 0 {
+				return nil, fmt.Errorf("command %v: invalid upload seeds %v", name, upload.Seeds)
+			}
+			if upload.Seeds > 0 && (cmd.Once || cmd.Serial > 0) {
+				return nil, fmt.Errorf("command %v: upload seeds can't be combined with once or serial", name)
+			}
+			if (upload.SEType != "" && upload.SEContext != "") || (upload.Restorecon && (upload.SEType != "" || upload.SEContext != "")) {
+				return nil, fmt.Errorf("command %v: upload setype, secontext and restorecon are mutually exclusive", name)
+			}
+		}
+		for _, cp := range cmd.CopyBetween {
+			if cp.From == "" || cp.Src == "" || cp.Dst == "" {
+				return nil, fmt.Errorf("command %v: copy_between needs from, src and dst", name)
+			}
+			if _, err := regexp.CompilePOSIX(cp.From); err != nil {
+				return nil, errors.Wrapf(err, "command %v: invalid copy_between host regexp", name)
+			}
+		}
+		if len(cmd.CacheKey) > 0 && (cmd.Local == "" || cmd.Run != "" || cmd.Script != "" || len(cmd.Upload) > 0 || len(cmd.CopyBetween) > 0) {
+			return nil, fmt.Errorf("command %v: cache_key is only supported by local commands", name)
+		}
+		if len(cmd.CachePaths) > 0 && len(cmd.CacheKey) == 0 {
+			return nil, fmt.Errorf("command %v: cache_paths requires cache_key", name)
+		}
+		for _, globs := range [][]string{cmd.CacheKey, cmd.CachePaths} {
+			for _, pattern := range globs {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("command %v: invalid cache glob %q", name, pattern)
+				}
+			}
+		}
+		if cmd.SurviveDisconnect && ((cmd.Run == "" && cmd.Script == "") || cmd.Stdin) {
+			return nil, fmt.Errorf("command %v: survive_disconnect is only supported by run and script commands without stdin", name)
+		}
+		if cmd.Pause != nil {
+			if cmd.Local != "" || cmd.isRemote() || cmd.Async {
+				return nil, fmt.Errorf("command %v: pause can't be combined with other actions", name)
+			}
+			if cmd.Pause.Default != "" && cmd.Pause.Default != PauseAbort && cmd.Pause.Default != PauseContinue {
+				return nil, fmt.Errorf("command %v: unsupported pause default %q", name, cmd.Pause.Default)
+			}
+		}
+		if b := cmd.Backup; b != nil {
+			if cmd.Local != "" || cmd.isRemote() || cmd.Pause != nil || cmd.Async || cmd.Once {
+				return nil, fmt.Errorf("command %v: backup can't be combined with other actions", name)
+			}
+			if len(b.Paths) == 0 || b.Dest == "" {
+				return nil, fmt.Errorf("command %v: backup requires paths and dest", name)
+			}
+			if b.Keep < 0 || b.MaxAge < 0 {
+				return nil, fmt.Errorf("command %v: invalid backup retention", name)
+			}
+		}
+		if cmd.HealthCheck != "" && !cmd.isRemote() {
+			return nil, fmt.Errorf("command %v: health_check is only supported by commands run on the hosts", name)
+		}
+		if cmd.Become && ((cmd.Run == "" && cmd.Script == "") || cmd.Stdin) {
+			return nil, fmt.Errorf("command %v: become is only supported by run and script commands without stdin", name)
+		}
+		if cmd.Async && (cmd.Local == "" || cmd.Run != "" || cmd.Script != "" || len(cmd.Upload) > 0 || len(cmd.CopyBetween) > 0 || cmd.Stdin || cmd.Sudo) {
+			return nil, fmt.Errorf("command %v: async is only supported by local commands without stdin or sudo", name)
+		}
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		if cmd.OnBatchFailure == "" {
+			continue
+		}
+		target := cmd.RollbackTarget()
+		if target == "" {
+			return nil, fmt.Errorf("command %v: unsupported on_batch_failure %q", name, cmd.OnBatchFailure)
+		}
+		rollback, ok := conf.Targets.Get(target)
+		if !ok {
+			return nil, fmt.Errorf("command %v: unknown rollback target %q", name, target)
+		}
+		for _, rollbackCmd := range rollback.Names() {
+			if _, ok := conf.Commands.Resolve(rollbackCmd); !ok {
+				return nil, fmt.Errorf("rollback target %v: unknown command %q", target, rollbackCmd)
+			}
+		}
+	}
+
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		network.Name = name
+		if network.DefaultTarget != "" {
+			_, isTarget := conf.Targets.Resolve(network.DefaultTarget)
+			_, isCommand := conf.Commands.Resolve(network.DefaultTarget)
+			if !isTarget && !isCommand {
+				return nil, fmt.Errorf("network %v: unknown default_target %q", name, network.DefaultTarget)
+			}
+		}
+		if network.ConnectRetries < 0 {
+			return nil, fmt.Errorf("network %v: invalid connect_retries %v", name, network.ConnectRetries)
+		}
+		if network.Bastion != "" && network.ProxyJump != "" {
+			return nil, fmt.Errorf("network %v: bastion and proxy_jump are mutually exclusive", name)
+		}
+		switch network.StrictHostKeyChecking {
+		case "", HostKeyCheckingYes, HostKeyCheckingAcceptNew, HostKeyCheckingNo:
+		default:
+			return nil, fmt.Errorf("network %v: unsupported strict_host_key_checking %q", name, network.StrictHostKeyChecking)
+		}
+		if conf.SecurityProfile == SecurityStrict {
+			if err := network.checkStrict(); err != nil {
+				return nil, errors.Wrapf(err, "network %v", name)
+			}
+		}
+		switch network.BecomeMethod {
+		case "", BecomeSudo, BecomeSu, BecomeDoas:
+		default:
+			return nil, fmt.Errorf("network %v: unsupported become_method %q", name, network.BecomeMethod)
+		}
+		providers := 0
+		for _, set := range []bool{network.Provider != "", network.AWS != nil, network.Terraform != nil, network.Consul != nil, network.Etcd != nil} {
+			if set {
+				providers++
+			}
+		}
+		if providers > 1 {
+			return nil, fmt.Errorf("network %v: provider, aws, terraform, consul and etcd are mutually exclusive", name)
+		}
+		if network.Consul != nil && network.Consul.Service == "" {
+			return nil, fmt.Errorf("network %v: consul service is required", name)
+		}
+		if network.Etcd != nil && network.Etcd.Prefix == "" {
+			return nil, fmt.Errorf("network %v: etcd prefix is required", name)
+		}
+		if network.Terraform != nil && network.Terraform.Output == "" {
+			return nil, fmt.Errorf("network %v: terraform output is required", name)
+		}
+		switch network.Provider {
+		case "", "vagrant", "multipass":
+		default:
+			return nil, fmt.Errorf("network %v: unsupported provider %q", name, network.Provider)
+		}
+		if network.AWS != nil {
+			switch network.AWS.Address {
+			case "", EC2Private, EC2Public:
+			default:
+				return nil, fmt.Errorf("network %v: unsupported aws address %q", name, network.AWS.Address)
+			}
+		}
+		if network.PasswordEnv != "" && network.PasswordFile != "" {
+			return nil, fmt.Errorf("network %v: password_env and password_file are mutually exclusive", name)
+		}
+		switch network.OnClockSkew {
+		case "", OnClockSkewWarn, OnClockSkewFail:
+		default:
+			return nil, fmt.Errorf("network %v: unsupported on_clock_skew %q", name, network.OnClockSkew)
+		}
+		if _, err := network.prefixTemplate(); err != nil {
+			return nil, errors.Wrapf(err, "network %v: invalid prefix", name)
+		}
+		if _, err := network.sudoPasswordTemplate(); err != nil {
+			return nil, errors.Wrapf(err, "network %v: invalid sudo_password", name)
+		}
+		var expanded []Host
+		for _, host := range network.Hosts {
+			addrs, err := expandHostRange(host.Addr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "network %v", name)
+			}
+			for _, addr := range addrs {
+				h := host
+				h.Addr = addr
+				expanded = append(expanded, h)
+			}
+		}
+		network.Hosts = expanded
+		for _, host := range network.Hosts {
+			if _, err := host.Transport(); err != nil && !strings.Contains(host.Addr, "${{") {
+				return nil, errors.Wrapf(err, "network %v", name)
+			}
+		}
+		conf.Networks.Set(name, network)
 	}
 
 	return &conf, nil
 }
 
+// checkAliases makes sure the aliases of the commands and targets
+// don't clash with each other, nor with the commands and targets.
+func (conf *Supfile) checkAliases() error {
+	names := map[string]bool{}
+	for _, name := range conf.Commands.Names {
+		names[name] = true
+	}
+	for _, name := range conf.Targets.Names {
+		names[name] = true
+	}
+	check := func(section, name string, aliases []string) error {
+		for _, alias := range aliases {
+			if names[alias] {
+				return fmt.Errorf("%v %v: alias %v is already defined", section, name, alias)
+			}
+			names[alias] = true
+		}
+		return nil
+	}
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		if err := check("command", name, cmd.Aliases); err != nil {
+			return err
+		}
+	}
+	for _, name := range conf.Targets.Names {
+		target, _ := conf.Targets.Get(name)
+		if err := check("target", name, target.Aliases); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixTemplate parses the template of the hosts' output prefix,
+// or returns nil if the network has none.
+func (n *Network) prefixTemplate() (*template.Template, error) {
+	if n.Prefix == "" {
+		return nil, nil
+	}
+	return template.New("prefix").Parse(n.Prefix)
+}
+
+// ResolveHosts adds the hosts of the network's inventory and provider (see
+// ProviderHosts) to its hosts. Only the networks being run are resolved,
+// so running one doesn't need the inventories or the cloud credentials of
+// the others.
+func (n *Network) ResolveHosts() error {
+	inventory, err := n.ParseInventory()
+	if err != nil {
+		return errors.Wrapf(err, "network %v: inventory", n.Name)
+	}
+	providerHosts, err := n.ProviderHosts()
+	if err != nil {
+		return errors.Wrapf(err, "network %v", n.Name)
+	}
+	var hosts []Host
+	for _, host := range inventory {
+		hosts = append(hosts, inventoryHost(host))
+	}
+	n.Hosts = n.Hosts[:len(n.Hosts):len(n.Hosts)] // Don't append to the Supfile's hosts.
+	for _, host := range append(hosts, providerHosts...) {
+		if _, err := host.Transport(); err != nil {
+			return errors.Wrapf(err, "network %v", n.Name)
+		}
+		n.Hosts = append(n.Hosts, host)
+	}
+	return nil
+}
+
 // ParseInventory runs the inventory command, if provided, and appends
 // the command's output lines to the manually defined list of hosts.
+// Each line holds a host, optionally followed by KEY=VALUE metadata.
 func (n Network) ParseInventory() ([]string, error) {
 	if n.Inventory == "" {
 		return nil, nil
@@ -246,20 +1112,19 @@ func (n Network) ParseInventory() ([]string, error) {
 	buf := bytes.NewBuffer(output)
 	for {
 		host, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		if err != nil && err != io.EOF {
 			return nil, err
 		}
 
-		host = strings.TrimSpace(host)
+		// The last line may lack its newline.
+		line := strings.TrimSpace(host)
 		// skip empty lines and comments
-		if host == "" || host[:1] == "#" {
-			continue
+		if line != "" && line[:1] != "#" {
+			hosts = append(hosts, line)
+		}
+		if err == io.EOF {
+			break
 		}
-
-		hosts = append(hosts, host)
 	}
 	return hosts, nil
 }
@@ -0,0 +1,96 @@
+package sup
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestResolveValuesKeepsLiterals(t *testing.T) {
+	values := []string{`p$a"ss`, "p`id`ss", `$(echo pwned)`, `it's`, `back\slash`}
+	for _, value := range values {
+		// As decrypted from an !encrypted value.
+		env := EnvList{{Key: "PASSWORD", Value: value, Secret: true, Literal: true}}
+		if err := env.ResolveValues(); err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if got := env.Get("PASSWORD"); got != value {
+			t.Errorf("ResolveValues(%q) = %q", value, got)
+		}
+
+		// Exported on the hosts as is.
+		out, err := exec.Command("bash", "-c", env.AsExport()+`printf %s "$PASSWORD"`).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if string(out) != value {
+			t.Errorf("export of %q = %q", value, out)
+		}
+	}
+}
+
+func TestResolveValuesSecretsAreLiteral(t *testing.T) {
+	const value = `p$a"ss`
+	RegisterSecretResolver("test-literal", SecretResolverFunc(func(ref string) (string, error) {
+		return value, nil
+	}))
+	env := EnvList{}
+	env.Set("PASSWORD", "test-literal:password")
+	if err := env.ResolveValues(); err != nil {
+		t.Fatal(err)
+	}
+	if v := env[0]; v.Value != value || !v.Secret || !v.Literal {
+		t.Errorf("resolved secret = %+v, want a literal secret %q", *v, value)
+	}
+}
+
+func TestResolveValuesCachesSecretsPerRun(t *testing.T) {
+	reads := 0
+	RegisterSecretResolver("test-cached", cachingResolverFunc(func(ref string, cache *secretCache) (string, error) {
+		return cache.get(ref, func() (string, error) {
+			reads++
+			return "secret", nil
+		})
+	}))
+	for run := 1; run <= 2; run++ {
+		env := EnvList{}
+		env.Set("A", "test-cached:db")
+		env.Set("B", "test-cached:db")
+		if err := env.ResolveValues(); err != nil {
+			t.Fatal(err)
+		}
+		if reads != run {
+			t.Errorf("run %d: secret read %d times in total, want %d", run, reads, run)
+		}
+	}
+}
+
+func TestEnvVarAsExport(t *testing.T) {
+	tests := []struct {
+		env    EnvVar
+		export string
+		value  string // Value in bash, with $HOME=/home/sup.
+	}{
+		{EnvVar{Key: "A", Value: "plain"}, `export A="plain";`, "plain"},
+		{EnvVar{Key: "A", Value: "$HOME/app"}, `export A="$HOME/app";`, "/home/sup/app"},
+		{EnvVar{Key: "A", Value: "$HOME/app", Secret: true}, `export A="$HOME/app";`, "/home/sup/app"},
+		{EnvVar{Key: "A", Value: "$HOME/app", Literal: true}, `export A='$HOME/app';`, "$HOME/app"},
+		{EnvVar{Key: "A", Value: `p$a"ss`, Secret: true, Literal: true}, `export A='p$a"ss';`, `p$a"ss`},
+		{EnvVar{Key: "A", Value: `it's`, Secret: true, Literal: true}, `export A='it'\''s';`, `it's`},
+		{EnvVar{Key: "A", Value: "$(id)`id`", Secret: true, Literal: true}, "export A='$(id)`id`';", "$(id)`id`"},
+		{EnvVar{Key: "A", Value: "", Literal: true}, `export A='';`, ""},
+	}
+	for _, test := range tests {
+		if got := test.env.AsExport(); got != test.export {
+			t.Errorf("AsExport(%+v) = %v, want %v", test.env, got, test.export)
+		}
+		cmd := exec.Command("bash", "-c", test.env.AsExport()+`printf %s "$A"`)
+		cmd.Env = []string{"HOME=/home/sup"}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%+v: %v", test.env, err)
+		}
+		if string(out) != test.value {
+			t.Errorf("export of %+v = %q, want %q", test.env, out, test.value)
+		}
+	}
+}
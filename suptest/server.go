@@ -0,0 +1,282 @@
+// Package suptest provides an in-process SSH server, so sup can be run
+// against simulated hosts without any real servers, e.g. to benchmark it
+// or to write deterministic integration tests of programs embedding sup:
+//
+//	srv, err := suptest.NewServer(suptest.Canned(nil,
+//		suptest.Response{Match: "^systemctl restart", Stderr: "failed\n", Exit: 1},
+//	))
+//	...
+//	defer srv.Close()
+//	// Run sup against srv.Addr(), then check srv.Commands()
+//	// and srv.Connections().
+package suptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"regexp"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler runs command received by the server, reading its STDIN from
+// stdin and writing its output to stdout and stderr. It returns the exit
+// status of the command.
+type Handler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// ExecHandler runs the commands locally by bash.
+func ExecHandler(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	// Like sshd, don't wait for the client to close STDIN
+	// once the command exits.
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		return 1
+	}
+	go func() {
+		io.Copy(pipe, stdin)
+		pipe.Close()
+	}()
+
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			if status := e.ExitCode(); status > 0 {
+				return status
+			}
+		}
+		return 1
+	}
+	return 0
+}
+
+// Server is an SSH server listening on a random local port.
+// It accepts any client without authentication and runs
+// every command it receives by its handler.
+type Server struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	handler  Handler
+
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	commands []string
+	conns    int
+}
+
+var (
+	hostKeyOnce sync.Once
+	hostKey     ssh.Signer
+	hostKeyErr  error
+)
+
+// NewServer starts a new server running the commands by handler,
+// or by ExecHandler if handler is nil.
+func NewServer(handler Handler) (*Server, error) {
+	// Generating a key is slow, share a single one by all the servers.
+	hostKeyOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			hostKeyErr = err
+			return
+		}
+		hostKey, hostKeyErr = ssh.NewSignerFromKey(key)
+	})
+	if hostKeyErr != nil {
+		return nil, hostKeyErr
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	if handler == nil {
+		handler = ExecHandler
+	}
+	s := &Server{
+		listener: listener,
+		config:   &ssh.ServerConfig{NoClientAuth: true},
+		handler:  handler,
+	}
+	s.config.AddHostKey(hostKey)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the server, e.g. "127.0.0.1:40001".
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Commands returns the commands received by the server so far,
+// in the order they were received.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Connections returns the number of the SSH connections accepted so far.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Close stops listening for new connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(ch, reqs)
+	}
+}
+
+func (s *Server) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	started := false
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.mu.Unlock()
+
+			go func() {
+				status := s.handler(payload.Command, ch, ch, ch.Stderr())
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				ch.Close()
+			}()
+
+		case "pty-req", "env", "signal":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// Discard is a handler reading and discarding the STDIN until EOF.
+// It's useful to simulate uploads.
+func Discard(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	io.Copy(ioutil.Discard, stdin)
+	return 0
+}
+
+// Output returns a handler writing n bytes of output in lines of 80 bytes,
+// discarding the command.
+func Output(n int) Handler {
+	line := make([]byte, 80)
+	for i := range line {
+		line[i] = 'x'
+	}
+	line[len(line)-1] = '\n'
+
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		for left := n; left > 0; {
+			m := len(line)
+			if m > left {
+				m = left
+			}
+			if _, err := stdout.Write(line[:m]); err != nil {
+				return 1
+			}
+			left -= m
+		}
+		return 0
+	}
+}
+
+// Response is a canned response to the commands matching a regexp.
+type Response struct {
+	Match  string // Regexp matching the command.
+	Stdout string
+	Stderr string
+	Exit   int  // Exit status.
+	Stdin  bool // Read the STDIN until EOF before responding, e.g. for uploads.
+}
+
+// Canned returns a handler responding to the commands by the first
+// matching response, or by fallback if none matches. Without fallback,
+// the other commands succeed without any output. It panics if the regexp
+// of a response doesn't compile.
+func Canned(fallback Handler, responses ...Response) Handler {
+	exprs := make([]*regexp.Regexp, len(responses))
+	for i, r := range responses {
+		exprs[i] = regexp.MustCompile(r.Match)
+	}
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		for i, expr := range exprs {
+			if !expr.MatchString(command) {
+				continue
+			}
+			r := responses[i]
+			if r.Stdin {
+				io.Copy(ioutil.Discard, stdin)
+			}
+			io.WriteString(stdout, r.Stdout)
+			io.WriteString(stderr, r.Stderr)
+			return r.Exit
+		}
+		if fallback != nil {
+			return fallback(command, stdin, stdout, stderr)
+		}
+		return 0
+	}
+}
@@ -1,10 +1,14 @@
 package sup
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -20,6 +24,10 @@ func RemoteTarCommand(dir string) string {
 }
 
 func LocalTarCmdArgs(path, exclude string) []string {
+	return localTarArgs(path, exclude, "-czf")
+}
+
+func localTarArgs(path, exclude, flags string) []string {
 	args := []string{}
 
 	// Added pattens to exclude from tar compress
@@ -28,7 +36,7 @@ func LocalTarCmdArgs(path, exclude string) []string {
 		args = append(args, `--exclude=`+strings.TrimSpace(exclude))
 	}
 
-	args = append(args, "-C", ".", "-czf", "-", path)
+	args = append(args, "-C", ".", flags, "-", path)
 	return args
 }
 
@@ -48,3 +56,100 @@ func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
 
 	return stdout, nil
 }
+
+// uploadStream is a gzipped TAR stream of a local path, like the one
+// of NewTarStreamReader, which tracks how much of the path it has archived.
+type uploadStream struct {
+	io.ReadCloser
+	cwd, path, exclude string
+
+	size     int64 // Estimated size of the uncompressed archive.
+	archived int64 // Uncompressed bytes archived so far, accessed atomically.
+}
+
+// newUploadStream creates an upload stream of a local path.
+func newUploadStream(cwd, path, exclude string) (*uploadStream, error) {
+	cmd := exec.Command("tar", localTarArgs(path, exclude, "-cf")...)
+	cmd.Dir = cwd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "tar: stdout pipe failed")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "tar: starting cmd failed")
+	}
+
+	pr, pw := io.Pipe()
+	s := &uploadStream{ReadCloser: pr, cwd: cwd, path: path, exclude: exclude, size: tarSize(cwd, path, exclude)}
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, &progressReader{r: stdout, progress: func(n int64) {
+			atomic.StoreInt64(&s.archived, n)
+		}})
+		if err == nil {
+			err = gz.Close()
+		} else {
+			cmd.Process.Kill() // The stream was closed, see uploadStream.Close.
+		}
+		if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+			err = errors.Wrap(waitErr, "tar")
+		}
+		pw.CloseWithError(err)
+	}()
+	return s, nil
+}
+
+// progress returns the uncompressed bytes archived so far and the estimated
+// total. The estimate is off if tar excludes other files than tarSize does.
+func (s *uploadStream) progress() (archived, size int64) {
+	archived = atomic.LoadInt64(&s.archived)
+	if archived > s.size {
+		return archived, archived
+	}
+	return archived, s.size
+}
+
+// tarSize estimates the size of the TAR archive of a local path:
+// a 512 byte header per file, the contents of the regular files
+// padded to 512 byte blocks and the two trailing zero blocks.
+func tarSize(cwd, path, exclude string) int64 {
+	size := int64(1024)
+	walkUpload(cwd, path, exclude, func(file string, info os.FileInfo) {
+		size += 512
+		if info.Mode().IsRegular() {
+			size += (info.Size() + 511) / 512 * 512
+		}
+	})
+	return size
+}
+
+// walkUpload calls fn for the files of a local path to be uploaded,
+// leaving out the files excluded the way tar does (mostly).
+func walkUpload(cwd, path, exclude string, fn func(file string, info os.FileInfo)) {
+	var patterns []string
+	for _, p := range strings.Split(exclude, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, info.Name()); ok {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		fn(file, info)
+		return nil
+	})
+}
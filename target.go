@@ -0,0 +1,100 @@
+package sup
+
+// Target is a named sequence of commands. In Supfile, it's either a list
+// of commands, or a mapping of the commands and the target's settings:
+//
+//	targets:
+//	  deploy:
+//	    requires_approval: true
+//	    aliases: [release]
+//	    commands:
+//	      - build
+//	      - deploy-web
+type Target struct {
+	Commands         []TargetCommand `yaml:"commands"`
+	RequiresApproval bool            `yaml:"requires_approval"` // Runs submitted to a sup server wait for approval by another user.
+	Aliases          []string        `yaml:"aliases"`           // Former names the target can still be invoked by.
+	Deprecated       string          `yaml:"deprecated"`        // Warning printed when the target is invoked.
+}
+
+func (t *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var commands []TargetCommand
+	if err := unmarshal(&commands); err == nil {
+		*t = Target{Commands: commands}
+		return nil
+	}
+
+	type target Target // Prevent recursion.
+	return unmarshal((*target)(t))
+}
+
+// TargetCommand is a command invoked by a target. In Supfile, it's either
+// a plain command name, or a mapping restricting the command to hosts
+// having one of the given roles:
+//
+//	targets:
+//	  deploy:
+//	    - build
+//	    - command: migrate
+//	      roles: [db-primary]
+//	      once: true
+//	    - command: deploy-web
+//	      roles: [web]
+type TargetCommand struct {
+	Command string   `yaml:"command"` // Command name.
+	Roles   []string `yaml:"roles"`   // Run on hosts having one of the roles only.
+	Once    bool     `yaml:"once"`    // Run on one (matching) host only.
+}
+
+func (t *TargetCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*t = TargetCommand{Command: name}
+		return nil
+	}
+
+	type targetCommand TargetCommand // Prevent recursion.
+	return unmarshal((*targetCommand)(t))
+}
+
+// Names returns the names of the target's commands.
+func (t Target) Names() []string {
+	var names []string
+	for _, cmd := range t.Commands {
+		names = append(names, cmd.Command)
+	}
+	return names
+}
+
+// Resolve returns the target's commands as defined in conf, restricted
+// by the target's roles and once settings. It returns an error
+// if a command is not defined.
+func (t Target) Resolve(conf *Supfile, name string) ([]*Command, error) {
+	var commands []*Command
+	for _, tc := range t.Commands {
+		cmdName, ok := conf.Commands.Resolve(tc.Command)
+		if !ok {
+			return nil, ErrUnknownCommand{tc.Command}
+		}
+		command, _ := conf.Commands.Get(cmdName)
+		command.Name = cmdName
+		command.Target = name
+		if len(tc.Roles) > 0 {
+			command.Roles = tc.Roles
+		}
+		if tc.Once {
+			command.Once = true
+		}
+		commands = append(commands, &command)
+	}
+	return commands, nil
+}
+
+// ErrUnknownCommand is returned when a target refers to an undefined command.
+type ErrUnknownCommand struct {
+	Name string
+}
+
+func (e ErrUnknownCommand) Error() string {
+	return "unknown command " + e.Name
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -15,9 +17,47 @@ type Task struct {
 	Input   io.Reader
 	Clients []Client
 	TTY     bool
+	Upload  *Upload // Set if the task uploads files.
+
+	LoginShell bool   // Run the task in a login shell.
+	Umask      string // File mode creation mask.
+	CleanEnv   bool   // Run the task with a clean environment.
+
+	AgentForwarding bool   // Forward the local ssh-agent to the task, on SSH hosts.
+	Become          string // Run the task as root by this method, if set, see becomeCommand.
+
+	Detach *Detach // Run detached from the SSH session, surviving disconnects, if set.
+
+	completes map[Client]bool // Clients completing the command by the task, see journal.
 }
 
-func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
+// cleanEnvPath is the PATH of tasks run with a clean environment.
+const cleanEnvPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Command returns the shell command running the task with the given
+// env exports (export FOO="bar"; ...), honoring the task's shell options.
+func (t *Task) Command(env string) string {
+	command := env + t.Run
+	if t.Umask != "" {
+		command = "umask " + t.Umask + "; " + command
+	}
+	if t.CleanEnv {
+		command = `exec env -i HOME="$HOME" USER="$USER" LOGNAME="$LOGNAME" SHELL="$SHELL" TERM="$TERM" ` +
+			`PATH="` + cleanEnvPath + `" bash --noprofile --norc -c ` + shellQuote(command)
+	}
+	if t.LoginShell {
+		command = loginShellCommand(command)
+	}
+	if t.Detach != nil {
+		command = detachedCommand(t.Detach, command)
+	}
+	if t.Become != "" {
+		command = becomeCommand(t.Become, command)
+	}
+	return command
+}
+
+func (sup *Stackup) createTasks(r *runState, cmd *Command, clients []Client, env string) ([]*Task, error) {
 	var tasks []*Task
 
 	cwd, err := os.Getwd()
@@ -26,44 +66,54 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 	}
 
 	// Anything to upload?
-	for _, upload := range cmd.Upload {
-		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
-		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
+	for i := range cmd.Upload {
+		if len(clients) == 0 {
+			break
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+		upload := &cmd.Upload[i]
+		sources, groups, err := r.uploadSources(cwd, upload.Src, env, clients)
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
+		for j, uploadFile := range sources {
+			clients := groups[j]
+			if sup.log.enabled(DebugUpload) {
+				walkUpload(cwd, uploadFile, upload.Exc, func(file string, info os.FileInfo) {
+					if rel, err := filepath.Rel(cwd, file); err == nil {
+						file = rel
+					}
+					sup.log.logf(DebugUpload, "%v -> %v: %v %v (%v bytes)", upload.Src, upload.Dst, info.Mode(), file, info.Size())
+				})
+			}
+			uploadTarReader, err := newUploadStream(cwd, uploadFile, upload.Exc)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
 
-		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
-			TTY:   false,
-		}
-
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
+			task := Task{
+				Run:    remoteUploadCommand(upload),
+				Input:  uploadTarReader,
+				TTY:    false,
+				Upload: upload,
+			}
+
+			if upload.Seeds > 0 && len(clients) > upload.Seeds {
+				// Let the seeds pass the files on, see seedTasks.
+				task.Clients = clients[:upload.Seeds]
+				tasks = append(tasks, &task)
+				tasks = append(tasks, seedTasks(r, upload, uploadFile, clients[:upload.Seeds], clients[upload.Seeds:])...)
+			} else {
+				for _, batch := range cmd.batches(clients) {
+					copy := task
+					copy.Clients = batch
+					tasks = append(tasks, &copy)
 				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
 	// Script. Read the file as a multiline input command.
-	if cmd.Script != "" {
+	if cmd.Script != "" && len(clients) > 0 {
 		f, err := os.Open(cmd.Script)
 		if err != nil {
 			return nil, errors.Wrap(err, "can't open script")
@@ -74,8 +124,12 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		}
 
 		task := Task{
-			Run: string(data),
-			TTY: true,
+			Run:             string(data),
+			TTY:             true,
+			LoginShell:      cmd.LoginShell,
+			Umask:           cmd.Umask,
+			CleanEnv:        cmd.CleanEnv,
+			AgentForwarding: cmd.AgentForwarding,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -83,36 +137,38 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
-			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
+		if cmd.SurviveDisconnect {
+			task.Detach = &Detach{Key: detachedKey(cmd, task.Run), Name: cmd.Name, Reattach: sup.resume}
+		}
+		if cmd.Become {
+			task.Become = r.become
+		}
+		for _, batch := range cmd.batches(clients) {
+			copy := task
+			copy.Clients = batch
+			tasks = append(tasks, &copy)
 		}
 	}
 
 	// Local command.
 	if cmd.Local != "" {
-		local := &LocalhostClient{
+		var local Client = &LocalhostClient{
 			env: env + `export SUP_HOST="localhost";`,
 		}
+		if sup.mock != nil {
+			local = &MockClient{
+				mock: sup.mock,
+				env:  env + `export SUP_HOST="localhost";`,
+			}
+		}
 		local.Connect("localhost")
 		task := &Task{
-			Run:     cmd.Local,
-			Clients: []Client{local},
-			TTY:     true,
+			Run:        cmd.Local,
+			Clients:    []Client{local},
+			TTY:        true,
+			LoginShell: cmd.LoginShell,
+			Umask:      cmd.Umask,
+			CleanEnv:   cmd.CleanEnv,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -124,10 +180,14 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 	}
 
 	// Remote command.
-	if cmd.Run != "" {
+	if cmd.Run != "" && len(clients) > 0 {
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Run:             cmd.Run,
+			TTY:             true,
+			LoginShell:      cmd.LoginShell,
+			Umask:           cmd.Umask,
+			CleanEnv:        cmd.CleanEnv,
+			AgentForwarding: cmd.AgentForwarding,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -135,29 +195,75 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
-			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
+		if cmd.SurviveDisconnect {
+			task.Detach = &Detach{Key: detachedKey(cmd, task.Run), Name: cmd.Name, Reattach: sup.resume}
+		}
+		if cmd.Become {
+			task.Become = r.become
+		}
+		for _, batch := range cmd.batches(clients) {
+			copy := task
+			copy.Clients = batch
+			tasks = append(tasks, &copy)
 		}
 	}
 
 	return tasks, nil
 }
 
+// isRemote reports whether cmd runs anything on the hosts.
+func (cmd *Command) isRemote() bool {
+	return cmd.Run != "" || cmd.Script != "" || len(cmd.Upload) > 0 || len(cmd.CopyBetween) > 0
+}
+
+// batches splits the clients the command runs on into the groups run
+// sequentially: the first client only for "once" commands, groups of
+// cmd.Serial clients for "serial" commands, or all of them at once.
+// The clients are expected to be filtered already (--only, --except,
+// roles) and to keep the order of the network's hosts.
+func (cmd *Command) batches(clients []Client) [][]Client {
+	var batches [][]Client
+	for _, b := range cmd.batchRanges(len(clients)) {
+		batches = append(batches, clients[b[0]:b[1]])
+	}
+	return batches
+}
+
+// batchRanges returns the [start, end) ranges of the batches of n hosts,
+// see batches.
+func (cmd *Command) batchRanges(n int) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	if cmd.Once {
+		return [][2]int{{0, 1}}
+	}
+	size := n
+	if cmd.Serial > 0 && cmd.Serial < size {
+		size = cmd.Serial
+	}
+	var ranges [][2]int
+	for i := 0; i < n; i += size {
+		j := i + size
+		if j > n {
+			j = n
+		}
+		ranges = append(ranges, [2]int{i, j})
+	}
+	return ranges
+}
+
+// shellQuote quotes s as a single word for POSIX shells.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// loginShellCommand wraps the command to be run in a login shell
+// of the remote user, so that profile files get sourced.
+func loginShellCommand(command string) string {
+	return `exec "${SHELL:-/bin/sh}" -l -c ` + shellQuote(command)
+}
+
 type ErrTask struct {
 	Task   *Task
 	Reason string
@@ -166,3 +272,37 @@ type ErrTask struct {
 func (e ErrTask) Error() string {
 	return fmt.Sprintf(`Run("%v"): %v`, e.Task, e.Reason)
 }
+
+// uploadSources resolves the local source src of an upload for every
+// client by the env vars of its host, so e.g. "./config/$SHARD" uploads
+// the config of the shard of every host. It returns the sources, and the
+// clients of every source, in order.
+func (r *runState) uploadSources(cwd, src, env string, clients []Client) (sources []string, groups [][]Client, err error) {
+	resolved := map[string]string{} // Sources by the env of the hosts.
+	index := map[string]int{}
+	for _, c := range clients {
+		host := r.host(c)
+		hostEnv := host.Env.Clone()
+		hostEnv.Set("SUP_HOST", host.Addr)
+		exports := env + hostEnv.AsExport()
+		if !strings.Contains(src, "$") {
+			exports = env // Resolved once for all the hosts.
+		}
+		file, ok := resolved[exports]
+		if !ok {
+			if file, err = ResolveLocalPath(cwd, src, exports); err != nil {
+				return nil, nil, err
+			}
+			resolved[exports] = file
+		}
+		i, ok := index[file]
+		if !ok {
+			i = len(sources)
+			index[file] = i
+			sources = append(sources, file)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], c)
+	}
+	return sources, groups, nil
+}
@@ -0,0 +1,86 @@
+package sup
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fakeClient is a Client told apart by its address only.
+type fakeClient struct {
+	Client
+	addr string
+}
+
+func TestBatchRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		n    int
+		want [][2]int
+	}{
+		{"no hosts", Command{}, 0, nil},
+		{"no hosts once", Command{Once: true}, 0, nil},
+		{"no hosts serial", Command{Serial: 2}, 0, nil},
+		{"parallel", Command{}, 3, [][2]int{{0, 3}}},
+		{"once", Command{Once: true}, 3, [][2]int{{0, 1}}},
+		{"once wins over serial", Command{Once: true, Serial: 2}, 3, [][2]int{{0, 1}}},
+		{"serial", Command{Serial: 2}, 5, [][2]int{{0, 2}, {2, 4}, {4, 5}}},
+		{"serial of one", Command{Serial: 1}, 3, [][2]int{{0, 1}, {1, 2}, {2, 3}}},
+		{"serial exact", Command{Serial: 2}, 4, [][2]int{{0, 2}, {2, 4}}},
+		{"serial above hosts", Command{Serial: 10}, 3, [][2]int{{0, 3}}},
+		{"negative serial", Command{Serial: -1}, 3, [][2]int{{0, 3}}},
+	}
+	for _, tt := range tests {
+		if got := tt.cmd.batchRanges(tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: batchRanges(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBatchesAfterFilters(t *testing.T) {
+	hosts := []Host{
+		{Addr: "web1", Roles: []string{"web"}},
+		{Addr: "db1", Roles: []string{"db"}},
+		{Addr: "web2", Roles: []string{"web"}},
+		{Addr: "web3", Roles: []string{"web"}},
+		{Addr: "db2", Roles: []string{"db"}},
+		{Addr: "web4", Roles: []string{"web"}},
+	}
+	r := &runState{hosts: map[Client]Host{}}
+	for _, host := range hosts {
+		c := &fakeClient{addr: host.Addr}
+		r.clients = append(r.clients, c)
+		r.hosts[c] = host
+	}
+
+	tests := []struct {
+		name string
+		cmd  Command
+		want [][]string
+	}{
+		{"all", Command{}, [][]string{{"web1", "db1", "web2", "web3", "db2", "web4"}}},
+		{"once", Command{Once: true}, [][]string{{"web1"}}},
+		{"once by role", Command{Once: true, Roles: []string{"db"}}, [][]string{{"db1"}}},
+		{"once only hosts", Command{Once: true, OnlyHosts: "^web[34]$"}, [][]string{{"web3"}}},
+		{"once except hosts", Command{Once: true, ExceptHosts: "^web1$"}, [][]string{{"db1"}}},
+		{"once no match", Command{Once: true, OnlyHosts: "^app"}, nil},
+		{"serial by role", Command{Serial: 2, Roles: []string{"web"}}, [][]string{{"web1", "web2"}, {"web3", "web4"}}},
+		{"serial only hosts", Command{Serial: 1, OnlyHosts: "^db"}, [][]string{{"db1"}, {"db2"}}},
+		{"serial except hosts", Command{Serial: 2, ExceptHosts: "^web[12]$"}, [][]string{{"db1", "web3"}, {"db2", "web4"}}},
+		{"serial role and except hosts", Command{Serial: 2, Roles: []string{"web"}, ExceptHosts: "2$"}, [][]string{{"web1", "web3"}, {"web4"}}},
+	}
+	for _, tt := range tests {
+		cmd := tt.cmd
+		var got [][]string
+		for _, batch := range cmd.batches(r.commandClients(&cmd)) {
+			var addrs []string
+			for _, c := range batch {
+				addrs = append(addrs, r.hostName(c))
+			}
+			got = append(got, addrs)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: batches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package sup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tracer collects spans of a run and exports them to an OpenTelemetry
+// collector using the OTLP/HTTP JSON protocol.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewTracerFromEnv creates a Tracer configured by the standard OpenTelemetry
+// environment variables OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_ENDPOINT), OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME.
+// It returns nil if no endpoint is configured.
+func NewTracerFromEnv() *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  map[string]string{},
+		service:  os.Getenv("OTEL_SERVICE_NAME"),
+	}
+	if t.service == "" {
+		t.service = "sup"
+	}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if i := strings.Index(header, "="); i > 0 {
+			t.headers[strings.TrimSpace(header[:i])] = strings.TrimSpace(header[i+1:])
+		}
+	}
+	return t
+}
+
+// Span represents a single timed operation of a run.
+// A nil *Span is valid and does nothing.
+type Span struct {
+	tracer   *Tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// Start starts a new span. If parent is nil, the span starts a new trace.
+// Attributes are given as key/value pairs. Start returns nil on a nil Tracer.
+func (t *Tracer) Start(parent *Span, name string, attrs ...string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		spanID: randomHex(8),
+		name:   name,
+		start:  time.Now(),
+		attrs:  map[string]string{},
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	return s
+}
+
+// End finishes the span, marking it as failed if err is not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+// Flush exports all the finished spans to the collector.
+func (t *Tracer) Flush() error {
+	return t.flush("")
+}
+
+// Flush exports the finished spans of the span's trace to the collector,
+// leaving the spans of concurrent runs to their own Flush.
+func (s *Span) Flush() error {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.flush(s.traceID)
+}
+
+// flush exports the finished spans of the trace, or of all traces.
+func (t *Tracer) flush(traceID string) error {
+	if t == nil {
+		return nil
+	}
+	var spans []*Span
+	t.mu.Lock()
+	if traceID == "" {
+		spans, t.spans = t.spans, nil
+	} else {
+		pending := t.spans[:0]
+		for _, s := range t.spans {
+			if s.traceID == traceID {
+				spans = append(spans, s)
+			} else {
+				pending = append(pending, s)
+			}
+		}
+		t.spans = pending
+	}
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type attr struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId,omitempty"`
+		Name         string `json:"name"`
+		Kind         int    `json:"kind"`
+		Start        string `json:"startTimeUnixNano"`
+		End          string `json:"endTimeUnixNano"`
+		Attributes   []attr `json:"attributes,omitempty"`
+		Status       status `json:"status"`
+	}
+
+	var out []span
+	for _, s := range spans {
+		o := span{
+			TraceID:      s.traceID,
+			SpanID:       s.spanID,
+			ParentSpanID: s.parentID,
+			Name:         s.name,
+			Kind:         1, // SPAN_KIND_INTERNAL
+			Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:       status{Code: 1}, // STATUS_CODE_OK
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, attr{k, map[string]string{"stringValue": v}})
+		}
+		if s.err != nil {
+			o.Status = status{Code: 2, Message: s.err.Error()} // STATUS_CODE_ERROR
+		}
+		out = append(out, o)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []attr{{"service.name", map[string]string{"stringValue": t.service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "sup", "version": VERSION},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+	header := http.Header{}
+	for k, v := range t.headers {
+		header.Set(k, v)
+	}
+	return errors.Wrap(postJSON(t.endpoint, header, payload), "exporting spans failed")
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,162 @@
+package sup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// TransferOptions configures Client.Upload and Client.Download.
+type TransferOptions struct {
+	Exclude  string            // Comma separated patterns of the files not to upload.
+	Progress func(bytes int64) // Called with the number of (compressed) bytes transferred so far.
+}
+
+// progressReader reports the bytes read from r by progress.
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.progress != nil {
+		p.progress(atomic.AddInt64(&p.n, int64(n)))
+	}
+	return n, err
+}
+
+// progressWriter reports the bytes written to w by progress.
+type progressWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if total := atomic.AddInt64(&p.n, int64(n)); n > 0 && p.progress != nil {
+		p.progress(total)
+	}
+	return n, err
+}
+
+// upload copies the local file or directory src (relative to the current
+// directory) into the directory dst of the host of c, streaming a tar archive.
+func upload(ctx context.Context, c Client, src, dst string, opts TransferOptions) error {
+	tar := exec.Command("tar", LocalTarCmdArgs(src, opts.Exclude)...)
+	var tarStderr bytes.Buffer
+	tar.Stderr = &tarStderr
+	archive, err := tar.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "tar: stdout pipe failed")
+	}
+	if err := tar.Start(); err != nil {
+		return errors.Wrap(err, "tar: starting cmd failed")
+	}
+
+	task := &Task{Run: RemoteTarCommand(dst)}
+	if err := c.Run(task); err != nil {
+		tar.Process.Kill()
+		tar.Wait()
+		return err
+	}
+	go func() {
+		io.Copy(c.Stdin(), &progressReader{r: archive, progress: opts.Progress})
+		c.WriteClose()
+		io.Copy(ioutil.Discard, archive) // Let tar exit if the host stopped reading.
+	}()
+
+	if err := waitTransfer(ctx, c, ioutil.Discard); err != nil {
+		tar.Wait()
+		return errors.Wrapf(err, "uploading %v failed", src)
+	}
+	if err := tar.Wait(); err != nil {
+		return errors.Wrapf(err, "tar: %v", strings.TrimSpace(tarStderr.String()))
+	}
+	return nil
+}
+
+// download copies the file or directory src of the host of c into
+// the local directory dst, streaming a tar archive.
+func download(ctx context.Context, c Client, src, dst string, opts TransferOptions) error {
+	tar := exec.Command("tar", "-C", dst, "-xzf", "-")
+	var tarStderr bytes.Buffer
+	tar.Stderr = &tarStderr
+	archive, err := tar.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "tar: stdin pipe failed")
+	}
+	if err := tar.Start(); err != nil {
+		return errors.Wrap(err, "tar: starting cmd failed")
+	}
+	if err := c.Run(downloadTask(src)); err != nil {
+		archive.Close()
+		tar.Wait()
+		return err
+	}
+	c.WriteClose()
+
+	err = waitTransfer(ctx, c, &progressWriter{w: archive, progress: opts.Progress})
+	archive.Close()
+	tarErr := tar.Wait()
+	if err != nil {
+		return errors.Wrapf(err, "downloading %v failed", src)
+	}
+	if tarErr != nil {
+		return errors.Wrapf(tarErr, "tar: %v", strings.TrimSpace(tarStderr.String()))
+	}
+	return nil
+}
+
+// downloadTask returns the task streaming the remote file or directory
+// src as a tar archive.
+func downloadTask(src string) *Task {
+	src = strings.TrimSuffix(src, "/")
+	return &Task{Run: "tar -C " + shellQuote(path.Dir(src)) + " -czf - " + shellQuote(path.Base(src))}
+}
+
+// waitTransfer copies the output of the command transferring files
+// to stdout and waits for it to finish, interrupting it if ctx is canceled.
+func waitTransfer(ctx context.Context, c Client, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, c.Stdout())
+		io.Copy(ioutil.Discard, c.Stdout()) // Let the command exit if stdout failed.
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&stderr, c.Stderr())
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		wg.Wait()
+		done <- c.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && stderr.Len() > 0 {
+			return errors.Wrap(err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	case <-ctx.Done():
+		c.Signal(os.Interrupt)
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Transports of the hosts, given by the scheme of their address:
+//
+//	api1.example.com, ssh://deploy@api1.example.com:2222
+//	localhost, local://
+//	docker://[user@]CONTAINER
+//	ssm://INSTANCE-ID[?region=REGION]
+//
+// Addresses without a scheme are SSH hosts, except "localhost".
+const (
+	TransportSSH    = "ssh"    // SSH connection.
+	TransportLocal  = "local"  // Local shell.
+	TransportDocker = "docker" // docker exec into a local container.
+	TransportSSM    = "ssm"    // AWS SSM session, by the aws CLI.
+)
+
+// Transport returns the transport of the host, see TransportSSH.
+func (h Host) Transport() (string, error) {
+	i := strings.Index(h.Addr, "://")
+	if i < 0 {
+		if h.Addr == "localhost" {
+			return TransportLocal, nil
+		}
+		return TransportSSH, nil
+	}
+	switch scheme := h.Addr[:i]; scheme {
+	case TransportSSH, TransportLocal, TransportDocker, TransportSSM:
+		return scheme, nil
+	default:
+		return "", fmt.Errorf("host %v: unsupported transport %q", h.Addr, scheme)
+	}
+}
+
+// execArgs returns the function building the command line running
+// a command on a host of a local transport (local, docker or ssm),
+// or nil for the local shell.
+func (h Host) execArgs(transport string) (func(command string) []string, error) {
+	if transport == TransportLocal {
+		return nil, nil
+	}
+	u, err := url.Parse(h.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("host %v: missing %v target", h.Addr, transport)
+	}
+
+	switch transport {
+	case TransportDocker:
+		prefix := []string{"docker", "exec", "-i"}
+		if u.User != nil && u.User.Username() != "" {
+			prefix = append(prefix, "-u", u.User.Username())
+		}
+		prefix = append(prefix, u.Host, "bash", "-c")
+		return func(command string) []string {
+			return append(append([]string(nil), prefix...), command)
+		}, nil
+
+	case TransportSSM:
+		prefix := []string{"aws", "ssm", "start-session", "--target", u.Host,
+			"--document-name", "AWS-StartInteractiveCommand"}
+		if region := u.Query().Get("region"); region != "" {
+			prefix = append(prefix, "--region", region)
+		}
+		return func(command string) []string {
+			params, _ := json.Marshal(map[string][]string{"command": {"bash -c " + shellQuote(command)}})
+			return append(append([]string(nil), prefix...), "--parameters", string(params))
+		}, nil
+	}
+	return nil, fmt.Errorf("host %v: %v is not a local transport", h.Addr, transport)
+}
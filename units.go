@@ -0,0 +1,110 @@
+package sup
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a duration of Supfile, e.g. "500ms", "30s", "5m", "1h30m"
+// or "7d". Numbers without a unit are rejected, except 0, since it's
+// unclear whether they're seconds or milliseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if value == nil {
+		*d = 0
+		return nil
+	}
+	duration, err := parseDuration(fmt.Sprint(value))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+var daysRegexp = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// parseDuration parses a Duration.
+func parseDuration(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return 0, fmt.Errorf("invalid duration %q: missing unit, e.g. %vs or %vm", value, s, s)
+	}
+	var days time.Duration
+	if m := daysRegexp.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		days, s = time.Duration(n)*24*time.Hour, m[2]
+		if s == "" {
+			s = "0"
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, e.g. 500ms, 30s, 5m, 1h30m or 7d", value)
+	}
+	return days + d, nil
+}
+
+// Size is a number of bytes of Supfile, e.g. "512", "64KB", "10MiB" or
+// "1.5GB". Units are powers of 1024, whether written KB or KiB.
+type Size int64
+
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if value == nil {
+		*s = 0
+		return nil
+	}
+	size, err := parseSize(fmt.Sprint(value))
+	if err != nil {
+		return err
+	}
+	*s = Size(size)
+	return nil
+}
+
+func (s Size) String() string {
+	return formatSize(int64(s))
+}
+
+var sizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)(?:I?B)?$`)
+
+// parseSize parses a Size.
+func parseSize(size string) (int64, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, e.g. 512, 64KB, 10MiB or 1.5GB", size)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	if m[2] != "" {
+		n *= math.Pow(1024, float64(strings.Index("KMGT", m[2])+1))
+	} else if n != math.Trunc(n) {
+		return 0, fmt.Errorf("invalid size %q: fraction of a byte", size)
+	}
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", size)
+	}
+	return int64(n), nil
+}
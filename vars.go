@@ -0,0 +1,330 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Vars are the variables of Supfile, declared by the "vars" section.
+// Unlike env vars, they're typed (strings, numbers, bools or lists of them)
+// and they're expanded by sup itself, before connecting to the hosts, in
+// the templates of hosts, commands and uploads:
+//
+//	vars:
+//	  region: eu
+//	  replicas: 3
+//	  zones: [a, b]
+//
+//	commands:
+//	  scale:
+//	    run: kubectl scale --replicas=${{ .replicas }} deploy/app
+type Vars map[string]interface{}
+
+func (v *Vars) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var vars map[string]interface{}
+	if err := unmarshal(&vars); err != nil {
+		return err
+	}
+	for key, value := range vars {
+		if err := checkVar(key, value); err != nil {
+			return err
+		}
+	}
+	*v = vars
+	return nil
+}
+
+// checkVar checks the type of a var's value.
+func checkVar(key string, value interface{}) error {
+	switch value := value.(type) {
+	case string, int, int64, float64, bool:
+		return nil
+	case []interface{}:
+		for _, item := range value {
+			switch item.(type) {
+			case string, int, int64, float64, bool:
+			default:
+				return fmt.Errorf("var %v: lists may only hold strings, numbers and bools", key)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("var %v: unsupported value %v, expected a string, number, bool or list", key, value)
+}
+
+// typeName returns the name of the type of a var's value.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case int, int64, float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "list"
+	}
+	return "string"
+}
+
+// Set overrides the var key by value, which is parsed according to the type
+// of the var declared by Supfile: "3" sets a number, "[a, b]" or "a,b" a list.
+func (v Vars) Set(key, value string) error {
+	current, ok := v[key]
+	if !ok {
+		return fmt.Errorf("unknown var %v", key)
+	}
+
+	var parsed interface{}
+	var err error
+	switch current.(type) {
+	case string:
+		parsed = value
+	case int:
+		parsed, err = strconv.Atoi(value)
+	case int64:
+		parsed, err = strconv.ParseInt(value, 10, 64)
+	case float64:
+		parsed, err = strconv.ParseFloat(value, 64)
+	case bool:
+		parsed, err = strconv.ParseBool(value)
+	case []interface{}:
+		var list []interface{}
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			err = yaml.Unmarshal([]byte(value), &list)
+		} else if value != "" {
+			for _, item := range strings.Split(value, ",") {
+				list = append(list, strings.TrimSpace(item))
+			}
+		}
+		parsed = list
+	}
+	if err == nil {
+		err = checkVar(key, parsed)
+	}
+	if err != nil {
+		return fmt.Errorf("var %v: invalid %v %q", key, typeName(current), value)
+	}
+	v[key] = parsed
+	return nil
+}
+
+// varFuncs are the functions available to the templates.
+var varFuncs = template.FuncMap{
+	// raw marks values not to be quoted, see Supfile.SafeInterpolation.
+	"raw": func(value interface{}) interface{} {
+		return value
+	},
+	"join": func(list []interface{}, sep string) string {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, sep)
+	},
+}
+
+// Expand expands the templates referencing the vars in s.
+// The templates are delimited by "${{" and "}}", e.g. "${{ .region }}",
+// so they don't clash with shell variables and Go templates in commands.
+func (v Vars) Expand(s string) (string, error) {
+	return v.expand(s, nil)
+}
+
+// expand expands the templates in s like Expand, quoting the output
+// of every template by quote, if not nil, unless it ends with "raw",
+// e.g. "${{ .flags | raw }}".
+func (v Vars) expand(s string, quote func(string) string) (string, error) {
+	if !strings.Contains(s, "${{") {
+		return s, nil
+	}
+	t := template.New("").Delims("${{", "}}").Funcs(varFuncs).Option("missingkey=error")
+	if quote != nil {
+		t.Funcs(template.FuncMap{
+			"quote": func(value interface{}) string { return quote(fmt.Sprint(value)) },
+		})
+	}
+	t, err := t.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if quote != nil {
+		quoteActions(t.Tree.Root)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]interface{}(v)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// quoteActions appends "quote" to the pipelines of the actions printing
+// a value, except the ones ending with "raw".
+func quoteActions(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			quoteActions(n)
+		}
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) > 0 {
+			return // Assignment, printing nothing.
+		}
+		last := node.Pipe.Cmds[len(node.Pipe.Cmds)-1]
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "raw" {
+			return
+		}
+		node.Pipe.Cmds = append(node.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      node.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("quote").SetPos(node.Pos)},
+		})
+	case *parse.IfNode:
+		quoteActions(node.List)
+		quoteActions(node.ElseList)
+	case *parse.RangeNode:
+		quoteActions(node.List)
+		quoteActions(node.ElseList)
+	case *parse.WithNode:
+		quoteActions(node.List)
+		quoteActions(node.ElseList)
+	}
+}
+
+// doubleQuote escapes s to be used within double quotes in shell,
+// e.g. by the exports of env vars.
+func doubleQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(s)
+}
+
+// ApplyVars overrides the vars of Supfile by the given "KEY=VALUE" pairs
+// and expands the vars in the networks and in the commands. It leaves out
+// the hosts whose "when" condition is false and runs the inventories
+// referencing vars.
+func (conf *Supfile) ApplyVars(overrides []string) error {
+	if conf.Vars == nil {
+		conf.Vars = Vars{}
+	}
+	for _, override := range overrides {
+		i := strings.Index(override, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid var %q, expected KEY=VALUE", override)
+		}
+		if err := conf.Vars.Set(override[:i], override[i+1:]); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	expandBy := func(quote func(string) string) func(where string, s *string) {
+		return func(where string, s *string) {
+			if err != nil {
+				return
+			}
+			var expanded string
+			if expanded, err = conf.Vars.expand(*s, quote); err != nil {
+				err = errors.Wrap(err, where)
+				return
+			}
+			*s = expanded
+		}
+	}
+	// Vars expanded into shell commands, or the env vars exported to them,
+	// are quoted with safe_interpolation, so they're never run as code.
+	expand, expandShell, expandEnv := expandBy(nil), expandBy(nil), expandBy(nil)
+	if conf.SafeInterpolation {
+		expandShell, expandEnv = expandBy(shellQuote), expandBy(doubleQuote)
+	}
+
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		where := "network " + name
+		var hosts []Host
+		for _, host := range network.Hosts {
+			expand(where+": host", &host.Addr)
+			expand(where+": host "+host.Addr+": when", &host.When)
+			var env EnvList
+			for _, v := range host.Env {
+				v := *v
+				expandEnv(where+": host "+host.Addr+": env "+v.Key, &v.Value)
+				env = append(env, &v)
+			}
+			host.Env = env
+			if err != nil {
+				return err
+			}
+			if host.When != "" {
+				ok, parseErr := strconv.ParseBool(strings.TrimSpace(host.When))
+				if parseErr != nil {
+					return fmt.Errorf("%v: host %v: when must be true or false, got %q", where, host.Addr, host.When)
+				}
+				if !ok {
+					continue
+				}
+			}
+			hosts = append(hosts, host)
+		}
+
+		// Run by Network.ResolveHosts.
+		expandShell(where+": inventory", &network.Inventory)
+		network.Hosts = hosts
+
+		expand(where+": bastion", &network.Bastion)
+		expand(where+": proxy_jump", &network.ProxyJump)
+		var env EnvList
+		for _, v := range network.Env {
+			v := *v
+			expandShell(where+": env "+v.Key, &v.Value) // Resolved by the shell, see EnvList.ResolveValues.
+			env = append(env, &v)
+		}
+		network.Env = env
+		conf.Networks.Set(name, network)
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		where := "command " + name
+		expandShell(where+": run", &cmd.Run)
+		expandShell(where+": local", &cmd.Local)
+		expand(where+": script", &cmd.Script)
+		uploads := make([]Upload, len(cmd.Upload))
+		copy(uploads, cmd.Upload)
+		for i := range uploads {
+			expand(where+": upload", &uploads[i].Src)
+			expand(where+": upload", &uploads[i].Dst)
+		}
+		cmd.Upload = uploads
+		copies := make([]CopyBetween, len(cmd.CopyBetween))
+		copy(copies, cmd.CopyBetween)
+		for i := range copies {
+			expand(where+": copy_between", &copies[i].Src)
+			expand(where+": copy_between", &copies[i].Dst)
+		}
+		cmd.CopyBetween = copies
+		if cmd.Pause != nil {
+			pause := *cmd.Pause
+			expand(where+": pause", &pause.Message)
+			cmd.Pause = &pause
+		}
+		if cmd.Backup != nil {
+			backup := *cmd.Backup
+			backup.Paths = make([]string, len(cmd.Backup.Paths))
+			copy(backup.Paths, cmd.Backup.Paths)
+			for i := range backup.Paths {
+				expand(where+": backup", &backup.Paths[i])
+			}
+			expand(where+": backup", &backup.Dest)
+			cmd.Backup = &backup
+		}
+		conf.Commands.Set(name, cmd)
+	}
+	return err
+}